@@ -0,0 +1,269 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/mattermost/bifrost/internal/server"
+)
+
+// command is a one-off maintenance task run with `bifrost <name> [flags]`
+// instead of starting the server. setup defines the flags of the command
+// and returns the function that runs it once the flags have been parsed.
+type command struct {
+	usage string
+	setup func(flags *flag.FlagSet) func(ctx context.Context, s *server.Server) error
+}
+
+var commands = map[string]command{
+	"cleanup-multipart": {
+		usage: "Abort multipart uploads that were started too long ago.",
+		setup: cleanupMultipartCommand,
+	},
+	"export": {
+		usage: "Export the objects of an installation to a tar or zip archive with a manifest.",
+		setup: exportCommand,
+	},
+	"import": {
+		usage: "Import a tar or zip archive, or a directory, into an installation.",
+		setup: importCommand,
+	},
+	"rotate-key": {
+		usage: "Generate a new encryption key for an installation and re-encrypt its objects with it.",
+		setup: rotateKeyCommand,
+	},
+	"tag-backfill": {
+		usage: "Add the tags of the tag template to the existing objects of an installation.",
+		setup: tagBackfillCommand,
+	},
+	"trash-list": {
+		usage: "List the objects in the trash of an installation.",
+		setup: trashListCommand,
+	},
+	"trash-restore": {
+		usage: "Restore an object from the trash of an installation to its original key.",
+		setup: trashRestoreCommand,
+	},
+}
+
+// runCommand parses the flags of the command, creates a server from the
+// configuration without starting it and runs the command. The command is
+// cancelled on SIGINT or SIGTERM.
+func runCommand(name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		printCommands()
+		return fmt.Errorf("unknown command %q", name)
+	}
+
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "%s\n\nUsage of %s:\n", cmd.usage, name)
+		flags.PrintDefaults()
+	}
+	configFile := flags.String("config", "config/config.json", "Configuration file for the Bifrost service.")
+	run := cmd.setup(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := server.ParseConfig(*configFile)
+	if err != nil {
+		return fmt.Errorf("could not parse config file: %w", err)
+	}
+	s, err := server.New(config)
+	if err != nil {
+		return fmt.Errorf("could not create the server: %w", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	return run(ctx, s)
+}
+
+func printCommands() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n    \t%s\n", name, commands[name].usage)
+	}
+}
+
+func cleanupMultipartCommand(flags *flag.FlagSet) func(ctx context.Context, s *server.Server) error {
+	maxAge := flags.Duration("max-age", 7*24*time.Hour, "Abort uploads started longer ago than this.")
+	dryRun := flags.Bool("dry-run", false, "Only report the uploads that would be aborted.")
+
+	return func(ctx context.Context, s *server.Server) error {
+		report, err := s.CleanupMultipartUploads(ctx, *maxAge, *dryRun)
+
+		installations := make([]string, 0, len(report.Installations))
+		for installationID := range report.Installations {
+			installations = append(installations, installationID)
+		}
+		sort.Strings(installations)
+		for _, installationID := range installations {
+			stats := report.Installations[installationID]
+			fmt.Printf("%s\t%d uploads\t%d bytes\n", installationID, stats.Uploads, stats.Bytes)
+		}
+
+		total := report.Total()
+		verb := "aborted"
+		if *dryRun {
+			verb = "would abort"
+		}
+		fmt.Printf("%s %d uploads, %d bytes\n", verb, total.Uploads, total.Bytes)
+
+		return err
+	}
+}
+
+func rotateKeyCommand(flags *flag.FlagSet) func(ctx context.Context, s *server.Server) error {
+	installationID := flags.String("installation", "", "Installation whose key is rotated.")
+	newKey := flags.Bool("new-key", true, "Generate a new key. Without it, the objects are re-encrypted with the current key, to finish an interrupted rotation.")
+
+	return func(ctx context.Context, s *server.Server) error {
+		if *installationID == "" {
+			return fmt.Errorf("-installation is required")
+		}
+
+		if *newKey {
+			keyID, err := s.RotateEncryptionKey(*installationID)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("generated key %s\n", keyID)
+		}
+
+		report, err := s.ReencryptObjects(ctx, *installationID)
+		if report != nil {
+			fmt.Printf("re-encrypted %d of %d objects with key %s\n", report.Reencrypted, report.Objects, report.KeyID)
+		}
+		return err
+	}
+}
+
+func trashListCommand(flags *flag.FlagSet) func(ctx context.Context, s *server.Server) error {
+	installationID := flags.String("installation", "", "Installation whose trash is listed.")
+
+	return func(ctx context.Context, s *server.Server) error {
+		if *installationID == "" {
+			return fmt.Errorf("-installation is required")
+		}
+
+		objects, err := s.ListTrash(ctx, *installationID)
+		for _, object := range objects {
+			fmt.Printf("%s\t%s\t%d bytes\t%s\n", object.DeletedAt.Format(time.RFC3339), object.Key, object.Size, object.TrashKey)
+		}
+		return err
+	}
+}
+
+func trashRestoreCommand(flags *flag.FlagSet) func(ctx context.Context, s *server.Server) error {
+	installationID := flags.String("installation", "", "Installation whose trash the object is in.")
+	trashKey := flags.String("trash-key", "", "Key of the object in the trash, as listed by trash-list.")
+	overwrite := flags.Bool("overwrite", false, "Replace the object at the original key if one was created since.")
+
+	return func(ctx context.Context, s *server.Server) error {
+		if *installationID == "" || *trashKey == "" {
+			return fmt.Errorf("-installation and -trash-key are required")
+		}
+
+		object, err := s.RestoreTrashedObject(ctx, *installationID, *trashKey, *overwrite)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("restored %s\n", object.Key)
+		return nil
+	}
+}
+
+func tagBackfillCommand(flags *flag.FlagSet) func(ctx context.Context, s *server.Server) error {
+	installationID := flags.String("installation", "", "Installation whose objects are tagged.")
+	dryRun := flags.Bool("dry-run", false, "Only report the objects that would be tagged.")
+
+	return func(ctx context.Context, s *server.Server) error {
+		if *installationID == "" {
+			return fmt.Errorf("-installation is required")
+		}
+
+		report, err := s.BackfillTags(ctx, *installationID, *dryRun)
+		if report != nil {
+			verb := "tagged"
+			if *dryRun {
+				verb = "would tag"
+			}
+			fmt.Printf("%s %d of %d objects, request ID %s\n", verb, report.Tagged, report.Objects, report.RequestID)
+		}
+		return err
+	}
+}
+
+func exportCommand(flags *flag.FlagSet) func(ctx context.Context, s *server.Server) error {
+	installationID := flags.String("installation", "", "Installation whose objects are exported.")
+	output := flags.String("output", "", "File the archive is written to.")
+	format := flags.String("format", server.ExportFormatTar, "Format of the archive, tar or zip.")
+	prefix := flags.String("prefix", "", "Only export the keys under this prefix, within the installation.")
+	startAfter := flags.String("start-after", "", "Only export the keys after this one, to resume an interrupted export.")
+	verify := flags.Bool("verify", false, "Verify the checksums of the objects.")
+
+	return func(ctx context.Context, s *server.Server) error {
+		if *installationID == "" || *output == "" {
+			return fmt.Errorf("-installation and -output are required")
+		}
+
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		opts := server.ExportOptions{Format: *format, Prefix: *prefix, StartAfter: *startAfter, Verify: *verify}
+		report, err := s.ExportInstallation(ctx, *installationID, opts, file)
+		if report != nil {
+			fmt.Printf("exported %d objects, %d bytes, %d verified, %d deleted meanwhile\n", report.Objects, report.Bytes, report.Verified, report.Skipped)
+		}
+		if err != nil {
+			if report != nil && report.LastKey != "" {
+				fmt.Printf("the archive is incomplete, resume with -start-after %q\n", report.LastKey)
+			}
+			return err
+		}
+		return file.Close()
+	}
+}
+
+func importCommand(flags *flag.FlagSet) func(ctx context.Context, s *server.Server) error {
+	installationID := flags.String("installation", "", "Installation the objects are imported into.")
+	input := flags.String("input", "", "Archive or directory to import.")
+	prefix := flags.String("prefix", "", "Prefix of the imported keys, within the installation.")
+	checkpoint := flags.String("checkpoint", "", "File the imported objects are recorded in, to resume an interrupted import.")
+	preserveMetadata := flags.Bool("preserve-metadata", false, "Set the metadata of the manifest of an export on the objects.")
+
+	return func(ctx context.Context, s *server.Server) error {
+		if *installationID == "" || *input == "" {
+			return fmt.Errorf("-installation and -input are required")
+		}
+
+		opts := server.ImportOptions{Prefix: *prefix, Checkpoint: *checkpoint, PreserveMetadata: *preserveMetadata}
+		report, err := s.ImportInstallation(ctx, *installationID, *input, opts)
+		if report != nil {
+			fmt.Printf("imported %d objects, %d bytes, %d as multipart uploads, %d already imported\n", report.Objects, report.Bytes, report.Multipart, report.Skipped)
+		}
+		return err
+	}
+}
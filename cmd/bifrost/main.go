@@ -8,14 +8,28 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/mattermost/bifrost/internal/server"
 )
 
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[1], err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var configFile string
 	flag.StringVar(&configFile, "config", "config/config.json", "Configuration file for the Bifrost service.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] | %s <command> [flags]\n\nFlags:\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+		printCommands()
+	}
 	flag.Parse()
 
 	config, err := server.ParseConfig(configFile)
@@ -24,7 +38,11 @@ func main() {
 		os.Exit(1)
 	}
 
-	s := server.New(config)
+	s, err := server.New(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not create the server: %s\n", err)
+		os.Exit(1)
+	}
 	go func() {
 		if err := s.Start(); err != nil {
 			fmt.Fprintf(os.Stderr, "could not start the server: %s\n", err)
@@ -7,6 +7,7 @@ toolchain go1.22.1
 require (
 	github.com/gorilla/mux v1.8.1
 	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/klauspost/compress v1.17.8
 	github.com/mattermost/mattermost-server/v5 v5.28.0
 	github.com/minio/minio-go/v7 v7.0.69
 	github.com/pkg/errors v0.9.1
@@ -25,7 +26,6 @@ require (
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
-	github.com/klauspost/compress v1.17.8 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.7 // indirect
 	github.com/mattermost/logr v1.0.13 // indirect
 	github.com/minio/md5-simd v1.1.2 // indirect
@@ -0,0 +1,378 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+// registerAdminRoutes adds the admin API to the service router. Requests
+// must carry the admin token as a bearer token, and the API is not served
+// at all without one.
+func (s *Server) registerAdminRoutes(router *mux.Router) {
+	if s.cfg.ServiceSettings.AdminToken == "" {
+		s.logger.Info("No admin token configured, the admin API is disabled")
+		return
+	}
+
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(s.withAdminToken)
+	admin.HandleFunc("/installations", s.listInstallationsHandler).Methods("GET")
+	admin.HandleFunc("/installations/{installationID}", s.getInstallationHandler).Methods("GET")
+	admin.HandleFunc("/installations/{installationID}/trash", s.listTrashHandler).Methods("GET")
+	admin.HandleFunc("/installations/{installationID}/changes", s.changesHandler).Methods("GET")
+	admin.HandleFunc("/installations/{installationID}/trash/restore", s.restoreTrashedObjectHandler).Methods("POST")
+	admin.HandleFunc("/policies/simulate", s.simulatePolicyHandler).Methods("POST")
+	admin.HandleFunc("/installations/{installationID}/freeze", s.freezeInstallationHandler).Methods("POST")
+	admin.HandleFunc("/installations/{installationID}/unfreeze", s.unfreezeInstallationHandler).Methods("POST")
+	if s.cfg.ExportSettings.Enable {
+		admin.HandleFunc("/installations/{installationID}/export", s.exportInstallationHandler).Methods("GET")
+	}
+	if s.cfg.ImportSettings.Enable {
+		admin.HandleFunc("/installations/{installationID}/import", s.importInstallationHandler).Methods("POST")
+	}
+	if s.cfg.OffboardingSettings.Enable {
+		admin.HandleFunc("/installations/{installationID}/offboard", s.offboardInstallationHandler).Methods("POST")
+		admin.HandleFunc("/installations/{installationID}/offboard/cancel", s.cancelOffboardingHandler).Methods("POST")
+		admin.HandleFunc("/installations/{installationID}/offboard/report", s.deletionReportHandler).Methods("GET")
+	}
+	if s.cfg.MoveSettings.Enable {
+		admin.HandleFunc("/installations/{installationID}/move", s.moveInstallationHandler).Methods("POST")
+		admin.HandleFunc("/installations/{installationID}/move/finish", s.finishMoveHandler).Methods("POST")
+	}
+}
+
+func (s *Server) withAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := s.cfg.ServiceSettings.AdminToken
+		if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) listInstallationsHandler(w http.ResponseWriter, _ *http.Request) {
+	s.writeAdminResponse(w, s.states.list())
+}
+
+func (s *Server) getInstallationHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeAdminResponse(w, s.states.get(mux.Vars(r)["installationID"]))
+}
+
+func (s *Server) freezeInstallationHandler(w http.ResponseWriter, r *http.Request) {
+	installationID := mux.Vars(r)["installationID"]
+	if err := s.freezeInstallation(installationID); err != nil {
+		s.logger.Error("failed to freeze installation", mlog.String("installation_id", installationID), mlog.Err(err))
+		http.Error(w, "failed to save the installation state", http.StatusInternalServerError)
+		return
+	}
+	s.writeAdminResponse(w, s.states.get(installationID))
+}
+
+func (s *Server) unfreezeInstallationHandler(w http.ResponseWriter, r *http.Request) {
+	installationID := mux.Vars(r)["installationID"]
+	if err := s.unfreezeInstallation(installationID); err != nil {
+		s.logger.Error("failed to unfreeze installation", mlog.String("installation_id", installationID), mlog.Err(err))
+		http.Error(w, "failed to save the installation state", http.StatusInternalServerError)
+		return
+	}
+	s.writeAdminResponse(w, s.states.get(installationID))
+}
+
+// offboardInstallationHandler rejects the requests of the installation, and
+// schedules the deletion of its data once the grace period is over.
+func (s *Server) offboardInstallationHandler(w http.ResponseWriter, r *http.Request) {
+	deleting, err := s.offboardInstallation(mux.Vars(r)["installationID"])
+	if err != nil {
+		s.writeAdminError(w, err)
+		return
+	}
+	s.writeAdminResponse(w, deleting)
+}
+
+// cancelOffboardingHandler cancels the offboarding of the installation during
+// its grace period.
+func (s *Server) cancelOffboardingHandler(w http.ResponseWriter, r *http.Request) {
+	installationID := mux.Vars(r)["installationID"]
+	if err := s.cancelOffboarding(installationID); err != nil {
+		s.writeAdminError(w, err)
+		return
+	}
+	s.writeAdminResponse(w, s.states.get(installationID))
+}
+
+// deletionReportHandler serves the signed report of the deletion of the data
+// of the installation, once it has completed.
+func (s *Server) deletionReportHandler(w http.ResponseWriter, r *http.Request) {
+	deleting := s.states.get(mux.Vars(r)["installationID"]).Deleting
+	if deleting == nil || deleting.Report == nil {
+		http.Error(w, "the deletion of the installation has not completed", http.StatusNotFound)
+		return
+	}
+	s.writeAdminResponse(w, deleting.Report)
+}
+
+// moveInstallationHandler starts moving the objects of the installation to
+// the prefix of the installation given by the to parameter, or resumes the
+// move. The move runs in the background.
+func (s *Server) moveInstallationHandler(w http.ResponseWriter, r *http.Request) {
+	installationID := mux.Vars(r)["installationID"]
+	moving, err := s.startMove(installationID, r.URL.Query().Get("to"))
+	if err != nil {
+		s.writeAdminError(w, err)
+		return
+	}
+	if moving.Phase != movePhaseDone {
+		go s.runMove(installationID)
+	}
+	s.writeAdminResponse(w, moving)
+}
+
+// finishMoveHandler ends the routing of the requests of the installation
+// once its move has completed.
+func (s *Server) finishMoveHandler(w http.ResponseWriter, r *http.Request) {
+	installationID := mux.Vars(r)["installationID"]
+	if err := s.finishMove(installationID); err != nil {
+		s.writeAdminError(w, err)
+		return
+	}
+	s.writeAdminResponse(w, s.states.get(installationID))
+}
+
+func (s *Server) listTrashHandler(w http.ResponseWriter, r *http.Request) {
+	objects, err := s.ListTrash(r.Context(), mux.Vars(r)["installationID"])
+	if err != nil {
+		s.writeAdminError(w, err)
+		return
+	}
+	s.writeAdminResponse(w, objects)
+}
+
+// restoreTrashedObjectHandler restores the object of the trash_key query
+// parameter, which holds slashes. With overwrite=true, an object created at
+// the original key since is replaced.
+func (s *Server) restoreTrashedObjectHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	overwrite, _ := strconv.ParseBool(query.Get("overwrite"))
+	object, err := s.RestoreTrashedObject(r.Context(), mux.Vars(r)["installationID"], query.Get("trash_key"), overwrite)
+	if err != nil {
+		s.writeAdminError(w, err)
+		return
+	}
+	s.writeAdminResponse(w, object)
+}
+
+// changesHandler serves the change feed of an installation. The cursor
+// query parameter is the cursor of the last change seen, empty to start at
+// the oldest change kept, or latest to get the cursor of the latest change.
+// With wait, the request waits up to that many seconds for changes.
+func (s *Server) changesHandler(w http.ResponseWriter, r *http.Request) {
+	if s.changes == nil {
+		http.Error(w, "the change feed is not enabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := defaultChangeFeedLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > maxChangeFeedLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxChangeFeedLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	var wait time.Duration
+	if value := query.Get("wait"); value != "" {
+		secs, err := strconv.Atoi(value)
+		if err != nil || secs < 0 {
+			http.Error(w, "wait must be a number of seconds", http.StatusBadRequest)
+			return
+		}
+		wait = min(time.Duration(secs)*time.Second, maxChangeFeedWait)
+	}
+
+	page, err := s.changes.changes(r, mux.Vars(r)["installationID"], query.Get("cursor"), limit, wait)
+	if err != nil {
+		s.writeAdminError(w, err)
+		return
+	}
+	s.writeAdminResponse(w, page)
+}
+
+// exportInstallationHandler streams the objects of an installation as an
+// archive. The format, prefix, start_after and verify query parameters are
+// the options of the export. The archive can take longer to send than the
+// write timeout of the service, so the timeout is lifted. Errors once the
+// archive has started abort the connection, so that a truncated archive
+// can't be taken for a complete one.
+func (s *Server) exportInstallationHandler(w http.ResponseWriter, r *http.Request) {
+	installationID := mux.Vars(r)["installationID"]
+	query := r.URL.Query()
+	verify, _ := strconv.ParseBool(query.Get("verify"))
+	opts := ExportOptions{
+		Format:     query.Get("format"),
+		Prefix:     query.Get("prefix"),
+		StartAfter: query.Get("start_after"),
+		Verify:     verify,
+	}
+	if opts.Format == "" {
+		opts.Format = ExportFormatTar
+	}
+	if err := opts.validate(); err != nil {
+		s.writeAdminError(w, err)
+		return
+	}
+
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", exportContentTypes[opts.Format])
+	w.Header().Set("Content-Disposition", `attachment; filename="`+installationID+"."+opts.Format+`"`)
+	report, err := s.ExportInstallation(r.Context(), installationID, opts, w)
+	if err != nil {
+		fields := []mlog.Field{mlog.String("installation_id", installationID), mlog.Err(err)}
+		if report != nil {
+			fields = append(fields, mlog.Int("objects", report.Objects), mlog.String("last_key", report.LastKey))
+		}
+		s.logger.Error("failed to export installation", fields...)
+		panic(http.ErrAbortHandler)
+	}
+	s.logger.Info("exported installation",
+		mlog.String("installation_id", installationID),
+		mlog.Int("objects", report.Objects),
+		mlog.Int64("bytes", report.Bytes),
+		mlog.Int("verified", report.Verified),
+	)
+}
+
+// importInstallationHandler imports the tar or zip archive of the body of
+// the request into an installation. The archive is spooled to a file
+// before it is imported. The prefix and preserve_metadata query parameters
+// are the options of the import, and checkpoint names its checkpoint file
+// in the checkpoint directory. The import can take longer than the
+// timeouts of the service, so they are lifted.
+func (s *Server) importInstallationHandler(w http.ResponseWriter, r *http.Request) {
+	installationID := mux.Vars(r)["installationID"]
+	query := r.URL.Query()
+	preserve, _ := strconv.ParseBool(query.Get("preserve_metadata"))
+	opts := ImportOptions{Prefix: query.Get("prefix"), PreserveMetadata: preserve}
+	if err := checkImportPrefix(opts.Prefix); err != nil {
+		s.writeAdminError(w, err)
+		return
+	}
+	if name := query.Get("checkpoint"); name != "" {
+		directory := s.cfg.ImportSettings.CheckpointDirectory
+		if directory == "" {
+			http.Error(w, "no checkpoint directory is configured", http.StatusBadRequest)
+			return
+		}
+		if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+			http.Error(w, "invalid checkpoint name", http.StatusBadRequest)
+			return
+		}
+		opts.Checkpoint = filepath.Join(directory, name)
+	}
+
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	archive, err := os.CreateTemp(s.cfg.ImportSettings.SpoolDirectory, "bifrost-import-")
+	if err != nil {
+		s.writeAdminError(w, errors.Wrap(err, "failed to create spool file"))
+		return
+	}
+	defer os.Remove(archive.Name())
+	_, err = io.Copy(archive, r.Body)
+	if closeErr := archive.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.writeAdminError(w, errors.Wrap(err, "failed to spool the archive"))
+		return
+	}
+
+	report, err := s.ImportInstallation(r.Context(), installationID, archive.Name(), opts)
+	if err != nil {
+		s.writeAdminError(w, err)
+		return
+	}
+	s.logger.Info("imported installation",
+		mlog.String("installation_id", installationID),
+		mlog.Int("objects", report.Objects),
+		mlog.Int64("bytes", report.Bytes),
+		mlog.Int("skipped", report.Skipped),
+	)
+	s.writeAdminResponse(w, report)
+}
+
+// simulatePolicyRequest is a request to evaluate, with the policies to
+// evaluate it against instead of the loaded ones, if any.
+type simulatePolicyRequest struct {
+	policyRequest
+	Policies *policyFile `json:"policies"`
+}
+
+// simulatePolicyHandler tells whether the access policies allow a request,
+// and which statement decided it, so that policies can be tested before
+// they are deployed.
+func (s *Server) simulatePolicyHandler(w http.ResponseWriter, r *http.Request) {
+	req := simulatePolicyRequest{policyRequest: policyRequest{ContentLength: -1}}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid simulation request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Action == "" {
+		http.Error(w, "action is required", http.StatusBadRequest)
+		return
+	}
+	if req.Time.IsZero() {
+		req.Time = time.Now()
+	}
+
+	policies := s.policies
+	if req.Policies != nil {
+		var err error
+		if policies, err = compilePolicies(*req.Policies); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if policies == nil {
+		http.Error(w, "access policies are not enabled", http.StatusNotFound)
+		return
+	}
+	s.writeAdminResponse(w, policies.evaluate(req.policyRequest))
+}
+
+// writeAdminError writes the message and status code of S3 errors, and
+// hides the details of the others.
+func (s *Server) writeAdminError(w http.ResponseWriter, err error) {
+	var s3Err *s3Error
+	if errors.As(err, &s3Err) && s3Err.StatusCode < http.StatusInternalServerError {
+		http.Error(w, s3Err.Message, s3Err.StatusCode)
+		return
+	}
+	s.logger.Error("admin request failed", mlog.Err(err))
+	http.Error(w, "internal error", http.StatusInternalServerError)
+}
+
+func (s *Server) writeAdminResponse(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.logger.Error("failed to write admin response", mlog.Err(err))
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminInstallations(t *testing.T) {
+	_, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{})
+	s.cfg.ServiceSettings.AdminToken = "secret"
+	s.handler()
+	router := mux.NewRouter()
+	s.registerAdminRoutes(router)
+
+	call := func(method, path, token string) (*httptest.ResponseRecorder, map[string]any) {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var body map[string]any
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		}
+		return w, body
+	}
+
+	w, _ := call("POST", "/admin/installations/inst/freeze", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w, _ = call("POST", "/admin/installations/inst/freeze", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Nil(t, s.states.get("inst").Frozen)
+
+	w, body := call("POST", "/admin/installations/inst/freeze", "secret")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, freezeReasonManual, body["frozen"].(map[string]any)["reason"])
+
+	_, body = call("GET", "/admin/installations", "secret")
+	assert.Contains(t, body, "inst")
+
+	_, body = call("GET", "/admin/installations/inst", "secret")
+	assert.Contains(t, body, "frozen")
+
+	w, body = call("POST", "/admin/installations/inst/unfreeze", "secret")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, body)
+	assert.Nil(t, s.states.get("inst").Frozen)
+
+	w, _ = call("GET", "/admin/installations/inst/unfreeze", "secret")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestAdminWithoutToken(t *testing.T) {
+	_, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{})
+	s.handler()
+	router := mux.NewRouter()
+	s.registerAdminRoutes(router)
+
+	for _, token := range []string{"", " "} {
+		req := httptest.NewRequest("POST", "/admin/installations/inst/freeze", nil)
+		req.Header.Set("Authorization", "Bearer"+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+	assert.Nil(t, s.states.get("inst").Frozen)
+}
+
+// newAdminRouter sets an admin token on the server and returns its admin
+// API, with the token added to the requests it serves.
+func newAdminRouter(s *Server) http.HandlerFunc {
+	s.cfg.ServiceSettings.AdminToken = "secret"
+	router := mux.NewRouter()
+	s.registerAdminRoutes(router)
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Authorization", "Bearer secret")
+		router.ServeHTTP(w, r)
+	}
+}
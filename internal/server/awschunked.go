@@ -0,0 +1,303 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/signer"
+	"github.com/pkg/errors"
+)
+
+// Payload hashes of aws-chunked uploads with chunk signatures. The chunk
+// signatures are chained to the signature of the client's request, so they
+// have to be signed again. Bodies of STREAMING-UNSIGNED-PAYLOAD-TRAILER
+// uploads are valid as they are.
+const (
+	streamingPayload             = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingPayloadTrailer      = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingECDSAPayload        = "STREAMING-AWS4-ECDSA-P256-SHA256-PAYLOAD"
+	streamingECDSAPayloadTrailer = "STREAMING-AWS4-ECDSA-P256-SHA256-PAYLOAD-TRAILER"
+
+	trailerSignatureHeader = "X-Amz-Trailer-Signature"
+	maxChunkLineLength     = 4096
+)
+
+// checksumTrailerLengths are the lengths of the base64 encoded values of the
+// checksum trailers. The length of the re-encoded body has to be known before
+// the trailers are read.
+var checksumTrailerLengths = map[string]int{
+	"X-Amz-Checksum-Crc32":     8,
+	"X-Amz-Checksum-Crc32c":    8,
+	"X-Amz-Checksum-Crc64nvme": 12,
+	"X-Amz-Checksum-Sha1":      28,
+	"X-Amz-Checksum-Sha256":    44,
+}
+
+// isSignedStreamingPayload reports whether the payload hash is the one of an
+// aws-chunked body with chunk signatures.
+func isSignedStreamingPayload(payloadHash string) bool {
+	switch payloadHash {
+	case streamingPayload, streamingPayloadTrailer, streamingECDSAPayload, streamingECDSAPayloadTrailer:
+		return true
+	}
+	return false
+}
+
+// prepareAWSChunked replaces the body of an aws-chunked request with chunk
+// signatures by the decoded payload, so that signRequest can encode it again
+// with chunk signatures of its own. The trailers declared by the client are
+// set in r.Trailer once the body has been read.
+//
+// Bifrost doesn't have the secret keys of the clients, so their chunk
+// signatures are dropped without being verified, whether or not clients
+// authenticate with certificates.
+func prepareAWSChunked(r *http.Request) error {
+	if !isSignedStreamingPayload(r.Header.Get("X-Amz-Content-Sha256")) {
+		return nil
+	}
+
+	decodedLength, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+	if err != nil || decodedLength < 0 {
+		return &s3Error{StatusCode: http.StatusLengthRequired, Code: "MissingContentLength", Message: "You must provide the X-Amz-Decoded-Content-Length HTTP header."}
+	}
+
+	// The trailers get placeholders of the length of their values, which is
+	// all the streaming signer needs to compute the length of the body.
+	trailer := make(http.Header)
+	for _, value := range r.Header.Values("X-Amz-Trailer") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			length, ok := checksumTrailerLengths[name]
+			if !ok {
+				return &s3Error{StatusCode: http.StatusBadRequest, Code: "InvalidRequest", Message: "Unsupported trailer " + name + "."}
+			}
+			trailer.Set(name, strings.Repeat("=", length))
+		}
+	}
+
+	decoder := newAWSChunkedReader(r.Body, trailer)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{decoder, r.Body}
+	r.ContentLength = decodedLength
+	r.Trailer = trailer
+	r.Header.Del("X-Amz-Trailer")
+
+	// The streaming signer can't encode an empty payload. The body is read
+	// right away and its checksums are sent as headers instead.
+	if decodedLength == 0 {
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			return err
+		}
+		for name, values := range trailer {
+			r.Header[name] = values
+		}
+		r.Body = http.NoBody
+		r.Trailer = nil
+		r.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+		r.Header.Del("X-Amz-Decoded-Content-Length")
+		removeAWSChunkedEncoding(r.Header)
+	}
+
+	return nil
+}
+
+// removeAWSChunkedEncoding removes aws-chunked from the Content-Encoding
+// header, keeping any other encoding.
+func removeAWSChunkedEncoding(header http.Header) {
+	var encodings []string
+	for _, value := range header.Values("Content-Encoding") {
+		for _, encoding := range strings.Split(value, ",") {
+			if encoding = strings.TrimSpace(encoding); encoding != "" && encoding != "aws-chunked" {
+				encodings = append(encodings, encoding)
+			}
+		}
+	}
+	header.Del("Content-Encoding")
+	if len(encodings) > 0 {
+		header.Set("Content-Encoding", strings.Join(encodings, ","))
+	}
+}
+
+// signStreamingRequest signs a request prepared by prepareAWSChunked,
+// encoding the payload in aws-chunked chunks with fresh signatures.
+func (s *Server) signStreamingRequest(r *http.Request, val credentials.Value) *http.Request {
+	req := r.Clone(r.Context())
+	// The decoder fills in the trailers of the original request.
+	req.Trailer = r.Trailer
+
+	signed := signer.StreamingSignV4(req, val.AccessKeyID, val.SecretAccessKey, val.SessionToken,
+		s.cfg.S3Settings.Region, r.ContentLength, time.Now().UTC(), sha256Hasher{sha256.New()})
+
+	// The streaming signer marks requests with trailers as aws-chunked
+	// transfer encoded, which the transport would send as is. The length of
+	// the body is known, so it is sent with a Content-Length instead.
+	signed.TransferEncoding = nil
+
+	return signed
+}
+
+// sha256Hasher adapts a SHA-256 hash to the hasher of the streaming signer.
+type sha256Hasher struct {
+	hash.Hash
+}
+
+func (sha256Hasher) Close() {}
+
+// awsChunkedReader decodes an aws-chunked body. Chunks look like
+//
+//	<hex size>[;chunk-signature=<signature>]\r\n<data>\r\n
+//
+// and the last one, of size zero, is followed by the trailers and an empty
+// line.
+type awsChunkedReader struct {
+	r *bufio.Reader
+	// trailer holds the declared trailers, which get their values at the
+	// end of the body.
+	trailer  http.Header
+	received map[string]bool
+
+	remaining int64
+	started   bool
+	err       error
+}
+
+func newAWSChunkedReader(r io.Reader, trailer http.Header) *awsChunkedReader {
+	return &awsChunkedReader{
+		r:        bufio.NewReader(r),
+		trailer:  trailer,
+		received: make(map[string]bool),
+	}
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	if c.remaining == 0 {
+		if c.err = c.nextChunk(); c.err != nil {
+			return 0, c.err
+		}
+		if c.remaining == 0 {
+			c.err = c.readTrailers()
+			if c.err == nil {
+				c.err = io.EOF
+			}
+			return 0, c.err
+		}
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.err = errors.Wrap(err, "failed to read aws-chunked body")
+	}
+	return n, err
+}
+
+// nextChunk reads the header of the next chunk, after the end of the
+// previous one.
+func (c *awsChunkedReader) nextChunk() error {
+	if c.started {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if len(line) != 0 {
+			return errors.New("invalid aws-chunked body: missing CRLF after chunk")
+		}
+	}
+	c.started = true
+
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	size, _, _ := bytes.Cut(line, []byte(";"))
+	c.remaining, err = strconv.ParseInt(string(size), 16, 64)
+	if err != nil || c.remaining < 0 {
+		return errors.Errorf("invalid aws-chunked chunk size %q", size)
+	}
+	return nil
+}
+
+// readTrailers reads the trailers after the last chunk.
+func (c *awsChunkedReader) readTrailers() error {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 {
+			// Some clients separate the trailer signature from the trailers
+			// with an empty line, so the trailers only end with the body.
+			if _, err := c.r.Peek(1); err == io.EOF {
+				break
+			}
+			continue
+		}
+
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok {
+			return errors.Errorf("invalid aws-chunked trailer %q", line)
+		}
+		key := http.CanonicalHeaderKey(string(bytes.TrimSpace(name)))
+		if key == trailerSignatureHeader {
+			continue
+		}
+		placeholder := c.trailer.Get(key)
+		if placeholder == "" {
+			return errors.Errorf("undeclared aws-chunked trailer %q", key)
+		}
+		value = bytes.TrimSpace(value)
+		if len(value) != len(placeholder) {
+			return errors.Errorf("invalid value for aws-chunked trailer %q", key)
+		}
+		c.trailer.Set(key, string(value))
+		c.received[key] = true
+	}
+
+	for key := range c.trailer {
+		if !c.received[key] {
+			return errors.Errorf("missing aws-chunked trailer %q", key)
+		}
+	}
+	return nil
+}
+
+// readLine reads a line ending with CRLF and returns it without the CRLF.
+func (c *awsChunkedReader) readLine() ([]byte, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > maxChunkLineLength {
+		return nil, errors.New("invalid aws-chunked body: line too long")
+	}
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read aws-chunked body")
+	}
+	return bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r")), nil
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/signer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAWSChunkedReader(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		body        string
+		trailer     http.Header
+		expected    string
+		expectedErr bool
+	}{
+		{
+			description: "signed chunks",
+			body:        "5;chunk-signature=aaaa\r\nhello\r\n6;chunk-signature=bbbb\r\n world\r\n0;chunk-signature=cccc\r\n\r\n",
+			expected:    "hello world",
+		},
+		{
+			description: "unsigned chunks with trailer",
+			body:        "5\r\nhello\r\n0\r\nx-amz-checksum-crc32:NhCmhg==\r\n\r\n",
+			trailer:     http.Header{"X-Amz-Checksum-Crc32": {"========"}},
+			expected:    "hello",
+		},
+		{
+			description: "signed trailer",
+			body:        "5;chunk-signature=aaaa\r\nhello\r\n0;chunk-signature=bbbb\r\nx-amz-checksum-crc32:NhCmhg==\n\r\nx-amz-trailer-signature:cccc\r\n\r\n",
+			trailer:     http.Header{"X-Amz-Checksum-Crc32": {"========"}},
+			expected:    "hello",
+		},
+		{
+			description: "missing trailer",
+			body:        "5\r\nhello\r\n0\r\n\r\n",
+			trailer:     http.Header{"X-Amz-Checksum-Crc32": {"========"}},
+			expectedErr: true,
+		},
+		{
+			description: "undeclared trailer",
+			body:        "5\r\nhello\r\n0\r\nx-amz-checksum-sha1:abc\r\n\r\n",
+			expectedErr: true,
+		},
+		{
+			description: "truncated chunk",
+			body:        "a;chunk-signature=aaaa\r\nhello",
+			expectedErr: true,
+		},
+		{
+			description: "invalid size",
+			body:        "zz\r\nhello\r\n0\r\n\r\n",
+			expectedErr: true,
+		},
+		{
+			description: "missing CRLF",
+			body:        "5\r\nhelloX0\r\n\r\n",
+			expectedErr: true,
+		},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			trailer := test.trailer
+			if trailer == nil {
+				trailer = make(http.Header)
+			}
+			data, err := io.ReadAll(newAWSChunkedReader(strings.NewReader(test.body), trailer))
+			if test.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, string(data))
+			if test.trailer != nil {
+				assert.Equal(t, "NhCmhg==", trailer.Get("X-Amz-Checksum-Crc32"))
+			}
+		})
+	}
+}
+
+func TestAWSChunkedUpload(t *testing.T) {
+	content := make([]byte, 150*1024)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+	checksum := make([]byte, 4)
+	crc := crc32.ChecksumIEEE(content)
+	checksum[0], checksum[1], checksum[2], checksum[3] = byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc)
+	crcValue := base64.StdEncoding.EncodeToString(checksum)
+
+	var received *http.Request
+	var receivedBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		receivedBody, _ = io.ReadAll(r.Body)
+	}))
+	defer upstream.Close()
+
+	s := newFakeS3Server(t, upstream, Config{})
+	handler := s.handler()
+
+	// newStreamingRequest encodes the content the way SDKs do, signed with
+	// the client's own credentials.
+	newStreamingRequest := func(content []byte, trailer http.Header) *http.Request {
+		req := httptest.NewRequest("PUT", "http://example.com/agnivatest/inst/file", bytes.NewReader(content))
+		req.Header.Set("Content-Encoding", "aws-chunked")
+		req.Trailer = trailer
+		signed := signer.StreamingSignV4(req, "client", "clientsecret", "", "us-east-1", int64(len(content)), time.Now().UTC(), sha256Hasher{sha256.New()})
+		body, err := io.ReadAll(signed.Body)
+		require.NoError(t, err)
+
+		inbound := httptest.NewRequest("PUT", "http://example.com/agnivatest/inst/file", bytes.NewReader(body))
+		inbound.Header = signed.Header.Clone()
+		return inbound
+	}
+
+	t.Run("with trailer", func(t *testing.T) {
+		req := newStreamingRequest(content, http.Header{"X-Amz-Checksum-Crc32": {crcValue}})
+		clientSignature := req.Header.Get("Authorization")
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NotNil(t, received)
+		assert.Equal(t, streamingPayloadTrailer, received.Header.Get("X-Amz-Content-Sha256"))
+		assert.Equal(t, "x-amz-checksum-crc32", received.Header.Get("X-Amz-Trailer"))
+		assert.Equal(t, strconv.Itoa(len(content)), received.Header.Get("X-Amz-Decoded-Content-Length"))
+		assert.Equal(t, "aws-chunked", received.Header.Get("Content-Encoding"))
+		assert.Equal(t, int64(len(receivedBody)), received.ContentLength)
+		assert.NotEqual(t, clientSignature, received.Header.Get("Authorization"))
+		assert.Contains(t, received.Header.Get("Authorization"), "Credential=AKIA2AccessKey/")
+
+		trailer := http.Header{"X-Amz-Checksum-Crc32": {"========"}}
+		decoded, err := io.ReadAll(newAWSChunkedReader(bytes.NewReader(receivedBody), trailer))
+		require.NoError(t, err)
+		assert.Equal(t, content, decoded)
+		assert.Equal(t, crcValue, trailer.Get("X-Amz-Checksum-Crc32"))
+	})
+
+	t.Run("without trailer", func(t *testing.T) {
+		req := newStreamingRequest(content, nil)
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, streamingPayload, received.Header.Get("X-Amz-Content-Sha256"))
+		decoded, err := io.ReadAll(newAWSChunkedReader(bytes.NewReader(receivedBody), make(http.Header)))
+		require.NoError(t, err)
+		assert.Equal(t, content, decoded)
+	})
+
+	t.Run("empty body", func(t *testing.T) {
+		req := httptest.NewRequest("PUT", "http://example.com/agnivatest/inst/file",
+			strings.NewReader("0;chunk-signature=aaaa\r\nx-amz-checksum-crc32:AAAAAA==\r\n\r\n"))
+		req.Header.Set("Content-Encoding", "aws-chunked")
+		req.Header.Set("X-Amz-Content-Sha256", streamingPayloadTrailer)
+		req.Header.Set("X-Amz-Decoded-Content-Length", "0")
+		req.Header.Set("X-Amz-Trailer", "x-amz-checksum-crc32")
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, emptySHA256, received.Header.Get("X-Amz-Content-Sha256"))
+		assert.Equal(t, "AAAAAA==", received.Header.Get("X-Amz-Checksum-Crc32"))
+		assert.Empty(t, received.Header.Get("Content-Encoding"))
+		assert.Empty(t, receivedBody)
+	})
+
+	t.Run("unsupported trailer", func(t *testing.T) {
+		req := newStreamingRequest(content, nil)
+		req.Header.Set("X-Amz-Trailer", "x-amz-meta-foo")
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("signed again with client certificates", func(t *testing.T) {
+		s.cfg.ServiceSettings.TLSClientAuth = TLSClientAuthVerify
+		defer func() { s.cfg.ServiceSettings.TLSClientAuth = TLSClientAuthNone }()
+		received = nil
+
+		req := newStreamingRequest(content, nil)
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NotNil(t, received)
+		assert.Contains(t, received.Header.Get("Authorization"), "Credential=AKIA2AccessKey/")
+		decoded, err := io.ReadAll(newAWSChunkedReader(bytes.NewReader(receivedBody), make(http.Header)))
+		require.NoError(t, err)
+		assert.Equal(t, content, decoded)
+	})
+}
@@ -0,0 +1,397 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states, also used as the value of the state metric.
+const (
+	breakerClosed   = 0
+	breakerHalfOpen = 1
+	breakerOpen     = 2
+)
+
+const (
+	defaultBreakerFailureThreshold = 20
+	defaultBreakerWindowSecs       = 10
+	defaultBreakerOpenSecs         = 5
+	defaultInitialConcurrency      = 100
+	defaultMinConcurrency          = 5
+	defaultMaxConcurrency          = 1000
+	defaultConcurrencyBackoff      = 0.5
+)
+
+// flowControllerIdleTimeout is how long the flow controller of an
+// installation is kept once it has no requests in flight and nothing to
+// remember, so that the installation IDs of the paths don't grow the
+// controllers and the metrics without limit.
+const flowControllerIdleTimeout = 5 * time.Minute
+
+// routeScope is the key of the flow controller that applies to all the
+// requests of the route, regardless of the installation.
+const routeScope = ""
+
+// Reasons of the requests rejected by the flow controllers.
+const (
+	rejectedCircuitOpen      = "circuit_open"
+	rejectedConcurrencyLimit = "concurrency_limit"
+)
+
+// upstreamOutcome is what the upstream made of the requests sent on behalf
+// of a client request. Requests rejected before anything was sent upstream
+// tell nothing about the upstream, and are neither successes nor failures.
+type upstreamOutcome struct {
+	sent       bool
+	overloaded bool
+}
+
+// upstreamTracker collects the outcome of the requests sent upstream on
+// behalf of a client request, which can be several, or several parts of
+// the same object. A 503 or a transport error on any of them counts as
+// overload.
+type upstreamTracker struct {
+	mu      sync.Mutex
+	outcome upstreamOutcome
+}
+
+func (t *upstreamTracker) record(statusCode int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.outcome.sent = true
+	if err != nil || statusCode == http.StatusServiceUnavailable {
+		t.outcome.overloaded = true
+	}
+}
+
+func (t *upstreamTracker) get() upstreamOutcome {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.outcome
+}
+
+type upstreamTrackerKey struct{}
+
+// withUpstreamTracker makes doUpstream record the outcome of the requests
+// made with the context in the tracker.
+func withUpstreamTracker(ctx context.Context, t *upstreamTracker) context.Context {
+	return context.WithValue(ctx, upstreamTrackerKey{}, t)
+}
+
+// recordUpstreamOutcome records the outcome of an upstream request in the
+// tracker of its context, if any.
+func recordUpstreamOutcome(ctx context.Context, statusCode int, err error) {
+	if t, ok := ctx.Value(upstreamTrackerKey{}).(*upstreamTracker); ok {
+		t.record(statusCode, err)
+	}
+}
+
+// circuitBreaker opens once the upstream answered with too many 503s within
+// a window. While open, requests are rejected without reaching the upstream.
+// Once the open period ends, a single request is let through: if it
+// succeeds the breaker closes, otherwise it opens again.
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	openFor   time.Duration
+
+	state       int
+	failures    []time.Time
+	openedUntil time.Time
+	probing     bool
+}
+
+func (b *circuitBreaker) allow(now time.Time) (bool, time.Duration) {
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.openedUntil) {
+			return false, b.openedUntil.Sub(now)
+		}
+		b.state = breakerHalfOpen
+		b.probing = false
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false, b.openFor
+		}
+		b.probing = true
+	}
+	return true, 0
+}
+
+func (b *circuitBreaker) record(now time.Time, overloaded bool) {
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		if overloaded {
+			b.trip(now)
+		} else {
+			b.state = breakerClosed
+			b.failures = nil
+		}
+		return
+	}
+
+	if !overloaded || b.state == breakerOpen {
+		return
+	}
+
+	cutoff := now.Add(-b.window)
+	kept := b.failures[:0]
+	for _, t := range b.failures {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	b.failures = append(kept, now)
+
+	if len(b.failures) >= b.threshold {
+		b.trip(now)
+	}
+}
+
+func (b *circuitBreaker) trip(now time.Time) {
+	b.state = breakerOpen
+	b.openedUntil = now.Add(b.openFor)
+	b.failures = nil
+}
+
+// adaptiveLimiter limits the number of concurrent requests with an additive
+// increase, multiplicative decrease algorithm. The limit grows by one for
+// every limit's worth of successful requests and is cut by the backoff ratio
+// whenever the upstream signals overload, either with a 503 or by answering
+// slower than the latency target.
+type adaptiveLimiter struct {
+	min, max      float64
+	backoff       float64
+	latencyTarget time.Duration
+
+	limit    float64
+	inflight int
+}
+
+func (l *adaptiveLimiter) acquire() bool {
+	if float64(l.inflight) >= math.Floor(l.limit) {
+		return false
+	}
+	l.inflight++
+	return true
+}
+
+func (l *adaptiveLimiter) release(overloaded bool, latency time.Duration) {
+	l.inflight--
+
+	if overloaded || (l.latencyTarget > 0 && latency > l.latencyTarget) {
+		l.limit = math.Max(l.min, l.limit*l.backoff)
+		return
+	}
+	l.limit = math.Min(l.max, l.limit+1/l.limit)
+}
+
+// flowController combines the circuit breaker and the concurrency limiter of
+// one scope.
+type flowController struct {
+	breaker  *circuitBreaker
+	limiter  *adaptiveLimiter
+	lastUsed time.Time
+}
+
+// idle reports whether the controller can be dropped: its breaker is closed
+// without recent failures, and it had no request in flight since the idle
+// timeout.
+func (c *flowController) idle(now time.Time) bool {
+	if c.breaker.state != breakerClosed || len(c.breaker.failures) > 0 {
+		return false
+	}
+	if c.limiter != nil && c.limiter.inflight > 0 {
+		return false
+	}
+	return now.Sub(c.lastUsed) >= flowControllerIdleTimeout
+}
+
+// flowControl holds the flow controllers of the route and of every
+// installation.
+type flowControl struct {
+	settings CircuitBreakerSettings
+	metrics  *metrics
+	nowFn    func() time.Time
+
+	mu          sync.Mutex
+	controllers map[string]*flowController
+	lastEvicted time.Time
+}
+
+func newFlowControl(settings CircuitBreakerSettings, m *metrics) *flowControl {
+	if settings.FailureThreshold == 0 {
+		settings.FailureThreshold = defaultBreakerFailureThreshold
+	}
+	if settings.WindowSecs == 0 {
+		settings.WindowSecs = defaultBreakerWindowSecs
+	}
+	if settings.OpenSecs == 0 {
+		settings.OpenSecs = defaultBreakerOpenSecs
+	}
+	if settings.InitialConcurrency == 0 {
+		settings.InitialConcurrency = defaultInitialConcurrency
+	}
+	if settings.MinConcurrency == 0 {
+		settings.MinConcurrency = defaultMinConcurrency
+	}
+	if settings.MaxConcurrency == 0 {
+		settings.MaxConcurrency = defaultMaxConcurrency
+	}
+	if settings.ConcurrencyBackoff == 0 {
+		settings.ConcurrencyBackoff = defaultConcurrencyBackoff
+	}
+
+	return &flowControl{
+		settings:    settings,
+		metrics:     m,
+		nowFn:       time.Now,
+		controllers: make(map[string]*flowController),
+	}
+}
+
+func (f *flowControl) controller(scope string) *flowController {
+	c, ok := f.controllers[scope]
+	if ok {
+		return c
+	}
+
+	c = &flowController{
+		lastUsed: f.nowFn(),
+		breaker: &circuitBreaker{
+			threshold: f.settings.FailureThreshold,
+			window:    time.Duration(f.settings.WindowSecs) * time.Second,
+			openFor:   time.Duration(f.settings.OpenSecs) * time.Second,
+		},
+	}
+	if f.settings.AdaptiveConcurrency {
+		c.limiter = &adaptiveLimiter{
+			min:           float64(f.settings.MinConcurrency),
+			max:           float64(f.settings.MaxConcurrency),
+			backoff:       f.settings.ConcurrencyBackoff,
+			latencyTarget: time.Duration(f.settings.LatencyTargetMillis) * time.Millisecond,
+			limit:         float64(f.settings.InitialConcurrency),
+		}
+	}
+	f.controllers[scope] = c
+	f.observe(scope, c)
+	return c
+}
+
+// acquire checks whether a request of the installation can be sent upstream.
+// If it can, the returned function must be called with the outcome of the
+// request. Otherwise, an error to return to the client is returned.
+func (f *flowControl) acquire(installationID string) (func(outcome upstreamOutcome, latency time.Duration), error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.nowFn()
+	f.evictIdle(now)
+	scopes := []string{routeScope, installationID}
+	if installationID == routeScope {
+		scopes = scopes[:1]
+	}
+
+	var acquired []*flowController
+	rollback := func() {
+		for _, c := range acquired {
+			c.breaker.probing = false
+			if c.limiter != nil {
+				c.limiter.inflight--
+			}
+		}
+	}
+
+	for _, scope := range scopes {
+		c := f.controller(scope)
+		if ok, retryAfter := c.breaker.allow(now); !ok {
+			rollback()
+			f.observe(scope, c)
+			f.metrics.incRejectedRequest(scope, rejectedCircuitOpen)
+			return nil, newSlowDownError("Circuit breaker is open, please reduce your request rate.", retryAfter)
+		}
+		if c.limiter != nil && !c.limiter.acquire() {
+			c.breaker.probing = false
+			rollback()
+			f.metrics.incRejectedRequest(scope, rejectedConcurrencyLimit)
+			return nil, newSlowDownError("Concurrency limit reached, please reduce your request rate.", time.Second)
+		}
+		c.lastUsed = now
+		acquired = append(acquired, c)
+		f.observe(scope, c)
+	}
+
+	var once sync.Once
+	return func(outcome upstreamOutcome, latency time.Duration) {
+		once.Do(func() {
+			f.release(scopes, acquired, outcome, latency)
+		})
+	}, nil
+}
+
+func (f *flowControl) release(scopes []string, acquired []*flowController, outcome upstreamOutcome, latency time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.nowFn()
+	for i, c := range acquired {
+		if outcome.sent {
+			c.breaker.record(now, outcome.overloaded)
+			if c.limiter != nil {
+				c.limiter.release(outcome.overloaded, latency)
+			}
+		} else {
+			// The probe of a half-open breaker has to be another request.
+			c.breaker.probing = false
+			if c.limiter != nil {
+				c.limiter.inflight--
+			}
+		}
+		c.lastUsed = now
+		f.observe(scopes[i], c)
+	}
+}
+
+// evictIdle drops the idle controllers of installations, along with their
+// metrics, at most once per idle timeout. The controller of the route is
+// kept.
+func (f *flowControl) evictIdle(now time.Time) {
+	if now.Sub(f.lastEvicted) < flowControllerIdleTimeout {
+		return
+	}
+	f.lastEvicted = now
+	for scope, c := range f.controllers {
+		if scope != routeScope && c.idle(now) {
+			delete(f.controllers, scope)
+			f.metrics.deleteFlowControl(scope)
+		}
+	}
+}
+
+func (f *flowControl) observe(scope string, c *flowController) {
+	limit := -1.0
+	if c.limiter != nil {
+		limit = math.Floor(c.limiter.limit)
+	}
+	f.metrics.setFlowControl(scope, c.breaker.state, limit)
+}
+
+// newSlowDownError returns the error S3 itself returns when a client sends
+// too many requests.
+func newSlowDownError(message string, retryAfter time.Duration) error {
+	return &s3Error{
+		StatusCode: http.StatusServiceUnavailable,
+		Code:       "SlowDown",
+		Message:    message,
+		RetryAfter: retryAfter,
+	}
+}
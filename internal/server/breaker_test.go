@@ -0,0 +1,296 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	prometheusModels "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	servedOutcome     = upstreamOutcome{sent: true}
+	overloadedOutcome = upstreamOutcome{sent: true, overloaded: true}
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	f := newFlowControl(CircuitBreakerSettings{
+		Enable:           true,
+		FailureThreshold: 3,
+		WindowSecs:       10,
+		OpenSecs:         5,
+	}, newMetrics())
+	f.nowFn = func() time.Time { return now }
+
+	fail := func(installationID string) {
+		release, err := f.acquire(installationID)
+		require.NoError(t, err)
+		release(overloadedOutcome, time.Millisecond)
+	}
+
+	t.Run("failures outside the window do not count", func(t *testing.T) {
+		fail("inst1")
+		fail("inst1")
+		now = now.Add(11 * time.Second)
+		fail("inst1")
+		_, err := f.acquire("inst1")
+		require.NoError(t, err)
+	})
+
+	t.Run("opens after too many failures", func(t *testing.T) {
+		fail("inst1")
+		fail("inst1")
+
+		_, err := f.acquire("inst1")
+		require.Error(t, err)
+		var s3Err *s3Error
+		require.ErrorAs(t, err, &s3Err)
+		assert.Equal(t, "SlowDown", s3Err.Code)
+		assert.Equal(t, http.StatusServiceUnavailable, s3Err.StatusCode)
+		assert.Equal(t, 5*time.Second, s3Err.RetryAfter)
+
+		// The route as a whole is also open, since all the failures went
+		// through it.
+		_, err = f.acquire("inst2")
+		require.Error(t, err)
+	})
+
+	t.Run("half open lets a single probe through", func(t *testing.T) {
+		now = now.Add(5 * time.Second)
+
+		release, err := f.acquire("inst1")
+		require.NoError(t, err)
+		_, err = f.acquire("inst1")
+		require.Error(t, err)
+
+		release(overloadedOutcome, time.Millisecond)
+		_, err = f.acquire("inst1")
+		require.Error(t, err)
+	})
+
+	t.Run("probes that are not sent upstream do not count", func(t *testing.T) {
+		now = now.Add(5 * time.Second)
+
+		release, err := f.acquire("inst1")
+		require.NoError(t, err)
+		release(upstreamOutcome{}, time.Millisecond)
+
+		release, err = f.acquire("inst1")
+		require.NoError(t, err)
+		_, err = f.acquire("inst1")
+		require.Error(t, err)
+		release(overloadedOutcome, time.Millisecond)
+	})
+
+	t.Run("closes after a successful probe", func(t *testing.T) {
+		now = now.Add(5 * time.Second)
+
+		release, err := f.acquire("inst1")
+		require.NoError(t, err)
+		release(servedOutcome, time.Millisecond)
+
+		release, err = f.acquire("inst1")
+		require.NoError(t, err)
+		release(servedOutcome, time.Millisecond)
+		release, err = f.acquire("inst1")
+		require.NoError(t, err)
+		release(servedOutcome, time.Millisecond)
+	})
+
+	t.Run("installations have their own breaker", func(t *testing.T) {
+		f := newFlowControl(CircuitBreakerSettings{FailureThreshold: 1, OpenSecs: 5}, newMetrics())
+		f.nowFn = func() time.Time { return now }
+
+		// Only the breaker of inst1 is open, the route one is closed.
+		c := f.controller("inst1")
+		c.breaker.trip(now)
+
+		_, err := f.acquire("inst1")
+		require.Error(t, err)
+		release, err := f.acquire("inst2")
+		require.NoError(t, err)
+		release(servedOutcome, time.Millisecond)
+	})
+}
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	m := newMetrics()
+	f := newFlowControl(CircuitBreakerSettings{
+		Enable:              true,
+		FailureThreshold:    1000,
+		AdaptiveConcurrency: true,
+		InitialConcurrency:  4,
+		MinConcurrency:      1,
+		MaxConcurrency:      5,
+		LatencyTargetMillis: 100,
+	}, m)
+
+	limit := func(installationID string) float64 {
+		metric := &prometheusModels.Metric{}
+		g, err := m.concurrencyLimit.GetMetricWith(prometheus.Labels{"installation_id": installationID})
+		require.NoError(t, err)
+		require.NoError(t, g.Write(metric))
+		return metric.Gauge.GetValue()
+	}
+
+	t.Run("rejects above the limit", func(t *testing.T) {
+		var releases []func(upstreamOutcome, time.Duration)
+		for i := 0; i < 4; i++ {
+			release, err := f.acquire("inst1")
+			require.NoError(t, err)
+			releases = append(releases, release)
+		}
+		_, err := f.acquire("inst1")
+		require.Error(t, err)
+
+		for _, release := range releases {
+			release(servedOutcome, time.Millisecond)
+		}
+		assert.Equal(t, 4.0, limit("inst1"))
+	})
+
+	t.Run("decreases multiplicatively on overload", func(t *testing.T) {
+		release, err := f.acquire("inst1")
+		require.NoError(t, err)
+		release(overloadedOutcome, time.Millisecond)
+		assert.Equal(t, 2.0, limit("inst1"))
+
+		release, err = f.acquire("inst1")
+		require.NoError(t, err)
+		release(servedOutcome, time.Second)
+		assert.Equal(t, 1.0, limit("inst1"))
+
+		release, err = f.acquire("inst1")
+		require.NoError(t, err)
+		release(overloadedOutcome, time.Millisecond)
+		assert.Equal(t, 1.0, limit("inst1"))
+	})
+
+	t.Run("increases additively on success", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			release, err := f.acquire("inst1")
+			require.NoError(t, err)
+			release(servedOutcome, time.Millisecond)
+		}
+		assert.Equal(t, 5.0, limit("inst1"))
+	})
+
+	t.Run("release is idempotent", func(t *testing.T) {
+		release, err := f.acquire("inst2")
+		require.NoError(t, err)
+		release(servedOutcome, time.Millisecond)
+		release(servedOutcome, time.Millisecond)
+		assert.Equal(t, 0, f.controllers["inst2"].limiter.inflight)
+	})
+}
+
+func TestFlowControlEvictsIdleControllers(t *testing.T) {
+	now := time.Now()
+	m := newMetrics()
+	f := newFlowControl(CircuitBreakerSettings{Enable: true, FailureThreshold: 1, AdaptiveConcurrency: true}, m)
+	f.nowFn = func() time.Time { return now }
+	gauges := func() int {
+		return testutil.CollectAndCount(m.breakerState)
+	}
+
+	release, err := f.acquire("inst1")
+	require.NoError(t, err)
+	release(servedOutcome, time.Millisecond)
+	m.incRejectedRequest("inst1", rejectedConcurrencyLimit)
+	m.incRejectedRequest("inst1", "frozen")
+	inflight, err := f.acquire("inst2")
+	require.NoError(t, err)
+	release, err = f.acquire("inst3")
+	require.NoError(t, err)
+	release(overloadedOutcome, time.Millisecond)
+	assert.Equal(t, 4, gauges())
+
+	// Only the controllers without requests in flight and with a closed
+	// breaker are dropped, once they have been idle long enough.
+	now = now.Add(flowControllerIdleTimeout)
+	release, err = f.acquire(routeScope)
+	require.NoError(t, err)
+	release(servedOutcome, time.Millisecond)
+	assert.NotContains(t, f.controllers, "inst1")
+	assert.Contains(t, f.controllers, "inst2")
+	assert.Contains(t, f.controllers, "inst3")
+	assert.Contains(t, f.controllers, routeScope)
+	assert.Equal(t, 3, gauges())
+	// Only the rejections of the flow controller go along with it.
+	assert.Equal(t, 1, testutil.CollectAndCount(m.rejectedRequests))
+
+	inflight(servedOutcome, time.Millisecond)
+}
+
+func TestHandlerCircuitBreaker(t *testing.T) {
+	upstreamCalls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	cfg := Config{
+		S3Settings: AmazonS3Settings{
+			AccessKeyID:     "AKIA2AccessKey",
+			SecretAccessKey: "start/secretkey/end",
+			Region:          "us-east-1",
+			Scheme:          "http",
+			Bucket:          "agnivatest",
+		},
+		CircuitBreakerSettings: CircuitBreakerSettings{
+			Enable:           true,
+			FailureThreshold: 2,
+		},
+	}
+
+	s := &Server{
+		logger:    mlog.NewTestingLogger(t, os.Stderr),
+		cfg:       cfg,
+		getHostFn: func(_, _ string) string { return strings.TrimPrefix(ts.URL, "http://") },
+		client:    http.DefaultClient,
+		creds: credentials.NewStatic(cfg.S3Settings.AccessKeyID,
+			cfg.S3Settings.SecretAccessKey, "", credentials.SignatureV4),
+		metrics: newMetrics(),
+	}
+	s.flow = newFlowControl(cfg.CircuitBreakerSettings, s.metrics)
+	handler := s.handler()
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "http://example.com/"+cfg.S3Settings.Bucket+"/inst1/foo", nil)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+		if i == 2 {
+			body, err := io.ReadAll(w.Body)
+			require.NoError(t, err)
+			assert.Contains(t, string(body), "<Code>SlowDown</Code>")
+			assert.Equal(t, "5", w.Header().Get("Retry-After"))
+		}
+	}
+	assert.Equal(t, 2, upstreamCalls)
+
+	// Transport errors are failures too.
+	s.flow = newFlowControl(cfg.CircuitBreakerSettings, s.metrics)
+	ts.Close()
+	for _, code := range []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "http://example.com/"+cfg.S3Settings.Bucket+"/inst1/foo", nil))
+		assert.Equal(t, code, w.Code)
+	}
+}
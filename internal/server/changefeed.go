@@ -0,0 +1,329 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+// Limits of the change feed requests.
+const (
+	defaultChangeFeedLimit = 1000
+	maxChangeFeedLimit     = 10000
+	// maxChangeFeedWait stays below the write timeout of the service host.
+	maxChangeFeedWait = 50 * time.Second
+	// changeFeedPruneInterval is how often the changes of every installation
+	// are pruned, not only the ones of installations that change.
+	changeFeedPruneInterval = time.Minute
+)
+
+// cursorLatest asks for the cursor of the latest change, without changes.
+const cursorLatest = "latest"
+
+// change is an object of an installation that was created or removed. Its
+// cursor is the sequencer of the event, and increases with every event.
+type change struct {
+	Cursor    string    `json:"cursor"`
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Key       string    `json:"key"`
+	Size      int64     `json:"size,omitempty"`
+	ETag      string    `json:"etag,omitempty"`
+	VersionID string    `json:"version_id,omitempty"`
+
+	seq uint64
+}
+
+// changePage is a page of the change feed of an installation. The next page
+// starts at its cursor.
+type changePage struct {
+	Changes []change `json:"changes"`
+	Cursor  string   `json:"cursor"`
+	HasMore bool     `json:"has_more"`
+}
+
+// installationChanges are the changes of an installation, in the order of
+// their cursors. A change that is followed by a change of the same key is
+// compacted away and left as nil.
+type installationChanges struct {
+	changes   []*change
+	latest    map[string]int
+	compacted int
+	// horizon is the cursor of the latest change dropped past retention.
+	horizon uint64
+}
+
+// changeFeed keeps the changes of every installation within the retention
+// window, compacted to the latest change of every key, so that consumers
+// that sync the objects of an installation can follow them with cursors.
+// Cursors stay valid as long as no change after them has been dropped past
+// retention. The feed is rebuilt from the event journal on startup, and the
+// changes before the first one in the journal are unknown.
+type changeFeed struct {
+	retention time.Duration
+	nowFn     func() time.Time
+
+	mu            sync.Mutex
+	installations map[string]*installationChanges
+	horizon       uint64
+	head          uint64
+	lastPrune     time.Time
+	// updated is closed and replaced whenever changes are added.
+	updated chan struct{}
+}
+
+func newChangeFeed(settings ChangeFeedSettings, journalFile string, logger *mlog.Logger) (*changeFeed, error) {
+	f := &changeFeed{
+		retention:     time.Duration(settings.RetentionSecs) * time.Second,
+		nowFn:         time.Now,
+		installations: make(map[string]*installationChanges),
+		updated:       make(chan struct{}),
+	}
+	// Sequencers start at the time the emitter is created, after this.
+	f.horizon = uint64(time.Now().UnixNano())
+
+	file, err := os.Open(journalFile)
+	if errors.Is(err, os.ErrNotExist) {
+		f.head = f.horizon
+		return f, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open event journal")
+	}
+	defer file.Close()
+
+	var records []eventRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record eventRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A line may have been cut short by a crash.
+			logger.Warn("skipped invalid event journal line", mlog.Err(err))
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read event journal")
+	}
+
+	if len(records) > 0 {
+		first, err := strconv.ParseUint(records[0].S3.Object.Sequencer, 16, 64)
+		if err == nil && first > 0 {
+			f.horizon = first - 1
+		}
+	}
+	f.head = f.horizon
+	f.add(records)
+	logger.Info("loaded change feed from the event journal", mlog.Int("events", len(records)))
+	return f, nil
+}
+
+// add adds the changes of the events to the feed.
+func (f *changeFeed) add(records []eventRecord) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, record := range records {
+		c, err := newChange(record)
+		if err != nil {
+			continue
+		}
+		installationID := record.UserIdentity.PrincipalID
+		changes, ok := f.installations[installationID]
+		if !ok {
+			changes = &installationChanges{latest: make(map[string]int)}
+			f.installations[installationID] = changes
+		}
+		changes.add(c)
+		f.head = max(f.head, c.seq)
+	}
+
+	now := f.nowFn()
+	if now.Sub(f.lastPrune) >= changeFeedPruneInterval {
+		f.lastPrune = now
+		for _, changes := range f.installations {
+			changes.prune(now.Add(-f.retention))
+		}
+	}
+
+	close(f.updated)
+	f.updated = make(chan struct{})
+}
+
+func newChange(record eventRecord) (*change, error) {
+	if !strings.HasPrefix(record.EventName, "ObjectCreated:") && !strings.HasPrefix(record.EventName, "ObjectRemoved:") {
+		return nil, errors.Errorf("event %s is not a change", record.EventName)
+	}
+	seq, err := strconv.ParseUint(record.S3.Object.Sequencer, 16, 64)
+	if err != nil {
+		return nil, err
+	}
+	key, err := url.QueryUnescape(record.S3.Object.Key)
+	if err != nil {
+		return nil, err
+	}
+	eventTime, err := time.Parse(time.RFC3339, record.EventTime)
+	if err != nil {
+		return nil, err
+	}
+	return &change{
+		Cursor:    record.S3.Object.Sequencer,
+		Time:      eventTime,
+		Event:     record.EventName,
+		Key:       key,
+		Size:      record.S3.Object.Size,
+		ETag:      record.S3.Object.ETag,
+		VersionID: record.S3.Object.VersionID,
+		seq:       seq,
+	}, nil
+}
+
+func (ic *installationChanges) add(c *change) {
+	if i, ok := ic.latest[c.Key]; ok {
+		ic.changes[i] = nil
+		ic.compacted++
+	}
+	ic.latest[c.Key] = len(ic.changes)
+	ic.changes = append(ic.changes, c)
+
+	if ic.compacted > len(ic.changes)/2 {
+		ic.rebuild(0)
+	}
+}
+
+// prune drops the changes made before cutoff.
+func (ic *installationChanges) prune(cutoff time.Time) {
+	n := 0
+	for n < len(ic.changes) && (ic.changes[n] == nil || ic.changes[n].Time.Before(cutoff)) {
+		if c := ic.changes[n]; c != nil {
+			ic.horizon = max(ic.horizon, c.seq)
+		}
+		n++
+	}
+	if n > 0 {
+		ic.rebuild(n)
+	}
+}
+
+// rebuild removes the compacted changes, and the first n changes.
+func (ic *installationChanges) rebuild(n int) {
+	changes := make([]*change, 0, len(ic.changes)-n)
+	for _, c := range ic.changes[n:] {
+		if c != nil {
+			changes = append(changes, c)
+		}
+	}
+	ic.changes = changes
+	ic.compacted = 0
+	ic.latest = make(map[string]int, len(changes))
+	for i, c := range changes {
+		ic.latest[c.Key] = i
+	}
+}
+
+// page returns up to limit changes of the installation after the cursor,
+// and the channel that is closed when changes are added to the feed.
+func (f *changeFeed) page(installationID, cursor string, limit int) (*changePage, <-chan struct{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	changes := f.installations[installationID]
+	if changes != nil {
+		changes.prune(f.nowFn().Add(-f.retention))
+	}
+
+	page := &changePage{Changes: []change{}, Cursor: cursor}
+	if cursor == cursorLatest {
+		page.Cursor = formatCursor(f.head)
+		return page, f.updated, nil
+	}
+
+	var after uint64
+	horizon := f.horizon
+	if changes != nil {
+		horizon = max(horizon, changes.horizon)
+	}
+	if cursor == "" {
+		after = horizon
+		page.Cursor = formatCursor(horizon)
+	} else {
+		var err error
+		if after, err = strconv.ParseUint(cursor, 16, 64); err != nil {
+			return nil, nil, &s3Error{StatusCode: http.StatusBadRequest, Code: "InvalidArgument", Message: "Invalid cursor."}
+		}
+		if after < horizon {
+			return nil, nil, &s3Error{StatusCode: http.StatusGone, Code: "ExpiredCursor", Message: "Changes after the cursor are no longer kept. List the objects again, and follow the feed from its latest cursor."}
+		}
+	}
+	if changes == nil {
+		return page, f.updated, nil
+	}
+
+	i := sort.Search(len(changes.changes), func(i int) bool {
+		// Compacted changes are skipped forward.
+		for j := i; j < len(changes.changes); j++ {
+			if c := changes.changes[j]; c != nil {
+				return c.seq > after
+			}
+		}
+		return true
+	})
+	for ; i < len(changes.changes); i++ {
+		c := changes.changes[i]
+		if c == nil {
+			continue
+		}
+		if len(page.Changes) == limit {
+			page.HasMore = true
+			break
+		}
+		page.Changes = append(page.Changes, *c)
+		page.Cursor = c.Cursor
+	}
+	return page, f.updated, nil
+}
+
+// changes returns up to limit changes of the installation after the cursor.
+// If there are none, it waits up to wait for some.
+func (f *changeFeed) changes(r *http.Request, installationID, cursor string, limit int, wait time.Duration) (*changePage, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		page, updated, err := f.page(installationID, cursor, limit)
+		if err != nil || len(page.Changes) > 0 || wait <= 0 {
+			return page, err
+		}
+		// Waiting goes on from the cursor the first page returned.
+		cursor = page.Cursor
+
+		select {
+		case <-updated:
+		case <-timer.C:
+			return page, nil
+		case <-r.Context().Done():
+			return page, nil
+		}
+	}
+}
+
+// formatCursor formats a cursor like the sequencers of the events.
+func formatCursor(seq uint64) string {
+	return fmt.Sprintf("%016X", seq)
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newChangeRecord(seq uint64, name, key string, at time.Time) eventRecord {
+	var e eventEmitter
+	record := e.newRecord(name, key)
+	record.EventTime = at.UTC().Format("2006-01-02T15:04:05.000Z")
+	record.S3.Object.Sequencer = formatCursor(seq)
+	return record
+}
+
+func pageKeys(page *changePage) []string {
+	var keys []string
+	for _, c := range page.Changes {
+		keys = append(keys, c.Key)
+	}
+	return keys
+}
+
+func TestChangeFeed(t *testing.T) {
+	now := time.Now()
+	f, err := newChangeFeed(ChangeFeedSettings{RetentionSecs: 3600}, filepath.Join(t.TempDir(), "missing.jsonl"), nil)
+	require.NoError(t, err)
+	f.nowFn = func() time.Time { return now }
+	base := f.horizon
+
+	f.add([]eventRecord{
+		newChangeRecord(base+1, eventObjectCreatedPut, "inst/a", now),
+		newChangeRecord(base+2, eventObjectCreatedPut, "inst/my file", now),
+		newChangeRecord(base+3, eventObjectCreatedPut, "other/c", now),
+		newChangeRecord(base+4, eventObjectCreatedPut, "inst/b", now),
+		newChangeRecord(base+5, eventObjectRemovedDelete, "inst/a", now),
+		// Rejected objects are no change.
+		newChangeRecord(base+6, eventObjectRejectedMalware, "inst/eicar", now),
+	})
+
+	// The first change of inst/a is compacted away.
+	page, _, err := f.page("inst", "", 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"inst/my file", "inst/b"}, pageKeys(page))
+	assert.True(t, page.HasMore)
+	assert.Equal(t, formatCursor(base+4), page.Cursor)
+
+	page, _, err = f.page("inst", page.Cursor, 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"inst/a"}, pageKeys(page))
+	assert.False(t, page.HasMore)
+	assert.Equal(t, eventObjectRemovedDelete, page.Changes[0].Event)
+
+	// A cursor before a compacted change is still valid.
+	page, _, err = f.page("inst", formatCursor(base+1), 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"inst/my file", "inst/b", "inst/a"}, pageKeys(page))
+
+	page, _, err = f.page("inst", formatCursor(base+5), 10)
+	require.NoError(t, err)
+	assert.Empty(t, page.Changes)
+	assert.Equal(t, formatCursor(base+5), page.Cursor)
+
+	page, _, err = f.page("inst", cursorLatest, 10)
+	require.NoError(t, err)
+	assert.Empty(t, page.Changes)
+	assert.Equal(t, formatCursor(base+5), page.Cursor)
+
+	page, _, err = f.page("none", "", 10)
+	require.NoError(t, err)
+	assert.Empty(t, page.Changes)
+
+	_, _, err = f.page("inst", "nope", 10)
+	assert.True(t, isS3ErrorCode(err, "InvalidArgument"))
+
+	// Changes before the feed started are unknown.
+	_, _, err = f.page("inst", formatCursor(base-1), 10)
+	assert.True(t, isS3ErrorCode(err, "ExpiredCursor"))
+
+	// Changes past retention are dropped, and so are the cursors before
+	// them, for their installation only.
+	f.add([]eventRecord{newChangeRecord(base+7, eventObjectCreatedPut, "inst/d", now.Add(90*time.Minute))})
+	now = now.Add(90 * time.Minute)
+
+	_, _, err = f.page("inst", formatCursor(base+4), 10)
+	assert.True(t, isS3ErrorCode(err, "ExpiredCursor"))
+	page, _, err = f.page("inst", formatCursor(base+5), 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"inst/d"}, pageKeys(page))
+	page, _, err = f.page("inst", "", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"inst/d"}, pageKeys(page))
+
+	page, _, err = f.page("other", formatCursor(base+3), 10)
+	require.NoError(t, err)
+	assert.Empty(t, page.Changes)
+}
+
+func TestChangeFeedCompaction(t *testing.T) {
+	f, err := newChangeFeed(ChangeFeedSettings{RetentionSecs: 3600}, filepath.Join(t.TempDir(), "missing.jsonl"), nil)
+	require.NoError(t, err)
+	base := f.horizon
+
+	for i := uint64(1); i <= 100; i++ {
+		f.add([]eventRecord{newChangeRecord(base+i, eventObjectCreatedPut, "inst/a", time.Now())})
+	}
+	changes := f.installations["inst"]
+	assert.LessOrEqual(t, len(changes.changes), 2)
+
+	page, _, err := f.page("inst", formatCursor(base+50), 10)
+	require.NoError(t, err)
+	require.Len(t, page.Changes, 1)
+	assert.Equal(t, formatCursor(base+100), page.Changes[0].Cursor)
+}
+
+func TestChangeFeedJournal(t *testing.T) {
+	_, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{})
+
+	journalFile := filepath.Join(t.TempDir(), "events.jsonl")
+	events, err := newEventEmitter(EventSettings{Enable: true, JournalFile: journalFile}, s.cfg.S3Settings, s.metrics, s.logger)
+	require.NoError(t, err)
+	s.events = events
+	handler := s.handler()
+
+	for _, key := range []string{"a", "b"} {
+		resp := serveRequest(handler, "PUT", "/inst/"+key, []byte("hello"), nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	s.events.close()
+
+	// A line cut short by a crash is skipped.
+	file, err := os.OpenFile(journalFile, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"eventVersion":`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	f, err := newChangeFeed(ChangeFeedSettings{RetentionSecs: 3600}, journalFile, s.logger)
+	require.NoError(t, err)
+	page, _, err := f.page("inst", "", 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"inst/a", "inst/b"}, pageKeys(page))
+	assert.Equal(t, int64(5), page.Changes[1].Size)
+	assert.Equal(t, "5d41402abc4b2a76b9719d911017c592", page.Changes[1].ETag)
+
+	page, _, err = f.page("inst", page.Changes[0].Cursor, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"inst/b"}, pageKeys(page))
+}
+
+func TestAdminChanges(t *testing.T) {
+	_, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{})
+	router := newAdminRouter(s)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/installations/inst/changes", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	journalFile := filepath.Join(t.TempDir(), "events.jsonl")
+	var err error
+	s.changes, err = newChangeFeed(ChangeFeedSettings{RetentionSecs: 3600}, journalFile, s.logger)
+	require.NoError(t, err)
+	events, err := newEventEmitter(EventSettings{Enable: true, JournalFile: journalFile}, s.cfg.S3Settings, s.metrics, s.logger)
+	require.NoError(t, err)
+	events.feed = s.changes
+	s.events = events
+	defer s.events.close()
+	handler := s.handler()
+
+	getChanges := func(query string) (int, *changePage) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/installations/inst/changes?"+query, nil))
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		var page changePage
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+		return w.Code, &page
+	}
+
+	code, latest := getChanges("cursor=latest")
+	require.Equal(t, http.StatusOK, code)
+
+	// A long-polling request returns once a change is made.
+	done := make(chan *changePage)
+	go func() {
+		_, page := getChanges("cursor=" + latest.Cursor + "&wait=10")
+		done <- page
+	}()
+	resp := serveRequest(handler, "PUT", "/inst/a", []byte("hello"), nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	select {
+	case page := <-done:
+		require.NotNil(t, page)
+		assert.Equal(t, []string{"inst/a"}, pageKeys(page))
+		assert.Equal(t, page.Changes[0].Cursor, page.Cursor)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "long-polling request did not return")
+	}
+
+	code, page := getChanges("")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"inst/a"}, pageKeys(page))
+
+	code, page = getChanges("cursor=" + page.Cursor + "&wait=0")
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, page.Changes)
+
+	code, _ = getChanges("limit=0")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = getChanges("wait=soon")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = getChanges("cursor=zz")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = getChanges("cursor=1")
+	assert.Equal(t, http.StatusGone, code)
+}
@@ -0,0 +1,306 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+const (
+	coalesceChunkSize            = 32 * 1024
+	defaultCoalescingBufferBytes = 1024 * 1024
+	coalesceSlowClientTimeout    = 5 * time.Second
+)
+
+// Request headers that change the response of a GetObject or HeadObject.
+// Requests are only coalesced if they agree on all of them. The SSE-C
+// headers make sure that an object encrypted with a customer key is only
+// shared between clients that know the key.
+var coalesceKeyHeaders = []string{
+	"Accept-Encoding",
+	"If-Match",
+	"If-Modified-Since",
+	"If-None-Match",
+	"If-Unmodified-Since",
+	"Range",
+	"X-Amz-Checksum-Mode",
+	"X-Amz-Expected-Bucket-Owner",
+	"X-Amz-Request-Payer",
+	"X-Amz-Server-Side-Encryption-Customer-Algorithm",
+	"X-Amz-Server-Side-Encryption-Customer-Key",
+	"X-Amz-Server-Side-Encryption-Customer-Key-Md5",
+}
+
+var errSlowSubscriber = errors.New("client too slow to keep up with coalesced response")
+
+// coalesceKey returns the key identifying identical requests. The URL has
+// already been rebuilt by the handler, so it only contains the object path
+// and the query.
+func coalesceKey(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte(' ')
+	b.WriteString(r.URL.RequestURI())
+	for _, name := range coalesceKeyHeaders {
+		for _, value := range r.Header.Values(name) {
+			b.WriteByte('\n')
+			b.WriteString(name)
+			b.WriteByte(':')
+			b.WriteString(value)
+		}
+	}
+	return b.String()
+}
+
+// coalescer merges concurrent identical GetObject and HeadObject requests
+// into a single upstream request. Requests join a flight until the response
+// headers arrive. From then on, the body is read once and fanned out to all
+// of them.
+type coalescer struct {
+	// bufferChunks is the number of chunks buffered for a subscriber. Once
+	// its buffer is full, the body isn't read any further until it catches
+	// up. If that takes longer than slowTimeout, it is dropped, so that a
+	// stalled client can't hold up the others for long.
+	bufferChunks int
+	slowTimeout  time.Duration
+	metrics      *metrics
+	logger       *mlog.Logger
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	// ready is closed once resp or err is set.
+	ready chan struct{}
+	resp  *http.Response
+	err   error
+	// trailerKeys are the trailers declared by the response. The values of
+	// resp.Trailer are only set once the body has been read.
+	trailerKeys http.Header
+
+	subscribers []*subscriber
+	cancel      context.CancelFunc
+}
+
+type subscriber struct {
+	chunks chan []byte
+	// gone is closed when the client went away.
+	gone chan struct{}
+	// err is set before chunks is closed if the body is incomplete.
+	err error
+}
+
+func newCoalescer(settings CoalescingSettings, m *metrics, logger *mlog.Logger) *coalescer {
+	bufferBytes := settings.MaxBufferBytes
+	if bufferBytes <= 0 {
+		bufferBytes = defaultCoalescingBufferBytes
+	}
+	bufferChunks := bufferBytes / coalesceChunkSize
+	if bufferChunks < 1 {
+		bufferChunks = 1
+	}
+
+	return &coalescer{
+		bufferChunks: bufferChunks,
+		slowTimeout:  coalesceSlowClientTimeout,
+		metrics:      m,
+		logger:       logger,
+		flights:      make(map[string]*flight),
+	}
+}
+
+// coalesceEligible reports whether the request can share its response with
+// identical concurrent requests.
+func (s *Server) coalesceEligible(op s3Request) bool {
+	return s.coalescer != nil && (op.Operation == opGetObject || op.Operation == opHeadObject)
+}
+
+// serve serves the request with the response of an identical request
+// in flight, or sends it upstream with fetch and shares the response with the
+// requests that come in until the response headers arrive. fetch is called
+// with a context that is only cancelled once every client has gone away.
+// Along with the status code, it returns how long the request waited for the
+// response headers.
+func (c *coalescer) serve(w http.ResponseWriter, r *http.Request, fetch func(ctx context.Context) (*http.Response, error)) (int, time.Duration, error) {
+	start := time.Now()
+	key := coalesceKey(r)
+	sub := &subscriber{
+		chunks: make(chan []byte, c.bufferChunks),
+		gone:   make(chan struct{}),
+	}
+	defer close(sub.gone)
+
+	c.mu.Lock()
+	f, ok := c.flights[key]
+	if ok {
+		c.metrics.incCoalescedRequest()
+	} else {
+		ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+		f = &flight{ready: make(chan struct{}), cancel: cancel}
+		c.flights[key] = f
+		go c.run(ctx, key, f, fetch)
+	}
+	f.subscribers = append(f.subscribers, sub)
+	c.mu.Unlock()
+
+	select {
+	case <-f.ready:
+	case <-r.Context().Done():
+		c.leave(key, f, sub)
+		return 0, time.Since(start), r.Context().Err()
+	}
+	latency := time.Since(start)
+	if f.err != nil {
+		return 0, latency, f.err
+	}
+
+	copyResponseHeaders(w, f.resp.Header)
+	announced := announceTrailers(w, f.trailerKeys)
+	w.WriteHeader(f.resp.StatusCode)
+	for chunk := range sub.chunks {
+		if _, err := w.Write(chunk); err != nil {
+			c.logger.Warn("failed to copy response body", mlog.Err(err))
+			return f.resp.StatusCode, latency, nil
+		}
+	}
+	if sub.err != nil {
+		c.logger.Warn("failed to copy coalesced response body", mlog.Err(sub.err))
+		return f.resp.StatusCode, latency, nil
+	}
+	// The trailers have been read along with the body, before the chunks
+	// were closed.
+	copyTrailers(w, f.resp.Trailer, announced)
+
+	return f.resp.StatusCode, latency, nil
+}
+
+// leave removes a subscriber from a flight whose response hasn't arrived yet.
+// The upstream request is cancelled once no one is waiting for it anymore.
+func (c *coalescer) leave(key string, f *flight, sub *subscriber) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Once run has taken the subscribers, it notices that the client is
+	// gone by itself.
+	if c.flights[key] != f {
+		return
+	}
+
+	subscribers := make([]*subscriber, 0, len(f.subscribers))
+	for _, other := range f.subscribers {
+		if other != sub {
+			subscribers = append(subscribers, other)
+		}
+	}
+	f.subscribers = subscribers
+	if len(subscribers) == 0 {
+		delete(c.flights, key)
+		f.cancel()
+	}
+}
+
+// run sends the request upstream and fans the response out to the
+// subscribers of the flight.
+func (c *coalescer) run(ctx context.Context, key string, f *flight, fetch func(ctx context.Context) (*http.Response, error)) {
+	defer f.cancel()
+
+	resp, err := fetch(ctx)
+
+	// No one can join the flight anymore, since they would miss the start of
+	// the body.
+	c.mu.Lock()
+	delete(c.flights, key)
+	subscribers := f.subscribers
+	c.mu.Unlock()
+
+	f.resp, f.err = resp, err
+	if resp != nil {
+		f.trailerKeys = resp.Trailer.Clone()
+	}
+	close(f.ready)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	finish := func(sub *subscriber, err error) {
+		sub.err = err
+		close(sub.chunks)
+	}
+
+	for len(subscribers) > 0 {
+		// Every chunk is a new slice, since it is shared by all subscribers.
+		chunk := make([]byte, coalesceChunkSize)
+		var n int
+		for n < len(chunk) && err == nil {
+			var m int
+			m, err = resp.Body.Read(chunk[n:])
+			n += m
+		}
+		if n > 0 {
+			subscribers = c.send(subscribers, chunk[:n], finish)
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			err = errors.Wrap(err, "failed to read upstream response")
+			for _, sub := range subscribers {
+				finish(sub, err)
+			}
+			return
+		}
+	}
+
+	for _, sub := range subscribers {
+		finish(sub, nil)
+	}
+}
+
+// send hands the chunk to every subscriber and returns the ones still
+// active. Subscribers with a full buffer are waited for until slowTimeout
+// has passed for the chunk, and dropped after that.
+func (c *coalescer) send(subscribers []*subscriber, chunk []byte, finish func(*subscriber, error)) []*subscriber {
+	timeout := time.NewTimer(c.slowTimeout)
+	defer timeout.Stop()
+	expired := false
+
+	active := subscribers[:0]
+	for _, sub := range subscribers {
+		select {
+		case <-sub.gone:
+			finish(sub, nil)
+			continue
+		case sub.chunks <- chunk:
+			active = append(active, sub)
+			continue
+		default:
+		}
+
+		if expired {
+			finish(sub, errSlowSubscriber)
+			continue
+		}
+		select {
+		case <-sub.gone:
+			finish(sub, nil)
+		case sub.chunks <- chunk:
+			active = append(active, sub)
+		case <-timeout.C:
+			expired = true
+			finish(sub, errSlowSubscriber)
+		}
+	}
+	return active
+}
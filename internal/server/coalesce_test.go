@@ -0,0 +1,202 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoalesceKey(t *testing.T) {
+	newRequest := func(method, target string, header map[string]string) *http.Request {
+		req := httptest.NewRequest(method, target, nil)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		return req
+	}
+
+	base := coalesceKey(newRequest("GET", "/inst/file", nil))
+	assert.Equal(t, base, coalesceKey(newRequest("GET", "/inst/file", map[string]string{"User-Agent": "other", "X-Amz-Date": "now"})))
+
+	for _, req := range []*http.Request{
+		newRequest("HEAD", "/inst/file", nil),
+		newRequest("GET", "/inst/other", nil),
+		newRequest("GET", "/inst/file?versionId=2", nil),
+		newRequest("GET", "/inst/file", map[string]string{"Range": "bytes=0-10"}),
+		newRequest("GET", "/inst/file", map[string]string{"If-None-Match": `"abc"`}),
+		newRequest("GET", "/inst/file", map[string]string{"X-Amz-Server-Side-Encryption-Customer-Key": "key"}),
+	} {
+		assert.NotEqual(t, base, coalesceKey(req), req.Method+" "+req.URL.String())
+	}
+}
+
+func TestCoalescing(t *testing.T) {
+	content := make([]byte, 200*1024)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	var requests int64
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		<-release
+		w.Header().Add("X-Amz-Meta-Tag", "a")
+		w.Header().Add("X-Amz-Meta-Tag", "b")
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	s := newFakeS3Server(t, ts, Config{CoalescingSettings: CoalescingSettings{Enable: true}})
+	handler := s.handler()
+
+	get := func(ctx context.Context, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/agnivatest"+path, nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	waitForRequests := func(n int64) {
+		require.Eventually(t, func() bool { return atomic.LoadInt64(&requests) == n }, time.Second, time.Millisecond)
+	}
+
+	t.Run("concurrent requests share the response", func(t *testing.T) {
+		atomic.StoreInt64(&requests, 0)
+		const clients = 10
+
+		var wg sync.WaitGroup
+		responses := make([]*httptest.ResponseRecorder, clients)
+		for i := 0; i < clients; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				responses[i] = get(context.Background(), "/inst/image")
+			}(i)
+			if i == 0 {
+				waitForRequests(1)
+			}
+		}
+		require.Eventually(t, func() bool {
+			return testutil.ToFloat64(s.metrics.coalesced) == clients-1
+		}, time.Second, time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		assert.Equal(t, int64(1), atomic.LoadInt64(&requests))
+		for _, w := range responses {
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, content, w.Body.Bytes())
+			assert.Equal(t, `"v1"`, w.Header().Get("ETag"))
+		}
+		assert.Empty(t, s.coalescer.flights)
+	})
+
+	t.Run("later requests are sent again", func(t *testing.T) {
+		atomic.StoreInt64(&requests, 0)
+		get(context.Background(), "/inst/image")
+		get(context.Background(), "/inst/image")
+		assert.Equal(t, int64(2), atomic.LoadInt64(&requests))
+	})
+
+	t.Run("leaving clients", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		release = make(chan struct{})
+		defer close(release)
+
+		done := make(chan *httptest.ResponseRecorder)
+		go func() { done <- get(ctx, "/inst/slow") }()
+		require.Eventually(t, func() bool {
+			s.coalescer.mu.Lock()
+			defer s.coalescer.mu.Unlock()
+			return len(s.coalescer.flights) == 1
+		}, time.Second, time.Millisecond)
+
+		cancel()
+		w := <-done
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		s.coalescer.mu.Lock()
+		assert.Empty(t, s.coalescer.flights)
+		s.coalescer.mu.Unlock()
+	})
+}
+
+func TestCoalescerSlowSubscriber(t *testing.T) {
+	c := newCoalescer(CoalescingSettings{MaxBufferBytes: 2 * coalesceChunkSize}, newMetrics(), mlog.NewTestingLogger(t, os.Stderr))
+	c.slowTimeout = 50 * time.Millisecond
+
+	body := strings.Repeat("a", 10*coalesceChunkSize)
+	fetched := make(chan struct{})
+	fetch := func(ctx context.Context) (*http.Response, error) {
+		<-fetched
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Length": {"327680"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+		}, nil
+	}
+
+	// The first client reads the whole body, the second one blocks on its
+	// first write.
+	fast := httptest.NewRecorder()
+	slow := &blockingWriter{ResponseRecorder: httptest.NewRecorder(), unblock: make(chan struct{})}
+	req := httptest.NewRequest("GET", "/inst/file", nil)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _, err := c.serve(fast, req, fetch)
+		assert.NoError(t, err)
+	}()
+	require.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.flights) == 1
+	}, time.Second, time.Millisecond)
+	go func() {
+		defer wg.Done()
+		_, _, err := c.serve(slow, req, fetch)
+		assert.NoError(t, err)
+	}()
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(c.metrics.coalesced) == 1
+	}, time.Second, time.Millisecond)
+
+	close(fetched)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		close(slow.unblock)
+	}()
+	wg.Wait()
+
+	assert.Equal(t, body, fast.Body.String())
+	assert.Less(t, slow.Body.Len(), len(body))
+}
+
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	unblock chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return w.ResponseRecorder.Write(p)
+}
@@ -0,0 +1,357 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+// Codecs objects can be compressed with.
+const (
+	compressionZstd = "zstd"
+)
+
+// Metadata of compressed objects. The original ETag is the one S3 would have
+// given the object if it had been stored as it was sent.
+const (
+	compressionHeader  = "X-Amz-Meta-Bifrost-Compression"
+	originalSizeHeader = "X-Amz-Meta-Bifrost-Original-Size"
+	originalETagHeader = "X-Amz-Meta-Bifrost-Original-Etag"
+)
+
+const (
+	defaultCompressionMaxSize = 64 * 1024 * 1024
+	// compressionSampleSize is the size of the start of the body that is
+	// compressed to tell whether the whole body is worth compressing.
+	compressionSampleSize = 64 * 1024
+	// compressionMaxRatio is the ratio of the compressed size of the sample
+	// to its original size above which the body is stored as it is.
+	compressionMaxRatio = 0.9
+)
+
+// defaultCompressibleContentTypes are the content types that are compressed
+// when CompressionSettings.ContentTypes is empty.
+var defaultCompressibleContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/x-ndjson",
+	"application/xml",
+	"application/x-yaml",
+	"application/yaml",
+	"image/svg+xml",
+}
+
+// compressionEligible reports whether the request is a PutObject of an
+// installation that has compression enabled, with a body whose content type
+// is worth compressing. Bodies that already have a content encoding are
+// stored as they are.
+func (s *Server) compressionEligible(r *http.Request, op s3Request, installationID string) bool {
+	settings := s.cfg.CompressionSettings
+	if !settings.Enable || op.Operation != opPutObject || !slices.Contains(settings.Installations, installationID) {
+		return false
+	}
+
+	maxSize := settings.MaxSizeBytes
+	if maxSize == 0 {
+		maxSize = defaultCompressionMaxSize
+	}
+	if r.ContentLength <= 0 || r.ContentLength < settings.MinSizeBytes || r.ContentLength > maxSize {
+		return false
+	}
+
+	for _, value := range r.Header.Values("Content-Encoding") {
+		for _, encoding := range strings.Split(value, ",") {
+			if encoding = strings.TrimSpace(encoding); encoding != "" && encoding != "aws-chunked" {
+				return false
+			}
+		}
+	}
+
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	contentTypes := settings.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = defaultCompressibleContentTypes
+	}
+	// Content types are matched the same way as header names.
+	return headerAllowed(contentType, contentTypes)
+}
+
+// prepareCompression replaces the body of a PutObject request by its zstd
+// compression, unless a sample of the body shows that it doesn't compress
+// well. The compressed body is buffered in memory or in the spool directory,
+// since its length has to be known before it is sent. The checksums of the
+// client are checked against the original body. It returns the ETag of the
+// original body if the body was compressed, and a function releasing the
+// buffer once the request is done.
+func (s *Server) prepareCompression(r *http.Request) (string, func(), error) {
+	noop := func() {}
+	sample := make([]byte, min(r.ContentLength, compressionSampleSize))
+	if _, err := io.ReadFull(r.Body, sample); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return "", noop, &s3Error{StatusCode: http.StatusBadRequest, Code: "IncompleteBody", Message: "You did not provide the number of bytes specified by the Content-Length HTTP header."}
+		}
+		return "", noop, errors.Wrap(err, "failed to read request body")
+	}
+	body := io.MultiReader(bytes.NewReader(sample), io.LimitReader(r.Body, r.ContentLength-int64(len(sample))))
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return "", noop, errors.Wrap(err, "failed to create zstd encoder")
+	}
+	if trial := encoder.EncodeAll(sample, nil); float64(len(trial)) > compressionMaxRatio*float64(len(sample)) {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, r.Body}
+		encoder.Close()
+		return "", noop, nil
+	}
+
+	buf, err := newPartBuffer(s.cfg.CompressionSettings.SpoolDirectory)
+	if err != nil {
+		encoder.Close()
+		return "", noop, err
+	}
+	cleanup := func() {
+		if err := buf.Close(); err != nil {
+			s.logger.Warn("failed to release compression buffer", mlog.Err(err))
+		}
+	}
+
+	var compressed byteCounter
+	compressedSHA := sha256.New()
+	encoder.Reset(io.MultiWriter(buf, compressedSHA, &compressed))
+	sha := sha256.New()
+	md := md5.New()
+	size, err := io.Copy(io.MultiWriter(encoder, sha, md), body)
+	if closeErr := encoder.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", noop, errors.Wrap(err, "failed to compress request body")
+	}
+	if size != r.ContentLength {
+		cleanup()
+		return "", noop, &s3Error{StatusCode: http.StatusBadRequest, Code: "IncompleteBody", Message: "You did not provide the number of bytes specified by the Content-Length HTTP header."}
+	}
+	if err := verifyBodyChecksums(bodyChecksums(r.Header), sha, md); err != nil {
+		cleanup()
+		return "", noop, err
+	}
+
+	reader, err := buf.Reader()
+	if err != nil {
+		cleanup()
+		return "", noop, err
+	}
+	etag := `"` + hex.EncodeToString(md.Sum(nil)) + `"`
+	removeBodyHeaders(r)
+	r.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(compressedSHA.Sum(nil)))
+	r.Header.Set(compressionHeader, compressionZstd)
+	r.Header.Set(originalSizeHeader, strconv.FormatInt(size, 10))
+	r.Header.Set(originalETagHeader, etag)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{reader, r.Body}
+	r.ContentLength = int64(compressed)
+
+	s.logger.Debug("compressed request body", mlog.String("object", r.URL.Path), mlog.Int64("size", size), mlog.Int64("compressed_size", int64(compressed)))
+	return etag, cleanup, nil
+}
+
+// byteCounter counts the bytes written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// etagWriter replaces the ETag of the response to a successful PutObject of
+// a compressed body by the ETag of the body the client sent.
+type etagWriter struct {
+	http.ResponseWriter
+	etag string
+}
+
+func (w *etagWriter) WriteHeader(statusCode int) {
+	if statusCode == http.StatusOK && w.Header().Get("ETag") != "" {
+		w.Header().Set("ETag", w.etag)
+		removeChecksumHeaders(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// decompressResponse decompresses the response of a GetObject or HeadObject
+// request if the object is compressed, and reports the size and ETag of the
+// original object. The range of the request is served by decompressing the
+// whole object and skipping to the start of the range, so S3 must have been
+// asked for the whole object.
+func (s *Server) decompressResponse(r *http.Request, resp *http.Response, rangeHeader string) (*http.Response, error) {
+	codec := resp.Header.Get(compressionHeader)
+	if codec == "" {
+		return resp, nil
+	}
+	if etag := resp.Header.Get(originalETagHeader); etag != "" {
+		resp.Header.Set("ETag", etag)
+	}
+	removeChecksumHeaders(resp.Header)
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return resp, nil
+	}
+	if codec != compressionZstd {
+		resp.Body.Close()
+		return nil, errors.Errorf("unknown compression %q", codec)
+	}
+	if r.URL.Query().Has("partNumber") {
+		resp.Body.Close()
+		return nil, &s3Error{StatusCode: http.StatusNotImplemented, Code: "NotImplemented", Message: "Reading parts of compressed objects is not supported."}
+	}
+	size, err := strconv.ParseInt(resp.Header.Get(originalSizeHeader), 10, 64)
+	if err != nil || size < 0 {
+		resp.Body.Close()
+		return nil, errors.Errorf("invalid original size %q of compressed object", resp.Header.Get(originalSizeHeader))
+	}
+
+	rng := byteRange{0, size - 1}
+	resp.StatusCode = http.StatusOK
+	resp.Header.Del("Content-Range")
+	if r.Method == http.MethodGet && rangeHeader != "" {
+		if rng, _, err = parseRange(rangeHeader, size); err != nil {
+			resp.Body.Close()
+			return nil, &s3Error{StatusCode: http.StatusRequestedRangeNotSatisfiable, Code: "InvalidRange", Message: "The requested range is not satisfiable"}
+		}
+		resp.StatusCode = http.StatusPartialContent
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rng.start, rng.end, size))
+	}
+	length := rng.end - rng.start + 1
+	resp.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	resp.ContentLength = length
+
+	if r.Method == http.MethodGet {
+		dec, err := zstd.NewReader(resp.Body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			resp.Body.Close()
+			return nil, errors.Wrap(err, "failed to create zstd decoder")
+		}
+		resp.Body = &decompressingReader{dec: dec, body: resp.Body, skip: rng.start, remaining: length}
+	}
+	return resp, nil
+}
+
+// decompressingReader reads length bytes of a zstd stream, after skipping
+// the first skip bytes.
+type decompressingReader struct {
+	dec       *zstd.Decoder
+	body      io.Closer
+	skip      int64
+	remaining int64
+}
+
+func (d *decompressingReader) Read(p []byte) (int, error) {
+	if d.skip > 0 {
+		if _, err := io.CopyN(io.Discard, d.dec, d.skip); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		d.skip = 0
+	}
+	if d.remaining <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > d.remaining {
+		p = p[:d.remaining]
+	}
+	n, err := d.dec.Read(p)
+	d.remaining -= int64(n)
+	if err == io.EOF && d.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (d *decompressingReader) Close() error {
+	d.dec.Close()
+	return d.body.Close()
+}
+
+// takeETagConditions removes the conditions on the ETag of the object from
+// the request, to be checked with checkETagConditions against the ETag of
+// the original object instead. Once the ETag conditions are removed, the
+// date conditions they take precedence over must not be evaluated by S3
+// either. See RFC 9110, section 13.2.2.
+func takeETagConditions(header http.Header) http.Header {
+	conditions := make(http.Header)
+	for _, pair := range [][2]string{{"If-Match", "If-Unmodified-Since"}, {"If-None-Match", "If-Modified-Since"}} {
+		if values := header.Values(pair[0]); len(values) > 0 {
+			conditions[pair[0]] = values
+			header.Del(pair[0])
+			header.Del(pair[1])
+		}
+	}
+	return conditions
+}
+
+// checkETagConditions evaluates the conditions taken from the request
+// against the ETag of the response. A GetObject or HeadObject whose
+// If-None-Match condition fails is answered with 304 Not Modified.
+func checkETagConditions(conditions http.Header, resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil
+	}
+	etag := resp.Header.Get("ETag")
+	if values := conditions.Values("If-Match"); len(values) > 0 && !etagListMatches(values, etag) {
+		resp.Body.Close()
+		return &s3Error{StatusCode: http.StatusPreconditionFailed, Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	}
+	if values := conditions.Values("If-None-Match"); len(values) > 0 && etagListMatches(values, etag) {
+		resp.Body.Close()
+		resp.Body = http.NoBody
+		resp.StatusCode = http.StatusNotModified
+		resp.ContentLength = 0
+		resp.Header.Del("Content-Length")
+		resp.Header.Del("Content-Range")
+		resp.Trailer = nil
+	}
+	return nil
+}
+
+// etagListMatches reports whether one of the ETags of the lists of a
+// conditional header matches the given ETag, comparing them weakly.
+func etagListMatches(lists []string, etag string) bool {
+	etag = strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+	for _, list := range lists {
+		for _, candidate := range strings.Split(list, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.Trim(strings.TrimPrefix(candidate, "W/"), `"`) == etag {
+				return true
+			}
+		}
+	}
+	return false
+}
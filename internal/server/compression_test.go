@@ -0,0 +1,313 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// compressibleContent returns size bytes of JSON lines.
+func compressibleContent(size int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < size; i++ {
+		fmt.Fprintf(&buf, `{"id": %d, "message": "user %d joined the channel"}`+"\n", i, i%97)
+	}
+	return buf.Bytes()[:size]
+}
+
+func TestCompressionEligible(t *testing.T) {
+	s := &Server{cfg: Config{CompressionSettings: CompressionSettings{
+		Enable:        true,
+		Installations: []string{"inst"},
+		MinSizeBytes:  10,
+		MaxSizeBytes:  1000,
+	}}}
+	putObject := s3Request{Operation: opPutObject}
+
+	for _, test := range []struct {
+		name           string
+		installationID string
+		op             s3Request
+		size           int64
+		header         http.Header
+		expected       bool
+	}{
+		{"json", "inst", putObject, 100, http.Header{"Content-Type": {"application/json"}}, true},
+		{"text with charset", "inst", putObject, 100, http.Header{"Content-Type": {"text/plain; charset=utf-8"}}, true},
+		{"aws-chunked", "inst", putObject, 100, http.Header{"Content-Type": {"text/csv"}, "Content-Encoding": {"aws-chunked"}}, true},
+		{"image", "inst", putObject, 100, http.Header{"Content-Type": {"image/png"}}, false},
+		{"no content type", "inst", putObject, 100, nil, false},
+		{"gzipped", "inst", putObject, 100, http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"gzip"}}, false},
+		{"too small", "inst", putObject, 5, http.Header{"Content-Type": {"text/plain"}}, false},
+		{"too large", "inst", putObject, 1001, http.Header{"Content-Type": {"text/plain"}}, false},
+		{"other installation", "other", putObject, 100, http.Header{"Content-Type": {"text/plain"}}, false},
+		{"upload part", "inst", s3Request{Operation: opUploadPart}, 100, http.Header{"Content-Type": {"text/plain"}}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", "http://example.com/inst/a", nil)
+			req.ContentLength = test.size
+			for name, values := range test.header {
+				req.Header[name] = values
+			}
+			assert.Equal(t, test.expected, s.compressionEligible(req, test.op, test.installationID))
+		})
+	}
+
+	s.cfg.CompressionSettings.ContentTypes = []string{"image/*"}
+	req := httptest.NewRequest("PUT", "http://example.com/inst/a", nil)
+	req.ContentLength = 100
+	req.Header.Set("Content-Type", "image/bmp")
+	assert.True(t, s.compressionEligible(req, putObject, "inst"))
+}
+
+func TestCompressedObjects(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{CompressionSettings: CompressionSettings{Enable: true, Installations: []string{"inst"}}})
+	handler := s.handler()
+
+	content := compressibleContent(200000)
+	sha := sha256.Sum256(content)
+	sum := md5.Sum(content)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	resp := serveRequest(handler, "PUT", "/inst/a", content, http.Header{
+		"Content-Type":         {"application/json"},
+		"Content-Md5":          {base64.StdEncoding.EncodeToString(sum[:])},
+		"X-Amz-Content-Sha256": {hex.EncodeToString(sha[:])},
+	})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	obj := fake.object("inst/a")
+	require.NotNil(t, obj)
+	assert.Less(t, len(obj.data), len(content)/4)
+	assert.Equal(t, compressionZstd, obj.header.Get(compressionHeader))
+	assert.Equal(t, "200000", obj.header.Get(originalSizeHeader))
+	assert.Equal(t, etag, obj.header.Get(originalETagHeader))
+	assert.Equal(t, "application/json", obj.header.Get("Content-Type"))
+
+	t.Run("get", func(t *testing.T) {
+		resp := serveRequest(handler, "GET", "/inst/a", nil, nil)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, content, body)
+		assert.Equal(t, "200000", resp.Header.Get("Content-Length"))
+		assert.Equal(t, etag, resp.Header.Get("ETag"))
+		assert.Empty(t, resp.Header.Get(compressionHeader))
+		assert.Empty(t, resp.Header.Get(originalSizeHeader))
+	})
+
+	t.Run("head", func(t *testing.T) {
+		resp := serveRequest(handler, "HEAD", "/inst/a", nil, nil)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "200000", resp.Header.Get("Content-Length"))
+		assert.Equal(t, etag, resp.Header.Get("ETag"))
+	})
+
+	t.Run("ranges", func(t *testing.T) {
+		for _, test := range []struct {
+			rangeHeader string
+			start, end  int
+		}{
+			{"bytes=0-9", 0, 9},
+			{"bytes=150000-150009", 150000, 150009},
+			{"bytes=-100", 199900, 199999},
+			{"bytes=199990-", 199990, 199999},
+		} {
+			t.Run(test.rangeHeader, func(t *testing.T) {
+				resp := serveRequest(handler, "GET", "/inst/a", nil, http.Header{"Range": {test.rangeHeader}})
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+
+				assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+				assert.Equal(t, content[test.start:test.end+1], body)
+				assert.Equal(t, fmt.Sprintf("bytes %d-%d/200000", test.start, test.end), resp.Header.Get("Content-Range"))
+				assert.Equal(t, strconv.Itoa(test.end-test.start+1), resp.Header.Get("Content-Length"))
+			})
+		}
+
+		resp := serveRequest(handler, "GET", "/inst/a", nil, http.Header{"Range": {"bytes=200001-"}})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+	})
+
+	t.Run("conditions use the original ETag", func(t *testing.T) {
+		resp := serveRequest(handler, "GET", "/inst/a", nil, http.Header{"If-None-Match": {etag}})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+		resp = serveRequest(handler, "GET", "/inst/a", nil, http.Header{"If-Match": {`"other"`}})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+		resp = serveRequest(handler, "GET", "/inst/a", nil, http.Header{"If-Match": {etag}, "Range": {"bytes=0-9"}})
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, content[:10], body)
+	})
+
+	t.Run("incompressible bodies are stored as they are", func(t *testing.T) {
+		random := make([]byte, 100000)
+		_, err := rand.Read(random)
+		require.NoError(t, err)
+
+		resp := serveRequest(handler, "PUT", "/inst/random", random, http.Header{"Content-Type": {"text/plain"}})
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		obj := fake.object("inst/random")
+		require.NotNil(t, obj)
+		assert.Equal(t, random, obj.data)
+		assert.Empty(t, obj.header.Get(compressionHeader))
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		resp := serveRequest(handler, "PUT", "/inst/bad", content, http.Header{
+			"Content-Type": {"text/plain"},
+			"Content-Md5":  {base64.StdEncoding.EncodeToString(make([]byte, md5.Size))},
+		})
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Nil(t, fake.object("inst/bad"))
+	})
+
+	t.Run("other installations are not compressed", func(t *testing.T) {
+		resp := serveRequest(handler, "PUT", "/other/a", content, http.Header{"Content-Type": {"application/json"}})
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		obj := fake.object("other/a")
+		require.NotNil(t, obj)
+		assert.Equal(t, content, obj.data)
+	})
+
+	t.Run("copy with replaced metadata", func(t *testing.T) {
+		resp := serveRequest(handler, "PUT", "/other/copy", nil, http.Header{
+			"X-Amz-Copy-Source":        {"/agnivatest/inst/a"},
+			"X-Amz-Metadata-Directive": {"REPLACE"},
+			"Content-Type":             {"text/plain"},
+		})
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = serveRequest(handler, "GET", "/other/copy", nil, nil)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, content, body)
+		assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	})
+}
+
+func TestCompressedEncryptedObjects(t *testing.T) {
+	s, fake, _ := newEncryptionTestServer(t)
+	s.cfg.CompressionSettings = CompressionSettings{Enable: true, Installations: []string{"inst"}}
+	handler := s.handler()
+
+	content := compressibleContent(300000)
+	resp := serveRequest(handler, "PUT", "/inst/a", content, http.Header{"Content-Type": {"text/plain"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	obj := fake.object("inst/a")
+	require.NotNil(t, obj)
+	assert.Less(t, len(obj.data), len(content)/4)
+	assert.Equal(t, encryptionScheme, obj.header.Get(encryptionHeader))
+	assert.Equal(t, compressionZstd, obj.header.Get(compressionHeader))
+
+	resp = serveRequest(handler, "GET", "/inst/a", nil, nil)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, content, body)
+
+	resp = serveRequest(handler, "GET", "/inst/a", nil, http.Header{"Range": {"bytes=250000-250099"}})
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, content[250000:250100], body)
+}
+
+func TestCompressedMultipartPut(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{
+		CompressionSettings:    CompressionSettings{Enable: true, Installations: []string{"inst"}},
+		MultipartSplitSettings: MultipartSplitSettings{Enable: true, ThresholdBytes: 1000},
+	})
+	handler := s.handler()
+
+	content := compressibleContent(100000)
+	sum := md5.Sum(content)
+	resp := serveRequest(handler, "PUT", "/inst/a", content, http.Header{"Content-Type": {"text/plain"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"`+hex.EncodeToString(sum[:])+`"`, resp.Header.Get("ETag"))
+
+	obj := fake.object("inst/a")
+	require.NotNil(t, obj)
+	assert.Contains(t, obj.etag, "-1")
+	assert.Equal(t, compressionZstd, obj.header.Get(compressionHeader))
+
+	resp = serveRequest(handler, "GET", "/inst/a", nil, nil)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, content, body)
+}
+
+func TestDecompressingReader(t *testing.T) {
+	encoded := compressedObject(t, compressibleContent(1000))
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{compressionHeader: {compressionZstd}, originalSizeHeader: {"2000"}},
+		Body:       io.NopCloser(bytes.NewReader(encoded)),
+	}
+	req := httptest.NewRequest("GET", "http://example.com/inst/a", nil)
+	resp, err := (&Server{}).decompressResponse(req, resp, "")
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+// compressedObject returns the zstd compression of content, as stored by
+// prepareCompression.
+func compressedObject(t *testing.T, content []byte) []byte {
+	s := &Server{logger: mlog.NewTestingLogger(t, os.Stderr)}
+	req := httptest.NewRequest("PUT", "http://example.com/inst/a", bytes.NewReader(content))
+	etag, cleanup, err := s.prepareCompression(req)
+	require.NoError(t, err)
+	defer cleanup()
+	require.NotEmpty(t, etag)
+	encoded, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	return encoded
+}
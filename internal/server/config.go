@@ -6,16 +6,40 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"regexp"
 
 	"github.com/kelseyhightower/envconfig"
 )
 
 // Config is the configuration for a bifrost server.
 type Config struct {
-	ServiceSettings ServiceSettings
-	S3Settings      AmazonS3Settings
-	LogSettings     LogSettings
+	ServiceSettings          ServiceSettings
+	S3Settings               AmazonS3Settings
+	LogSettings              LogSettings
+	CircuitBreakerSettings   CircuitBreakerSettings
+	ParallelGetSettings      ParallelGetSettings
+	MultipartSplitSettings   MultipartSplitSettings
+	MultipartJanitorSettings MultipartJanitorSettings
+	CoalescingSettings       CoalescingSettings
+	ProxySettings            ProxySettings
+	EncryptionSettings       EncryptionSettings
+	CompressionSettings      CompressionSettings
+	MassDeleteSettings       MassDeleteSettings
+	TrashSettings            TrashSettings
+	EventSettings            EventSettings
+	ChangeFeedSettings       ChangeFeedSettings
+	ScanSettings             ScanSettings
+	PolicySettings           PolicySettings
+	RequestGuardSettings     RequestGuardSettings
+	InjectionSettings        InjectionSettings
+	TaggingSettings          TaggingSettings
+	ExportSettings           ExportSettings
+	ImportSettings           ImportSettings
+	OffboardingSettings      OffboardingSettings
+	MoveSettings             MoveSettings
 }
 
 // ServiceSettings is the configuration related to the web server.
@@ -31,6 +55,11 @@ type ServiceSettings struct {
 	IdleTimeoutSecs                     int
 	RequestValidation                   bool
 	RequestValidationExpectedNameSuffix string
+	TLSClientCAFile                     string
+	TLSClientAuth                       string
+	TLSClientIdentityPattern            string
+	StateFile                           string
+	AdminToken                          string
 }
 
 // AmazonS3Settings is the configuration related to the Amazon S3.
@@ -41,6 +70,21 @@ type AmazonS3Settings struct {
 	Region          string
 	Endpoint        string
 	Scheme          string
+
+	Endpoints                []string
+	LoadBalancing            string
+	HealthCheckIntervalSecs  int
+	HealthCheckTimeoutSecs   int
+	OutlierConsecutiveErrors int
+	OutlierEjectionSecs      int
+
+	CACertFile         string
+	ClientCertFile     string
+	ClientKeyFile      string
+	TLSMinVersion      string
+	TLSServerName      string
+	PinnedSPKIHashes   []string
+	InsecureSkipVerify bool
 }
 
 // LogSettings is the configuration for the logger.
@@ -54,6 +98,228 @@ type LogSettings struct {
 	FileLocation  string
 }
 
+// CircuitBreakerSettings is the configuration of the circuit breakers and the
+// adaptive concurrency limits protecting S3 from overload. They apply both to
+// the route as a whole and to every installation separately.
+type CircuitBreakerSettings struct {
+	Enable              bool
+	FailureThreshold    int
+	WindowSecs          int
+	OpenSecs            int
+	AdaptiveConcurrency bool
+	InitialConcurrency  int
+	MinConcurrency      int
+	MaxConcurrency      int
+	ConcurrencyBackoff  float64
+	LatencyTargetMillis int
+}
+
+// ParallelGetSettings is the configuration of the download acceleration of
+// large objects with parallel ranged requests.
+type ParallelGetSettings struct {
+	Enable             bool
+	MinObjectSizeBytes int64
+	PartSizeBytes      int64
+	Concurrency        int
+}
+
+// MultipartSplitSettings is the configuration of the transparent conversion
+// of large PutObject requests into multipart uploads.
+type MultipartSplitSettings struct {
+	Enable           bool
+	ThresholdBytes   int64
+	PartSizeBytes    int64
+	Concurrency      int
+	SpoolDirectory   string
+	MemoryLimitBytes int64
+}
+
+// MultipartJanitorSettings is the configuration of the background job that
+// aborts abandoned multipart uploads.
+type MultipartJanitorSettings struct {
+	Enable       bool
+	IntervalSecs int
+	MaxAgeSecs   int
+	DryRun       bool
+}
+
+// CoalescingSettings is the configuration of the merging of concurrent
+// identical GetObject and HeadObject requests.
+type CoalescingSettings struct {
+	Enable         bool
+	MaxBufferBytes int
+}
+
+// ProxySettings is the configuration of how requests and responses are
+// passed between clients and S3.
+type ProxySettings struct {
+	RequestHeaderAllowlist []string
+}
+
+// EncryptionSettings is the configuration of the encryption of objects with
+// per-installation master keys.
+type EncryptionSettings struct {
+	Enable   bool
+	KeyStore string
+	KeyFile  string
+}
+
+// CompressionSettings is the configuration of the compression of objects of
+// the installations that opted in.
+type CompressionSettings struct {
+	Enable         bool
+	Installations  []string
+	ContentTypes   []string
+	MinSizeBytes   int64
+	MaxSizeBytes   int64
+	SpoolDirectory string
+}
+
+// MassDeleteSettings is the configuration of the protection against mass
+// deletes and overwrites, which freezes the installations doing too many of
+// them.
+type MassDeleteSettings struct {
+	Enable     bool
+	Thresholds []MassDeleteThreshold
+}
+
+// MassDeleteThreshold is the number of objects an installation can delete
+// and overwrite within a sliding window. Zero means no limit.
+type MassDeleteThreshold struct {
+	WindowSecs    int
+	MaxDeletes    int
+	MaxOverwrites int
+}
+
+// TrashSettings is the configuration of the trash, where deleted objects are
+// kept for a while before they are purged.
+type TrashSettings struct {
+	Enable            bool
+	RetentionSecs     int
+	PurgeIntervalSecs int
+}
+
+// EventSettings is the configuration of the events emitted for the objects
+// created and deleted through Bifrost.
+type EventSettings struct {
+	Enable                    bool
+	JournalFile               string
+	DeadLetterFile            string
+	QueueSize                 int
+	Webhooks                  []WebhookSettings
+	WebhookMaxAttempts        int
+	WebhookRetryBackoffMillis int
+	WebhookTimeoutSecs        int
+}
+
+// WebhookSettings is an HTTP endpoint events are sent to. The requests are
+// signed with the secret, if any.
+type WebhookSettings struct {
+	URL    string
+	Secret string
+}
+
+// ChangeFeedSettings is the configuration of the change feed of the
+// installations, which is built from the event journal.
+type ChangeFeedSettings struct {
+	Enable        bool
+	RetentionSecs int
+}
+
+// ScanSettings is the configuration of the scanning of the objects of the
+// installations for malware, by an ICAP server.
+type ScanSettings struct {
+	Enable         bool
+	ICAPURL        string
+	Installations  []string
+	MaxSizeBytes   int64
+	TimeoutSecs    int
+	SpoolDirectory string
+	FailOpen       bool
+	ScanOnRead     bool
+}
+
+// RequestGuardSettings is the configuration of the rejection of the requests
+// that would change the security of the whole bucket, and of the handling
+// of the server-side encryption and storage class headers of the requests
+// writing objects.
+type RequestGuardSettings struct {
+	AllowedOperations    []string
+	AllowedCannedACLs    []string
+	AllowGrantHeaders    bool
+	ServerSideEncryption HeaderPolicy
+	StorageClass         HeaderPolicy
+}
+
+// HeaderPolicy is how a family of headers is handled: passed on, stripped,
+// or overridden with Values.
+type HeaderPolicy struct {
+	Mode   string
+	Values map[string]string
+}
+
+// InjectionSettings is the configuration of the server-side encryption and
+// storage class set on the objects written through Bifrost.
+type InjectionSettings struct {
+	Enable                   bool
+	ServerSideEncryption     string
+	KMSKeyID                 string
+	InstallationKMSKeyIDs    map[string]string
+	BucketKeyEnabled         bool
+	StorageClass             string
+	StorageClassMinSizeBytes int64
+}
+
+// TaggingSettings is the configuration of the tags and metadata added to
+// the objects written through Bifrost, with the installation that wrote
+// them.
+type TaggingSettings struct {
+	Enable bool
+	Tags   map[string]string
+}
+
+// ExportSettings is the configuration of the exports of installations with
+// the admin API.
+type ExportSettings struct {
+	Enable bool
+}
+
+// ImportSettings is the configuration of the imports of archives into
+// installations. Entries larger than a part are uploaded as multipart
+// uploads. Enable only applies to the imports of the admin API.
+type ImportSettings struct {
+	Enable              bool
+	Concurrency         int
+	PartSizeBytes       int64
+	SpoolDirectory      string
+	CheckpointDirectory string
+}
+
+// OffboardingSettings is the configuration of the deletion of the data of
+// offboarded installations, which starts once their grace period is over.
+// The completion reports are signed with the Ed25519 key of SigningKeyFile.
+type OffboardingSettings struct {
+	Enable             bool
+	GracePeriodSecs    int
+	IntervalSecs       int
+	SigningKeyFile     string
+	MaxAttempts        int
+	RetryBackoffMillis int
+}
+
+// MoveSettings is the configuration of the moves of installations with the
+// admin API.
+type MoveSettings struct {
+	Enable bool
+}
+
+// PolicySettings is the configuration of the access policies of the
+// installations, which are read from the policy file.
+type PolicySettings struct {
+	Enable bool
+	File   string
+}
+
 // ParseConfig reads the config file and returns a new *Config,
 // This method overrides values in the file if there is any environment
 // variables corresponding to a specific setting.
@@ -74,5 +340,233 @@ func ParseConfig(path string) (Config, error) {
 		return cfg, err
 	}
 
+	if err = cfg.IsValid(); err != nil {
+		return cfg, fmt.Errorf("invalid configuration: %w", err)
+	}
+
 	return cfg, nil
 }
+
+// IsValid reports whether the configuration contains settings that the
+// server would not be able to start with.
+func (cfg Config) IsValid() error {
+	switch cfg.ServiceSettings.TLSClientAuth {
+	case TLSClientAuthNone, TLSClientAuthVerify, TLSClientAuthRequire:
+	default:
+		return fmt.Errorf("unknown TLSClientAuth mode %q", cfg.ServiceSettings.TLSClientAuth)
+	}
+
+	if cfg.ServiceSettings.TLSClientAuth != TLSClientAuthNone && cfg.ServiceSettings.TLSClientCAFile == "" {
+		return fmt.Errorf("TLSClientCAFile is required when TLSClientAuth is %q", cfg.ServiceSettings.TLSClientAuth)
+	}
+
+	if cfg.ServiceSettings.TLSClientAuth != TLSClientAuthNone && (cfg.ServiceSettings.TLSCertFile == "" || cfg.ServiceSettings.TLSKeyFile == "") {
+		return fmt.Errorf("TLSCertFile and TLSKeyFile are required when TLSClientAuth is %q", cfg.ServiceSettings.TLSClientAuth)
+	}
+
+	if _, ok := tlsVersions[cfg.S3Settings.TLSMinVersion]; !ok {
+		return fmt.Errorf("unsupported S3 TLSMinVersion %q", cfg.S3Settings.TLSMinVersion)
+	}
+
+	switch cfg.S3Settings.LoadBalancing {
+	case "", LoadBalancingRoundRobin, LoadBalancingLeastConnections:
+	default:
+		return fmt.Errorf("unknown S3 LoadBalancing strategy %q", cfg.S3Settings.LoadBalancing)
+	}
+
+	if (cfg.S3Settings.ClientCertFile == "") != (cfg.S3Settings.ClientKeyFile == "") {
+		return fmt.Errorf("S3 ClientCertFile and ClientKeyFile must be set together")
+	}
+
+	if backoff := cfg.CircuitBreakerSettings.ConcurrencyBackoff; backoff < 0 || backoff >= 1 {
+		return fmt.Errorf("ConcurrencyBackoff must be between 0 and 1")
+	}
+
+	if cfg.MultipartSplitSettings.Enable && cfg.MultipartSplitSettings.ThresholdBytes < minMultipartPartSize {
+		return fmt.Errorf("multipart ThresholdBytes must be at least %d", minMultipartPartSize)
+	}
+
+	if partSize := cfg.MultipartSplitSettings.PartSizeBytes; partSize != 0 && partSize < minMultipartPartSize {
+		return fmt.Errorf("multipart PartSizeBytes must be at least %d", minMultipartPartSize)
+	}
+	if cfg.MultipartSplitSettings.MemoryLimitBytes < 0 {
+		return fmt.Errorf("multipart MemoryLimitBytes can't be negative")
+	}
+
+	if cfg.MultipartJanitorSettings.Enable && (cfg.MultipartJanitorSettings.IntervalSecs <= 0 || cfg.MultipartJanitorSettings.MaxAgeSecs <= 0) {
+		return fmt.Errorf("multipart janitor IntervalSecs and MaxAgeSecs must be positive")
+	}
+
+	if cfg.EncryptionSettings.Enable {
+		switch cfg.EncryptionSettings.KeyStore {
+		case "", KeyStoreFile:
+			if cfg.EncryptionSettings.KeyFile == "" {
+				return fmt.Errorf("encryption KeyFile is required for the file key store")
+			}
+		default:
+			return fmt.Errorf("unknown encryption KeyStore %q", cfg.EncryptionSettings.KeyStore)
+		}
+	}
+
+	if settings := cfg.CompressionSettings; settings.MinSizeBytes < 0 || settings.MaxSizeBytes < 0 || (settings.MaxSizeBytes != 0 && settings.MinSizeBytes > settings.MaxSizeBytes) {
+		return fmt.Errorf("compression MinSizeBytes and MaxSizeBytes must be positive, with MinSizeBytes at most MaxSizeBytes")
+	}
+
+	for _, threshold := range cfg.MassDeleteSettings.Thresholds {
+		if threshold.WindowSecs <= 0 || threshold.MaxDeletes < 0 || threshold.MaxOverwrites < 0 {
+			return fmt.Errorf("mass delete thresholds must have a positive WindowSecs, and MaxDeletes and MaxOverwrites can't be negative")
+		}
+	}
+
+	if cfg.TrashSettings.Enable && (cfg.TrashSettings.RetentionSecs <= 0 || cfg.TrashSettings.PurgeIntervalSecs <= 0) {
+		return fmt.Errorf("trash RetentionSecs and PurgeIntervalSecs must be positive")
+	}
+
+	if settings := cfg.EventSettings; settings.Enable {
+		if settings.JournalFile == "" {
+			return fmt.Errorf("event JournalFile is required")
+		}
+		if settings.QueueSize < 0 || settings.WebhookMaxAttempts < 0 || settings.WebhookRetryBackoffMillis < 0 || settings.WebhookTimeoutSecs < 0 {
+			return fmt.Errorf("event QueueSize, WebhookMaxAttempts, WebhookRetryBackoffMillis and WebhookTimeoutSecs can't be negative")
+		}
+		for _, webhook := range settings.Webhooks {
+			if u, err := url.Parse(webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("invalid event webhook URL %q", webhook.URL)
+			}
+		}
+	}
+
+	if cfg.ChangeFeedSettings.Enable {
+		if !cfg.EventSettings.Enable {
+			return fmt.Errorf("the change feed requires events to be enabled")
+		}
+		if cfg.ChangeFeedSettings.RetentionSecs <= 0 {
+			return fmt.Errorf("change feed RetentionSecs must be positive")
+		}
+	}
+
+	if settings := cfg.ScanSettings; settings.Enable {
+		if u, err := url.Parse(settings.ICAPURL); err != nil || u.Scheme != "icap" || u.Host == "" {
+			return fmt.Errorf("invalid scan ICAPURL %q", settings.ICAPURL)
+		}
+		if settings.MaxSizeBytes < 0 || settings.TimeoutSecs < 0 {
+			return fmt.Errorf("scan MaxSizeBytes and TimeoutSecs can't be negative")
+		}
+	}
+
+	if cfg.PolicySettings.Enable && cfg.PolicySettings.File == "" {
+		return fmt.Errorf("policy File is required")
+	}
+
+	if err := cfg.RequestGuardSettings.ServerSideEncryption.isValid(func(name string) bool {
+		return serverSideEncryptionOverrideHeaders[name]
+	}); err != nil {
+		return fmt.Errorf("invalid ServerSideEncryption header policy: %w", err)
+	}
+	if err := cfg.RequestGuardSettings.StorageClass.isValid(func(name string) bool {
+		return name == storageClassHeader
+	}); err != nil {
+		return fmt.Errorf("invalid StorageClass header policy: %w", err)
+	}
+
+	if settings := cfg.InjectionSettings; settings.Enable {
+		switch settings.ServerSideEncryption {
+		case "", sseAlgorithmAES256, sseAlgorithmKMS, sseAlgorithmKMSDSSE:
+		default:
+			return fmt.Errorf("unknown injected ServerSideEncryption %q", settings.ServerSideEncryption)
+		}
+		if settings.ServerSideEncryption == "" && settings.StorageClass == "" {
+			return fmt.Errorf("injection requires a ServerSideEncryption or a StorageClass")
+		}
+		if !isKMSAlgorithm(settings.ServerSideEncryption) && (settings.KMSKeyID != "" || len(settings.InstallationKMSKeyIDs) > 0 || settings.BucketKeyEnabled) {
+			return fmt.Errorf("injected KMS keys require KMS server-side encryption")
+		}
+		if settings.StorageClassMinSizeBytes < 0 {
+			return fmt.Errorf("injection StorageClassMinSizeBytes can't be negative")
+		}
+		if settings.ServerSideEncryption != "" && cfg.RequestGuardSettings.ServerSideEncryption.Mode == HeaderModeOverride {
+			return fmt.Errorf("server-side encryption can't be both injected and overridden")
+		}
+		if settings.StorageClass != "" && cfg.RequestGuardSettings.StorageClass.Mode == HeaderModeOverride {
+			return fmt.Errorf("the storage class can't be both injected and overridden")
+		}
+	}
+
+	if settings := cfg.TaggingSettings; settings.Enable {
+		if len(settings.Tags) > maxObjectTags {
+			return fmt.Errorf("tagging can't add more than %d Tags", maxObjectTags)
+		}
+		for key := range settings.Tags {
+			if key == "" {
+				return fmt.Errorf("tag keys can't be empty")
+			}
+		}
+	}
+
+	if cfg.ExportSettings.Enable && cfg.ServiceSettings.AdminToken == "" {
+		return fmt.Errorf("exports require an AdminToken")
+	}
+	if cfg.ImportSettings.Enable && cfg.ServiceSettings.AdminToken == "" {
+		return fmt.Errorf("imports require an AdminToken")
+	}
+	if cfg.OffboardingSettings.Enable && cfg.ServiceSettings.AdminToken == "" {
+		return fmt.Errorf("offboarding requires an AdminToken")
+	}
+	if cfg.MoveSettings.Enable && cfg.ServiceSettings.AdminToken == "" {
+		return fmt.Errorf("moves require an AdminToken")
+	}
+
+	if partSize := cfg.ImportSettings.PartSizeBytes; partSize != 0 && (partSize < minMultipartPartSize || partSize > maxPartSize) {
+		return fmt.Errorf("import PartSizeBytes must be between %d and %d", minMultipartPartSize, maxPartSize)
+	}
+	if cfg.ImportSettings.Concurrency < 0 {
+		return fmt.Errorf("import Concurrency can't be negative")
+	}
+
+	if settings := cfg.OffboardingSettings; settings.Enable {
+		if settings.IntervalSecs <= 0 {
+			return fmt.Errorf("offboarding IntervalSecs must be positive")
+		}
+		if settings.GracePeriodSecs < 0 || settings.MaxAttempts < 0 || settings.RetryBackoffMillis < 0 {
+			return fmt.Errorf("offboarding GracePeriodSecs, MaxAttempts and RetryBackoffMillis can't be negative")
+		}
+		if settings.SigningKeyFile == "" {
+			return fmt.Errorf("offboarding SigningKeyFile is required")
+		}
+	}
+
+	if pattern := cfg.ServiceSettings.TLSClientIdentityPattern; pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("could not compile TLSClientIdentityPattern: %w", err)
+		}
+		if re.NumSubexp() != 1 {
+			return fmt.Errorf("TLSClientIdentityPattern must have exactly one capture group")
+		}
+	}
+
+	return nil
+}
+
+// isValid reports whether the header policy is valid, with Values setting
+// only the headers that allowed accepts.
+func (p HeaderPolicy) isValid(allowed func(name string) bool) error {
+	switch p.Mode {
+	case HeaderModePass, HeaderModeStrip:
+		if len(p.Values) > 0 {
+			return fmt.Errorf("values are only set in %q mode", HeaderModeOverride)
+		}
+	case HeaderModeOverride:
+		if len(p.Values) == 0 {
+			return fmt.Errorf("values are required in %q mode", HeaderModeOverride)
+		}
+		for name := range p.Values {
+			if !allowed(http.CanonicalHeaderKey(name)) {
+				return fmt.Errorf("header %q can't be set", name)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", p.Mode)
+	}
+	return nil
+}
@@ -59,3 +59,60 @@ func TestParseConfig(t *testing.T) {
 		require.Equal(t, cfg.ServiceSettings.TLSCertFile, "/home/test/file.cert")
 	})
 }
+
+func TestConfigIsValid(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		settings    ServiceSettings
+		s3Settings  AmazonS3Settings
+		valid       bool
+	}{
+		{"defaults", ServiceSettings{}, AmazonS3Settings{}, true},
+		{"client auth with CA", ServiceSettings{TLSClientAuth: TLSClientAuthRequire, TLSClientCAFile: "ca.pem", TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"}, AmazonS3Settings{}, true},
+		{"client auth without CA", ServiceSettings{TLSClientAuth: TLSClientAuthVerify, TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"}, AmazonS3Settings{}, false},
+		{"client auth without server certificate", ServiceSettings{TLSClientAuth: TLSClientAuthRequire, TLSClientCAFile: "ca.pem"}, AmazonS3Settings{}, false},
+		{"client auth without server key", ServiceSettings{TLSClientAuth: TLSClientAuthVerify, TLSClientCAFile: "ca.pem", TLSCertFile: "cert.pem"}, AmazonS3Settings{}, false},
+		{"unknown client auth mode", ServiceSettings{TLSClientAuth: "sometimes", TLSClientCAFile: "ca.pem", TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"}, AmazonS3Settings{}, false},
+		{"identity pattern", ServiceSettings{TLSClientIdentityPattern: `^spiffe://cloud/ns/([^/]+)/`}, AmazonS3Settings{}, true},
+		{"identity pattern without group", ServiceSettings{TLSClientIdentityPattern: `^inst$`}, AmazonS3Settings{}, false},
+		{"invalid identity pattern", ServiceSettings{TLSClientIdentityPattern: `([`}, AmazonS3Settings{}, false},
+		{"S3 TLS 1.3", ServiceSettings{}, AmazonS3Settings{TLSMinVersion: "1.3"}, true},
+		{"S3 TLS 1.1", ServiceSettings{}, AmazonS3Settings{TLSMinVersion: "1.1"}, false},
+		{"S3 client cert without key", ServiceSettings{}, AmazonS3Settings{ClientCertFile: "client.pem"}, false},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			err := Config{ServiceSettings: test.settings, S3Settings: test.s3Settings}.IsValid()
+			if test.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestConfigIsValidAdminFeatures(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		cfg         Config
+		valid       bool
+	}{
+		{"export with token", Config{ServiceSettings: ServiceSettings{AdminToken: "secret"}, ExportSettings: ExportSettings{Enable: true}}, true},
+		{"export without token", Config{ExportSettings: ExportSettings{Enable: true}}, false},
+		{"import with token", Config{ServiceSettings: ServiceSettings{AdminToken: "secret"}, ImportSettings: ImportSettings{Enable: true}}, true},
+		{"import without token", Config{ImportSettings: ImportSettings{Enable: true}}, false},
+		{"offboarding with token", Config{ServiceSettings: ServiceSettings{AdminToken: "secret"}, OffboardingSettings: OffboardingSettings{Enable: true, IntervalSecs: 60, SigningKeyFile: "key.pem"}}, true},
+		{"move with token", Config{ServiceSettings: ServiceSettings{AdminToken: "secret"}, MoveSettings: MoveSettings{Enable: true}}, true},
+		{"move without token", Config{MoveSettings: MoveSettings{Enable: true}}, false},
+		{"offboarding without token", Config{OffboardingSettings: OffboardingSettings{Enable: true, IntervalSecs: 60, SigningKeyFile: "key.pem"}}, false},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			err := test.cfg.IsValid()
+			if test.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,881 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+// Encrypted objects are a sequence of segments, each holding up to
+// encryptionSegmentSize bytes of the object:
+//
+//	<part number><index><nonce><ciphertext><tag>
+//
+// The part number is 0 for objects uploaded with PutObject, and the index
+// counts the segments of the part. Both are authenticated along with the
+// ciphertext, so that segments can't be reordered. Every segment but the last
+// one of the object is full, which is what makes it possible to find the
+// segments of a range and the size of the object from the size of the
+// encrypted object.
+//
+// Nothing in the segments tells the last one apart, so the size of the
+// object is authenticated along with its wrapped data key. Objects are
+// truncated at a segment boundary, or lose a part, without their size
+// changing otherwise.
+const (
+	encryptionSegmentSize = 64 * 1024
+	segmentHeaderSize     = 8
+	segmentNonceSize      = 12
+	segmentTagSize        = 16
+	segmentOverhead       = segmentHeaderSize + segmentNonceSize + segmentTagSize
+	encryptedSegmentSize  = encryptionSegmentSize + segmentOverhead
+
+	dataKeySize = 32
+
+	// encryptionScheme is the value of the encryption metadata of objects
+	// encrypted in the format above. Multipart uploads have no size until
+	// they are completed and sealed, and objects without a size are not
+	// read.
+	encryptionScheme = "AES256-GCM-SEGMENTED-1"
+
+	// encryptedUploadIDPrefix marks the upload IDs handed out for encrypted
+	// multipart uploads, which carry the wrapped data key of the upload.
+	encryptedUploadIDPrefix = "bfe1."
+)
+
+// Metadata of encrypted objects.
+const (
+	encryptionHeader      = "X-Amz-Meta-Bifrost-Encryption"
+	encryptionKeyIDHeader = "X-Amz-Meta-Bifrost-Key-Id"
+	wrappedKeyHeader      = "X-Amz-Meta-Bifrost-Key"
+	encryptedSizeHeader   = "X-Amz-Meta-Bifrost-Encrypted-Size"
+)
+
+// objectKey is the data key of an encrypted object, along with the master
+// key that wraps it. size is the size of the object before encryption, which
+// is authenticated by the wrapped key, or -1 if it is unknown.
+type objectKey struct {
+	keyID   string
+	wrapped string
+	dataKey []byte
+	size    int64
+}
+
+func (k *objectKey) setHeader(header http.Header) {
+	header.Set(encryptionHeader, encryptionScheme)
+	if k.size < 0 {
+		header.Del(encryptedSizeHeader)
+	} else {
+		header.Set(encryptedSizeHeader, strconv.FormatInt(k.size, 10))
+	}
+	header.Set(encryptionKeyIDHeader, k.keyID)
+	header.Set(wrappedKeyHeader, k.wrapped)
+}
+
+// newObjectKey generates the data key of a new object of the installation,
+// of size bytes, or -1 for multipart uploads. It returns nil if the
+// installation has no master key, in which case its objects are not
+// encrypted.
+func (s *Server) newObjectKey(installationID string, size int64) (*objectKey, error) {
+	keyID, masterKey, err := s.keys.currentKey(installationID)
+	if errors.Is(err, errNoInstallationKey) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, errors.Wrap(err, "failed to generate data key")
+	}
+	wrapped, err := wrapKey(masterKey, keyID, dataKey, size)
+	if err != nil {
+		return nil, err
+	}
+	return &objectKey{keyID: keyID, wrapped: wrapped, dataKey: dataKey, size: size}, nil
+}
+
+// objectKeyFromHeader unwraps the data key of an object from its metadata.
+// It returns nil if the object isn't encrypted, and an error if it has no
+// authenticated size, which is the case of a multipart upload that was
+// completed without being sealed.
+func (s *Server) objectKeyFromHeader(header http.Header) (*objectKey, error) {
+	switch scheme := header.Get(encryptionHeader); scheme {
+	case "":
+		return nil, nil
+	case encryptionScheme:
+	default:
+		return nil, errors.Errorf("unknown encryption scheme %q", scheme)
+	}
+
+	sizeValue := header.Get(encryptedSizeHeader)
+	if sizeValue == "" {
+		return nil, errors.New("encrypted object is not sealed with its size")
+	}
+	size, err := strconv.ParseInt(sizeValue, 10, 64)
+	if err != nil || size < 0 {
+		return nil, errors.Errorf("invalid size %q of encrypted object", sizeValue)
+	}
+	return s.unwrapObjectKey(header.Get(encryptionKeyIDHeader), header.Get(wrappedKeyHeader), size)
+}
+
+func (s *Server) unwrapObjectKey(keyID, wrapped string, size int64) (*objectKey, error) {
+	masterKey, err := s.keys.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := unwrapKey(masterKey, keyID, wrapped, size)
+	if err != nil {
+		return nil, err
+	}
+	return &objectKey{keyID: keyID, wrapped: wrapped, dataKey: dataKey, size: size}, nil
+}
+
+// wrapKey encrypts a data key with a master key. The key ID and the size of
+// the object, unless it is unknown, are authenticated along with it.
+func wrapKey(masterKey []byte, keyID string, dataKey []byte, size int64) (string, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "failed to generate nonce")
+	}
+	sealed := aead.Seal(nonce, nonce, dataKey, wrappedKeyData(keyID, size))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func unwrapKey(masterKey []byte, keyID, wrapped string, size int64) ([]byte, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, errors.New("invalid wrapped data key")
+	}
+	dataKey, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], wrappedKeyData(keyID, size))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to unwrap data key with key %q", keyID)
+	}
+	return dataKey, nil
+}
+
+// wrappedKeyData returns the data authenticated along with a wrapped key.
+func wrappedKeyData(keyID string, size int64) []byte {
+	if size < 0 {
+		return []byte(keyID)
+	}
+	return []byte(keyID + "\x00" + strconv.FormatInt(size, 10))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptedSize returns the size of an encrypted object of size bytes.
+func encryptedSize(size int64) int64 {
+	segments := (size + encryptionSegmentSize - 1) / encryptionSegmentSize
+	return size + segments*segmentOverhead
+}
+
+// decryptedSize returns the size of an object whose encrypted size is size.
+func decryptedSize(size int64) (int64, error) {
+	segments := (size + encryptedSegmentSize - 1) / encryptedSegmentSize
+	if rest := size % encryptedSegmentSize; rest != 0 && rest <= segmentOverhead {
+		return 0, errors.Errorf("invalid size %d for an encrypted object", size)
+	}
+	return size - segments*segmentOverhead, nil
+}
+
+// encryptedUploadID returns the upload ID handed out to the client for an
+// encrypted multipart upload. The data key of the upload is only known to
+// Bifrost when the parts are uploaded if it comes along with the upload ID.
+func encryptedUploadID(uploadID string, key *objectKey) (string, error) {
+	data, err := json.Marshal(struct{ U, K, W string }{uploadID, key.keyID, key.wrapped})
+	if err != nil {
+		return "", err
+	}
+	return encryptedUploadIDPrefix + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// parseEncryptedUploadID returns the upload ID, key ID and wrapped data key
+// of an upload ID returned by encryptedUploadID. ok is false for the upload
+// IDs of uploads that are not encrypted.
+func parseEncryptedUploadID(id string) (uploadID, keyID, wrapped string, ok bool, err error) {
+	encoded, ok := strings.CutPrefix(id, encryptedUploadIDPrefix)
+	if !ok {
+		return "", "", "", false, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", "", true, &s3Error{StatusCode: http.StatusNotFound, Code: "NoSuchUpload", Message: "The specified multipart upload does not exist."}
+	}
+	var v struct{ U, K, W string }
+	if err := json.Unmarshal(data, &v); err != nil || v.U == "" {
+		return "", "", "", true, &s3Error{StatusCode: http.StatusNotFound, Code: "NoSuchUpload", Message: "The specified multipart upload does not exist."}
+	}
+	return v.U, v.K, v.W, true, nil
+}
+
+// errPlainUploadID is returned for the multipart requests of an encrypted
+// upload sent with the upload ID of S3 instead of the one Bifrost handed out.
+var errPlainUploadID = &s3Error{
+	StatusCode: http.StatusBadRequest,
+	Code:       "InvalidArgument",
+	Message:    "Multipart uploads of this installation are encrypted, use the upload ID returned by CreateMultipartUpload.",
+}
+
+// prepareEncryption encrypts the body of PutObject and UploadPart requests of
+// installations with a master key, and sets the metadata the objects are
+// decrypted with. It returns the key of a CreateMultipartUpload, whose upload
+// ID has to be replaced by encryptedUploadID in the response, and the one of
+// a CompleteMultipartUpload, whose object has to be sealed with its size.
+func (s *Server) prepareEncryption(r *http.Request, op s3Request, installationID string) (*objectKey, error) {
+	switch op.Operation {
+	case opPutObject:
+		key, err := s.newObjectKey(installationID, r.ContentLength)
+		if err != nil || key == nil {
+			return nil, err
+		}
+		key.setHeader(r.Header)
+		return nil, encryptRequestBody(r, key, 0)
+
+	case opCreateMultipartUpload:
+		key, err := s.newObjectKey(installationID, -1)
+		if err != nil || key == nil {
+			return nil, err
+		}
+		key.setHeader(r.Header)
+		return key, nil
+
+	case opUploadPart:
+		key, err := s.translateUploadID(r, installationID)
+		if err != nil || key == nil {
+			return nil, err
+		}
+		partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		if err != nil || partNumber < 1 {
+			return nil, &s3Error{StatusCode: http.StatusBadRequest, Code: "InvalidArgument", Message: "Part number must be an integer between 1 and 10000, inclusive."}
+		}
+		return nil, encryptRequestBody(r, key, uint32(partNumber))
+
+	case opUploadPartCopy:
+		key, err := s.translateUploadID(r, installationID)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			return nil, &s3Error{StatusCode: http.StatusNotImplemented, Code: "NotImplemented", Message: "UploadPartCopy is not supported for encrypted uploads."}
+		}
+
+	case opCompleteMultipartUpload:
+		key, err := s.translateUploadID(r, installationID)
+		if err != nil || key == nil {
+			return nil, err
+		}
+		if key.size, err = s.checkEncryptedParts(r); err != nil {
+			return nil, err
+		}
+		return key, nil
+
+	case opAbortMultipartUpload, opListParts:
+		// The upload IDs of S3, as listed by ListMultipartUploads, are
+		// enough to abort an upload or list its parts.
+		_, err := s.translateUploadID(r, "")
+		return nil, err
+
+	}
+
+	return nil, nil
+}
+
+// translateUploadID replaces the upload ID of an encrypted multipart upload
+// in the query of the request by the one of S3, and returns the data key of
+// the upload. The multipart uploads of an installation with a master key are
+// encrypted, so the upload IDs of S3 are rejected for them, unless
+// installationID is empty: parts sent with them would not be encrypted.
+func (s *Server) translateUploadID(r *http.Request, installationID string) (*objectKey, error) {
+	query := r.URL.Query()
+	uploadID, keyID, wrapped, ok, err := parseEncryptedUploadID(query.Get("uploadId"))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if installationID == "" {
+			return nil, nil
+		}
+		_, _, err := s.keys.currentKey(installationID)
+		if errors.Is(err, errNoInstallationKey) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nil, errPlainUploadID
+	}
+	key, err := s.unwrapObjectKey(keyID, wrapped, -1)
+	if err != nil {
+		return nil, err
+	}
+	query.Set("uploadId", uploadID)
+	r.URL.RawQuery = query.Encode()
+	return key, nil
+}
+
+// checkEncryptedParts checks that every part of a CompleteMultipartUpload
+// request but the last one is made of full segments. Otherwise, the segments
+// of the object couldn't be told apart. It returns the size of the object
+// once decrypted, which the object is sealed with.
+func (s *Server) checkEncryptedParts(r *http.Request) (int64, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 4*1024*1024))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read request body")
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+
+	var complete struct {
+		Parts []completePart `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &complete); err != nil {
+		return 0, &s3Error{StatusCode: http.StatusBadRequest, Code: "MalformedXML", Message: "The XML you provided was not well-formed."}
+	}
+
+	sizes := make(map[int]int64)
+	marker := 0
+	for {
+		page, err := s.listParts(r.Context(), r.URL.Path, r.URL.Query().Get("uploadId"), marker)
+		if err != nil {
+			return 0, err
+		}
+		for _, part := range page.Parts {
+			sizes[part.PartNumber] = part.Size
+		}
+		if !page.IsTruncated {
+			break
+		}
+		marker = page.NextPartNumberMarker
+	}
+
+	var total int64
+	for i, part := range complete.Parts {
+		size, ok := sizes[part.PartNumber]
+		if !ok {
+			return 0, &s3Error{StatusCode: http.StatusBadRequest, Code: "InvalidPart", Message: "One or more of the specified parts could not be found. The part may not have been uploaded, or the specified entity tag may not match the part's entity tag."}
+		}
+		if i < len(complete.Parts)-1 && size%encryptedSegmentSize != 0 {
+			return 0, &s3Error{StatusCode: http.StatusBadRequest, Code: "InvalidPart", Message: fmt.Sprintf("The size of every part of an encrypted upload except the last one must be a multiple of %d bytes.", encryptionSegmentSize)}
+		}
+		decrypted, err := decryptedSize(size)
+		if err != nil {
+			return 0, &s3Error{StatusCode: http.StatusBadRequest, Code: "InvalidPart", Message: err.Error()}
+		}
+		total += decrypted
+	}
+	return total, nil
+}
+
+// completeEncryptedMultipartUpload completes an encrypted multipart upload,
+// and seals the object with its size. The metadata of an object can only be
+// changed by copying it onto itself, which also changes its ETag, so the
+// ETag of the completed upload is kept as the one of the object. If the
+// object can't be sealed, it is deleted and the request fails: the object
+// couldn't be read without its size anyway.
+func (s *Server) completeEncryptedMultipartUpload(r *http.Request, op s3Request, installationID string, key *objectKey) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	if s.scanEligible(installationID) {
+		resp, err = s.completeScannedMultipartUpload(r, op)
+	} else {
+		resp, err = s.doUpstream(r)
+	}
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	// S3 can fail after it sent a 200 status code.
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the response of CompleteMultipartUpload")
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	var result struct {
+		XMLName xml.Name
+		ETag    string
+	}
+	if xml.Unmarshal(body, &result) != nil || result.XMLName.Local != "CompleteMultipartUploadResult" {
+		return resp, nil
+	}
+
+	if err := s.sealEncryptedObject(r.Context(), "/"+op.Key, key, result.ETag); err != nil {
+		if deleteErr := s.deleteObject(r.Context(), "/"+op.Key); deleteErr != nil {
+			s.logger.Error("failed to delete unsealed encrypted object", mlog.String("key", op.Key), mlog.Err(deleteErr))
+		}
+		return nil, errors.Wrap(err, "failed to seal encrypted object")
+	}
+	return resp, nil
+}
+
+// sealEncryptedObject wraps the data key of a completed multipart upload
+// again along with the size of the object.
+func (s *Server) sealEncryptedObject(ctx context.Context, objectPath string, key *objectKey, etag string) error {
+	header, size, err := s.headObject(ctx, objectPath)
+	if err != nil {
+		return err
+	}
+	if header.Get("ETag") != etag || header.Get(wrappedKeyHeader) != key.wrapped {
+		// The object was replaced in the meantime.
+		return nil
+	}
+	if decrypted, err := decryptedSize(size); err != nil || decrypted != key.size {
+		return errors.Errorf("encrypted object has %d bytes, expected %d once decrypted", size, key.size)
+	}
+
+	masterKey, err := s.keys.key(key.keyID)
+	if err != nil {
+		return err
+	}
+	wrapped, err := wrapKey(masterKey, key.keyID, key.dataKey, key.size)
+	if err != nil {
+		return err
+	}
+
+	copyHeader := objectMetadata(header)
+	(&objectKey{keyID: key.keyID, wrapped: wrapped, size: key.size}).setHeader(copyHeader)
+	if copyHeader.Get(originalETagHeader) == "" {
+		copyHeader.Set(originalETagHeader, etag)
+	}
+	copyHeader.Set("X-Amz-Metadata-Directive", "REPLACE")
+	copyHeader.Set("X-Amz-Copy-Source-If-Match", etag)
+	err = s.copyObject(ctx, objectPath, objectPath, size, copyHeader)
+	if isS3ErrorCode(err, "PreconditionFailed") || isS3ErrorCode(err, "NoSuchKey") {
+		return nil
+	}
+	return err
+}
+
+// encryptRequestBody replaces the body of the request by its encryption as
+// the given part of an object. The checksums of the client can't be checked
+// by S3 anymore, so they are checked by Bifrost before the last segment is
+// sent. If they don't match, the request fails before it is complete and S3
+// drops it.
+func encryptRequestBody(r *http.Request, key *objectKey, partNumber uint32) error {
+	if r.ContentLength < 0 {
+		return &s3Error{StatusCode: http.StatusLengthRequired, Code: "MissingContentLength", Message: "You must provide the Content-Length HTTP header."}
+	}
+	aead, err := newAEAD(key.dataKey)
+	if err != nil {
+		return err
+	}
+
+	expected := bodyChecksums(r.Header)
+	removeBodyHeaders(r)
+	r.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	enc := &encryptingReader{
+		r:          r.Body,
+		aead:       aead,
+		partNumber: partNumber,
+		size:       r.ContentLength,
+		expected:   expected,
+		sha:        sha256.New(),
+		md:         md5.New(),
+		plain:      make([]byte, encryptionSegmentSize),
+		segment:    make([]byte, 0, encryptedSegmentSize),
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{enc, r.Body}
+	r.ContentLength = encryptedSize(r.ContentLength)
+	return nil
+}
+
+// encryptingReader encrypts size bytes of its reader segment by segment.
+type encryptingReader struct {
+	r          io.Reader
+	aead       cipher.AEAD
+	partNumber uint32
+	index      uint32
+	size       int64
+	read       int64
+
+	// expected are the checksums of the body sent by the client.
+	expected http.Header
+	sha      hash.Hash
+	md       hash.Hash
+	verified bool
+
+	plain   []byte
+	segment []byte
+	pending []byte
+	err     error
+}
+
+func (e *encryptingReader) Read(p []byte) (int, error) {
+	for len(e.pending) == 0 {
+		if e.err != nil {
+			return 0, e.err
+		}
+		if e.read == e.size {
+			e.err = e.verify()
+			if e.err == nil {
+				e.err = io.EOF
+			}
+			continue
+		}
+		e.err = e.next()
+	}
+
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+// next reads and encrypts the next segment. The checksums are verified before
+// the last segment is handed out.
+func (e *encryptingReader) next() error {
+	n := min(int64(encryptionSegmentSize), e.size-e.read)
+	plain := e.plain[:n]
+	if _, err := io.ReadFull(e.r, plain); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return &s3Error{StatusCode: http.StatusBadRequest, Code: "IncompleteBody", Message: "You did not provide the number of bytes specified by the Content-Length HTTP header."}
+		}
+		return errors.Wrap(err, "failed to read request body")
+	}
+	e.sha.Write(plain)
+	e.md.Write(plain)
+	e.read += n
+	if e.read == e.size {
+		if err := e.verify(); err != nil {
+			return err
+		}
+	}
+
+	e.segment = sealSegment(e.segment[:0], e.aead, e.partNumber, e.index, plain)
+	e.pending = e.segment
+	e.index++
+	return nil
+}
+
+func (e *encryptingReader) verify() error {
+	if e.verified {
+		return nil
+	}
+	e.verified = true
+	return verifyBodyChecksums(e.expected, e.sha, e.md)
+}
+
+// sealSegment appends the encrypted segment to dst.
+func sealSegment(dst []byte, aead cipher.AEAD, partNumber, index uint32, plain []byte) []byte {
+	start := len(dst)
+	dst = binary.BigEndian.AppendUint32(dst, partNumber)
+	dst = binary.BigEndian.AppendUint32(dst, index)
+	dst = append(dst, make([]byte, segmentNonceSize)...)
+	header := dst[start : start+segmentHeaderSize]
+	nonce := dst[start+segmentHeaderSize:]
+	_, _ = rand.Read(nonce)
+	return aead.Seal(dst, nonce, plain, header)
+}
+
+// openSegment decrypts an encrypted segment.
+func openSegment(dst []byte, aead cipher.AEAD, segment []byte) ([]byte, uint32, uint32, error) {
+	if len(segment) <= segmentOverhead {
+		return nil, 0, 0, errors.New("invalid encrypted segment")
+	}
+	header := segment[:segmentHeaderSize]
+	nonce := segment[segmentHeaderSize : segmentHeaderSize+segmentNonceSize]
+	plain, err := aead.Open(dst, nonce, segment[segmentHeaderSize+segmentNonceSize:], header)
+	if err != nil {
+		return nil, 0, 0, errors.Wrap(err, "failed to decrypt segment")
+	}
+	return plain, binary.BigEndian.Uint32(header), binary.BigEndian.Uint32(header[4:]), nil
+}
+
+// decryptingReader decrypts an encrypted object, or the segments of a range
+// of it. skip bytes are dropped from the first segment, and remaining bytes
+// are returned.
+type decryptingReader struct {
+	r         io.Reader
+	aead      cipher.AEAD
+	skip      int64
+	remaining int64
+
+	started    bool
+	partNumber uint32
+	index      uint32
+
+	segment []byte
+	plain   []byte
+	pending []byte
+	err     error
+}
+
+func newDecryptingReader(r io.Reader, key *objectKey, skip, length int64) (*decryptingReader, error) {
+	aead, err := newAEAD(key.dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{
+		r:         r,
+		aead:      aead,
+		skip:      skip,
+		remaining: length,
+		segment:   make([]byte, encryptedSegmentSize),
+		plain:     make([]byte, 0, encryptionSegmentSize),
+	}, nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	if d.remaining == 0 && d.err == nil {
+		d.err = io.EOF
+	}
+	for len(d.pending) == 0 || d.err != nil {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.err = d.next()
+	}
+
+	if int64(len(p)) > d.remaining {
+		p = p[:d.remaining]
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	d.remaining -= int64(n)
+	return n, nil
+}
+
+func (d *decryptingReader) next() error {
+	n, err := io.ReadFull(d.r, d.segment)
+	if err == io.EOF {
+		return errors.Wrap(io.ErrUnexpectedEOF, "encrypted object is truncated")
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return errors.Wrap(err, "failed to read encrypted object")
+	}
+
+	plain, partNumber, index, err := openSegment(d.plain[:0], d.aead, d.segment[:n])
+	if err != nil {
+		return err
+	}
+	if d.started {
+		next := partNumber == d.partNumber && index == d.index+1
+		first := partNumber > d.partNumber && index == 0
+		if !next && !first {
+			return errors.New("segments of encrypted object are out of order")
+		}
+	}
+	d.started = true
+	d.partNumber, d.index = partNumber, index
+
+	skip := min(d.skip, int64(len(plain)))
+	d.pending = plain[skip:]
+	d.skip -= skip
+	return nil
+}
+
+// serveEncryptedCreateMultipartUpload sends a CreateMultipartUpload request
+// for an encrypted object, and hands out an upload ID that carries the data
+// key of the upload.
+func (s *Server) serveEncryptedCreateMultipartUpload(w http.ResponseWriter, r *http.Request, key *objectKey) (int, error) {
+	resp, err := s.doUpstream(r)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		s.copyResponse(w, resp)
+		return resp.StatusCode, nil
+	}
+
+	var result struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadID string `xml:"UploadId"`
+	}
+	if err := decodeS3Response(resp, &result); err != nil {
+		return 0, err
+	}
+	if result.UploadID, err = encryptedUploadID(result.UploadID, key); err != nil {
+		return 0, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(result); err != nil {
+		return 0, err
+	}
+
+	copyResponseHeaders(w, resp.Header)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		s.logger.Warn("failed to write response", mlog.Err(err))
+	}
+	return http.StatusOK, nil
+}
+
+// decryptResponse decrypts the response of a GetObject or HeadObject request
+// if the object is encrypted. A range of an encrypted object is read by
+// requesting the segments that cover it once the size of the object is known
+// from the first response.
+func (s *Server) decryptResponse(r *http.Request, resp *http.Response) (*http.Response, error) {
+	key, err := s.objectKeyFromHeader(resp.Header)
+	if err != nil || key == nil {
+		if err != nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+	removeChecksumHeaders(resp.Header)
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return resp, nil
+	}
+	if r.URL.Query().Has("partNumber") {
+		resp.Body.Close()
+		return nil, &s3Error{StatusCode: http.StatusNotImplemented, Code: "NotImplemented", Message: "Reading parts of encrypted objects is not supported."}
+	}
+
+	encrypted := resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent {
+		encrypted, err = contentRangeSize(resp.Header.Get("Content-Range"))
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	size, err := decryptedSize(encrypted)
+	if err == nil && key.size >= 0 && size != key.size {
+		err = errors.Errorf("encrypted object is truncated: %d bytes instead of %d", size, key.size)
+	}
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	rangeHeader := r.Header.Get("Range")
+	if r.Method == http.MethodHead || rangeHeader == "" || resp.StatusCode != http.StatusPartialContent {
+		resp.StatusCode = http.StatusOK
+		resp.Header.Del("Content-Range")
+		resp.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+		resp.ContentLength = size
+		if r.Method == http.MethodGet {
+			if resp.Body, err = decryptBody(resp.Body, key, 0, size); err != nil {
+				return nil, err
+			}
+		}
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	rng, _, err := parseRange(rangeHeader, size)
+	if err != nil {
+		return nil, &s3Error{StatusCode: http.StatusRequestedRangeNotSatisfiable, Code: "InvalidRange", Message: "The requested range is not satisfiable"}
+	}
+	first := rng.start / encryptionSegmentSize
+	last := rng.end / encryptionSegmentSize
+	start := first * encryptedSegmentSize
+	end := min((last+1)*encryptedSegmentSize, encrypted) - 1
+
+	// The segments must come from the object the size was taken from.
+	r.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if etag := resp.Header.Get("ETag"); etag != "" && r.Header.Get("If-Match") == "" {
+		r.Header.Set("If-Match", etag)
+	}
+	resp, err = s.doUpstream(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		return nil, errors.Wrap(parseS3Error(resp), "failed to get the segments of an encrypted range")
+	}
+	removeChecksumHeaders(resp.Header)
+
+	length := rng.end - rng.start + 1
+	resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rng.start, rng.end, size))
+	resp.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	resp.ContentLength = length
+	if resp.Body, err = decryptBody(resp.Body, key, rng.start-first*encryptionSegmentSize, length); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// decryptBody replaces an encrypted response body by its decryption.
+func decryptBody(body io.ReadCloser, key *objectKey, skip, length int64) (io.ReadCloser, error) {
+	dec, err := newDecryptingReader(body, key, skip, length)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{dec, body}, nil
+}
+
+// removeBodyHeaders removes the headers describing the body sent by
+// the client, before the body is replaced by one computed from it.
+func removeBodyHeaders(r *http.Request) {
+	removeChecksumHeaders(r.Header)
+	r.Header.Del("Content-Md5")
+	r.Header.Del("X-Amz-Sdk-Checksum-Algorithm")
+	r.Header.Del("X-Amz-Decoded-Content-Length")
+	removeAWSChunkedEncoding(r.Header)
+	// The trailing checksums of aws-chunked uploads are still read by the
+	// decoder, but they are not sent.
+	r.Trailer = nil
+}
+
+// removeChecksumHeaders removes the X-Amz-Checksum-* headers. The checksums
+// of what S3 stores don't match what the client sends or gets back.
+func removeChecksumHeaders(header http.Header) {
+	for name := range header {
+		if strings.HasPrefix(name, "X-Amz-Checksum-") {
+			header.Del(name)
+		}
+	}
+}
+
+// contentRangeSize returns the complete size from a Content-Range header.
+func contentRangeSize(contentRange string) (int64, error) {
+	_, total, ok := strings.Cut(contentRange, "/")
+	size, err := strconv.ParseInt(total, 10, 64)
+	if !ok || err != nil {
+		return 0, errors.Errorf("invalid Content-Range %q", contentRange)
+	}
+	return size, nil
+}
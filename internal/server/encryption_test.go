@@ -0,0 +1,439 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newEncryptionTestServer returns a server whose installation inst has the
+// master key inst-1. Other installations aren't encrypted.
+func newEncryptionTestServer(t *testing.T) (*Server, *fakeS3, string) {
+	keyFile := filepath.Join(t.TempDir(), "keys.json")
+	key := make([]byte, dataKeySize)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	content := fmt.Sprintf(`{"Keys": {"inst-1": %q}, "Installations": {"inst": "inst-1"}}`, base64.StdEncoding.EncodeToString(key))
+	require.NoError(t, os.WriteFile(keyFile, []byte(content), 0600))
+
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{})
+	s.keys, err = newFileKeyStore(keyFile, s.logger)
+	require.NoError(t, err)
+	return s, fake, keyFile
+}
+
+func serveRequest(handler http.HandlerFunc, method, path string, body []byte, header http.Header) *http.Response {
+	req := httptest.NewRequest(method, "http://example.com/agnivatest"+path, bytes.NewReader(body))
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w.Result()
+}
+
+func TestEncryptedSize(t *testing.T) {
+	for _, size := range []int64{0, 1, encryptionSegmentSize - 1, encryptionSegmentSize, encryptionSegmentSize + 1, 10*encryptionSegmentSize + 5} {
+		decrypted, err := decryptedSize(encryptedSize(size))
+		require.NoError(t, err)
+		assert.Equal(t, size, decrypted)
+	}
+	assert.Equal(t, int64(encryptedSegmentSize+1+segmentOverhead), encryptedSize(encryptionSegmentSize+1))
+
+	_, err := decryptedSize(encryptedSegmentSize + segmentOverhead)
+	assert.Error(t, err)
+}
+
+func TestEncryptingReader(t *testing.T) {
+	key := &objectKey{dataKey: make([]byte, dataKeySize)}
+	content := make([]byte, 3*encryptionSegmentSize+100)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	encrypt := func(t *testing.T, header http.Header) ([]byte, error) {
+		req := httptest.NewRequest("PUT", "http://example.com/inst/a", bytes.NewReader(content))
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		require.NoError(t, encryptRequestBody(req, key, 0))
+		assert.Equal(t, encryptedSize(int64(len(content))), req.ContentLength)
+		return io.ReadAll(req.Body)
+	}
+	decrypt := func(encrypted []byte, skip, length int64) ([]byte, error) {
+		dec, err := newDecryptingReader(bytes.NewReader(encrypted), key, skip, length)
+		require.NoError(t, err)
+		return io.ReadAll(dec)
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		encrypted, err := encrypt(t, nil)
+		require.NoError(t, err)
+		require.Len(t, encrypted, int(encryptedSize(int64(len(content)))))
+
+		decrypted, err := decrypt(encrypted, 0, int64(len(content)))
+		require.NoError(t, err)
+		assert.Equal(t, content, decrypted)
+
+		decrypted, err = decrypt(encrypted[encryptedSegmentSize:], 10, 100)
+		require.NoError(t, err)
+		assert.Equal(t, content[encryptionSegmentSize+10:encryptionSegmentSize+110], decrypted)
+	})
+
+	t.Run("checksums are verified before the last segment", func(t *testing.T) {
+		sha := sha256.Sum256(content)
+		encrypted, err := encrypt(t, http.Header{"X-Amz-Content-Sha256": {hex.EncodeToString(sha[:])}})
+		require.NoError(t, err)
+		assert.Len(t, encrypted, int(encryptedSize(int64(len(content)))))
+
+		encrypted, err = encrypt(t, http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(make([]byte, md5.Size))}})
+		var s3Err *s3Error
+		require.ErrorAs(t, err, &s3Err)
+		assert.Equal(t, "BadDigest", s3Err.Code)
+		assert.Len(t, encrypted, 3*encryptedSegmentSize)
+	})
+
+	t.Run("tampered segments are rejected", func(t *testing.T) {
+		encrypted, err := encrypt(t, nil)
+		require.NoError(t, err)
+
+		tampered := bytes.Clone(encrypted)
+		tampered[encryptedSegmentSize+100] ^= 1
+		_, err = decrypt(tampered, 0, int64(len(content)))
+		assert.Error(t, err)
+
+		reordered := bytes.Clone(encrypted)
+		copy(reordered, encrypted[encryptedSegmentSize:2*encryptedSegmentSize])
+		copy(reordered[encryptedSegmentSize:], encrypted[:encryptedSegmentSize])
+		_, err = decrypt(reordered, 0, int64(len(content)))
+		assert.Error(t, err)
+
+		_, err = decrypt(encrypted[:2*encryptedSegmentSize], 0, int64(len(content)))
+		assert.Error(t, err)
+	})
+}
+
+func TestEncryptedObjects(t *testing.T) {
+	s, fake, _ := newEncryptionTestServer(t)
+	handler := s.handler()
+
+	content := make([]byte, 200000)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+	sha := sha256.Sum256(content)
+
+	resp := serveRequest(handler, "PUT", "/inst/a", content, http.Header{
+		"Content-Type":         {"video/mp4"},
+		"X-Amz-Content-Sha256": {hex.EncodeToString(sha[:])},
+	})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	obj := fake.object("inst/a")
+	require.NotNil(t, obj)
+	assert.Len(t, obj.data, int(encryptedSize(int64(len(content)))))
+	assert.False(t, bytes.Contains(obj.data, content[:100]))
+	assert.Equal(t, encryptionScheme, obj.header.Get(encryptionHeader))
+	assert.Equal(t, "inst-1", obj.header.Get(encryptionKeyIDHeader))
+	assert.Equal(t, "video/mp4", obj.header.Get("Content-Type"))
+
+	t.Run("get", func(t *testing.T) {
+		resp := serveRequest(handler, "GET", "/inst/a", nil, nil)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, content, body)
+		assert.Equal(t, "200000", resp.Header.Get("Content-Length"))
+		assert.Equal(t, "video/mp4", resp.Header.Get("Content-Type"))
+		assert.Empty(t, resp.Header.Get(encryptionHeader))
+		assert.Empty(t, resp.Header.Get(wrappedKeyHeader))
+	})
+
+	t.Run("head", func(t *testing.T) {
+		resp := serveRequest(handler, "HEAD", "/inst/a", nil, nil)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "200000", resp.Header.Get("Content-Length"))
+		assert.Empty(t, resp.Header.Get(encryptionKeyIDHeader))
+	})
+
+	t.Run("ranges", func(t *testing.T) {
+		for _, test := range []struct {
+			rangeHeader string
+			start, end  int
+		}{
+			{"bytes=0-9", 0, 9},
+			{"bytes=65530-65545", 65530, 65545},
+			{"bytes=-100", 199900, 199999},
+			{"bytes=199990-", 199990, 199999},
+			{"bytes=100000-300000", 100000, 199999},
+		} {
+			t.Run(test.rangeHeader, func(t *testing.T) {
+				resp := serveRequest(handler, "GET", "/inst/a", nil, http.Header{"Range": {test.rangeHeader}})
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+
+				assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+				assert.Equal(t, content[test.start:test.end+1], body)
+				assert.Equal(t, fmt.Sprintf("bytes %d-%d/200000", test.start, test.end), resp.Header.Get("Content-Range"))
+			})
+		}
+
+		resp := serveRequest(handler, "GET", "/inst/a", nil, http.Header{"Range": {"bytes=200001-"}})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+	})
+
+	t.Run("truncated objects are rejected", func(t *testing.T) {
+		assert.Equal(t, "200000", obj.header.Get(encryptedSizeHeader))
+		fake.put("inst/truncated", obj.data[:3*encryptedSegmentSize], obj.header.Clone())
+
+		resp := serveRequest(handler, "GET", "/inst/truncated", nil, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+		resp = serveRequest(handler, "GET", "/inst/truncated", nil, http.Header{"Range": {"bytes=0-9"}})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	})
+
+	t.Run("unsealed objects are rejected", func(t *testing.T) {
+		key, err := s.newObjectKey("inst", -1)
+		require.NoError(t, err)
+		req := httptest.NewRequest("PUT", "http://example.com/inst/unsealed", bytes.NewReader(content))
+		require.NoError(t, encryptRequestBody(req, key, 0))
+		data, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		header := make(http.Header)
+		key.setHeader(header)
+		assert.Equal(t, encryptionScheme, header.Get(encryptionHeader))
+		assert.Empty(t, header.Get(encryptedSizeHeader))
+		fake.put("inst/unsealed", data, header)
+
+		resp := serveRequest(handler, "GET", "/inst/unsealed", nil, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		resp := serveRequest(handler, "PUT", "/inst/bad", content, http.Header{
+			"Content-Md5": {base64.StdEncoding.EncodeToString(make([]byte, md5.Size))},
+		})
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Nil(t, fake.object("inst/bad"))
+	})
+
+	t.Run("installations without a key are not encrypted", func(t *testing.T) {
+		resp := serveRequest(handler, "PUT", "/other/a", content[:100], http.Header{
+			encryptionHeader: {encryptionScheme},
+		})
+		resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		obj := fake.object("other/a")
+		require.NotNil(t, obj)
+		assert.Equal(t, content[:100], obj.data)
+		assert.Empty(t, obj.header.Get(encryptionHeader))
+	})
+
+	t.Run("copy with replaced metadata", func(t *testing.T) {
+		resp := serveRequest(handler, "PUT", "/other/copy", nil, http.Header{
+			"X-Amz-Copy-Source":        {"/agnivatest/inst/a"},
+			"X-Amz-Metadata-Directive": {"REPLACE"},
+			"Content-Type":             {"text/plain"},
+		})
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = serveRequest(handler, "GET", "/other/copy", nil, nil)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, content, body)
+		assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	})
+}
+
+func TestEncryptedMultipartUpload(t *testing.T) {
+	s, fake, _ := newEncryptionTestServer(t)
+	handler := s.handler()
+
+	content := make([]byte, 2*encryptionSegmentSize+1000)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	create := func(t *testing.T) string {
+		resp := serveRequest(handler, "POST", "/inst/mp?uploads", nil, http.Header{"Content-Type": {"video/mp4"}})
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var result initiateMultipartUploadResult
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&result))
+		require.True(t, strings.HasPrefix(result.UploadID, encryptedUploadIDPrefix))
+		return result.UploadID
+	}
+	uploadPart := func(t *testing.T, uploadID string, partNumber int, data []byte) string {
+		resp := serveRequest(handler, "PUT", fmt.Sprintf("/inst/mp?partNumber=%d&uploadId=%s", partNumber, uploadID), data, nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp.Header.Get("ETag")
+	}
+	complete := func(uploadID string, etags ...string) *http.Response {
+		var body strings.Builder
+		body.WriteString(`<CompleteMultipartUpload xmlns="http://s3.amazonaws.com/doc/2006-03-01/">`)
+		for i, etag := range etags {
+			fmt.Fprintf(&body, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, xmlEscape(etag))
+		}
+		body.WriteString("</CompleteMultipartUpload>")
+		return serveRequest(handler, "POST", "/inst/mp?uploadId="+uploadID, []byte(body.String()), nil)
+	}
+
+	t.Run("upload and read", func(t *testing.T) {
+		uploadID := create(t)
+		etag1 := uploadPart(t, uploadID, 1, content[:2*encryptionSegmentSize])
+		etag2 := uploadPart(t, uploadID, 2, content[2*encryptionSegmentSize:])
+		resp := complete(uploadID, etag1, etag2)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var result completeMultipartUploadResult
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&result))
+
+		// The object is sealed with its size, and keeps the ETag of the
+		// completed upload.
+		obj := fake.object("inst/mp")
+		require.NotNil(t, obj)
+		assert.Equal(t, "inst-1", obj.header.Get(encryptionKeyIDHeader))
+		assert.Equal(t, encryptionScheme, obj.header.Get(encryptionHeader))
+		assert.Equal(t, strconv.Itoa(len(content)), obj.header.Get(encryptedSizeHeader))
+		assert.Equal(t, "video/mp4", obj.header.Get("Content-Type"))
+
+		resp = serveRequest(handler, "HEAD", "/inst/mp", nil, http.Header{"If-Match": {result.ETag}})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, result.ETag, resp.Header.Get("ETag"))
+
+		resp = serveRequest(handler, "GET", "/inst/mp", nil, nil)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, content, body)
+
+		resp = serveRequest(handler, "GET", "/inst/mp", nil, http.Header{"Range": {"bytes=131000-131100"}})
+		defer resp.Body.Close()
+		body, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, content[131000:131101], body)
+
+		// Without its last part, the object is too short.
+		fake.put("inst/mp-truncated", obj.data[:2*encryptedSegmentSize], obj.header.Clone())
+		resp = serveRequest(handler, "GET", "/inst/mp-truncated", nil, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	})
+
+	t.Run("parts must be made of full segments", func(t *testing.T) {
+		uploadID := create(t)
+		etag1 := uploadPart(t, uploadID, 1, content[:1000])
+		etag2 := uploadPart(t, uploadID, 2, content[1000:])
+		resp := complete(uploadID, etag1, etag2)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = serveRequest(handler, "DELETE", "/inst/mp?uploadId="+uploadID, nil, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		assert.Empty(t, fake.uploads)
+	})
+
+	t.Run("part copies are rejected", func(t *testing.T) {
+		uploadID := create(t)
+		resp := serveRequest(handler, "PUT", "/inst/mp?partNumber=1&uploadId="+uploadID, nil, http.Header{
+			"X-Amz-Copy-Source": {"/agnivatest/inst/mp"},
+		})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+	})
+
+	t.Run("unknown upload ID", func(t *testing.T) {
+		resp := serveRequest(handler, "PUT", "/inst/mp?partNumber=1&uploadId="+encryptedUploadIDPrefix+"!!", content[:10], nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("upload IDs of S3 are rejected", func(t *testing.T) {
+		uploadID := create(t)
+		s3UploadID, _, _, ok, err := parseEncryptedUploadID(uploadID)
+		require.True(t, ok)
+		require.NoError(t, err)
+
+		resp := serveRequest(handler, "PUT", "/inst/mp?partNumber=1&uploadId="+s3UploadID, content[:10], nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		fake.put("inst/plain", content[:10], nil)
+		resp = serveRequest(handler, "PUT", "/inst/mp?partNumber=1&uploadId="+s3UploadID, nil, http.Header{
+			"X-Amz-Copy-Source": {"/agnivatest/inst/plain"},
+		})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		resp = complete(s3UploadID)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Empty(t, fake.uploads[s3UploadID].parts)
+
+		// They are enough to list the parts and abort the upload.
+		resp = serveRequest(handler, "GET", "/inst/mp?uploadId="+s3UploadID, nil, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = serveRequest(handler, "DELETE", "/inst/mp?uploadId="+s3UploadID, nil, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		// Installations without a key use them as they are.
+		resp = serveRequest(handler, "POST", "/other/mp?uploads", nil, nil)
+		defer resp.Body.Close()
+		var result initiateMultipartUploadResult
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&result))
+		resp = serveRequest(handler, "PUT", "/other/mp?partNumber=1&uploadId="+result.UploadID, content[:10], nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("objects that can't be sealed are deleted", func(t *testing.T) {
+		fake.mu.Lock()
+		fake.failCopies = true
+		fake.mu.Unlock()
+		defer func() { fake.failCopies = false }()
+
+		uploadID := create(t)
+		etag := uploadPart(t, uploadID, 1, content)
+		resp := complete(uploadID, etag)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		assert.Nil(t, fake.object("inst/mp"))
+	})
+}
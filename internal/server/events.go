@@ -0,0 +1,569 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+// Names of the events, as in S3 event notifications.
+const (
+	eventObjectCreatedPut      = "ObjectCreated:Put"
+	eventObjectCreatedCopy     = "ObjectCreated:Copy"
+	eventObjectCreatedComplete = "ObjectCreated:CompleteMultipartUpload"
+	eventObjectRemovedDelete   = "ObjectRemoved:Delete"
+	// eventObjectRejectedMalware isn't an S3 event: it audits the objects
+	// rejected because malware was found in them.
+	eventObjectRejectedMalware = "ObjectRejected:Malware"
+)
+
+// Defaults of the event settings left at zero.
+const (
+	defaultEventQueueSize            = 10000
+	defaultWebhookMaxAttempts        = 5
+	defaultWebhookRetryBackoff       = time.Second
+	defaultWebhookTimeout            = 10 * time.Second
+	maxWebhookRetryBackoff           = time.Minute
+	maxEventJournalBatch             = 100
+	maxEventResponseBodySize   int64 = 4 * 1024 * 1024
+)
+
+// webhookSignatureHeader carries the HMAC-SHA256 of the body of webhook
+// requests, keyed with the secret of the webhook.
+const webhookSignatureHeader = "X-Bifrost-Signature"
+
+// eventRecord is an event in the shape of the records of S3 event
+// notifications. The principal of the user identity is the installation.
+type eventRecord struct {
+	EventVersion      string              `json:"eventVersion"`
+	EventSource       string              `json:"eventSource"`
+	AWSRegion         string              `json:"awsRegion"`
+	EventTime         string              `json:"eventTime"`
+	EventName         string              `json:"eventName"`
+	UserIdentity      eventIdentity       `json:"userIdentity"`
+	RequestParameters eventRequest        `json:"requestParameters"`
+	ResponseElements  eventResponse       `json:"responseElements"`
+	S3                eventS3Notification `json:"s3"`
+	ScanEventData     *eventScanData      `json:"scanEventData,omitempty"`
+}
+
+// eventScanData tells what an ObjectRejected:Malware event was found in.
+type eventScanData struct {
+	Operation string `json:"operation"`
+	Threat    string `json:"threat"`
+}
+
+type eventIdentity struct {
+	PrincipalID string `json:"principalId"`
+}
+
+type eventRequest struct {
+	SourceIPAddress string `json:"sourceIPAddress"`
+}
+
+type eventResponse struct {
+	RequestID string `json:"x-amz-request-id"`
+	HostID    string `json:"x-amz-id-2"`
+}
+
+type eventS3Notification struct {
+	SchemaVersion   string      `json:"s3SchemaVersion"`
+	ConfigurationID string      `json:"configurationId"`
+	Bucket          eventBucket `json:"bucket"`
+	Object          eventObject `json:"object"`
+}
+
+type eventBucket struct {
+	Name          string        `json:"name"`
+	OwnerIdentity eventIdentity `json:"ownerIdentity"`
+	ARN           string        `json:"arn"`
+}
+
+// eventObject describes the object of an event. As in S3, the key is URL
+// encoded, and removed objects have no size nor ETag.
+type eventObject struct {
+	Key       string `json:"key"`
+	Size      int64  `json:"size,omitempty"`
+	ETag      string `json:"eTag,omitempty"`
+	VersionID string `json:"versionId,omitempty"`
+	Sequencer string `json:"sequencer"`
+}
+
+// eventNotification is the body of webhook requests.
+type eventNotification struct {
+	Records []eventRecord `json:"Records"`
+}
+
+// deadLetter is a line of the dead-letter file.
+type deadLetter struct {
+	Webhook  string      `json:"webhook"`
+	Error    string      `json:"error"`
+	FailedAt time.Time   `json:"failed_at"`
+	Record   eventRecord `json:"record"`
+}
+
+// eventEmitter appends events to the journal, and sends them to the
+// webhooks once they are in it. Every webhook gets the events one at a
+// time, in order. Events that can't be delivered after the retries, or that
+// don't fit in the queue of a webhook, are written to the dead-letter file.
+type eventEmitter struct {
+	cfg     EventSettings
+	bucket  string
+	region  string
+	client  *http.Client
+	metrics *metrics
+	logger  *mlog.Logger
+
+	journal    *os.File
+	deadLetter *os.File
+	deadMu     sync.Mutex
+
+	records  chan eventRecord
+	webhooks []*webhook
+	sequence uint64
+	// feed, if any, gets the events once they are in the journal.
+	feed *changeFeed
+
+	// ctx is cancelled when the emitter closes, to give up on deliveries.
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type webhook struct {
+	url    string
+	name   string
+	secret string
+	queue  chan eventRecord
+}
+
+func newEventEmitter(cfg EventSettings, s3Settings AmazonS3Settings, m *metrics, logger *mlog.Logger) (*eventEmitter, error) {
+	queueSize := cfg.QueueSize
+	if queueSize == 0 {
+		queueSize = defaultEventQueueSize
+	}
+	timeout := time.Duration(cfg.WebhookTimeoutSecs) * time.Second
+	if timeout == 0 {
+		timeout = defaultWebhookTimeout
+	}
+
+	e := &eventEmitter{
+		cfg:     cfg,
+		bucket:  s3Settings.Bucket,
+		region:  s3Settings.Region,
+		client:  &http.Client{Timeout: timeout},
+		metrics: m,
+		logger:  logger,
+		records: make(chan eventRecord, queueSize),
+		done:    make(chan struct{}),
+	}
+	e.sequence = uint64(time.Now().UnixNano())
+
+	var err error
+	if e.journal, err = os.OpenFile(cfg.JournalFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		return nil, errors.Wrap(err, "failed to open event journal")
+	}
+	if cfg.DeadLetterFile != "" {
+		if e.deadLetter, err = os.OpenFile(cfg.DeadLetterFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+			e.journal.Close()
+			return nil, errors.Wrap(err, "failed to open event dead-letter file")
+		}
+	}
+
+	for _, settings := range cfg.Webhooks {
+		// The name is the host, which is safe to log and to use as a label,
+		// unlike a URL that may hold credentials.
+		u, _ := url.Parse(settings.URL)
+		e.webhooks = append(e.webhooks, &webhook{
+			url:    settings.URL,
+			name:   u.Host,
+			secret: settings.Secret,
+			queue:  make(chan eventRecord, queueSize),
+		})
+	}
+
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	go e.run()
+	return e, nil
+}
+
+// emit queues the event. It blocks while the queue is full.
+func (e *eventEmitter) emit(record eventRecord) {
+	e.metrics.incEvent(record.EventName)
+	e.records <- record
+}
+
+// close writes the events left in the queue to the journal, and gives up on
+// the ones that haven't been delivered yet, which go to the dead-letter
+// file. Nothing must be emitted once close has been called.
+func (e *eventEmitter) close() {
+	e.cancel()
+	close(e.records)
+	<-e.done
+	e.journal.Close()
+	if e.deadLetter != nil {
+		e.deadLetter.Close()
+	}
+}
+
+func (e *eventEmitter) run() {
+	var wg sync.WaitGroup
+	for _, hook := range e.webhooks {
+		wg.Add(1)
+		go func(hook *webhook) {
+			defer wg.Done()
+			e.deliver(hook)
+		}(hook)
+	}
+
+	for record := range e.records {
+		// The journal is synced once for all the events that are waiting.
+		batch := []eventRecord{record}
+	drain:
+		for len(batch) < maxEventJournalBatch {
+			select {
+			case record, ok := <-e.records:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, record)
+			default:
+				break drain
+			}
+		}
+
+		// Sequencers are given here, so that they follow the order of the
+		// journal, which the change feed relies on.
+		for i := range batch {
+			e.sequence++
+			batch[i].S3.Object.Sequencer = fmt.Sprintf("%016X", e.sequence)
+		}
+		if err := e.writeJournal(batch); err != nil {
+			e.logger.Error("failed to write events to the journal", mlog.Int("events", len(batch)), mlog.Err(err))
+		}
+		if e.feed != nil {
+			e.feed.add(batch)
+		}
+		for _, record := range batch {
+			for _, hook := range e.webhooks {
+				select {
+				case hook.queue <- record:
+				default:
+					e.writeDeadLetter(hook, record, errors.New("webhook queue is full"))
+				}
+			}
+		}
+	}
+
+	for _, hook := range e.webhooks {
+		close(hook.queue)
+	}
+	wg.Wait()
+	close(e.done)
+}
+
+// writeJournal appends the events to the journal, one JSON record per line.
+func (e *eventEmitter) writeJournal(batch []eventRecord) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, record := range batch {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	if _, err := e.journal.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return e.journal.Sync()
+}
+
+func (e *eventEmitter) deliver(hook *webhook) {
+	for record := range hook.queue {
+		err := e.post(hook, record)
+		if err != nil {
+			e.writeDeadLetter(hook, record, err)
+			continue
+		}
+		e.metrics.incWebhookDelivery(hook.name, "success")
+	}
+}
+
+// post sends the event to the webhook, and retries with an exponential
+// backoff until it is accepted with a 2xx status code.
+func (e *eventEmitter) post(hook *webhook, record eventRecord) error {
+	body, err := json.Marshal(eventNotification{Records: []eventRecord{record}})
+	if err != nil {
+		return err
+	}
+
+	maxAttempts := e.cfg.WebhookMaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = defaultWebhookMaxAttempts
+	}
+	backoff := time.Duration(e.cfg.WebhookRetryBackoffMillis) * time.Millisecond
+	if backoff == 0 {
+		backoff = defaultWebhookRetryBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = e.postOnce(hook, body)
+		if err == nil || attempt == maxAttempts || e.ctx.Err() != nil {
+			return err
+		}
+		e.metrics.incWebhookDelivery(hook.name, "retry")
+		e.logger.Debug("failed to deliver event, retrying", mlog.String("webhook", hook.name), mlog.Int("attempt", attempt), mlog.Err(err))
+
+		select {
+		case <-e.ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxWebhookRetryBackoff)
+	}
+}
+
+func (e *eventEmitter) postOnce(hook *webhook, body []byte) error {
+	req, err := http.NewRequestWithContext(e.ctx, http.MethodPost, hook.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if hook.secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhookBody(hook.secret, body))
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("webhook responded with status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signWebhookBody returns the hex encoded HMAC-SHA256 of the body.
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (e *eventEmitter) writeDeadLetter(hook *webhook, record eventRecord, deliveryErr error) {
+	e.metrics.incWebhookDelivery(hook.name, "dead_letter")
+	e.logger.Warn("failed to deliver event", mlog.String("webhook", hook.name), mlog.String("event", record.EventName), mlog.String("key", record.S3.Object.Key), mlog.Err(deliveryErr))
+	if e.deadLetter == nil {
+		return
+	}
+
+	line, err := json.Marshal(deadLetter{Webhook: hook.url, Error: deliveryErr.Error(), FailedAt: time.Now().UTC(), Record: record})
+	if err != nil {
+		e.logger.Error("failed to encode dead letter", mlog.Err(err))
+		return
+	}
+	e.deadMu.Lock()
+	defer e.deadMu.Unlock()
+	if _, err := e.deadLetter.Write(append(line, '\n')); err != nil {
+		e.logger.Error("failed to write dead letter", mlog.Err(err))
+	}
+}
+
+// newRecord returns the event for the object with the given key, which
+// includes the installation.
+func (e *eventEmitter) newRecord(name, key string) eventRecord {
+	installationID, _, _ := strings.Cut(key, "/")
+	return eventRecord{
+		EventVersion: "2.1",
+		EventSource:  "aws:s3",
+		AWSRegion:    e.region,
+		EventTime:    time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		EventName:    name,
+		UserIdentity: eventIdentity{PrincipalID: installationID},
+		S3: eventS3Notification{
+			SchemaVersion:   "1.0",
+			ConfigurationID: "bifrost",
+			Bucket:          eventBucket{Name: e.bucket, ARN: "arn:aws:s3:::" + e.bucket},
+			Object:          eventObject{Key: eventKey(key)},
+		},
+	}
+}
+
+// eventKey URL encodes a key the way S3 does in event notifications.
+func eventKey(key string) string {
+	return strings.ReplaceAll(url.QueryEscape(key), "%2F", "/")
+}
+
+// eventWriter records the status code of the response to a request that
+// may emit events, and the body of the responses that tell what happened.
+type eventWriter struct {
+	http.ResponseWriter
+	r          *http.Request
+	op         s3Request
+	size       int64
+	deleted    []deleteObjectsEntry
+	statusCode int
+	body       bytes.Buffer
+}
+
+// deleteObjectsEntry is an object of a DeleteObjects request.
+type deleteObjectsEntry struct {
+	Key       string
+	VersionId string
+}
+
+func (w *eventWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	if w.op.Operation != opPutObject && w.op.Operation != opDeleteObject && int64(w.body.Len()) < maxEventResponseBodySize {
+		w.body.Write(p[:min(int64(len(p)), maxEventResponseBodySize-int64(w.body.Len()))])
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// prepareEvents wraps the response writer of the requests that emit events
+// when they succeed, with what is known of the request before it is sent.
+// The size of a PutObject is the one of the body the client sent.
+func (s *Server) prepareEvents(w http.ResponseWriter, r *http.Request, op s3Request) (*eventWriter, error) {
+	ew := &eventWriter{ResponseWriter: w, r: r, op: op, size: r.ContentLength}
+	switch op.Operation {
+	case opPutObject, opCopyObject, opCompleteMultipartUpload, opDeleteObject:
+	case opDeleteObjects:
+		request, err := readDeleteObjectsRequest(r)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range request.Objects {
+			ew.deleted = append(ew.deleted, deleteObjectsEntry{Key: object.Key, VersionId: object.VersionId})
+		}
+	default:
+		return nil, nil
+	}
+	return ew, nil
+}
+
+// emitEvents emits the events of a request once it has been served, if it
+// succeeded.
+func (s *Server) emitEvents(w *eventWriter) {
+	if w.statusCode < 200 || w.statusCode > 299 {
+		return
+	}
+	// The request context is cancelled once the response has been sent.
+	ctx := context.WithoutCancel(w.r.Context())
+	header := w.Header()
+	sourceIP, _, _ := net.SplitHostPort(w.r.RemoteAddr)
+	newRecord := func(name, key string) eventRecord {
+		record := s.events.newRecord(name, key)
+		record.RequestParameters.SourceIPAddress = sourceIP
+		record.ResponseElements = eventResponse{RequestID: header.Get("X-Amz-Request-Id"), HostID: header.Get("X-Amz-Id-2")}
+		return record
+	}
+
+	switch w.op.Operation {
+	case opPutObject:
+		record := newRecord(eventObjectCreatedPut, w.op.Key)
+		record.S3.Object.Size = w.size
+		record.S3.Object.ETag = strings.Trim(header.Get("ETag"), `"`)
+		record.S3.Object.VersionID = header.Get("X-Amz-Version-Id")
+		s.events.emit(record)
+
+	case opCopyObject, opCompleteMultipartUpload:
+		// Both can fail after S3 sent a 200 status code.
+		var result struct {
+			XMLName xml.Name
+		}
+		if xml.Unmarshal(w.body.Bytes(), &result) == nil && result.XMLName.Local == "Error" {
+			return
+		}
+		name := eventObjectCreatedCopy
+		if w.op.Operation == opCompleteMultipartUpload {
+			name = eventObjectCreatedComplete
+		}
+		record := newRecord(name, w.op.Key)
+		record.S3.Object.VersionID = header.Get("X-Amz-Version-Id")
+		if err := s.describeEventObject(ctx, w.op.Key, &record.S3.Object); err != nil {
+			s.logger.Warn("failed to get the size of a created object", mlog.String("key", w.op.Key), mlog.Err(err))
+		}
+		s.events.emit(record)
+
+	case opDeleteObject:
+		record := newRecord(eventObjectRemovedDelete, w.op.Key)
+		record.S3.Object.VersionID = w.r.URL.Query().Get("versionId")
+		s.events.emit(record)
+
+	case opDeleteObjects:
+		// Quiet responses only list the keys that couldn't be deleted.
+		var result struct {
+			Errors []deleteObjectsEntry `xml:"Error"`
+		}
+		if err := xml.Unmarshal(w.body.Bytes(), &result); err != nil {
+			s.logger.Warn("failed to decode the result of DeleteObjects", mlog.Err(err))
+			return
+		}
+		failed := make(map[deleteObjectsEntry]bool)
+		for _, entry := range result.Errors {
+			failed[entry] = true
+		}
+		for _, entry := range w.deleted {
+			if failed[entry] {
+				continue
+			}
+			record := newRecord(eventObjectRemovedDelete, entry.Key)
+			record.S3.Object.VersionID = entry.VersionId
+			s.events.emit(record)
+		}
+	}
+}
+
+// describeEventObject sets the size and the ETag of the object as clients
+// see it, which differ from the ones in S3 for compressed and encrypted
+// objects.
+func (s *Server) describeEventObject(ctx context.Context, key string, object *eventObject) error {
+	header, size, err := s.headObject(ctx, "/"+key)
+	if err != nil {
+		return err
+	}
+
+	object.ETag = header.Get("ETag")
+	switch {
+	case header.Get(compressionHeader) != "":
+		object.ETag = header.Get(originalETagHeader)
+		if size, err = strconv.ParseInt(header.Get(originalSizeHeader), 10, 64); err != nil {
+			return errors.Wrap(err, "invalid original size")
+		}
+	case header.Get(encryptionHeader) != "":
+		if size, err = decryptedSize(size); err != nil {
+			return err
+		}
+	}
+	object.ETag = strings.Trim(object.ETag, `"`)
+	object.Size = size
+	return nil
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventKey(t *testing.T) {
+	assert.Equal(t, "inst/data/my+file%2B1.txt", eventKey("inst/data/my file+1.txt"))
+}
+
+// readJSONLines decodes the JSON lines of the file.
+func readJSONLines[T any](t *testing.T, path string) []T {
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var values []T
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var value T
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &value))
+		values = append(values, value)
+	}
+	require.NoError(t, scanner.Err())
+	return values
+}
+
+func TestEvents(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{})
+
+	// The webhook fails the first attempt of every event.
+	var mu sync.Mutex
+	var received []eventRecord
+	attempts := make(map[string]int)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "sha256="+signWebhookBody("secret", body), r.Header.Get(webhookSignatureHeader))
+
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[string(body)]++
+		if attempts[string(body)] == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var notification eventNotification
+		require.NoError(t, json.Unmarshal(body, &notification))
+		received = append(received, notification.Records...)
+	}))
+	defer hook.Close()
+
+	dir := t.TempDir()
+	settings := EventSettings{
+		Enable:                    true,
+		JournalFile:               filepath.Join(dir, "events.jsonl"),
+		DeadLetterFile:            filepath.Join(dir, "dead.jsonl"),
+		Webhooks:                  []WebhookSettings{{URL: hook.URL, Secret: "secret"}},
+		WebhookRetryBackoffMillis: 1,
+	}
+	events, err := newEventEmitter(settings, s.cfg.S3Settings, s.metrics, s.logger)
+	require.NoError(t, err)
+	s.events = events
+	handler := s.handler()
+
+	resp := serveRequest(handler, "PUT", "/inst/a", []byte("hello"), nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = serveRequest(handler, "PUT", "/inst/copy", nil, http.Header{"X-Amz-Copy-Source": {"/agnivatest/inst/a"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Failed requests emit nothing.
+	resp = serveRequest(handler, "PUT", "/inst/copy2", nil, http.Header{"X-Amz-Copy-Source": {"/agnivatest/inst/missing"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = serveRequest(handler, "DELETE", "/inst/a", nil, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	fake.put("other/b", []byte("b"), nil)
+	body := `<Delete><Object><Key>inst/copy</Key></Object><Object><Key>other/b</Key></Object></Delete>`
+	resp = serveRequest(handler, "POST", "?delete", []byte(body), nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = serveRequest(handler, "GET", "/inst/copy", nil, nil)
+	resp.Body.Close()
+
+	deliveries := s.metrics.webhookDelivered.WithLabelValues(strings.TrimPrefix(hook.URL, "http://"), "success")
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(deliveries) == 5
+	}, 5*time.Second, time.Millisecond)
+	s.events.close()
+
+	journal := readJSONLines[eventRecord](t, settings.JournalFile)
+	require.Len(t, journal, 5)
+	mu.Lock()
+	assert.Equal(t, journal, received)
+	mu.Unlock()
+
+	put := journal[0]
+	assert.Equal(t, eventObjectCreatedPut, put.EventName)
+	assert.Equal(t, "aws:s3", put.EventSource)
+	assert.Equal(t, "inst", put.UserIdentity.PrincipalID)
+	assert.Equal(t, "agnivatest", put.S3.Bucket.Name)
+	assert.Equal(t, "inst/a", put.S3.Object.Key)
+	assert.Equal(t, int64(5), put.S3.Object.Size)
+	assert.Equal(t, "5d41402abc4b2a76b9719d911017c592", put.S3.Object.ETag)
+	assert.NotEmpty(t, put.S3.Object.Sequencer)
+
+	assert.Equal(t, eventObjectCreatedCopy, journal[1].EventName)
+	assert.Equal(t, "inst/copy", journal[1].S3.Object.Key)
+	assert.Equal(t, int64(5), journal[1].S3.Object.Size)
+	assert.Equal(t, put.S3.Object.ETag, journal[1].S3.Object.ETag)
+	assert.Less(t, put.S3.Object.Sequencer, journal[1].S3.Object.Sequencer)
+
+	for i, key := range []string{"inst/a", "inst/copy", "other/b"} {
+		assert.Equal(t, eventObjectRemovedDelete, journal[2+i].EventName)
+		assert.Equal(t, key, journal[2+i].S3.Object.Key)
+		assert.Zero(t, journal[2+i].S3.Object.Size)
+	}
+	assert.Equal(t, "other", journal[4].UserIdentity.PrincipalID)
+
+	_, err = os.Stat(settings.DeadLetterFile)
+	require.NoError(t, err)
+	assert.Empty(t, readJSONLines[deadLetter](t, settings.DeadLetterFile))
+}
+
+func TestEventsDeadLetter(t *testing.T) {
+	_, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{})
+
+	var mu sync.Mutex
+	var calls int
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer hook.Close()
+
+	dir := t.TempDir()
+	settings := EventSettings{
+		Enable:                    true,
+		JournalFile:               filepath.Join(dir, "events.jsonl"),
+		DeadLetterFile:            filepath.Join(dir, "dead.jsonl"),
+		Webhooks:                  []WebhookSettings{{URL: hook.URL}},
+		WebhookMaxAttempts:        3,
+		WebhookRetryBackoffMillis: 1,
+	}
+	events, err := newEventEmitter(settings, s.cfg.S3Settings, s.metrics, s.logger)
+	require.NoError(t, err)
+	s.events = events
+	handler := s.handler()
+
+	resp := serveRequest(handler, "PUT", "/inst/a", []byte("hello"), nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	deadLetters := s.metrics.webhookDelivered.WithLabelValues(strings.TrimPrefix(hook.URL, "http://"), "dead_letter")
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(deadLetters) == 1
+	}, 5*time.Second, time.Millisecond)
+	s.events.close()
+
+	mu.Lock()
+	assert.Equal(t, 3, calls)
+	mu.Unlock()
+	letters := readJSONLines[deadLetter](t, settings.DeadLetterFile)
+	assert.Equal(t, hook.URL, letters[0].Webhook)
+	assert.Contains(t, letters[0].Error, "500")
+	assert.Equal(t, "inst/a", letters[0].Record.S3.Object.Key)
+	assert.Len(t, readJSONLines[eventRecord](t, settings.JournalFile), 1)
+}
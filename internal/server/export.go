@@ -0,0 +1,306 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+// Archive formats of installation exports.
+const (
+	ExportFormatTar = "tar"
+	ExportFormatZip = "zip"
+)
+
+// exportContentTypes are the content types of the archive formats.
+var exportContentTypes = map[string]string{
+	ExportFormatTar: "application/x-tar",
+	ExportFormatZip: "application/zip",
+}
+
+// An export archive holds the objects under objects/, at their key within
+// the installation, followed by the manifest. Archives without a manifest
+// are incomplete.
+const (
+	exportObjectsDir   = "objects/"
+	exportManifestName = "manifest.json"
+)
+
+// ExportOptions select the objects of an export and its format.
+type ExportOptions struct {
+	Format string
+	// Prefix restricts the export to the keys under it, and StartAfter to
+	// the keys after it, to resume an interrupted export. Both are within
+	// the installation.
+	Prefix     string
+	StartAfter string
+	// Verify checks the objects against their ETag while they are exported.
+	Verify bool
+}
+
+// validate checks the options before anything is exported.
+func (o ExportOptions) validate() error {
+	if _, ok := exportContentTypes[o.Format]; !ok {
+		return &s3Error{StatusCode: http.StatusBadRequest, Code: "InvalidArgument", Message: "Unknown archive format " + o.Format + "."}
+	}
+	return nil
+}
+
+// ExportManifest lists the objects of an export archive.
+type ExportManifest struct {
+	InstallationID string           `json:"installation_id"`
+	Prefix         string           `json:"prefix,omitempty"`
+	StartAfter     string           `json:"start_after,omitempty"`
+	ExportedAt     time.Time        `json:"exported_at"`
+	Objects        []ExportedObject `json:"objects"`
+}
+
+// ExportedObject is an object of an export archive, as the clients of the
+// installation see it. The ETag is the one S3 has for the object.
+type ExportedObject struct {
+	Key          string            `json:"key"`
+	Size         int64             `json:"size"`
+	ETag         string            `json:"etag"`
+	SHA256       string            `json:"sha256"`
+	LastModified time.Time         `json:"last_modified"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// ExportReport sums up an export.
+type ExportReport struct {
+	Objects int
+	Bytes   int64
+	// Verified is the number of objects whose checksum was verified. The
+	// ETags of multipart uploads aren't checksums of the object, and can't
+	// be used to verify it.
+	Verified int
+	// Skipped is the number of objects deleted while the export was running.
+	Skipped int
+	// LastKey is the key of the last object fully written to the archive,
+	// to resume the export after if it failed.
+	LastKey string
+}
+
+// archiveWriter writes the entries of an export archive.
+type archiveWriter interface {
+	create(name string, size int64, modTime time.Time) (io.Writer, error)
+	Close() error
+}
+
+type tarArchive struct {
+	*tar.Writer
+}
+
+func (a tarArchive) create(name string, size int64, modTime time.Time) (io.Writer, error) {
+	header := &tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0o644, ModTime: modTime}
+	if err := a.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	return a.Writer, nil
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (a zipArchive) create(name string, _ int64, modTime time.Time) (io.Writer, error) {
+	header := &zip.FileHeader{Name: name, Method: zip.Store, Modified: modTime}
+	header.SetMode(0o644)
+	return a.CreateHeader(header)
+}
+
+func newArchiveWriter(format string, w io.Writer) archiveWriter {
+	if format == ExportFormatZip {
+		return zipArchive{zip.NewWriter(w)}
+	}
+	return tarArchive{tar.NewWriter(w)}
+}
+
+// ExportInstallation writes the objects of the installation, decrypted and
+// decompressed, to an archive along with their manifest. The trash isn't
+// exported. Objects deleted while the export is running are skipped. When
+// an error occurs, the archive is left without its manifest, and the report
+// tells which key to resume the export after.
+func (s *Server) ExportInstallation(ctx context.Context, installationID string, opts ExportOptions, w io.Writer) (*ExportReport, error) {
+	if installationID == "" || strings.Contains(installationID, "/") {
+		return nil, errors.Errorf("invalid installation ID %q", installationID)
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	report := &ExportReport{}
+	manifest := ExportManifest{
+		InstallationID: installationID,
+		Prefix:         opts.Prefix,
+		StartAfter:     opts.StartAfter,
+		ExportedAt:     time.Now().UTC(),
+		Objects:        []ExportedObject{},
+	}
+	archive := newArchiveWriter(opts.Format, w)
+
+	installationPrefix := installationID + "/"
+	var startAfter, token string
+	if opts.StartAfter != "" {
+		startAfter = installationPrefix + opts.StartAfter
+	}
+	for {
+		page, err := s.listObjectsV2(ctx, installationPrefix+opts.Prefix, "", startAfter, token)
+		if err != nil {
+			return report, err
+		}
+		for _, object := range page.Contents {
+			key := strings.TrimPrefix(object.Key, installationPrefix)
+			if strings.HasPrefix(key, trashPrefix) {
+				continue
+			}
+			exported, verified, err := s.exportObject(ctx, archive, key, "/"+object.Key, opts.Verify)
+			if isS3ErrorCode(err, "NoSuchKey") {
+				report.Skipped++
+				continue
+			}
+			if err != nil {
+				return report, errors.Wrapf(err, "failed to export %s", key)
+			}
+			manifest.Objects = append(manifest.Objects, *exported)
+			report.Objects++
+			report.Bytes += exported.Size
+			report.LastKey = key
+			if verified {
+				report.Verified++
+			}
+		}
+		if !page.IsTruncated {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+
+	body, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return report, err
+	}
+	entry, err := archive.create(exportManifestName, int64(len(body)), manifest.ExportedAt)
+	if err != nil {
+		return report, errors.Wrap(err, "failed to write the manifest")
+	}
+	if _, err := entry.Write(body); err != nil {
+		return report, errors.Wrap(err, "failed to write the manifest")
+	}
+	if err := archive.Close(); err != nil {
+		return report, errors.Wrap(err, "failed to close the archive")
+	}
+	return report, nil
+}
+
+// exportObject writes the object to the archive, and reports whether its
+// checksum was verified. Plain and compressed objects are verified against
+// the MD5 of their ETag, unless S3 encrypted them with KMS or customer keys.
+// Objects encrypted by Bifrost are authenticated while they are
+// decrypted, which fails if they are corrupted.
+func (s *Server) exportObject(ctx context.Context, archive archiveWriter, key, objectPath string, verify bool) (*ExportedObject, bool, error) {
+	req, err := s.newUpstreamRequest(ctx, http.MethodGet, objectPath, nil, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := s.fetchDecodedObject(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, errors.Wrap(parseS3Error(resp), "failed to get object")
+	}
+	if resp.ContentLength < 0 {
+		return nil, false, errors.New("unknown object size")
+	}
+
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	entry, err := archive.create(exportObjectsDir+key, resp.ContentLength, lastModified)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to write archive entry")
+	}
+	sha := sha256.New()
+	md := md5.New()
+	size, err := io.Copy(io.MultiWriter(entry, sha, md), resp.Body)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to copy object")
+	}
+	if size != resp.ContentLength {
+		return nil, false, errors.Errorf("read %d bytes of %d", size, resp.ContentLength)
+	}
+
+	exported := &ExportedObject{
+		Key:          key,
+		Size:         size,
+		ETag:         strings.Trim(resp.Header.Get("ETag"), `"`),
+		SHA256:       hex.EncodeToString(sha.Sum(nil)),
+		LastModified: lastModified.UTC(),
+		Metadata:     exportedMetadata(resp.Header),
+	}
+	if !verify {
+		return exported, false, nil
+	}
+	switch {
+	case resp.Header.Get(encryptionHeader) != "" && resp.Header.Get(compressionHeader) == "":
+		return exported, true, nil
+	case hasMD5ETag(resp.Header):
+		if sum := hex.EncodeToString(md.Sum(nil)); sum != exported.ETag {
+			return nil, false, errors.Errorf("checksum mismatch: the MD5 of the object is %s, its ETag %s", sum, exported.ETag)
+		}
+		return exported, true, nil
+	default:
+		s.logger.Debug("can't verify exported object", mlog.String("object", objectPath), mlog.String("etag", exported.ETag))
+		return exported, false, nil
+	}
+}
+
+// hasMD5ETag reports whether the ETag of the object is its MD5. The ETags
+// recorded by Bifrost are, but the ones of S3 aren't for multipart uploads,
+// nor for objects encrypted with KMS or customer-provided keys.
+func hasMD5ETag(header http.Header) bool {
+	etag := strings.Trim(header.Get("ETag"), `"`)
+	if _, err := hex.DecodeString(etag); err != nil || len(etag) != 2*md5.Size {
+		return false
+	}
+	if header.Get(originalETagHeader) != "" {
+		return true
+	}
+	switch header.Get(sseHeader) {
+	case "aws:kms", "aws:kms:dsse":
+		return false
+	}
+	return header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") == ""
+}
+
+// exportedMetadata returns the metadata of the object the clients set, by
+// header. The metadata of Bifrost and the encryption and storage class of
+// the bucket aren't part of it.
+func exportedMetadata(header http.Header) map[string]string {
+	var metadata map[string]string
+	for name, values := range objectMetadata(header) {
+		switch {
+		case strings.HasPrefix(name, bifrostMetadataPrefix), name == sseHeader, name == sseKMSKeyIDHeader, name == storageClassHeader:
+			continue
+		}
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		metadata[name] = values[0]
+	}
+	return metadata
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readTarArchive returns the entries of a tar archive by name.
+func readTarArchive(t *testing.T, data []byte) map[string][]byte {
+	entries := make(map[string][]byte)
+	reader := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return entries
+		}
+		require.NoError(t, err)
+		entries[header.Name], err = io.ReadAll(reader)
+		require.NoError(t, err)
+	}
+}
+
+// readZipArchive returns the entries of a zip archive by name.
+func readZipArchive(t *testing.T, data []byte) map[string][]byte {
+	entries := make(map[string][]byte)
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	for _, file := range reader.File {
+		rc, err := file.Open()
+		require.NoError(t, err)
+		entries[file.Name], err = io.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+	}
+	return entries
+}
+
+func exportManifest(t *testing.T, entries map[string][]byte) ExportManifest {
+	var manifest ExportManifest
+	require.Contains(t, entries, exportManifestName)
+	require.NoError(t, json.Unmarshal(entries[exportManifestName], &manifest))
+	return manifest
+}
+
+func TestExportInstallation(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{})
+
+	fake.put("inst/a", []byte("first"), http.Header{"Content-Type": {"text/plain"}, "X-Amz-Meta-Owner": {"bob"}, installationMetadataHeader: {"inst"}})
+	fake.put("inst/dir/b", []byte("second"), nil)
+	fake.put("inst/dir/c", []byte("third"), nil).etag = `"0123456789abcdef0123456789abcdef-2"`
+	fake.put("inst/.trash/20240101T000000.000000000Z/d", []byte("trashed"), nil)
+	fake.put("other/e", []byte("other"), nil)
+	// The ETags of objects encrypted with KMS aren't their MD5.
+	fake.put("inst/kms", []byte("fourth"), http.Header{sseHeader: {"aws:kms"}}).etag = `"0123456789abcdef0123456789abcdef"`
+
+	var buf bytes.Buffer
+	report, err := s.ExportInstallation(context.Background(), "inst", ExportOptions{Format: ExportFormatTar, Verify: true}, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, &ExportReport{Objects: 4, Bytes: 22, Verified: 2, LastKey: "kms"}, report)
+
+	entries := readTarArchive(t, buf.Bytes())
+	assert.Len(t, entries, 5)
+	assert.Equal(t, "first", string(entries["objects/a"]))
+	assert.Equal(t, "second", string(entries["objects/dir/b"]))
+	assert.Equal(t, "third", string(entries["objects/dir/c"]))
+	manifest := exportManifest(t, entries)
+	assert.Equal(t, "inst", manifest.InstallationID)
+	require.Len(t, manifest.Objects, 4)
+	first := manifest.Objects[0]
+	assert.Equal(t, "a", first.Key)
+	assert.Equal(t, int64(5), first.Size)
+	assert.Equal(t, "8b04d5e3775d298e78455efc5ca404d5", first.ETag)
+	assert.Equal(t, "a7937b64b8caa58f03721bb6bacf5c78cb235febe0e70b1b84cd99541461a08e", first.SHA256)
+	assert.Equal(t, map[string]string{"Content-Type": "text/plain", "X-Amz-Meta-Owner": "bob"}, first.Metadata)
+
+	// Exports can be restricted to a prefix and resumed after a key.
+	buf.Reset()
+	report, err = s.ExportInstallation(context.Background(), "inst", ExportOptions{Format: ExportFormatZip, Prefix: "dir/", StartAfter: "dir/b"}, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Objects)
+	assert.Equal(t, 0, report.Verified)
+	entries = readZipArchive(t, buf.Bytes())
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "third", string(entries["objects/dir/c"]))
+	manifest = exportManifest(t, entries)
+	assert.Equal(t, "dir/", manifest.Prefix)
+	assert.Equal(t, "dir/b", manifest.StartAfter)
+
+	// Corrupted objects fail the export, which is left without a manifest.
+	fake.object("inst/dir/b").data = []byte("SECOND")
+	buf.Reset()
+	report, err = s.ExportInstallation(context.Background(), "inst", ExportOptions{Format: ExportFormatTar, Verify: true}, &buf)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum mismatch")
+	assert.Equal(t, "a", report.LastKey)
+
+	_, err = s.ExportInstallation(context.Background(), "inst", ExportOptions{Format: "rar"}, &buf)
+	assert.True(t, isS3ErrorCode(err, "InvalidArgument"))
+	_, err = s.ExportInstallation(context.Background(), "", ExportOptions{Format: ExportFormatTar}, &buf)
+	assert.Error(t, err)
+}
+
+func TestExportEncryptedInstallation(t *testing.T) {
+	s, _, _ := newEncryptionTestServer(t)
+	handler := s.handler()
+
+	resp := serveRequest(handler, "PUT", "/inst/a", []byte("secret"), http.Header{"X-Amz-Meta-Owner": {"bob"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var buf bytes.Buffer
+	report, err := s.ExportInstallation(context.Background(), "inst", ExportOptions{Format: ExportFormatTar, Verify: true}, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Verified)
+	entries := readTarArchive(t, buf.Bytes())
+	assert.Equal(t, "secret", string(entries["objects/a"]))
+	manifest := exportManifest(t, entries)
+	require.Len(t, manifest.Objects, 1)
+	assert.Equal(t, int64(6), manifest.Objects[0].Size)
+	assert.Equal(t, "bob", manifest.Objects[0].Metadata["X-Amz-Meta-Owner"])
+}
+
+func TestAdminExport(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{})
+	router := newAdminRouter(s)
+
+	fake.put("inst/a", []byte("first"), nil)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/installations/inst/export", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	s.cfg.ExportSettings.Enable = true
+	router = newAdminRouter(s)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/installations/inst/export?format=zip&verify=true", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="inst.zip"`, w.Header().Get("Content-Disposition"))
+	entries := readZipArchive(t, w.Body.Bytes())
+	assert.Equal(t, "first", string(entries["objects/a"]))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/installations/inst/export", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-tar", w.Header().Get("Content-Type"))
+	assert.Len(t, readTarArchive(t, w.Body.Bytes()), 2)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/installations/inst/export?format=rar", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,513 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type fakeObject struct {
+	data         []byte
+	header       http.Header
+	etag         string
+	lastModified time.Time
+}
+
+// fakeVersion is a noncurrent version or a delete marker. The current
+// versions are the objects, whose version ID is "null".
+type fakeVersion struct {
+	key          string
+	versionID    string
+	deleteMarker bool
+}
+
+type fakeUpload struct {
+	key       string
+	header    http.Header
+	parts     map[int][]byte
+	initiated time.Time
+}
+
+// fakeS3 is a minimal in-memory S3 bucket served with virtual-host style
+// paths, just enough to exercise the requests Bifrost sends on its own.
+type fakeS3 struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	objects  map[string]*fakeObject
+	uploads  map[string]*fakeUpload
+	versions []fakeVersion
+	nextID   int
+	requests []string
+
+	// failPart makes UploadPart fail for the given part number.
+	failPart int
+	// failCopies makes CopyObject fail.
+	failCopies bool
+	// failDeletes is the number of keys DeleteObjects fails to delete
+	// before it succeeds.
+	failDeletes int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{
+		t:       t,
+		objects: make(map[string]*fakeObject),
+		uploads: make(map[string]*fakeUpload),
+	}
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+	return f, ts
+}
+
+// newFakeS3Server returns a server whose only endpoint is ts.
+func newFakeS3Server(t *testing.T, ts *httptest.Server, cfg Config) *Server {
+	cfg.S3Settings.AccessKeyID = "AKIA2AccessKey"
+	cfg.S3Settings.SecretAccessKey = "start/secretkey/end"
+	cfg.S3Settings.Region = "us-east-1"
+	cfg.S3Settings.Scheme = "http"
+	cfg.S3Settings.Bucket = "agnivatest"
+
+	s := &Server{
+		logger:    mlog.NewTestingLogger(t, os.Stderr),
+		cfg:       cfg,
+		getHostFn: func(_, _ string) string { return strings.TrimPrefix(ts.URL, "http://") },
+		client:    http.DefaultClient,
+		creds: credentials.NewStatic(cfg.S3Settings.AccessKeyID,
+			cfg.S3Settings.SecretAccessKey, "", credentials.SignatureV4),
+		metrics: newMetrics(),
+	}
+	s.upstreams = s.newUpstreamPool()
+	return s
+}
+
+func (f *fakeS3) put(key string, data []byte, header http.Header) *fakeObject {
+	sum := md5.Sum(data)
+	obj := &fakeObject{
+		data:         data,
+		header:       header,
+		etag:         `"` + hex.EncodeToString(sum[:]) + `"`,
+		lastModified: time.Now().UTC(),
+	}
+	f.objects[key] = obj
+	return obj
+}
+
+func (f *fakeS3) object(key string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[key]
+}
+
+func (f *fakeS3) writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256") {
+		f.writeError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	query := r.URL.Query()
+	f.requests = append(f.requests, r.Method+" "+r.URL.RequestURI())
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := "upload-" + strconv.Itoa(f.nextID)
+		f.uploads[id] = &fakeUpload{key: key, header: r.Header.Clone(), parts: make(map[int][]byte), initiated: time.Now().UTC()}
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>agnivatest</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, key, id)
+
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		if partNumber == f.failPart {
+			f.writeError(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		if copySource := r.Header.Get("X-Amz-Copy-Source"); copySource != "" {
+			obj, ok := f.objects[strings.TrimPrefix(copySource, "/agnivatest/")]
+			if !ok {
+				f.writeError(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			if match := r.Header.Get("X-Amz-Copy-Source-If-Match"); match != "" && match != obj.etag {
+				f.writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+				return
+			}
+			var start, end int
+			fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end)
+			body = append([]byte(nil), obj.data[start:end+1]...)
+			upload.parts[partNumber] = body
+			sum := md5.Sum(body)
+			fmt.Fprintf(w, `<CopyPartResult><ETag>"%s"</ETag></CopyPartResult>`, hex.EncodeToString(sum[:]))
+			return
+		}
+		upload.parts[partNumber] = body
+		sum := md5.Sum(body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var complete completeMultipartUpload
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			f.writeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var data []byte
+		var sums []byte
+		for i, part := range complete.Parts {
+			if part.PartNumber != i+1 {
+				f.writeError(w, http.StatusBadRequest, "InvalidPartOrder")
+				return
+			}
+			partData := upload.parts[part.PartNumber]
+			sum := md5.Sum(partData)
+			if `"`+hex.EncodeToString(sum[:])+`"` != part.ETag {
+				f.writeError(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			data = append(data, partData...)
+			sums = append(sums, sum[:]...)
+		}
+		obj := f.put(upload.key, data, upload.header)
+		sum := md5.Sum(sums)
+		obj.etag = fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(complete.Parts))
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>`, key, obj.etag)
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		if _, ok := f.uploads[query.Get("uploadId")]; !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodGet && key == "" && query.Has("uploads"):
+		f.listMultipartUploads(w, query.Get("prefix"), query.Get("delimiter"), query.Get("key-marker"))
+
+	case r.Method == http.MethodGet && query.Has("uploadId"):
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok || upload.key != key {
+			f.writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		f.listParts(w, upload)
+
+	case r.Method == http.MethodGet && key == "" && query.Has("versions"):
+		f.listObjectVersions(w, query.Get("prefix"), query.Get("key-marker"), query.Get("version-id-marker"))
+
+	case r.Method == http.MethodGet && key == "":
+		f.listObjects(w, query.Get("prefix"), query.Get("delimiter"), query.Get("start-after"), query.Get("continuation-token"))
+
+	case r.Method == http.MethodPost && key == "" && query.Has("delete"):
+		f.deleteObjects(w, body)
+
+	case r.Method == http.MethodGet && query.Has("tagging"):
+		obj, ok := f.objects[key]
+		if !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		tags, _ := url.ParseQuery(obj.header.Get("X-Amz-Tagging"))
+		var tagging objectTagging
+		for key := range tags {
+			tagging.TagSet = append(tagging.TagSet, objectTag{Key: key, Value: tags.Get(key)})
+		}
+		xml.NewEncoder(w).Encode(tagging)
+
+	case r.Method == http.MethodPut && query.Has("tagging"):
+		obj, ok := f.objects[key]
+		if !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		var tagging objectTagging
+		if err := xml.Unmarshal(body, &tagging); err != nil {
+			f.writeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		tags := make(url.Values)
+		for _, tag := range tagging.TagSet {
+			tags.Set(tag.Key, tag.Value)
+		}
+		obj.header = obj.header.Clone()
+		if obj.header == nil {
+			obj.header = make(http.Header)
+		}
+		obj.header.Set("X-Amz-Tagging", tags.Encode())
+
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		if f.failCopies {
+			f.writeError(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		source := strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/agnivatest/")
+		obj, ok := f.objects[source]
+		if !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if match := r.Header.Get("X-Amz-Copy-Source-If-Match"); match != "" && match != obj.etag {
+			f.writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		header := obj.header
+		if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			header = r.Header.Clone()
+		}
+		if r.Header.Get("X-Amz-Tagging-Directive") == "REPLACE" {
+			header = header.Clone()
+			if header == nil {
+				header = make(http.Header)
+			}
+			header.Set("X-Amz-Tagging", r.Header.Get("X-Amz-Tagging"))
+		}
+		copied := f.put(key, append([]byte(nil), obj.data...), header)
+		fmt.Fprintf(w, `<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>`, copied.etag)
+
+	case r.Method == http.MethodPut:
+		obj := f.put(key, body, r.Header.Clone())
+		w.Header().Set("ETag", obj.etag)
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := f.objects[key]
+		if !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for name, values := range obj.header {
+			if strings.HasPrefix(name, "X-Amz-Meta-") || name == "Content-Type" || name == sseHeader {
+				w.Header()[name] = values
+			}
+		}
+		w.Header().Set("ETag", obj.etag)
+		http.ServeContent(w, r, "", obj.lastModified, bytes.NewReader(obj.data))
+
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		f.writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) listObjects(w http.ResponseWriter, prefix, delimiter, startAfter, token string) {
+	if token != "" {
+		startAfter = token
+	}
+	// Common prefixes are returned along with the keys, as entries that sort
+	// like their prefix.
+	var keys []string
+	prefixes := make(map[string]bool)
+	for key := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			key = key[:len(prefix)+i+1]
+			if prefixes[key] || key <= startAfter {
+				continue
+			}
+			prefixes[key] = true
+		} else if key <= startAfter {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	const maxKeys = 2
+	truncated := len(keys) > maxKeys
+	if truncated {
+		keys = keys[:maxKeys]
+	}
+
+	fmt.Fprintf(w, `<ListBucketResult><KeyCount>%d</KeyCount>`, len(keys))
+	for _, key := range keys {
+		if prefixes[key] {
+			fmt.Fprintf(w, `<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>`, key)
+			continue
+		}
+		obj := f.objects[key]
+		fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>%d</Size><ETag>%s</ETag><LastModified>%s</LastModified></Contents>`,
+			key, len(obj.data), xmlEscape(obj.etag), obj.lastModified.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, `<IsTruncated>%t</IsTruncated>`, truncated)
+	if truncated {
+		fmt.Fprintf(w, `<NextContinuationToken>%s</NextContinuationToken>`, keys[len(keys)-1])
+	}
+	fmt.Fprint(w, `</ListBucketResult>`)
+}
+
+func (f *fakeS3) listMultipartUploads(w http.ResponseWriter, prefix, delimiter, keyMarker string) {
+	var ids []string
+	prefixes := make(map[string]bool)
+	for id, upload := range f.uploads {
+		if !strings.HasPrefix(upload.key, prefix) || upload.key <= keyMarker {
+			continue
+		}
+		if i := strings.Index(upload.key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			prefixes[upload.key[:len(prefix)+i+1]] = true
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return f.uploads[ids[i]].key < f.uploads[ids[j]].key })
+
+	const maxUploads = 2
+	truncated := len(ids) > maxUploads
+	if truncated {
+		ids = ids[:maxUploads]
+	}
+
+	fmt.Fprint(w, `<ListMultipartUploadsResult>`)
+	for _, id := range ids {
+		upload := f.uploads[id]
+		fmt.Fprintf(w, `<Upload><Key>%s</Key><UploadId>%s</UploadId><Initiated>%s</Initiated></Upload>`,
+			upload.key, id, upload.initiated.Format(time.RFC3339))
+	}
+	for prefix := range prefixes {
+		fmt.Fprintf(w, `<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>`, prefix)
+	}
+	fmt.Fprintf(w, `<IsTruncated>%t</IsTruncated>`, truncated)
+	if truncated {
+		last := ids[len(ids)-1]
+		fmt.Fprintf(w, `<NextKeyMarker>%s</NextKeyMarker><NextUploadIdMarker>%s</NextUploadIdMarker>`, f.uploads[last].key, last)
+	}
+	fmt.Fprint(w, `</ListMultipartUploadsResult>`)
+}
+
+func (f *fakeS3) listParts(w http.ResponseWriter, upload *fakeUpload) {
+	var numbers []int
+	for number := range upload.parts {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	fmt.Fprint(w, `<ListPartsResult>`)
+	for _, number := range numbers {
+		fmt.Fprintf(w, `<Part><PartNumber>%d</PartNumber><Size>%d</Size></Part>`, number, len(upload.parts[number]))
+	}
+	fmt.Fprint(w, `<IsTruncated>false</IsTruncated></ListPartsResult>`)
+}
+
+func (f *fakeS3) listObjectVersions(w http.ResponseWriter, prefix, keyMarker, versionIDMarker string) {
+	var versions []fakeVersion
+	for key := range f.objects {
+		versions = append(versions, fakeVersion{key: key, versionID: "null"})
+	}
+	versions = append(versions, f.versions...)
+	versions = slices.DeleteFunc(versions, func(v fakeVersion) bool {
+		return !strings.HasPrefix(v.key, prefix) || v.key < keyMarker || (v.key == keyMarker && v.versionID <= versionIDMarker)
+	})
+	sort.Slice(versions, func(i, j int) bool {
+		if versions[i].key != versions[j].key {
+			return versions[i].key < versions[j].key
+		}
+		return versions[i].versionID < versions[j].versionID
+	})
+
+	const maxKeys = 2
+	truncated := len(versions) > maxKeys
+	if truncated {
+		versions = versions[:maxKeys]
+	}
+
+	fmt.Fprint(w, `<ListVersionsResult>`)
+	for _, v := range versions {
+		element := "Version"
+		if v.deleteMarker {
+			element = "DeleteMarker"
+		}
+		fmt.Fprintf(w, `<%s><Key>%s</Key><VersionId>%s</VersionId></%s>`, element, v.key, v.versionID, element)
+	}
+	fmt.Fprintf(w, `<IsTruncated>%t</IsTruncated>`, truncated)
+	if truncated {
+		last := versions[len(versions)-1]
+		fmt.Fprintf(w, `<NextKeyMarker>%s</NextKeyMarker><NextVersionIdMarker>%s</NextVersionIdMarker>`, last.key, last.versionID)
+	}
+	fmt.Fprint(w, `</ListVersionsResult>`)
+}
+
+func (f *fakeS3) deleteObjects(w http.ResponseWriter, body []byte) {
+	var req struct {
+		Quiet   bool
+		Objects []struct {
+			Key       string
+			VersionId string
+		} `xml:"Object"`
+	}
+	if err := xml.Unmarshal(body, &req); err != nil {
+		f.writeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	fmt.Fprint(w, `<DeleteResult>`)
+	for _, obj := range req.Objects {
+		if f.failDeletes > 0 {
+			f.failDeletes--
+			fmt.Fprintf(w, `<Error><Key>%s</Key><VersionId>%s</VersionId><Code>InternalError</Code></Error>`, obj.Key, obj.VersionId)
+			continue
+		}
+		if obj.VersionId == "" || obj.VersionId == "null" {
+			delete(f.objects, obj.Key)
+		} else {
+			f.versions = slices.DeleteFunc(f.versions, func(v fakeVersion) bool {
+				return v.key == obj.Key && v.versionID == obj.VersionId
+			})
+		}
+		if !req.Quiet {
+			fmt.Fprintf(w, `<Deleted><Key>%s</Key></Deleted>`, obj.Key)
+		}
+	}
+	fmt.Fprint(w, `</DeleteResult>`)
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	_ = xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
@@ -5,9 +5,10 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"fmt"
-	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -22,11 +23,36 @@ import (
 )
 
 func (s *Server) handler() http.HandlerFunc {
-	// We need a separate function to compute the host so that we can override
-	// it during testing. And we don't want to have a variable for this because
-	// later we can have a dynamic mapping between requests and buckets, in which
-	// case we need to compute the host for every request.
-	host := s.getHostFn(s.cfg.S3Settings.Bucket, s.cfg.S3Settings.Endpoint)
+	// The hosts of the upstream endpoints are computed with getHostFn so
+	// that we can override it during testing. The endpoint, and with it the
+	// host, is picked for every request.
+	if s.upstreams == nil {
+		s.upstreams = s.newUpstreamPool()
+	}
+	if s.coalescer == nil && s.cfg.CoalescingSettings.Enable {
+		s.coalescer = newCoalescer(s.cfg.CoalescingSettings, s.metrics, s.logger)
+	}
+	if s.states == nil {
+		// A store without a file can't fail to load.
+		s.states, _ = newStateStore("")
+	}
+	if s.moves == nil {
+		s.moves = newMoveLocks()
+	}
+	if s.splitMemory == nil {
+		s.splitMemory = newSplitMemory(s.cfg.MultipartSplitSettings)
+	}
+	if s.massDeletes == nil && s.cfg.MassDeleteSettings.Enable {
+		s.massDeletes = newMassDeleteDetector(s.cfg.MassDeleteSettings, s.states, s.metrics, s.logger)
+	}
+	if s.scanner == nil && s.cfg.ScanSettings.Enable {
+		timeout := time.Duration(s.cfg.ScanSettings.TimeoutSecs) * time.Second
+		if timeout == 0 {
+			timeout = defaultScanTimeout
+		}
+		// The URL has already been validated by Config.IsValid.
+		s.scanner, _ = newICAPClient(s.cfg.ScanSettings.ICAPURL, timeout)
+	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -41,13 +67,34 @@ func (s *Server) handler() http.HandlerFunc {
 			installationID = s[2]
 		}
 
-		if s.cfg.ServiceSettings.RequestValidation {
+		// The flow controllers only learn from the requests that were
+		// actually sent upstream.
+		var tracker *upstreamTracker
+		if s.flow != nil {
+			tracker = &upstreamTracker{}
+			r = r.WithContext(withUpstreamTracker(r.Context(), tracker))
+		}
+
+		// Requests Bifrost sends to itself on behalf of an installation
+		// don't come from one of its clients.
+		internal := isInternalRequest(r)
+
+		if s.cfg.ServiceSettings.RequestValidation && !internal {
 			if err := s.validateRequestMatchesInstallationID(r, installationID); err != nil {
 				s.writeError(w, errors.Wrap(err, "installation ID request validation failed"))
 				return
 			}
 		}
 
+		if s.cfg.ServiceSettings.TLSClientAuth != TLSClientAuthNone && !internal {
+			if err := s.validateClientCertificate(r, installationID); err != nil {
+				s.writeError(w, errors.Wrap(err, "client certificate validation failed"))
+				return
+			}
+		}
+
+		op := classifyRequest(r, s.cfg.S3Settings.Bucket)
+
 		// Strip the bucket name from the path which gets added by Minio
 		// if the S3 hostname does not match a URL pattern.
 		objectName := strings.TrimPrefix(r.URL.Path, "/"+s.cfg.S3Settings.Bucket)
@@ -69,7 +116,9 @@ func (s *Server) handler() http.HandlerFunc {
 		// We have to do it here, within Bifrost, and not from Mattermost, otherwise we're
 		// effectively just double escaping. While that works to avoid the signature
 		// mismatch, it changes the lookup paths for previously created files.
-		urlStr := s.cfg.S3Settings.Scheme + "://" + host + s3utils.EncodePath(objectName)
+		//
+		// The host is filled in once the upstream endpoint has been picked.
+		urlStr := s.cfg.S3Settings.Scheme + "://" + s3utils.EncodePath(objectName)
 		if len(r.URL.RawQuery) > 0 {
 			urlStr += "?" + r.URL.RawQuery
 		}
@@ -82,31 +131,207 @@ func (s *Server) handler() http.HandlerFunc {
 
 		originalURL := r.URL
 		r.URL = targetURL
-		r.Host = host
 		// Wiping out RequestURI
 		r.RequestURI = ""
+		s.prepareUpstreamHeaders(r)
+		if err = prepareAWSChunked(r); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		removeBifrostMetadata(r.Header)
+
+		if err := s.guardDeletion(r, op, installationID); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		if s.policies != nil {
+			if err := s.checkPolicies(r, op); err != nil {
+				s.writeError(w, err)
+				return
+			}
+		}
+		if err := s.guardRequest(r, op, installationID); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		s.applyHeaderPolicies(r, op)
+		if s.cfg.InjectionSettings.Enable {
+			if err := s.injectObjectSettings(r, op, installationID); err != nil {
+				s.writeError(w, err)
+				return
+			}
+		}
+
+		recordWrite, err := s.guardWrites(r, op, installationID)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		if recordWrite != nil {
+			defer func() {
+				if statusCode >= 200 && statusCode < 300 {
+					recordWrite()
+				}
+			}()
+		}
+
+		if s.events != nil {
+			ew, err := s.prepareEvents(w, r, op)
+			if err != nil {
+				s.writeError(w, err)
+				return
+			}
+			if ew != nil {
+				w = ew
+				defer s.emitEvents(ew)
+			}
+		}
 
 		s.logger.Debug("received request", mlog.String("method", r.Method), mlog.String("url", originalURL.String()), mlog.String("target_url", targetURL.String()))
 
-		// Get credentials.
-		val, err := s.creds.Get()
+		// The time to the response headers is what tells whether the upstream
+		// is overloaded, but the concurrency slot is held until the body has
+		// been copied.
+		var upstreamLatency time.Duration
+		if s.flow != nil {
+			release, err := s.flow.acquire(installationID)
+			if err != nil {
+				statusCode = http.StatusServiceUnavailable
+				s.writeError(w, err)
+				return
+			}
+			defer func() {
+				release(tracker.get(), upstreamLatency)
+			}()
+		}
+
+		// Requests are checked and recorded as the client sent them, and only
+		// then routed to where the objects of moving installations are.
+		route, err := s.routeMove(r, &op)
 		if err != nil {
 			s.writeError(w, err)
 			return
 		}
+		if route != nil {
+			objectName = "/" + op.Key
+			defer func() {
+				route.done(statusCode)
+			}()
+		}
 
-		if s.isUsingIAMRoleCredentials() {
-			s.cfg.S3Settings.AccessKeyID = val.AccessKeyID
-			s.cfg.S3Settings.SecretAccessKey = val.SecretAccessKey
+		if s.cfg.TrashSettings.Enable {
+			if err = s.prepareTrash(r, op); err != nil {
+				s.writeError(w, err)
+				return
+			}
+		}
+
+		if s.keys != nil || s.cfg.CompressionSettings.Enable || s.scanner != nil {
+			if err = s.prepareCopy(r, op); err != nil {
+				s.writeError(w, err)
+				return
+			}
 		}
 
-		// Need to sign the header, just before sending it
-		r = signer.SignV4(*r, s.cfg.S3Settings.AccessKeyID,
-			s.cfg.S3Settings.SecretAccessKey,
-			val.SessionToken,
-			s.cfg.S3Settings.Region)
+		// The metadata of the copies is set after the one of their source
+		// has been copied.
+		if s.cfg.TaggingSettings.Enable {
+			if err = s.prepareTagging(r, op, installationID); err != nil {
+				s.writeError(w, err)
+				return
+			}
+		}
 
-		resp, err := s.client.Do(r)
+		if s.scanEligible(installationID) {
+			cleanup, err := s.prepareScan(r, op)
+			if err != nil {
+				s.writeError(w, err)
+				return
+			}
+			defer cleanup()
+		}
+
+		if s.compressionEligible(r, op, installationID) {
+			etag, cleanup, err := s.prepareCompression(r)
+			if err != nil {
+				s.writeError(w, err)
+				return
+			}
+			defer cleanup()
+			if etag != "" {
+				w = &etagWriter{ResponseWriter: w, etag: etag}
+			}
+		}
+
+		var uploadKey *objectKey
+		if s.keys != nil {
+			if uploadKey, err = s.prepareEncryption(r, op, installationID); err != nil {
+				s.writeError(w, err)
+				return
+			}
+		}
+
+		if uploadKey != nil && op.Operation == opCreateMultipartUpload {
+			code, err := s.serveEncryptedCreateMultipartUpload(w, r, uploadKey)
+			if err != nil {
+				s.writeError(w, err)
+				return
+			}
+			statusCode = code
+			elapsed = float64(time.Since(start)) / float64(time.Second)
+			return
+		}
+
+		if s.multipartSplitEligible(r, op) {
+			code, err := s.serveMultipartPut(w, r, objectName)
+			if err != nil {
+				s.writeError(w, err)
+				return
+			}
+			statusCode = code
+			elapsed = float64(time.Since(start)) / float64(time.Second)
+			return
+		}
+
+		if s.parallelGetEligible(r) {
+			if code, ok := s.serveParallelGet(w, r); ok {
+				statusCode = code
+				elapsed = float64(time.Since(start)) / float64(time.Second)
+				return
+			}
+		}
+
+		if s.coalesceEligible(op) {
+			code, latency, err := s.coalescer.serve(w, r, func(ctx context.Context) (*http.Response, error) {
+				return s.fetchObject(r.Clone(ctx))
+			})
+			upstreamLatency = latency
+			if err != nil {
+				s.writeError(w, err)
+				return
+			}
+			statusCode = code
+			elapsed = float64(time.Since(start)) / float64(time.Second)
+			return
+		}
+
+		upstreamStart := time.Now()
+		var resp *http.Response
+		switch {
+		case op.Operation == opGetObject || op.Operation == opHeadObject:
+			resp, err = s.fetchObject(r)
+		case route != nil && route.listing:
+			resp, err = s.fetchMovedListing(r, route)
+		case s.cfg.TrashSettings.Enable && (op.Operation == opListObjects || op.Operation == opListObjectsV2):
+			resp, err = s.fetchListing(r)
+		case op.Operation == opCompleteMultipartUpload && uploadKey != nil:
+			resp, err = s.completeEncryptedMultipartUpload(r, op, installationID, uploadKey)
+		case op.Operation == opCompleteMultipartUpload && s.scanEligible(installationID):
+			resp, err = s.completeScannedMultipartUpload(r, op)
+		default:
+			resp, err = s.doUpstream(r)
+		}
+		upstreamLatency = time.Since(upstreamStart)
 		if err != nil {
 			s.writeError(w, err)
 			return
@@ -114,19 +339,164 @@ func (s *Server) handler() http.HandlerFunc {
 		defer resp.Body.Close()
 		statusCode = resp.StatusCode
 
-		// We copy over the response headers
-		for key, value := range resp.Header {
-			w.Header().Set(key, strings.Join(value, ", "))
+		s.copyResponse(w, resp)
+		elapsed = float64(time.Since(start)) / float64(time.Second)
+	}
+}
+
+// fetchObject sends a GetObject or HeadObject request, and returns the
+// object as the client sees it. Objects that weren't scanned for malware
+// when they were written are scanned before they are served, if ScanOnRead
+// is set.
+func (s *Server) fetchObject(r *http.Request) (*http.Response, error) {
+	resp, err := s.fetchDecodedObject(r)
+	if err != nil {
+		return nil, err
+	}
+	if s.scanOnReadEligible(r, resp) {
+		if resp, err = s.scanObjectResponse(r, resp); err != nil {
+			return nil, err
 		}
+	}
+	removeBifrostMetadata(resp.Header)
+	return resp, nil
+}
+
+// fetchDecodedObject sends a GetObject or HeadObject request, and decrypts
+// and decompresses the response if the object is stored encrypted or
+// compressed. Conditions on the ETag are checked by Bifrost when compression,
+// multipart splitting or encryption is enabled, since the client only knows
+// the ETag of the original object. The metadata of Bifrost is left in the
+// response.
+func (s *Server) fetchDecodedObject(r *http.Request) (*http.Response, error) {
+	var conditions http.Header
+	if s.cfg.CompressionSettings.Enable || s.cfg.MultipartSplitSettings.Enable || s.keys != nil {
+		conditions = takeETagConditions(r.Header)
+	}
+	rangeHeader := r.Header.Get("Range")
+
+	resp, err := s.doUpstream(r)
+	if err != nil {
+		return nil, err
+	}
 
-		w.WriteHeader(resp.StatusCode)
+	if r.Method == http.MethodGet && rangeHeader != "" && s.cfg.CompressionSettings.Enable {
+		if resp, err = s.fetchCompressedRange(r, resp); err != nil {
+			return nil, err
+		}
+	}
 
-		_, err = io.Copy(w, resp.Body)
+	if s.keys != nil {
+		if resp, err = s.decryptResponse(r, resp); err != nil {
+			return nil, err
+		}
+	}
+	if resp, err = s.decompressResponse(r, resp, rangeHeader); err != nil {
+		return nil, err
+	}
+	if etag := resp.Header.Get(originalETagHeader); etag != "" {
+		resp.Header.Set("ETag", etag)
+	}
+	if err = checkETagConditions(conditions, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// fetchCompressedRange requests the whole object again if the response to a
+// ranged GetObject is a range of a compressed object, which has to be read
+// from the start. The whole object must be the one the range came from. S3
+// can't satisfy ranges past the end of a compressed object either, which may
+// still be within the original object.
+func (s *Server) fetchCompressedRange(r *http.Request, resp *http.Response) (*http.Response, error) {
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && resp.Header.Get(compressionHeader) != "":
+		r.Header.Set("If-Match", resp.Header.Get("ETag"))
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+	default:
+		return resp, nil
+	}
+	resp.Body.Close()
+	r.Header.Del("Range")
+
+	resp, err := s.doUpstream(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, errors.Wrap(parseS3Error(resp), "failed to get a compressed object")
+	}
+	if resp.Header.Get(compressionHeader) == "" {
+		resp.Body.Close()
+		return nil, &s3Error{StatusCode: http.StatusRequestedRangeNotSatisfiable, Code: "InvalidRange", Message: "The requested range is not satisfiable"}
+	}
+	return resp, nil
+}
+
+// doUpstream sends the request to one of the upstream endpoints. The host of
+// the request is set to the chosen endpoint before signing, so that the
+// signature always matches the endpoint the request is actually sent to.
+// Requests without a body are retried on another endpoint after a connection
+// error.
+func (s *Server) doUpstream(r *http.Request) (*http.Response, error) {
+	tried := make(map[*upstream]bool)
+	for {
+		u := s.upstreams.pick(tried)
+		if u == nil {
+			return nil, errors.New("no S3 endpoint available")
+		}
+		tried[u] = true
+
+		r.URL.Host = u.host
+		r.Host = u.host
+
+		signed, err := s.signRequest(r)
 		if err != nil {
-			s.logger.Warn("failed to copy response body", mlog.Err(err))
+			s.upstreams.done(u, 0, nil)
+			return nil, err
 		}
-		elapsed = float64(time.Since(start)) / float64(time.Second)
+
+		resp, err := s.client.Do(signed)
+		if err != nil {
+			s.upstreams.done(u, 0, err)
+			if isReplayable(r) && len(tried) < len(s.upstreams.list()) {
+				s.logger.Warn("failed to reach S3 endpoint, trying another one", mlog.String("endpoint", u.endpoint), mlog.Err(err))
+				continue
+			}
+			// Clients that went away don't say anything about S3.
+			if r.Context().Err() == nil {
+				recordUpstreamOutcome(r.Context(), 0, err)
+			}
+			return nil, err
+		}
+		s.upstreams.record(u, resp.StatusCode, nil)
+		recordUpstreamOutcome(r.Context(), resp.StatusCode, nil)
+		resp.Body = &upstreamBody{ReadCloser: resp.Body, release: func() { s.upstreams.release(u) }}
+
+		return resp, nil
+	}
+}
+
+// signRequest signs the request for S3 with the current credentials. The
+// host of the request must already be set.
+func (s *Server) signRequest(r *http.Request) (*http.Request, error) {
+	val, err := s.creds.Get()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get credentials")
 	}
+
+	if isSignedStreamingPayload(r.Header.Get("X-Amz-Content-Sha256")) {
+		return s.signStreamingRequest(r, val), nil
+	}
+
+	return signer.SignV4(*r, val.AccessKeyID, val.SecretAccessKey, val.SessionToken, s.cfg.S3Settings.Region), nil
+}
+
+// isReplayable reports whether the request can be sent again after a failed
+// attempt, which is only the case if it has no body.
+func isReplayable(r *http.Request) bool {
+	return r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0
 }
 
 func (s *Server) getHost(bucket, endPoint string) string {
@@ -137,14 +507,40 @@ func (s *Server) isUsingIAMRoleCredentials() bool {
 	return s.cfg.S3Settings.AccessKeyID == "" && s.cfg.S3Settings.SecretAccessKey == ""
 }
 
-func (s *Server) writeError(w http.ResponseWriter, sourceErr error) {
-	s.logger.Error("error", mlog.Err(sourceErr))
+// s3Error is an error that is returned to the client with a specific S3 error
+// code and status code, instead of the default internal error.
+type s3Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+}
 
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func (s *Server) writeError(w http.ResponseWriter, sourceErr error) {
+	statusCode := http.StatusInternalServerError
 	resp := minio.ErrorResponse{
 		Code:       strconv.Itoa(http.StatusInternalServerError),
 		Message:    sourceErr.Error(),
 		BucketName: s.cfg.S3Settings.Bucket,
 	}
+
+	var s3Err *s3Error
+	if errors.As(sourceErr, &s3Err) {
+		s.logger.Warn("request rejected", mlog.Err(sourceErr))
+		statusCode = s3Err.StatusCode
+		resp.Code = s3Err.Code
+		resp.Message = s3Err.Message
+		if s3Err.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(s3Err.RetryAfter.Seconds()))))
+		}
+	} else {
+		s.logger.Error("error", mlog.Err(sourceErr))
+	}
+
 	// We write an XML response back to the client to match what AWS would return.
 	var buf bytes.Buffer
 	buf.WriteString(xml.Header)
@@ -153,13 +549,29 @@ func (s *Server) writeError(w http.ResponseWriter, sourceErr error) {
 		s.logger.Error("failed to encode error body", mlog.Err(err))
 		return
 	}
-	w.WriteHeader(http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
 	_, err = w.Write(buf.Bytes())
 	if err != nil {
 		s.logger.Warn("failed to write error response", mlog.Err(err))
 	}
 }
 
+type internalRequestKey struct{}
+
+// withInternalRequest marks the requests made with the context as sent by
+// Bifrost itself to its handler, on behalf of an installation. Clients
+// can't set the context of their requests.
+func withInternalRequest(ctx context.Context) context.Context {
+	return context.WithValue(ctx, internalRequestKey{}, true)
+}
+
+// isInternalRequest reports whether the request was sent by Bifrost itself.
+func isInternalRequest(r *http.Request) bool {
+	internal, _ := r.Context().Value(internalRequestKey{}).(bool)
+	return internal
+}
+
 func (s *Server) validateRequestMatchesInstallationID(r *http.Request, installationID string) error {
 	addr := strings.Split(r.RemoteAddr, ":")[0]
 	names, err := s.lookupAddrFn(addr)
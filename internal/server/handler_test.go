@@ -418,9 +418,7 @@ func TestValidateRequest(t *testing.T) {
 	s := &Server{
 		logger: mlog.NewTestingLogger(t, os.Stderr),
 		cfg: Config{
-			ServiceSettings{RequestValidationExpectedNameSuffix: "svc.cluster.local."},
-			AmazonS3Settings{},
-			LogSettings{},
+			ServiceSettings: ServiceSettings{RequestValidationExpectedNameSuffix: "svc.cluster.local."},
 		},
 	}
 
@@ -0,0 +1,140 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultICAPPort = "1344"
+	icapChunkSize   = 64 * 1024
+)
+
+// icapClient scans bodies with an ICAP server (RFC 3507), such as c-icap
+// with ClamAV. Every scan is a RESPMOD request of its own, with the body
+// encapsulated in an HTTP response.
+type icapClient struct {
+	url     string
+	host    string
+	address string
+	timeout time.Duration
+}
+
+func newICAPClient(rawURL string, timeout time.Duration) (*icapClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid ICAP URL")
+	}
+	if u.Scheme != "icap" || u.Host == "" {
+		return nil, errors.Errorf("invalid ICAP URL %q", rawURL)
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), defaultICAPPort)
+	}
+	return &icapClient{url: u.String(), host: u.Host, address: address, timeout: timeout}, nil
+}
+
+// scan sends the body, of the object at key, to the ICAP server. It returns
+// the name of the threat the server found in it, or an empty string if the
+// body is clean. The server tells that the body is clean by not modifying
+// it, and that it isn't by replacing it.
+func (c *icapClient) scan(ctx context.Context, key string, body io.Reader, size int64) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to connect to the ICAP server")
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	// The encapsulated request tells the server which object it scans.
+	reqHeader := "GET " + (&url.URL{Path: "/" + key}).EscapedPath() + " HTTP/1.1\r\nHost: bifrost\r\n\r\n"
+	resHeader := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\n\r\n", size)
+
+	w := bufio.NewWriterSize(conn, icapChunkSize+32)
+	fmt.Fprintf(w, "RESPMOD %s ICAP/1.0\r\n", c.url)
+	fmt.Fprintf(w, "Host: %s\r\n", c.host)
+	fmt.Fprintf(w, "Allow: 204\r\n")
+	fmt.Fprintf(w, "Encapsulated: req-hdr=0, res-hdr=%d, res-body=%d\r\n\r\n", len(reqHeader), len(reqHeader)+len(resHeader))
+	w.WriteString(reqHeader)
+	w.WriteString(resHeader)
+
+	chunk := make([]byte, icapChunkSize)
+	for {
+		n, readErr := io.ReadFull(body, chunk)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(chunk[:n])
+			w.WriteString("\r\n")
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return "", errors.Wrap(readErr, "failed to read the body to scan")
+		}
+	}
+	w.WriteString("0\r\n\r\n")
+	if err := w.Flush(); err != nil {
+		return "", errors.Wrap(err, "failed to send the body to the ICAP server")
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	line, err := reader.ReadLine()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read the response of the ICAP server")
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read the response of the ICAP server")
+	}
+
+	proto, status, _ := strings.Cut(line, " ")
+	code, _, _ := strings.Cut(status, " ")
+	switch {
+	case !strings.HasPrefix(proto, "ICAP/"):
+		return "", errors.Errorf("invalid ICAP response %q", line)
+	case code == "204":
+		return "", nil
+	case code == "200":
+		return icapThreat(header), nil
+	default:
+		return "", errors.Errorf("ICAP server responded with %q", status)
+	}
+}
+
+// icapThreat returns the name of the threat in the headers of a response
+// of an ICAP server, which are not standard.
+func icapThreat(header textproto.MIMEHeader) string {
+	// X-Infection-Found: Type=0; Resolution=2; Threat=Eicar-Test-Signature;
+	for _, field := range strings.Split(header.Get("X-Infection-Found"), ";") {
+		if threat, ok := strings.CutPrefix(strings.TrimSpace(field), "Threat="); ok && threat != "" {
+			return threat
+		}
+	}
+	if threat := strings.TrimSpace(header.Get("X-Virus-Id")); threat != "" {
+		return threat
+	}
+	return "unknown"
+}
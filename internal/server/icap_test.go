@@ -0,0 +1,170 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http/httputil"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// eicar is the signature of the EICAR test file, which the fake ICAP server
+// reports as malware.
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeICAP is an ICAP server that finds malware in the bodies holding the
+// EICAR signature.
+type fakeICAP struct {
+	listener net.Listener
+
+	mu     sync.Mutex
+	fail   bool
+	scans  []string
+	bodies [][]byte
+}
+
+func newFakeICAP(t *testing.T) *fakeICAP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeICAP{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return f
+}
+
+func (f *fakeICAP) url() string {
+	return "icap://" + f.listener.Addr().String() + "/avscan"
+}
+
+func (f *fakeICAP) setFail(fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail = fail
+}
+
+// scanned returns the keys of the objects scanned so far.
+func (f *fakeICAP) scanned() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.scans...)
+}
+
+func (f *fakeICAP) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	tp := textproto.NewReader(reader)
+	if _, err := tp.ReadLine(); err != nil {
+		return
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return
+	}
+
+	var bodyOffset int
+	for _, part := range strings.Split(header.Get("Encapsulated"), ",") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(part), "res-body="); ok {
+			bodyOffset, _ = strconv.Atoi(value)
+		}
+	}
+	headers := make([]byte, bodyOffset)
+	if _, err := io.ReadFull(reader, headers); err != nil {
+		return
+	}
+	body, err := io.ReadAll(httputil.NewChunkedReader(reader))
+	if err != nil {
+		return
+	}
+	var key string
+	if line, _, ok := strings.Cut(string(headers), " HTTP/1.1"); ok {
+		key = strings.TrimPrefix(line, "GET /")
+	}
+
+	f.mu.Lock()
+	f.scans = append(f.scans, key)
+	f.bodies = append(f.bodies, body)
+	fail := f.fail
+	f.mu.Unlock()
+
+	switch {
+	case fail:
+		io.WriteString(conn, "ICAP/1.0 500 Server Error\r\nEncapsulated: null-body=0\r\n\r\n")
+	case bytes.Contains(body, []byte(eicar)):
+		res := "HTTP/1.1 403 Forbidden\r\n\r\n"
+		io.WriteString(conn, "ICAP/1.0 200 OK\r\nISTag: \"fake\"\r\nX-Infection-Found: Type=0; Resolution=2; Threat=Eicar-Test-Signature;\r\nEncapsulated: res-hdr=0, null-body="+strconv.Itoa(len(res))+"\r\n\r\n"+res)
+	default:
+		io.WriteString(conn, "ICAP/1.0 204 No Content\r\nISTag: \"fake\"\r\nEncapsulated: null-body=0\r\n\r\n")
+	}
+}
+
+func TestICAPClient(t *testing.T) {
+	fake := newFakeICAP(t)
+	client, err := newICAPClient(fake.url(), 5*time.Second)
+	require.NoError(t, err)
+
+	// The body spans several chunks.
+	body := bytes.Repeat([]byte("clean"), icapChunkSize)
+	threat, err := client.scan(context.Background(), "inst/my file", bytes.NewReader(body), int64(len(body)))
+	require.NoError(t, err)
+	assert.Empty(t, threat)
+	assert.Equal(t, []string{"inst/my%20file"}, fake.scanned())
+	fake.mu.Lock()
+	assert.Equal(t, body, fake.bodies[0])
+	fake.mu.Unlock()
+
+	threat, err = client.scan(context.Background(), "inst/eicar", strings.NewReader(eicar), int64(len(eicar)))
+	require.NoError(t, err)
+	assert.Equal(t, "Eicar-Test-Signature", threat)
+
+	threat, err = client.scan(context.Background(), "inst/empty", strings.NewReader(""), 0)
+	require.NoError(t, err)
+	assert.Empty(t, threat)
+
+	fake.setFail(true)
+	_, err = client.scan(context.Background(), "inst/a", strings.NewReader("a"), 1)
+	assert.ErrorContains(t, err, "500 Server Error")
+
+	fake.listener.Close()
+	_, err = client.scan(context.Background(), "inst/a", strings.NewReader("a"), 1)
+	assert.Error(t, err)
+}
+
+func TestNewICAPClient(t *testing.T) {
+	client, err := newICAPClient("icap://clamav/avscan", time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "clamav:1344", client.address)
+
+	client, err = newICAPClient("icap://clamav:11344/avscan", time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "clamav:11344", client.address)
+
+	_, err = newICAPClient("http://clamav/avscan", time.Second)
+	assert.Error(t, err)
+}
+
+func TestICAPThreat(t *testing.T) {
+	assert.Equal(t, "Eicar-Test-Signature", icapThreat(textproto.MIMEHeader{"X-Infection-Found": {"Type=0; Resolution=2; Threat=Eicar-Test-Signature;"}}))
+	assert.Equal(t, "Win.Test.EICAR_HDB-1", icapThreat(textproto.MIMEHeader{"X-Virus-Id": {"Win.Test.EICAR_HDB-1"}}))
+	assert.Equal(t, "unknown", icapThreat(textproto.MIMEHeader{}))
+}
@@ -0,0 +1,829 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxPartSize and maxUploadParts are the limits of S3 on the parts of
+	// multipart uploads.
+	maxPartSize    = 5 * 1024 * 1024 * 1024
+	maxUploadParts = 10000
+
+	// checkpointSaveInterval is how often the checkpoint of an import is
+	// saved while objects are imported.
+	checkpointSaveInterval = time.Second
+)
+
+// ImportOptions tell where and how the objects of an import are written.
+type ImportOptions struct {
+	// Prefix is prepended to the keys of the objects, within the
+	// installation.
+	Prefix string
+	// Checkpoint is the file the imported objects are recorded in, so that
+	// an interrupted import skips them when it runs again.
+	Checkpoint string
+	// PreserveMetadata sets the metadata of the manifest on the objects.
+	PreserveMetadata bool
+}
+
+// ImportReport sums up an import.
+type ImportReport struct {
+	Objects int   `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+	// Multipart is the number of objects uploaded as multipart uploads.
+	Multipart int `json:"multipart"`
+	// Skipped is the number of objects the checkpoint had already imported,
+	// and of entries whose name isn't a key within the installation.
+	Skipped int `json:"skipped"`
+}
+
+// ImportInstallation uploads the objects of a tar or zip archive, or of a
+// directory, to the installation. Archives made by ExportInstallation, and
+// directories they were extracted to, are recognized by their manifest:
+// their objects are checked against the SHA-256 of the manifest, and can
+// get back their metadata. The objects are written through the handler of
+// the S3 API, as if the installation wrote them, so that they are checked
+// and stored the same way. Objects larger than a part are uploaded as
+// multipart uploads, and parts and objects are uploaded with bounded
+// concurrency. When an error occurs, the objects already imported are in
+// the checkpoint, if any.
+func (s *Server) ImportInstallation(ctx context.Context, installationID, source string, opts ImportOptions) (*ImportReport, error) {
+	if installationID == "" || strings.Contains(installationID, "/") {
+		return nil, errors.Errorf("invalid installation ID %q", installationID)
+	}
+	if err := checkImportPrefix(opts.Prefix); err != nil {
+		return nil, err
+	}
+	src, err := openImportSource(source)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	checkpoint, err := loadImportCheckpoint(opts.Checkpoint, installationID)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := s.cfg.ImportSettings
+	concurrency := settings.Concurrency
+	if concurrency == 0 {
+		concurrency = defaultMultipartConcurrency
+	}
+	im := &importer{
+		s:              s,
+		handler:        s.handler(),
+		installationID: installationID,
+		opts:           opts,
+		partSize:       settings.PartSizeBytes,
+		checkpoint:     checkpoint,
+		manifest:       make(map[string]ExportedObject),
+		sem:            make(chan struct{}, concurrency),
+	}
+	if im.partSize == 0 {
+		im.partSize = defaultMultipartPartSize
+	}
+	if manifest := src.manifest(); manifest != nil {
+		for _, object := range manifest.Objects {
+			im.manifest[object.Key] = object
+		}
+	}
+	im.ctx, im.cancel = context.WithCancel(ctx)
+	defer im.cancel()
+
+	err = src.walk(func(entry importEntry) error {
+		if err := im.err(); err != nil {
+			return err
+		}
+		if err := im.importEntry(entry); err != nil {
+			im.fail(errors.Wrapf(err, "failed to import %s", entry.key))
+		}
+		return im.err()
+	})
+	im.wg.Wait()
+	if err == nil {
+		err = im.err()
+	}
+	if saveErr := checkpoint.save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return &im.report, err
+}
+
+// importer uploads the objects of an import.
+type importer struct {
+	s              *Server
+	handler        http.HandlerFunc
+	installationID string
+	opts           ImportOptions
+	partSize       int64
+	checkpoint     *importCheckpoint
+	manifest       map[string]ExportedObject
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// sem bounds the number of objects and parts uploaded at the same time.
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	mu       sync.Mutex
+	firstErr error
+	report   ImportReport
+}
+
+func (im *importer) fail(err error) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if im.firstErr == nil {
+		im.firstErr = err
+		im.cancel()
+	}
+}
+
+func (im *importer) err() error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	return im.firstErr
+}
+
+// acquire waits for an upload slot, which is released by sending to sem.
+func (im *importer) acquire() error {
+	select {
+	case im.sem <- struct{}{}:
+		return nil
+	case <-im.ctx.Done():
+		return im.ctx.Err()
+	}
+}
+
+// imported records an object once it is fully uploaded.
+func (im *importer) imported(key string, size int64, multipart bool) {
+	im.mu.Lock()
+	im.report.Objects++
+	im.report.Bytes += size
+	if multipart {
+		im.report.Multipart++
+	}
+	im.mu.Unlock()
+	if err := im.checkpoint.add(key, size); err != nil {
+		im.fail(err)
+	}
+}
+
+// importEntry reads the entry and starts uploading it. The entry has been
+// read, and checked against the manifest, when importEntry returns.
+func (im *importer) importEntry(entry importEntry) error {
+	if entry.key == "" {
+		im.s.logger.Warn("skipping import entry with an invalid name", mlog.String("installation_id", im.installationID), mlog.String("name", entry.name))
+		im.mu.Lock()
+		im.report.Skipped++
+		im.mu.Unlock()
+		return nil
+	}
+
+	key := im.opts.Prefix + entry.key
+	if im.checkpoint.has(key, entry.size) {
+		im.mu.Lock()
+		im.report.Skipped++
+		im.mu.Unlock()
+		return nil
+	}
+
+	header := make(http.Header)
+	exported, inManifest := im.manifest[entry.key]
+	if inManifest && im.opts.PreserveMetadata {
+		for name, value := range exported.Metadata {
+			header.Set(name, value)
+		}
+	}
+	verify := func(sha hash.Hash) error {
+		if sum := hex.EncodeToString(sha.Sum(nil)); inManifest && sum != exported.SHA256 {
+			return errors.Errorf("checksum mismatch: the SHA-256 of the entry is %s, the one of the manifest %s", sum, exported.SHA256)
+		}
+		return nil
+	}
+
+	if entry.size > im.partSize {
+		return im.importMultipart(key, entry, header, verify)
+	}
+	return im.importObject(key, entry, header, verify)
+}
+
+// importObject uploads an entry with a PutObject request.
+func (im *importer) importObject(key string, entry importEntry, header http.Header, verify func(hash.Hash) error) error {
+	buf, sha, md, err := im.readPart(entry.body, entry.size)
+	if err != nil {
+		return err
+	}
+	if err := verify(sha); err != nil {
+		buf.Close()
+		return err
+	}
+	if err := im.acquire(); err != nil {
+		buf.Close()
+		return err
+	}
+
+	im.wg.Add(1)
+	go func() {
+		defer im.wg.Done()
+		defer func() { <-im.sem }()
+		defer buf.Close()
+
+		body, err := buf.Reader()
+		if err != nil {
+			im.fail(err)
+			return
+		}
+		header.Set("Content-Md5", base64.StdEncoding.EncodeToString(md.Sum(nil)))
+		header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sha.Sum(nil)))
+		resp, err := im.do(http.MethodPut, key, nil, header, body, entry.size)
+		if err != nil {
+			im.fail(errors.Wrapf(err, "failed to import %s", entry.key))
+			return
+		}
+		resp.Body.Close()
+		im.imported(key, entry.size, false)
+	}()
+	return nil
+}
+
+// importMultipart uploads an entry with a multipart upload. The parts are
+// read one after the other and uploaded concurrently. The upload is
+// completed once all of them are uploaded, or aborted if anything fails.
+func (im *importer) importMultipart(key string, entry importEntry, header http.Header, verify func(hash.Hash) error) error {
+	uploadID, err := im.createMultipartUpload(key, header)
+	if err != nil {
+		return err
+	}
+
+	// S3 allows a limited number of parts, and the parts of encrypted
+	// uploads must be made of full segments.
+	partSize := max(im.partSize, (entry.size+maxUploadParts-1)/maxUploadParts)
+	partSize = (partSize + encryptionSegmentSize - 1) / encryptionSegmentSize * encryptionSegmentSize
+
+	var (
+		mu    sync.Mutex
+		parts []completePart
+		wg    sync.WaitGroup
+	)
+	upload := func() error {
+		sha := sha256.New()
+		body := io.TeeReader(entry.body, sha)
+		for partNumber, read := 1, int64(0); read < entry.size; partNumber++ {
+			size := min(partSize, entry.size-read)
+			buf, partSHA, md, err := im.readPart(body, size)
+			if err != nil {
+				return err
+			}
+			read += size
+			if err := im.acquire(); err != nil {
+				buf.Close()
+				return err
+			}
+
+			wg.Add(1)
+			go func(partNumber int) {
+				defer wg.Done()
+				defer func() { <-im.sem }()
+				defer buf.Close()
+
+				reader, err := buf.Reader()
+				if err != nil {
+					im.fail(err)
+					return
+				}
+				query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+				partHeader := http.Header{
+					"Content-Md5":          {base64.StdEncoding.EncodeToString(md.Sum(nil))},
+					"X-Amz-Content-Sha256": {hex.EncodeToString(partSHA.Sum(nil))},
+				}
+				resp, err := im.do(http.MethodPut, key, query, partHeader, reader, size)
+				if err != nil {
+					im.fail(errors.Wrapf(err, "failed to import part %d of %s", partNumber, entry.key))
+					return
+				}
+				resp.Body.Close()
+
+				mu.Lock()
+				parts = append(parts, completePart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+				mu.Unlock()
+			}(partNumber)
+		}
+		return verify(sha)
+	}
+	if err := upload(); err != nil {
+		im.fail(errors.Wrapf(err, "failed to import %s", entry.key))
+	}
+
+	im.wg.Add(1)
+	go func() {
+		defer im.wg.Done()
+		wg.Wait()
+
+		err := im.err()
+		if err == nil {
+			sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+			if err = im.completeMultipartUpload(key, uploadID, parts); err != nil {
+				im.fail(errors.Wrapf(err, "failed to import %s", entry.key))
+			}
+		}
+		if err != nil {
+			query := url.Values{"uploadId": {uploadID}}
+			resp, abortErr := im.doContext(context.WithoutCancel(im.ctx), http.MethodDelete, key, query, nil, nil, 0)
+			if abortErr != nil {
+				im.s.logger.Error("failed to abort multipart upload", mlog.String("key", key), mlog.String("upload_id", uploadID), mlog.Err(abortErr))
+				return
+			}
+			resp.Body.Close()
+			return
+		}
+		im.imported(key, entry.size, true)
+	}()
+	return nil
+}
+
+// readPart reads size bytes of the body into a part buffer, along with
+// their checksums.
+func (im *importer) readPart(body io.Reader, size int64) (partBuffer, hash.Hash, hash.Hash, error) {
+	buf, err := newPartBuffer(im.s.cfg.ImportSettings.SpoolDirectory)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sha := sha256.New()
+	md := md5.New()
+	n, err := io.CopyN(io.MultiWriter(buf, sha, md), body, size)
+	if err != nil {
+		buf.Close()
+		if err == io.EOF {
+			return nil, nil, nil, errors.Errorf("the entry has %d bytes less than its size", size-n)
+		}
+		return nil, nil, nil, errors.Wrap(err, "failed to read entry")
+	}
+	return buf, sha, md, nil
+}
+
+func (im *importer) createMultipartUpload(key string, header http.Header) (string, error) {
+	resp, err := im.do(http.MethodPost, key, url.Values{"uploads": {""}}, header, nil, 0)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create multipart upload")
+	}
+	defer resp.Body.Close()
+
+	var result initiateMultipartUploadResult
+	if err := decodeS3Response(resp, &result); err != nil {
+		return "", err
+	}
+	return result.UploadID, nil
+}
+
+func (im *importer) completeMultipartUpload(key, uploadID string, parts []completePart) error {
+	body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := im.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return errors.Wrap(err, "failed to complete multipart upload")
+	}
+	defer resp.Body.Close()
+
+	var result completeMultipartUploadResult
+	return decodeS3Response(resp, &result)
+}
+
+func (im *importer) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	return im.doContext(im.ctx, method, key, query, header, body, size)
+}
+
+// doContext sends a request for the object with the key, within the
+// installation, to the handler of the S3 API, and turns error responses into
+// an *s3Error.
+func (im *importer) doContext(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	urlStr := "http://bifrost" + s3utils.EncodePath("/"+im.s.cfg.S3Settings.Bucket+"/"+im.installationID+"/"+key)
+	if len(query) > 0 {
+		urlStr += "?" + s3utils.QueryEncode(query)
+	}
+	req, err := http.NewRequestWithContext(withInternalRequest(ctx), method, urlStr, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = size
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	}
+
+	w := &importResponseWriter{header: make(http.Header)}
+	im.handler(w, req)
+	resp := &http.Response{StatusCode: w.status, Header: w.header, Body: io.NopCloser(&w.body)}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, parseS3Error(resp)
+	}
+	return resp, nil
+}
+
+// importResponseWriter keeps the response of the handler of the S3 API to a
+// request of an import, whose bodies are small.
+type importResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *importResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *importResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+func (w *importResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+// importCheckpoint records the objects an import has written, by key and
+// size. It is saved to its file from time to time, and when the import
+// ends, unless it has no file.
+type importCheckpoint struct {
+	path  string
+	mu    sync.Mutex
+	saved time.Time
+
+	InstallationID string           `json:"installation_id"`
+	Imported       map[string]int64 `json:"imported"`
+}
+
+func loadImportCheckpoint(path, installationID string) (*importCheckpoint, error) {
+	c := &importCheckpoint{path: path, InstallationID: installationID, Imported: make(map[string]int64)}
+	if path == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read checkpoint")
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, errors.Wrap(err, "failed to decode checkpoint")
+	}
+	if c.InstallationID != installationID {
+		return nil, errors.Errorf("the checkpoint is the one of an import into %s", c.InstallationID)
+	}
+	if c.Imported == nil {
+		c.Imported = make(map[string]int64)
+	}
+	return c, nil
+}
+
+// has reports whether the object was imported with the given size.
+func (c *importCheckpoint) has(key string, size int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	imported, ok := c.Imported[key]
+	return ok && imported == size
+}
+
+// add records an imported object, and saves the checkpoint if it wasn't
+// saved for a while.
+func (c *importCheckpoint) add(key string, size int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Imported[key] = size
+	if time.Since(c.saved) < checkpointSaveInterval {
+		return nil
+	}
+	return c.saveLocked()
+}
+
+func (c *importCheckpoint) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.saveLocked()
+}
+
+func (c *importCheckpoint) saveLocked() error {
+	if c.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := replaceFile(c.path, data); err != nil {
+		return errors.Wrap(err, "failed to save checkpoint")
+	}
+	c.saved = time.Now()
+	return nil
+}
+
+// importEntry is an object of an import source, with its key within the
+// installation.
+type importEntry struct {
+	name string
+	key  string
+	size int64
+	body io.Reader
+}
+
+// importSource reads the objects of an import.
+type importSource interface {
+	// manifest returns the manifest of an export, or nil if the source
+	// isn't one.
+	manifest() *ExportManifest
+	// walk calls fn with the objects of the source one after the other,
+	// until it fails. The body of an entry can only be read until fn
+	// returns.
+	walk(fn func(entry importEntry) error) error
+	Close() error
+}
+
+// openImportSource opens the directory, or the archive, whose format is told
+// by its first bytes.
+func openImportSource(path string) (importSource, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open import source")
+	}
+	if info.IsDir() {
+		return newDirectorySource(path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open import source")
+	}
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to read import source")
+	}
+	var src importSource
+	if bytes.HasPrefix(magic, []byte("PK\x03\x04")) || bytes.HasPrefix(magic, []byte("PK\x05\x06")) {
+		src, err = newZipSource(f, info.Size())
+	} else {
+		src, err = newTarSource(f)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return src, nil
+}
+
+// readManifest decodes the manifest of an export.
+func readManifest(r io.Reader) (*ExportManifest, error) {
+	var manifest ExportManifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, errors.Wrap(err, "failed to decode the manifest")
+	}
+	return &manifest, nil
+}
+
+// checkImportPrefix checks that the keys under the prefix of an import stay
+// within the installation, the same way importKey checks the names of the
+// entries: the prefix is prepended to names that are already local, so it
+// must be local itself, and already clean.
+func checkImportPrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	name := strings.TrimSuffix(prefix, "/")
+	if name == "" || path.Clean(name) != name || !filepath.IsLocal(filepath.FromSlash(name)) {
+		return &s3Error{StatusCode: http.StatusBadRequest, Code: "InvalidArgument", Message: fmt.Sprintf("Invalid import prefix %q, it must stay within the installation.", prefix)}
+	}
+	return nil
+}
+
+// importKey returns the key of the object of an archive entry, and whether
+// the entry is an object. The objects of exports are under objects/, beside
+// their manifest. Objects whose name doesn't stay within the installation,
+// like ../x or /x, get an empty key, and are skipped.
+func importKey(name string, export bool) (string, bool) {
+	name = strings.TrimPrefix(name, "./")
+	if export {
+		var ok bool
+		if name, ok = strings.CutPrefix(name, exportObjectsDir); !ok {
+			return "", false
+		}
+	}
+	if name == "" || strings.HasSuffix(name, "/") {
+		return "", false
+	}
+	if name = path.Clean(name); !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", true
+	}
+	return name, true
+}
+
+type tarSource struct {
+	f *os.File
+	m *ExportManifest
+}
+
+// newTarSource reads the manifest of the archive, if any, before the objects
+// are imported. It is the last entry of exports, and the entries before it
+// are skipped over.
+func newTarSource(f *os.File) (*tarSource, error) {
+	src := &tarSource{f: f}
+	err := src.each(func(header *tar.Header, r io.Reader) error {
+		if header.Name != exportManifestName {
+			return nil
+		}
+		var err error
+		src.m, err = readManifest(r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+func (src *tarSource) each(fn func(header *tar.Header, r io.Reader) error) error {
+	if _, err := src.f.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "failed to rewind tar archive")
+	}
+	reader := tar.NewReader(src.f)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read tar archive")
+		}
+		if err := fn(header, reader); err != nil {
+			return err
+		}
+	}
+}
+
+func (src *tarSource) manifest() *ExportManifest {
+	return src.m
+}
+
+func (src *tarSource) walk(fn func(entry importEntry) error) error {
+	return src.each(func(header *tar.Header, r io.Reader) error {
+		key, ok := importKey(header.Name, src.m != nil)
+		if !ok || header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		return fn(importEntry{name: header.Name, key: key, size: header.Size, body: r})
+	})
+}
+
+func (src *tarSource) Close() error {
+	return src.f.Close()
+}
+
+type zipSource struct {
+	f      *os.File
+	reader *zip.Reader
+	m      *ExportManifest
+}
+
+func newZipSource(f *os.File, size int64) (*zipSource, error) {
+	reader, err := zip.NewReader(f, size)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read zip archive")
+	}
+	src := &zipSource{f: f, reader: reader}
+	for _, file := range reader.File {
+		if file.Name != exportManifestName {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the manifest")
+		}
+		src.m, err = readManifest(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return src, nil
+}
+
+func (src *zipSource) manifest() *ExportManifest {
+	return src.m
+}
+
+func (src *zipSource) walk(fn func(entry importEntry) error) error {
+	for _, file := range src.reader.File {
+		key, ok := importKey(file.Name, src.m != nil)
+		if !ok || file.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", file.Name)
+		}
+		err = fn(importEntry{name: file.Name, key: key, size: int64(file.UncompressedSize64), body: rc})
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (src *zipSource) Close() error {
+	return src.f.Close()
+}
+
+// directorySource reads the files of a directory, or the objects of an
+// export extracted to it.
+type directorySource struct {
+	root string
+	m    *ExportManifest
+}
+
+func newDirectorySource(path string) (*directorySource, error) {
+	src := &directorySource{root: path}
+	f, err := os.Open(filepath.Join(path, exportManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return src, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the manifest")
+	}
+	defer f.Close()
+	if src.m, err = readManifest(f); err != nil {
+		return nil, err
+	}
+	src.root = filepath.Join(path, exportObjectsDir)
+	return src, nil
+}
+
+func (src *directorySource) manifest() *ExportManifest {
+	return src.m
+}
+
+func (src *directorySource) walk(fn func(entry importEntry) error) error {
+	return filepath.WalkDir(src.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src.root, path)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return fn(importEntry{name: path, key: filepath.ToSlash(rel), size: info.Size(), body: f})
+	})
+}
+
+func (src *directorySource) Close() error {
+	return nil
+}
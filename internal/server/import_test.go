@@ -0,0 +1,233 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// exportToFile exports the installation to an archive in a temporary
+// directory, and returns the path of the archive.
+func exportToFile(t *testing.T, s *Server, installationID, format string) string {
+	path := filepath.Join(t.TempDir(), installationID+"."+format)
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = s.ExportInstallation(context.Background(), installationID, ExportOptions{Format: format}, f)
+	require.NoError(t, err)
+	return path
+}
+
+func TestImportInstallation(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{ImportSettings: ImportSettings{PartSizeBytes: encryptionSegmentSize, Concurrency: 2}})
+
+	large := bytes.Repeat([]byte("0123456789"), 20000)
+	fake.put("old/a", []byte("first"), http.Header{"Content-Type": {"text/plain"}, "X-Amz-Meta-Owner": {"bob"}})
+	fake.put("old/dir/b", []byte("second"), nil)
+	fake.put("old/large", large, nil)
+	archive := exportToFile(t, s, "old", ExportFormatTar)
+
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint.json")
+	report, err := s.ImportInstallation(context.Background(), "new", archive, ImportOptions{Checkpoint: checkpoint, PreserveMetadata: true})
+	require.NoError(t, err)
+	assert.Equal(t, &ImportReport{Objects: 3, Bytes: int64(11 + len(large)), Multipart: 1}, report)
+	assert.Equal(t, "first", string(fake.object("new/a").data))
+	assert.Equal(t, "text/plain", fake.object("new/a").header.Get("Content-Type"))
+	assert.Equal(t, "bob", fake.object("new/a").header.Get("X-Amz-Meta-Owner"))
+	assert.Equal(t, "second", string(fake.object("new/dir/b").data))
+	assert.Equal(t, large, fake.object("new/large").data)
+	assert.Empty(t, fake.uploads)
+
+	// The checkpoint skips the objects already imported.
+	report, err = s.ImportInstallation(context.Background(), "new", archive, ImportOptions{Checkpoint: checkpoint})
+	require.NoError(t, err)
+	assert.Equal(t, &ImportReport{Skipped: 3}, report)
+	_, err = s.ImportInstallation(context.Background(), "other", archive, ImportOptions{Checkpoint: checkpoint})
+	assert.Error(t, err)
+
+	// Archives are checked against their manifest.
+	zipArchive := exportToFile(t, s, "old", ExportFormatZip)
+	fake.object("old/dir/b").data = []byte("SECOND")
+	tarArchive := exportToFile(t, s, "old", ExportFormatTar)
+	data, err := os.ReadFile(zipArchive)
+	require.NoError(t, err)
+	entries := readZipArchive(t, data)
+	entries[exportManifestName] = readTarArchive(t, mustReadFile(t, tarArchive))[exportManifestName]
+	_, err = s.ImportInstallation(context.Background(), "mismatch", writeZipFile(t, entries), ImportOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum mismatch")
+	assert.Nil(t, fake.object("mismatch/dir/b"))
+
+	_, err = s.ImportInstallation(context.Background(), "new", filepath.Join(t.TempDir(), "missing"), ImportOptions{})
+	assert.Error(t, err)
+	_, err = s.ImportInstallation(context.Background(), "", archive, ImportOptions{})
+	assert.Error(t, err)
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return data
+}
+
+// writeZipFile writes the entries to a zip archive in a temporary directory,
+// and returns the path of the archive.
+func writeZipFile(t *testing.T, entries map[string][]byte) string {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, data := range entries {
+		f, err := w.Create(name)
+		require.NoError(t, err)
+		_, err = f.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	path := filepath.Join(t.TempDir(), "archive.zip")
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0600))
+	return path
+}
+
+func TestImportSources(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{})
+
+	// Archives that aren't exports are imported as they are.
+	archive := writeZipFile(t, map[string][]byte{"a": []byte("first"), "dir/": nil, "dir/b": []byte("second")})
+	report, err := s.ImportInstallation(context.Background(), "inst", archive, ImportOptions{Prefix: "zip/"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Objects)
+	assert.Equal(t, "first", string(fake.object("inst/zip/a").data))
+	assert.Equal(t, "second", string(fake.object("inst/zip/dir/b").data))
+
+	// Entries are only imported within the installation.
+	archive = writeZipFile(t, map[string][]byte{"../x": []byte("x"), "/y": []byte("y"), "a//b": []byte("b"), "./c/../d": []byte("d")})
+	report, err = s.ImportInstallation(context.Background(), "names", archive, ImportOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, &ImportReport{Objects: 2, Bytes: 2, Skipped: 2}, report)
+	assert.Equal(t, "b", string(fake.object("names/a/b").data))
+	assert.Equal(t, "d", string(fake.object("names/d").data))
+	assert.Nil(t, fake.object("x"))
+
+	// So is the prefix.
+	for _, prefix := range []string{"../other/", "/abs/", "a/../../b/", "a//b/", "./a/", "/"} {
+		_, err = s.ImportInstallation(context.Background(), "names", archive, ImportOptions{Prefix: prefix})
+		assert.True(t, isS3ErrorCode(err, "InvalidArgument"), prefix)
+	}
+	assert.Nil(t, fake.object("other/d"))
+	assert.Nil(t, fake.object("abs/d"))
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "c"), []byte("third"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "d"), []byte("fourth"), 0600))
+	report, err = s.ImportInstallation(context.Background(), "inst", dir, ImportOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Objects)
+	assert.Equal(t, "third", string(fake.object("inst/c").data))
+	assert.Equal(t, "fourth", string(fake.object("inst/sub/d").data))
+
+	// Exports extracted to a directory are recognized by their manifest.
+	entries := readTarArchive(t, mustReadFile(t, exportToFile(t, s, "inst", ExportFormatTar)))
+	extracted := t.TempDir()
+	for name, data := range entries {
+		path := filepath.Join(extracted, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, os.WriteFile(path, data, 0600))
+	}
+	report, err = s.ImportInstallation(context.Background(), "copy", extracted, ImportOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.Objects)
+	assert.Equal(t, "second", string(fake.object("copy/zip/dir/b").data))
+	assert.Nil(t, fake.object("copy/"+exportManifestName))
+}
+
+func TestImportEncryptedInstallation(t *testing.T) {
+	s, fake, _ := newEncryptionTestServer(t)
+	s.cfg.ImportSettings.PartSizeBytes = encryptionSegmentSize
+	handler := s.handler()
+
+	large := bytes.Repeat([]byte("0123456789"), 20000)
+	fake.put("old/small", []byte("small"), nil)
+	fake.put("old/large", large, nil)
+	report, err := s.ImportInstallation(context.Background(), "inst", exportToFile(t, s, "old", ExportFormatTar), ImportOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Multipart)
+
+	for key, data := range map[string][]byte{"/inst/small": []byte("small"), "/inst/large": large} {
+		assert.NotEqual(t, data, fake.object(key[1:]).data)
+		resp := serveRequest(handler, "GET", key, nil, nil)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, data, body)
+	}
+}
+
+func TestImportPolicies(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{ServiceSettings: ServiceSettings{RequestValidation: true}})
+	s.lookupAddrFn = func(string) ([]string, error) { return nil, nil }
+	s.policies = newTestPolicies(t, `{"Policies": [{"Installations": ["inst"], "Statement": [{"Effect": "Deny", "Action": "s3:PutObject", "Resource": "secret/*"}]}]}`)
+
+	archive := writeZipFile(t, map[string][]byte{"public/a": []byte("a"), "secret/b": []byte("b")})
+	_, err := s.ImportInstallation(context.Background(), "inst", archive, ImportOptions{})
+	require.Error(t, err)
+	assert.True(t, isS3ErrorCode(err, "AccessDenied"))
+	assert.Nil(t, fake.object("inst/secret/b"))
+}
+
+func TestAdminImport(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	checkpoints := t.TempDir()
+	s := newFakeS3Server(t, ts, Config{ImportSettings: ImportSettings{CheckpointDirectory: checkpoints}})
+	router := newAdminRouter(s)
+
+	fake.put("old/a", []byte("first"), nil)
+	archive := mustReadFile(t, exportToFile(t, s, "old", ExportFormatZip))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/installations/new/import", bytes.NewReader(archive)))
+	require.Equal(t, http.StatusNotFound, w.Code)
+	assert.Nil(t, fake.object("new/a"))
+
+	s.cfg.ImportSettings.Enable = true
+	router = newAdminRouter(s)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/installations/new/import?checkpoint=new.json", bytes.NewReader(archive)))
+	require.Equal(t, http.StatusOK, w.Code)
+	var report ImportReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, 1, report.Objects)
+	assert.Equal(t, "first", string(fake.object("new/a").data))
+	assert.FileExists(t, filepath.Join(checkpoints, "new.json"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/installations/new/import?checkpoint=../new.json", bytes.NewReader(archive)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/installations/new/import?prefix=../old/", bytes.NewReader(archive)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestImportSettingsIsValid(t *testing.T) {
+	assert.NoError(t, Config{ImportSettings: ImportSettings{PartSizeBytes: minMultipartPartSize, Concurrency: 8}}.IsValid())
+	assert.Error(t, Config{ImportSettings: ImportSettings{PartSizeBytes: 1024}}.IsValid())
+	assert.Error(t, Config{ImportSettings: ImportSettings{PartSizeBytes: maxPartSize + 1}}.IsValid())
+	assert.Error(t, Config{ImportSettings: ImportSettings{Concurrency: -1}}.IsValid())
+}
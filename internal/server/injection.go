@@ -0,0 +1,146 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+)
+
+// Server-side encryption algorithms of S3.
+const (
+	sseAlgorithmAES256  = "AES256"
+	sseAlgorithmKMS     = "aws:kms"
+	sseAlgorithmKMSDSSE = "aws:kms:dsse"
+)
+
+const (
+	sseHeader                = "X-Amz-Server-Side-Encryption"
+	sseKMSKeyIDHeader        = "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"
+	sseBucketKeyHeader       = "X-Amz-Server-Side-Encryption-Bucket-Key-Enabled"
+	sseCustomerHeaderPrefix  = "X-Amz-Server-Side-Encryption-Customer-"
+	injectionRejectionReason = "injection_conflict"
+)
+
+// isKMSAlgorithm reports whether the server-side encryption algorithm uses
+// KMS keys.
+func isKMSAlgorithm(algorithm string) bool {
+	return algorithm == sseAlgorithmKMS || algorithm == sseAlgorithmKMSDSSE
+}
+
+// injectObjectSettings sets the server-side encryption and the storage class
+// of the settings on the objects written by PutObject, CopyObject and
+// CreateMultipartUpload, before the requests are signed. Requests whose
+// headers ask for something else are rejected rather than silently changed.
+// The storage class is only set on objects at least as large as the
+// minimum size; multipart uploads are assumed to be large enough.
+func (s *Server) injectObjectSettings(r *http.Request, op s3Request, installationID string) error {
+	switch op.Operation {
+	case opPutObject, opCopyObject, opCreateMultipartUpload:
+	default:
+		return nil
+	}
+	settings := s.cfg.InjectionSettings
+
+	inject := make(map[string]string)
+	if settings.ServerSideEncryption != "" {
+		for name := range r.Header {
+			if strings.HasPrefix(name, sseCustomerHeaderPrefix) {
+				return s.rejectInjectionConflict(r, op, installationID, name, "Server-side encryption with customer-provided keys is not allowed. Objects are encrypted with "+settings.ServerSideEncryption+".")
+			}
+		}
+		inject[sseHeader] = settings.ServerSideEncryption
+		if isKMSAlgorithm(settings.ServerSideEncryption) {
+			keyID := settings.KMSKeyID
+			if id, ok := settings.InstallationKMSKeyIDs[installationID]; ok {
+				keyID = id
+			}
+			if keyID != "" {
+				inject[sseKMSKeyIDHeader] = keyID
+			}
+			if settings.BucketKeyEnabled {
+				inject[sseBucketKeyHeader] = "true"
+			}
+		}
+	}
+
+	if settings.StorageClass != "" {
+		large, err := s.isLargeObject(r, op, settings.StorageClassMinSizeBytes)
+		if err != nil {
+			return err
+		}
+		if large {
+			inject[storageClassHeader] = settings.StorageClass
+		}
+	}
+
+	for name, value := range inject {
+		if client := r.Header.Get(name); client != "" && !injectedValueMatches(name, client, value) {
+			return s.rejectInjectionConflict(r, op, installationID, name, "Header "+name+" must be "+value+".")
+		}
+	}
+	for name, value := range inject {
+		r.Header.Set(name, value)
+		s.logger.Debug("injected object setting",
+			mlog.String("installation_id", installationID),
+			mlog.String("key", op.Key),
+			mlog.String("operation", op.Operation),
+			mlog.String("header", name),
+			mlog.String("value", value),
+		)
+	}
+	return nil
+}
+
+// injectedValueMatches reports whether the value of the client asks for the
+// same as the injected one. Only KMS key IDs are case sensitive.
+func injectedValueMatches(name, client, injected string) bool {
+	if name == sseKMSKeyIDHeader {
+		return client == injected
+	}
+	return strings.EqualFold(client, injected)
+}
+
+// isLargeObject reports whether the object written by the request is at
+// least minSize bytes large. The size of a copy is the size of its source,
+// which is only looked up when there is a minimum size.
+func (s *Server) isLargeObject(r *http.Request, op s3Request, minSize int64) (bool, error) {
+	if minSize <= 0 {
+		return true, nil
+	}
+	switch op.Operation {
+	case opPutObject:
+		return r.ContentLength < 0 || r.ContentLength >= minSize, nil
+	case opCopyObject:
+		key, err := s.copySourceKey(r)
+		if err != nil {
+			return false, err
+		}
+		_, size, err := s.headObject(r.Context(), "/"+key)
+		if err != nil {
+			return false, err
+		}
+		return size >= minSize, nil
+	default:
+		return true, nil
+	}
+}
+
+func (s *Server) rejectInjectionConflict(r *http.Request, op s3Request, installationID, header, message string) error {
+	s.metrics.incRejectedRequest(installationID, injectionRejectionReason)
+	fields := []mlog.Field{
+		mlog.String("installation_id", installationID),
+		mlog.String("key", op.Key),
+		mlog.String("operation", op.Operation),
+		mlog.String("header", header),
+	}
+	// Keys provided by customers aren't logged.
+	if !strings.HasPrefix(header, sseCustomerHeaderPrefix) {
+		fields = append(fields, mlog.String("value", r.Header.Get(header)))
+	}
+	s.logger.Warn("request conflicts with the injected object settings", fields...)
+	return &s3Error{StatusCode: http.StatusBadRequest, Code: "InvalidArgument", Message: message}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInjectObjectSettings(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{InjectionSettings: InjectionSettings{
+		Enable:                   true,
+		ServerSideEncryption:     sseAlgorithmKMS,
+		KMSKeyID:                 "default-key",
+		InstallationKMSKeyIDs:    map[string]string{"inst": "inst-key"},
+		BucketKeyEnabled:         true,
+		StorageClass:             "INTELLIGENT_TIERING",
+		StorageClassMinSizeBytes: 4,
+	}})
+	handler := s.handler()
+
+	resp := serveRequest(handler, "PUT", "/inst/large", []byte("large"), nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	header := fake.object("inst/large").header
+	assert.Equal(t, sseAlgorithmKMS, header.Get(sseHeader))
+	assert.Equal(t, "inst-key", header.Get(sseKMSKeyIDHeader))
+	assert.Equal(t, "true", header.Get(sseBucketKeyHeader))
+	assert.Equal(t, "INTELLIGENT_TIERING", header.Get(storageClassHeader))
+
+	// Small objects keep the storage class of the client.
+	resp = serveRequest(handler, "PUT", "/other/small", []byte("abc"), http.Header{storageClassHeader: {"STANDARD_IA"}, sseHeader: {"AWS:KMS"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	header = fake.object("other/small").header
+	assert.Equal(t, sseAlgorithmKMS, header.Get(sseHeader))
+	assert.Equal(t, "default-key", header.Get(sseKMSKeyIDHeader))
+	assert.Equal(t, "STANDARD_IA", header.Get(storageClassHeader))
+
+	// Copies are as large as their source.
+	resp = serveRequest(handler, "PUT", "/inst/copy", nil, http.Header{"X-Amz-Copy-Source": {"/agnivatest/inst/large"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "INTELLIGENT_TIERING", fake.object("inst/copy").header.Get(storageClassHeader))
+	assert.Equal(t, "inst-key", fake.object("inst/copy").header.Get(sseKMSKeyIDHeader))
+
+	resp = serveRequest(handler, "POST", "/inst/upload?uploads", nil, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	for _, upload := range fake.uploads {
+		assert.Equal(t, "inst-key", upload.header.Get(sseKMSKeyIDHeader))
+		assert.Equal(t, "INTELLIGENT_TIERING", upload.header.Get(storageClassHeader))
+	}
+
+	for _, tc := range []struct {
+		name   string
+		path   string
+		header http.Header
+	}{
+		{"other algorithm", "/inst/a", http.Header{sseHeader: {sseAlgorithmAES256}}},
+		{"other key", "/inst/a", http.Header{sseKMSKeyIDHeader: {"default-key"}}},
+		{"no bucket key", "/inst/a", http.Header{sseBucketKeyHeader: {"false"}}},
+		{"customer key", "/inst/a", http.Header{"X-Amz-Server-Side-Encryption-Customer-Key": {"secret"}}},
+		{"other storage class", "/inst/a", http.Header{storageClassHeader: {"GLACIER"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := serveRequest(handler, "PUT", tc.path, []byte("large"), tc.header)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			assert.Equal(t, "InvalidArgument", readS3ErrorCode(t, resp))
+		})
+	}
+	assert.Nil(t, fake.object("inst/a"))
+	assert.Equal(t, 5.0, testutil.ToFloat64(s.metrics.rejectedRequests.WithLabelValues("inst", injectionRejectionReason)))
+}
+
+func TestInjectionSettingsIsValid(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   Config
+		valid bool
+	}{
+		{"disabled", Config{InjectionSettings: InjectionSettings{ServerSideEncryption: "rot13"}}, true},
+		{"kms", Config{InjectionSettings: InjectionSettings{Enable: true, ServerSideEncryption: sseAlgorithmKMS, KMSKeyID: "key", BucketKeyEnabled: true}}, true},
+		{"storage class", Config{InjectionSettings: InjectionSettings{Enable: true, StorageClass: "INTELLIGENT_TIERING", StorageClassMinSizeBytes: 1024}}, true},
+		{"nothing", Config{InjectionSettings: InjectionSettings{Enable: true}}, false},
+		{"unknown algorithm", Config{InjectionSettings: InjectionSettings{Enable: true, ServerSideEncryption: "rot13"}}, false},
+		{"key without kms", Config{InjectionSettings: InjectionSettings{Enable: true, ServerSideEncryption: sseAlgorithmAES256, KMSKeyID: "key"}}, false},
+		{"negative size", Config{InjectionSettings: InjectionSettings{Enable: true, StorageClass: "STANDARD", StorageClassMinSizeBytes: -1}}, false},
+		{"overridden", Config{
+			InjectionSettings:    InjectionSettings{Enable: true, ServerSideEncryption: sseAlgorithmAES256},
+			RequestGuardSettings: RequestGuardSettings{ServerSideEncryption: HeaderPolicy{Mode: HeaderModeOverride, Values: map[string]string{sseHeader: sseAlgorithmAES256}}},
+		}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.valid {
+				assert.NoError(t, tc.cfg.IsValid())
+			} else {
+				assert.Error(t, tc.cfg.IsValid())
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+// MultipartCleanupReport sums up the stale multipart uploads found by a run
+// of the multipart janitor, per installation.
+type MultipartCleanupReport struct {
+	DryRun        bool
+	Installations map[string]*MultipartCleanupStats
+}
+
+// MultipartCleanupStats are the stale multipart uploads of an installation.
+// In a dry run, they have been counted but not aborted.
+type MultipartCleanupStats struct {
+	Uploads int
+	Bytes   int64
+}
+
+// Total returns the number of stale uploads and their size over all
+// installations.
+func (r *MultipartCleanupReport) Total() MultipartCleanupStats {
+	var total MultipartCleanupStats
+	for _, stats := range r.Installations {
+		total.Uploads += stats.Uploads
+		total.Bytes += stats.Bytes
+	}
+	return total
+}
+
+func (s *Server) runMultipartJanitor(ctx context.Context) {
+	settings := s.cfg.MultipartJanitorSettings
+	ticker := time.NewTicker(time.Duration(settings.IntervalSecs) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		maxAge := time.Duration(settings.MaxAgeSecs) * time.Second
+		report, err := s.CleanupMultipartUploads(ctx, maxAge, settings.DryRun)
+		if err != nil && ctx.Err() == nil {
+			s.logger.Error("failed to clean up stale multipart uploads", mlog.Err(err))
+		} else if total := report.Total(); total.Uploads > 0 {
+			s.logger.Info("cleaned up stale multipart uploads", mlog.Int("uploads", total.Uploads), mlog.Int64("bytes", total.Bytes), mlog.Bool("dry_run", settings.DryRun))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CleanupMultipartUploads aborts the multipart uploads of every installation
+// that were started more than maxAge ago. The installations are the top level
+// prefixes of the bucket. With dryRun, the uploads are only counted. The
+// report covers the uploads handled before an error, if any.
+func (s *Server) CleanupMultipartUploads(ctx context.Context, maxAge time.Duration, dryRun bool) (*MultipartCleanupReport, error) {
+	report := &MultipartCleanupReport{
+		DryRun:        dryRun,
+		Installations: make(map[string]*MultipartCleanupStats),
+	}
+	cutoff := time.Now().Add(-maxAge)
+
+	// Uploads of objects at the top level of the bucket don't belong to any
+	// installation. They are returned along with the prefixes.
+	var prefixes []string
+	var keyMarker, uploadIDMarker string
+	for {
+		page, err := s.listMultipartUploads(ctx, "", "/", keyMarker, uploadIDMarker)
+		if err != nil {
+			return report, err
+		}
+		for _, prefix := range page.CommonPrefixes {
+			prefixes = append(prefixes, prefix.Prefix)
+		}
+		if err := s.cleanupUploads(ctx, "", page.Uploads, cutoff, report); err != nil {
+			return report, err
+		}
+		if !page.IsTruncated {
+			break
+		}
+		keyMarker, uploadIDMarker = page.NextKeyMarker, page.NextUploadIDMarker
+	}
+	sort.Strings(prefixes)
+
+	for _, prefix := range prefixes {
+		installationID := strings.TrimSuffix(prefix, "/")
+		keyMarker, uploadIDMarker = "", ""
+		for {
+			page, err := s.listMultipartUploads(ctx, prefix, "", keyMarker, uploadIDMarker)
+			if err != nil {
+				return report, errors.Wrapf(err, "failed to list multipart uploads of %s", installationID)
+			}
+			if err := s.cleanupUploads(ctx, installationID, page.Uploads, cutoff, report); err != nil {
+				return report, err
+			}
+			if !page.IsTruncated {
+				break
+			}
+			keyMarker, uploadIDMarker = page.NextKeyMarker, page.NextUploadIDMarker
+		}
+	}
+
+	return report, nil
+}
+
+// cleanupUploads aborts the uploads initiated before cutoff.
+func (s *Server) cleanupUploads(ctx context.Context, installationID string, uploads []multipartUpload, cutoff time.Time, report *MultipartCleanupReport) error {
+	for _, upload := range uploads {
+		if !upload.Initiated.Before(cutoff) {
+			continue
+		}
+
+		objectPath := "/" + upload.Key
+		size, err := s.uploadedSize(ctx, objectPath, upload.UploadID)
+		if err != nil {
+			return err
+		}
+
+		if !report.DryRun {
+			if err := s.abortMultipartUpload(ctx, objectPath, upload.UploadID); err != nil {
+				return err
+			}
+		}
+		s.logger.Debug("stale multipart upload", mlog.String("installation_id", installationID), mlog.String("key", upload.Key), mlog.String("upload_id", upload.UploadID), mlog.String("initiated", upload.Initiated.Format(time.RFC3339)), mlog.Int64("bytes", size), mlog.Bool("dry_run", report.DryRun))
+
+		stats, ok := report.Installations[installationID]
+		if !ok {
+			stats = &MultipartCleanupStats{}
+			report.Installations[installationID] = stats
+		}
+		stats.Uploads++
+		stats.Bytes += size
+		s.metrics.addStaleMultipartUpload(installationID, size, report.DryRun)
+	}
+	return nil
+}
+
+// uploadedSize returns the total size of the parts of a multipart upload.
+func (s *Server) uploadedSize(ctx context.Context, objectPath, uploadID string) (int64, error) {
+	var size int64
+	marker := 0
+	for {
+		page, err := s.listParts(ctx, objectPath, uploadID, marker)
+		if err != nil {
+			return 0, err
+		}
+		for _, part := range page.Parts {
+			size += part.Size
+		}
+		if !page.IsTruncated {
+			return size, nil
+		}
+		marker = page.NextPartNumberMarker
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanupMultipartUploads(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{})
+
+	old := time.Now().Add(-48 * time.Hour)
+	addUpload := func(key string, initiated time.Time, parts ...string) {
+		upload := &fakeUpload{key: key, header: http.Header{}, parts: make(map[int][]byte), initiated: initiated}
+		for i, part := range parts {
+			upload.parts[i+1] = []byte(part)
+		}
+		fake.uploads["upload-"+key] = upload
+	}
+	addUpload("inst1/a", old, "12345", "123")
+	addUpload("inst1/b", old, "1")
+	addUpload("inst1/c", old)
+	addUpload("inst1/new", time.Now(), "12345")
+	addUpload("inst2/a", old, "12")
+	addUpload("root", old, "1234")
+
+	t.Run("dry run", func(t *testing.T) {
+		report, err := s.CleanupMultipartUploads(context.Background(), 24*time.Hour, true)
+		require.NoError(t, err)
+
+		assert.True(t, report.DryRun)
+		assert.Equal(t, map[string]*MultipartCleanupStats{
+			"":      {Uploads: 1, Bytes: 4},
+			"inst1": {Uploads: 3, Bytes: 9},
+			"inst2": {Uploads: 1, Bytes: 2},
+		}, report.Installations)
+		assert.Equal(t, MultipartCleanupStats{Uploads: 5, Bytes: 15}, report.Total())
+		assert.Len(t, fake.uploads, 6)
+		assert.Equal(t, 9.0, testutil.ToFloat64(s.metrics.staleUploadBytes.WithLabelValues("inst1", "true")))
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		report, err := s.CleanupMultipartUploads(context.Background(), 24*time.Hour, false)
+		require.NoError(t, err)
+
+		assert.Equal(t, MultipartCleanupStats{Uploads: 5, Bytes: 15}, report.Total())
+		require.Len(t, fake.uploads, 1)
+		assert.Contains(t, fake.uploads, "upload-inst1/new")
+		assert.Equal(t, 3.0, testutil.ToFloat64(s.metrics.staleUploads.WithLabelValues("inst1", "false")))
+		assert.Equal(t, 2.0, testutil.ToFloat64(s.metrics.staleUploadBytes.WithLabelValues("inst2", "false")))
+	})
+
+	t.Run("unreachable S3", func(t *testing.T) {
+		_, closed := newFakeS3(t)
+		closed.Close()
+		s := newFakeS3Server(t, closed, Config{})
+
+		report, err := s.CleanupMultipartUploads(context.Background(), 24*time.Hour, false)
+		require.Error(t, err)
+		assert.Empty(t, report.Installations)
+	})
+}
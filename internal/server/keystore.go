@@ -0,0 +1,239 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+// Key stores available for the master keys.
+const (
+	// KeyStoreFile reads the master keys from a JSON file on disk.
+	KeyStoreFile = "file"
+)
+
+// keyStoreCheckInterval is the minimum amount of time between two checks of
+// the key file on disk.
+const keyStoreCheckInterval = 5 * time.Second
+
+var errNoInstallationKey = errors.New("installation has no encryption key")
+
+// keyStore provides the master keys that wrap the data keys of encrypted
+// objects. Keys are identified by an ID that is unique across installations,
+// so that an object can be read after being copied to another installation
+// or after the key of its installation has been rotated.
+type keyStore interface {
+	// currentKey returns the ID and value of the key new objects of the
+	// installation are encrypted with. It returns errNoInstallationKey if
+	// the objects of the installation are not encrypted.
+	currentKey(installationID string) (string, []byte, error)
+	// key returns the value of the key with the given ID.
+	key(keyID string) ([]byte, error)
+}
+
+func newKeyStore(settings EncryptionSettings, logger *mlog.Logger) (keyStore, error) {
+	switch settings.KeyStore {
+	case "", KeyStoreFile:
+		return newFileKeyStore(settings.KeyFile, logger)
+	default:
+		return nil, errors.Errorf("unknown key store %q", settings.KeyStore)
+	}
+}
+
+// keyFile is the content of the key file of a fileKeyStore. Keys are base64
+// encoded 256-bit keys, and Installations maps installation IDs to the ID of
+// their current key.
+type keyFile struct {
+	Keys          map[string]string
+	Installations map[string]string
+}
+
+// fileKeyStore reads the master keys from a JSON file, which is reloaded
+// whenever it changes, so that new installations and rotated keys are picked
+// up without a restart.
+type fileKeyStore struct {
+	path   string
+	logger *mlog.Logger
+	nowFn  func() time.Time
+
+	mu            sync.RWMutex
+	keys          map[string][]byte
+	installations map[string]string
+	modTime       time.Time
+	lastCheck     time.Time
+}
+
+func newFileKeyStore(path string, logger *mlog.Logger) (*fileKeyStore, error) {
+	ks := &fileKeyStore{
+		path:   path,
+		logger: logger,
+		nowFn:  time.Now,
+	}
+	if err := ks.load(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+func (ks *fileKeyStore) currentKey(installationID string) (string, []byte, error) {
+	ks.maybeReload()
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	keyID, ok := ks.installations[installationID]
+	if !ok {
+		return "", nil, errNoInstallationKey
+	}
+	key, ok := ks.keys[keyID]
+	if !ok {
+		return "", nil, errors.Errorf("unknown key %q for installation %s", keyID, installationID)
+	}
+	return keyID, key, nil
+}
+
+func (ks *fileKeyStore) key(keyID string) ([]byte, error) {
+	ks.maybeReload()
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	key, ok := ks.keys[keyID]
+	if !ok {
+		return nil, errors.Errorf("unknown key %q", keyID)
+	}
+	return key, nil
+}
+
+// rotate generates a new key for the installation and makes it the current
+// one. The previous keys are kept, since the objects they encrypted still
+// need them until they are wrapped with the new key.
+func (ks *fileKeyStore) rotate(installationID string) (string, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	content, err := readKeyFile(ks.path)
+	if err != nil {
+		return "", err
+	}
+
+	suffix := make([]byte, 8)
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", errors.Wrap(err, "failed to generate key ID")
+	}
+	if _, err := rand.Read(key); err != nil {
+		return "", errors.Wrap(err, "failed to generate key")
+	}
+	keyID := installationID + "-" + hex.EncodeToString(suffix)
+
+	if content.Keys == nil {
+		content.Keys = make(map[string]string)
+	}
+	if content.Installations == nil {
+		content.Installations = make(map[string]string)
+	}
+	content.Keys[keyID] = base64.StdEncoding.EncodeToString(key)
+	content.Installations[installationID] = keyID
+
+	data, err := json.MarshalIndent(content, "", "    ")
+	if err != nil {
+		return "", err
+	}
+
+	// The file is replaced at once, so that servers reloading it never see
+	// it half written.
+	if err := replaceFile(ks.path, data); err != nil {
+		return "", errors.Wrap(err, "failed to replace key file")
+	}
+
+	ks.keys[keyID] = key
+	ks.installations[installationID] = keyID
+	return keyID, nil
+}
+
+func (ks *fileKeyStore) maybeReload() {
+	now := ks.nowFn()
+
+	ks.mu.Lock()
+	if now.Sub(ks.lastCheck) < keyStoreCheckInterval {
+		ks.mu.Unlock()
+		return
+	}
+	ks.lastCheck = now
+	ks.mu.Unlock()
+
+	info, err := os.Stat(ks.path)
+	if err != nil {
+		ks.logger.Warn("failed to stat key file", mlog.Err(err))
+		return
+	}
+
+	ks.mu.RLock()
+	changed := !info.ModTime().Equal(ks.modTime)
+	ks.mu.RUnlock()
+	if !changed {
+		return
+	}
+
+	if err := ks.load(); err != nil {
+		ks.logger.Warn("failed to reload key file, keeping the previous keys", mlog.Err(err))
+		return
+	}
+	ks.logger.Info("reloaded key file", mlog.String("key_file", ks.path))
+}
+
+func (ks *fileKeyStore) load() error {
+	info, err := os.Stat(ks.path)
+	if err != nil {
+		return errors.Wrap(err, "failed to stat key file")
+	}
+	content, err := readKeyFile(ks.path)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string][]byte, len(content.Keys))
+	for keyID, encoded := range content.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != dataKeySize {
+			return errors.Errorf("key %q must be %d base64 encoded bytes", keyID, dataKeySize)
+		}
+		keys[keyID] = key
+	}
+	installations := make(map[string]string, len(content.Installations))
+	for installationID, keyID := range content.Installations {
+		if _, ok := keys[keyID]; !ok {
+			return errors.Errorf("unknown key %q for installation %s", keyID, installationID)
+		}
+		installations[installationID] = keyID
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys = keys
+	ks.installations = installations
+	ks.modTime = info.ModTime()
+	ks.lastCheck = ks.nowFn()
+	return nil
+}
+
+func readKeyFile(path string) (*keyFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read key file")
+	}
+	var content keyFile
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, errors.Wrap(err, "failed to decode key file")
+	}
+	return &content, nil
+}
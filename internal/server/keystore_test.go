@@ -0,0 +1,112 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileKeyStore(t *testing.T) {
+	logger := mlog.NewTestingLogger(t, os.Stderr)
+	key1 := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("1", dataKeySize)))
+	key2 := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("2", dataKeySize)))
+
+	writeKeys := func(t *testing.T, path, content string) {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	}
+
+	t.Run("keys", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "keys.json")
+		writeKeys(t, path, `{"Keys": {"k1": "`+key1+`", "k2": "`+key2+`"}, "Installations": {"inst1": "k2"}}`)
+		ks, err := newFileKeyStore(path, logger)
+		require.NoError(t, err)
+
+		keyID, key, err := ks.currentKey("inst1")
+		require.NoError(t, err)
+		assert.Equal(t, "k2", keyID)
+		assert.Equal(t, strings.Repeat("2", dataKeySize), string(key))
+
+		key, err = ks.key("k1")
+		require.NoError(t, err)
+		assert.Equal(t, strings.Repeat("1", dataKeySize), string(key))
+
+		_, _, err = ks.currentKey("inst2")
+		assert.ErrorIs(t, err, errNoInstallationKey)
+		_, err = ks.key("k3")
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid files", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "keys.json")
+		for _, content := range []string{
+			`{"Keys": {"k1": "c2hvcnQ="}}`,
+			`{"Keys": {"k1": "` + key1 + `"}, "Installations": {"inst1": "k2"}}`,
+			`not json`,
+		} {
+			writeKeys(t, path, content)
+			_, err := newFileKeyStore(path, logger)
+			assert.Error(t, err, content)
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "keys.json")
+		writeKeys(t, path, `{"Keys": {"k1": "`+key1+`"}, "Installations": {"inst1": "k1"}}`)
+		ks, err := newFileKeyStore(path, logger)
+		require.NoError(t, err)
+
+		now := time.Now()
+		ks.nowFn = func() time.Time { return now }
+		writeKeys(t, path, `{"Keys": {"k1": "`+key1+`", "k2": "`+key2+`"}, "Installations": {"inst1": "k2"}}`)
+		require.NoError(t, os.Chtimes(path, now.Add(time.Minute), now.Add(time.Minute)))
+
+		keyID, _, err := ks.currentKey("inst1")
+		require.NoError(t, err)
+		assert.Equal(t, "k1", keyID, "the file is only checked every few seconds")
+
+		now = now.Add(keyStoreCheckInterval)
+		keyID, _, err = ks.currentKey("inst1")
+		require.NoError(t, err)
+		assert.Equal(t, "k2", keyID)
+	})
+
+	t.Run("rotate", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "keys.json")
+		writeKeys(t, path, `{"Keys": {"k1": "`+key1+`"}, "Installations": {"inst1": "k1"}}`)
+		ks, err := newFileKeyStore(path, logger)
+		require.NoError(t, err)
+
+		keyID, err := ks.rotate("inst1")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(keyID, "inst1-"))
+
+		current, _, err := ks.currentKey("inst1")
+		require.NoError(t, err)
+		assert.Equal(t, keyID, current)
+
+		// The file has the new key, and still the previous one.
+		reloaded, err := newFileKeyStore(path, logger)
+		require.NoError(t, err)
+		current, _, err = reloaded.currentKey("inst1")
+		require.NoError(t, err)
+		assert.Equal(t, keyID, current)
+		_, err = reloaded.key("k1")
+		assert.NoError(t, err)
+
+		keyID, err = ks.rotate("inst2")
+		require.NoError(t, err)
+		current, _, err = ks.currentKey("inst2")
+		require.NoError(t, err)
+		assert.Equal(t, keyID, current)
+	})
+}
@@ -0,0 +1,304 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+// Reasons an installation gets frozen for.
+const (
+	freezeReasonDeletes    = "deletes"
+	freezeReasonOverwrites = "overwrites"
+	freezeReasonManual     = "manual"
+)
+
+// maxDeleteObjectsBodySize bounds the body of DeleteObjects requests, which
+// have at most 1000 keys of at most 1024 bytes.
+const maxDeleteObjectsBodySize = 2 * 1024 * 1024
+
+// defaultMassDeleteThresholds are used when MassDeleteSettings.Thresholds is
+// empty.
+var defaultMassDeleteThresholds = []MassDeleteThreshold{
+	{WindowSecs: 60, MaxDeletes: 1000, MaxOverwrites: 1000},
+	{WindowSecs: 3600, MaxDeletes: 10000, MaxOverwrites: 10000},
+}
+
+// writeActivity is the number of objects an installation deleted and
+// overwrote within a second.
+type writeActivity struct {
+	at         time.Time
+	deletes    int
+	overwrites int
+}
+
+// massDeleteDetector watches the deletes and overwrites of every
+// installation over sliding windows, and freezes the installations that do
+// more of them than the thresholds allow. Frozen installations can only read
+// until an administrator unfreezes them.
+type massDeleteDetector struct {
+	thresholds []MassDeleteThreshold
+	maxWindow  time.Duration
+	overwrites bool
+	states     *stateStore
+	metrics    *metrics
+	logger     *mlog.Logger
+	nowFn      func() time.Time
+
+	mu       sync.Mutex
+	activity map[string][]writeActivity
+}
+
+func newMassDeleteDetector(settings MassDeleteSettings, states *stateStore, m *metrics, logger *mlog.Logger) *massDeleteDetector {
+	thresholds := settings.Thresholds
+	if len(thresholds) == 0 {
+		thresholds = defaultMassDeleteThresholds
+	}
+	d := &massDeleteDetector{
+		thresholds: thresholds,
+		states:     states,
+		metrics:    m,
+		logger:     logger,
+		nowFn:      time.Now,
+		activity:   make(map[string][]writeActivity),
+	}
+	for _, threshold := range thresholds {
+		d.maxWindow = max(d.maxWindow, time.Duration(threshold.WindowSecs)*time.Second)
+		d.overwrites = d.overwrites || threshold.MaxOverwrites > 0
+	}
+	return d
+}
+
+// record adds the deletes and overwrites of a successful request to the
+// activity of the installation, and freezes the installation if they cross
+// a threshold.
+func (d *massDeleteDetector) record(installationID string, deletes, overwrites int) {
+	now := d.nowFn()
+	second := now.Truncate(time.Second)
+
+	d.mu.Lock()
+	activity := d.activity[installationID]
+	kept := activity[:0]
+	for _, a := range activity {
+		if now.Sub(a.at) < d.maxWindow {
+			kept = append(kept, a)
+		}
+	}
+	if n := len(kept); n > 0 && kept[n-1].at.Equal(second) {
+		kept[n-1].deletes += deletes
+		kept[n-1].overwrites += overwrites
+	} else {
+		kept = append(kept, writeActivity{at: second, deletes: deletes, overwrites: overwrites})
+	}
+	d.activity[installationID] = kept
+
+	freeze := d.crossedThreshold(now, kept)
+	if freeze != nil {
+		delete(d.activity, installationID)
+	}
+	d.mu.Unlock()
+
+	if freeze != nil {
+		d.freeze(installationID, freeze)
+	}
+}
+
+// crossedThreshold returns the freeze for the first threshold the activity
+// crosses, if any.
+func (d *massDeleteDetector) crossedThreshold(now time.Time, activity []writeActivity) *freezeState {
+	for _, threshold := range d.thresholds {
+		window := time.Duration(threshold.WindowSecs) * time.Second
+		var deletes, overwrites int
+		for _, a := range activity {
+			if now.Sub(a.at) < window {
+				deletes += a.deletes
+				overwrites += a.overwrites
+			}
+		}
+
+		freeze := &freezeState{Since: now.UTC(), WindowSecs: threshold.WindowSecs, Deletes: deletes, Overwrites: overwrites}
+		switch {
+		case threshold.MaxDeletes > 0 && deletes > threshold.MaxDeletes:
+			freeze.Reason = freezeReasonDeletes
+		case threshold.MaxOverwrites > 0 && overwrites > threshold.MaxOverwrites:
+			freeze.Reason = freezeReasonOverwrites
+		default:
+			continue
+		}
+		return freeze
+	}
+	return nil
+}
+
+func (d *massDeleteDetector) freeze(installationID string, freeze *freezeState) {
+	var alreadyFrozen bool
+	err := d.states.update(installationID, func(state *installationState) {
+		alreadyFrozen = state.Frozen != nil
+		if !alreadyFrozen {
+			state.Frozen = freeze
+		}
+	})
+	if alreadyFrozen {
+		return
+	}
+	if err != nil {
+		// The installation is frozen until the server restarts anyway.
+		d.logger.Error("failed to save installation freeze", mlog.String("installation_id", installationID), mlog.Err(err))
+	}
+
+	d.metrics.setInstallationFrozen(installationID, true)
+	d.metrics.incInstallationFreeze(installationID, freeze.Reason)
+	d.logger.Error("froze installation after a burst of writes",
+		mlog.String("event", "installation_frozen"),
+		mlog.String("installation_id", installationID),
+		mlog.String("reason", freeze.Reason),
+		mlog.Int("window_secs", freeze.WindowSecs),
+		mlog.Int("deletes", freeze.Deletes),
+		mlog.Int("overwrites", freeze.Overwrites),
+	)
+}
+
+// reset forgets the activity of the installation, once it is unfrozen.
+func (d *massDeleteDetector) reset(installationID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.activity, installationID)
+}
+
+// guardWrites rejects the requests of frozen installations, except for
+// reads and aborted multipart uploads. When mass delete detection is
+// enabled, it returns the function that records the deletes and overwrites
+// of the request, to be called once the request succeeded. Objects are
+// overwritten by PutObject, CopyObject and CompleteMultipartUpload requests
+// for keys that exist, which is checked beforehand.
+func (s *Server) guardWrites(r *http.Request, op s3Request, installationID string) (func(), error) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || op.Operation == opAbortMultipartUpload {
+		return nil, nil
+	}
+
+	// The keys of DeleteObjects requests can belong to any installation.
+	deletes := map[string]int{installationID: 0}
+	if op.Operation == opDeleteObjects {
+		request, err := readDeleteObjectsRequest(r)
+		if err != nil {
+			return nil, err
+		}
+		deletes = request.installations()
+	}
+	for id := range deletes {
+		if s.states.get(id).Frozen != nil {
+			s.metrics.incRejectedRequest(id, "frozen")
+			return nil, &s3Error{StatusCode: http.StatusForbidden, Code: "AccessDenied", Message: "Installation " + id + " is frozen. Writes are rejected until an administrator unfreezes it."}
+		}
+	}
+
+	if s.massDeletes == nil {
+		return nil, nil
+	}
+	overwrites := 0
+	switch op.Operation {
+	case opDeleteObject:
+		deletes[installationID] = 1
+	case opDeleteObjects:
+	case opPutObject, opCopyObject, opCompleteMultipartUpload:
+		if !s.massDeletes.overwrites {
+			return nil, nil
+		}
+		_, _, err := s.headObject(r.Context(), "/"+op.Key)
+		if isS3ErrorCode(err, "404") {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to check whether the object exists")
+		}
+		overwrites = 1
+	default:
+		return nil, nil
+	}
+
+	return func() {
+		for id, n := range deletes {
+			s.massDeletes.record(id, n, overwrites)
+		}
+	}, nil
+}
+
+// deleteObjectsRequest is the body of a DeleteObjects request.
+type deleteObjectsRequest struct {
+	Objects []struct {
+		Key       string
+		VersionId string
+	} `xml:"Object"`
+}
+
+// installations returns the number of keys of each installation in the
+// request.
+func (req *deleteObjectsRequest) installations() map[string]int {
+	keys := make(map[string]int)
+	for _, object := range req.Objects {
+		installationID, _, _ := strings.Cut(object.Key, "/")
+		keys[installationID]++
+	}
+	return keys
+}
+
+// readDeleteObjectsRequest decodes the body of a DeleteObjects request. The
+// body is read, and replaced so that it can still be sent.
+func readDeleteObjectsRequest(r *http.Request) (*deleteObjectsRequest, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxDeleteObjectsBodySize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read request body")
+	}
+	if len(body) > maxDeleteObjectsBodySize {
+		return nil, &s3Error{StatusCode: http.StatusBadRequest, Code: "MalformedXML", Message: "The XML you provided was not well-formed or did not validate against our published schema."}
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var request deleteObjectsRequest
+	if err := xml.Unmarshal(body, &request); err != nil {
+		return nil, &s3Error{StatusCode: http.StatusBadRequest, Code: "MalformedXML", Message: "The XML you provided was not well-formed or did not validate against our published schema."}
+	}
+	return &request, nil
+}
+
+// unfreezeInstallation lets the installation write again.
+func (s *Server) unfreezeInstallation(installationID string) error {
+	err := s.states.update(installationID, func(state *installationState) {
+		state.Frozen = nil
+	})
+	if s.massDeletes != nil {
+		s.massDeletes.reset(installationID)
+	}
+	s.metrics.setInstallationFrozen(installationID, false)
+	s.logger.Info("unfroze installation", mlog.String("installation_id", installationID))
+	return err
+}
+
+// freezeInstallation rejects the writes of the installation until it is
+// unfrozen.
+func (s *Server) freezeInstallation(installationID string) error {
+	var alreadyFrozen bool
+	err := s.states.update(installationID, func(state *installationState) {
+		alreadyFrozen = state.Frozen != nil
+		if !alreadyFrozen {
+			state.Frozen = &freezeState{Reason: freezeReasonManual, Since: time.Now().UTC()}
+		}
+	})
+	if alreadyFrozen {
+		return err
+	}
+	s.metrics.setInstallationFrozen(installationID, true)
+	s.metrics.incInstallationFreeze(installationID, freezeReasonManual)
+	s.logger.Info("froze installation", mlog.String("installation_id", installationID))
+	return err
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMassDeleteDetector(t *testing.T) {
+	states, err := newStateStore("")
+	require.NoError(t, err)
+	d := newMassDeleteDetector(MassDeleteSettings{Thresholds: []MassDeleteThreshold{
+		{WindowSecs: 10, MaxDeletes: 5},
+		{WindowSecs: 100, MaxDeletes: 20, MaxOverwrites: 3},
+	}}, states, newMetrics(), mlog.NewTestingLogger(t, os.Stderr))
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	d.nowFn = func() time.Time { return now }
+
+	t.Run("deletes spread over time stay below the short window", func(t *testing.T) {
+		for i := 0; i < 15; i++ {
+			d.record("slow", 1, 0)
+			now = now.Add(3 * time.Second)
+		}
+		assert.Nil(t, states.get("slow").Frozen)
+	})
+
+	t.Run("short window", func(t *testing.T) {
+		d.record("burst", 5, 0)
+		assert.Nil(t, states.get("burst").Frozen)
+		d.record("burst", 1, 0)
+		freeze := states.get("burst").Frozen
+		require.NotNil(t, freeze)
+		assert.Equal(t, freezeReasonDeletes, freeze.Reason)
+		assert.Equal(t, 10, freeze.WindowSecs)
+		assert.Equal(t, 6, freeze.Deletes)
+	})
+
+	t.Run("overwrites", func(t *testing.T) {
+		for i := 0; i < 4; i++ {
+			d.record("overwriter", 0, 1)
+			now = now.Add(20 * time.Second)
+		}
+		freeze := states.get("overwriter").Frozen
+		require.NotNil(t, freeze)
+		assert.Equal(t, freezeReasonOverwrites, freeze.Reason)
+		assert.Equal(t, 100, freeze.WindowSecs)
+	})
+
+	t.Run("long window", func(t *testing.T) {
+		for i := 0; i < 21; i++ {
+			d.record("steady", 1, 0)
+			now = now.Add(4 * time.Second)
+		}
+		require.NotNil(t, states.get("steady").Frozen)
+	})
+}
+
+func TestFrozenInstallations(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{MassDeleteSettings: MassDeleteSettings{
+		Enable:     true,
+		Thresholds: []MassDeleteThreshold{{WindowSecs: 60, MaxDeletes: 3, MaxOverwrites: 2}},
+	}})
+	handler := s.handler()
+
+	for i := 0; i < 5; i++ {
+		fake.put(fmt.Sprintf("inst/%d", i), []byte("data"), nil)
+	}
+
+	for i := 0; i < 3; i++ {
+		resp := serveRequest(handler, "DELETE", fmt.Sprintf("/inst/%d", i), nil, nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+	assert.Nil(t, s.states.get("inst").Frozen)
+
+	// DeleteObjects counts every key, for the installation it belongs to.
+	body := `<Delete><Object><Key>inst/3</Key></Object><Object><Key>other/a</Key></Object></Delete>`
+	resp := serveRequest(handler, "POST", "?delete", []byte(body), nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotNil(t, s.states.get("inst").Frozen)
+	assert.Nil(t, s.states.get("other").Frozen)
+
+	resp = serveRequest(handler, "PUT", "/inst/new", []byte("data"), nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Nil(t, fake.object("inst/new"))
+
+	resp = serveRequest(handler, "POST", "?delete", []byte(`<Delete><Object><Key>inst/4</Key></Object></Delete>`), nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.NotNil(t, fake.object("inst/4"))
+
+	resp = serveRequest(handler, "GET", "/inst/4", nil, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = serveRequest(handler, "PUT", "/other/a", []byte("data"), nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.NoError(t, s.unfreezeInstallation("inst"))
+	resp = serveRequest(handler, "PUT", "/inst/new", []byte("data"), nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	t.Run("overwrites", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			resp := serveRequest(handler, "PUT", "/inst/4", []byte("encrypted"), nil)
+			resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+		freeze := s.states.get("inst").Frozen
+		require.NotNil(t, freeze)
+		assert.Equal(t, freezeReasonOverwrites, freeze.Reason)
+		assert.Equal(t, 3, freeze.Overwrites)
+	})
+}
+
+func TestReadDeleteObjectsRequest(t *testing.T) {
+	body := `<Delete><Quiet>true</Quiet><Object><Key>inst/a</Key></Object><Object><Key>inst/b/c</Key><VersionId>1</VersionId></Object><Object><Key>other/d</Key></Object></Delete>`
+	req, err := http.NewRequest("POST", "http://example.com/agnivatest?delete", strings.NewReader(body))
+	require.NoError(t, err)
+
+	request, err := readDeleteObjectsRequest(req)
+	require.NoError(t, err)
+	require.Len(t, request.Objects, 3)
+	assert.Equal(t, "inst/b/c", request.Objects[1].Key)
+	assert.Equal(t, "1", request.Objects[1].VersionId)
+	assert.Equal(t, map[string]int{"inst": 2, "other": 1}, request.installations())
+
+	// The body can still be sent.
+	sent, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(sent))
+
+	req, err = http.NewRequest("POST", "http://example.com/agnivatest?delete", strings.NewReader("<Delete>"))
+	require.NoError(t, err)
+	_, err = readDeleteObjectsRequest(req)
+	var s3Err *s3Error
+	require.ErrorAs(t, err, &s3Err)
+	assert.Equal(t, "MalformedXML", s3Err.Code)
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// bifrostMetadataPrefix is the prefix of the metadata Bifrost keeps on the
+// objects it transforms. Clients never see it, and can't set it.
+const bifrostMetadataPrefix = "X-Amz-Meta-Bifrost-"
+
+// removeBifrostMetadata removes the metadata of Bifrost from the header.
+func removeBifrostMetadata(header http.Header) {
+	for name := range header {
+		if strings.HasPrefix(name, bifrostMetadataPrefix) {
+			header.Del(name)
+		}
+	}
+}
+
+// Headers of an object that are its metadata, and have to be set again when
+// the metadata is replaced.
+var objectMetadataHeaders = []string{
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Type",
+	"Expires",
+	"X-Amz-Server-Side-Encryption",
+	"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id",
+	"X-Amz-Storage-Class",
+	"X-Amz-Website-Redirect-Location",
+}
+
+// objectMetadata returns the metadata of the object with the given headers,
+// as the headers that set it on a copy with the metadata replaced. Copies of
+// large objects are made part by part and always need it.
+func objectMetadata(header http.Header) http.Header {
+	metadata := make(http.Header)
+	for name, values := range header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			metadata[name] = values
+		}
+	}
+	for _, name := range objectMetadataHeaders {
+		if values, ok := header[name]; ok {
+			metadata[name] = values
+		}
+	}
+	return metadata
+}
+
+// isTransformedObject reports whether the object with the given headers is
+// stored encrypted or compressed, and can't be read from S3 as it is.
+func isTransformedObject(header http.Header) bool {
+	return header.Get(encryptionHeader) != "" || header.Get(compressionHeader) != ""
+}
+
+// prepareCopy keeps the metadata of Bifrost on objects copied with their
+// metadata replaced, since the copy is stored the same way as the source.
+// Parts of a multipart upload can't be copied from a transformed object,
+// whose bytes in S3 don't match the ones the client sees.
+func (s *Server) prepareCopy(r *http.Request, op s3Request) error {
+	switch op.Operation {
+	case opUploadPartCopy:
+	case opCopyObject:
+		// S3 copies the metadata along with the object, unless it is
+		// replaced by the metadata of the request.
+		if !strings.EqualFold(r.Header.Get("X-Amz-Metadata-Directive"), "REPLACE") {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	source, err := s.copySourceHeader(r)
+	if err != nil {
+		return err
+	}
+	if op.Operation == opUploadPartCopy {
+		if isTransformedObject(source) {
+			return &s3Error{StatusCode: http.StatusNotImplemented, Code: "NotImplemented", Message: "UploadPartCopy is not supported for encrypted or compressed objects."}
+		}
+		return nil
+	}
+	for name, values := range source {
+		if strings.HasPrefix(name, bifrostMetadataPrefix) {
+			r.Header[name] = values
+		}
+	}
+	return nil
+}
+
+// copySourceKey returns the key of the source object of a copy.
+func (s *Server) copySourceKey(r *http.Request) (string, error) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return "", &s3Error{StatusCode: http.StatusBadRequest, Code: "InvalidArgument", Message: "Invalid copy source."}
+	}
+	source, _, _ = strings.Cut(source, "?versionId=")
+	key, ok := strings.CutPrefix(strings.TrimPrefix(source, "/"), s.cfg.S3Settings.Bucket+"/")
+	if !ok {
+		return "", &s3Error{StatusCode: http.StatusBadRequest, Code: "InvalidArgument", Message: "Copy source must be in bucket " + s.cfg.S3Settings.Bucket + "."}
+	}
+	return key, nil
+}
+
+// copySourceHeader returns the headers of the source object of a copy.
+func (s *Server) copySourceHeader(r *http.Request) (http.Header, error) {
+	key, err := s.copySourceKey(r)
+	if err != nil {
+		return nil, err
+	}
+
+	header, _, err := s.headObject(r.Context(), "/"+key)
+	if err != nil {
+		return nil, err
+	}
+	return header, nil
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoveBifrostMetadata(t *testing.T) {
+	header := http.Header{
+		"X-Amz-Meta-Bifrost-Compression": {"zstd"},
+		"X-Amz-Meta-Bifrost-Key":         {"key"},
+		"X-Amz-Meta-Author":              {"someone"},
+		"Content-Type":                   {"text/plain"},
+	}
+	removeBifrostMetadata(header)
+	assert.Equal(t, http.Header{
+		"X-Amz-Meta-Author": {"someone"},
+		"Content-Type":      {"text/plain"},
+	}, header)
+}
+
+func TestPrepareCopy(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{})
+	fake.put("inst/compressed", []byte("data"), http.Header{compressionHeader: {compressionZstd}, originalSizeHeader: {"100"}})
+	fake.put("inst/plain", []byte("data"), http.Header{"X-Amz-Meta-Author": {"someone"}})
+
+	t.Run("metadata of Bifrost is kept when replaced", func(t *testing.T) {
+		resp := serveRequest(s.handler(), "PUT", "/inst/copy", nil, http.Header{
+			"X-Amz-Copy-Source":        {"/agnivatest/inst/compressed"},
+			"X-Amz-Metadata-Directive": {"REPLACE"},
+			compressionHeader:          {"other"},
+		})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		s.cfg.CompressionSettings.Enable = true
+		defer func() { s.cfg.CompressionSettings.Enable = false }()
+		resp = serveRequest(s.handler(), "PUT", "/inst/copy", nil, http.Header{
+			"X-Amz-Copy-Source":        {"/agnivatest/inst/compressed"},
+			"X-Amz-Metadata-Directive": {"REPLACE"},
+		})
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		obj := fake.object("inst/copy")
+		require.NotNil(t, obj)
+		assert.Equal(t, compressionZstd, obj.header.Get(compressionHeader))
+		assert.Equal(t, "100", obj.header.Get(originalSizeHeader))
+	})
+
+	t.Run("parts can't be copied from transformed objects", func(t *testing.T) {
+		for source, expected := range map[string]int{
+			"/agnivatest/inst/compressed": http.StatusNotImplemented,
+			"/agnivatest/inst/plain":      http.StatusOK,
+		} {
+			req, err := http.NewRequest("PUT", "http://example.com/agnivatest/inst/dest?partNumber=1&uploadId=1", nil)
+			require.NoError(t, err)
+			req.Header.Set("X-Amz-Copy-Source", source)
+			err = s.prepareCopy(req, s3Request{Operation: opUploadPartCopy})
+			if expected == http.StatusOK {
+				assert.NoError(t, err)
+				continue
+			}
+			var s3Err *s3Error
+			require.ErrorAs(t, err, &s3Err)
+			assert.Equal(t, expected, s3Err.StatusCode)
+		}
+	})
+}
@@ -20,6 +20,22 @@ const (
 type metrics struct {
 	registry         *prometheus.Registry
 	requestsDuration *prometheus.HistogramVec
+	upstreamHealthy  *prometheus.GaugeVec
+	breakerState     *prometheus.GaugeVec
+	concurrencyLimit *prometheus.GaugeVec
+	rejectedRequests *prometheus.CounterVec
+	parallelGets     prometheus.Counter
+	multipartSplits  prometheus.Counter
+	staleUploads     *prometheus.CounterVec
+	staleUploadBytes *prometheus.CounterVec
+	coalesced        prometheus.Counter
+	frozen           *prometheus.GaugeVec
+	freezes          *prometheus.CounterVec
+	trashed          *prometheus.CounterVec
+	trashPurged      *prometheus.CounterVec
+	events           *prometheus.CounterVec
+	webhookDelivered *prometheus.CounterVec
+	objectScans      *prometheus.CounterVec
 }
 
 func newMetrics() *metrics {
@@ -41,6 +57,163 @@ func newMetrics() *metrics {
 	)
 	m.registry.MustRegister(m.requestsDuration)
 
+	m.upstreamHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "upstream_healthy",
+			Help:      "Whether the S3 endpoint passed its last health check.",
+		},
+		[]string{"endpoint"},
+	)
+	m.registry.MustRegister(m.upstreamHealthy)
+
+	m.breakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "circuit_breaker_state",
+			Help:      "State of the circuit breaker: 0 closed, 1 half-open, 2 open. An empty installation ID is the whole route.",
+		},
+		[]string{"installation_id"},
+	)
+	m.registry.MustRegister(m.breakerState)
+
+	m.concurrencyLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "concurrency_limit",
+			Help:      "Current adaptive concurrency limit. An empty installation ID is the whole route.",
+		},
+		[]string{"installation_id"},
+	)
+	m.registry.MustRegister(m.concurrencyLimit)
+
+	m.rejectedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rejected_requests_total",
+			Help:      "Requests rejected without reaching S3.",
+		},
+		[]string{"installation_id", "reason"},
+	)
+	m.registry.MustRegister(m.rejectedRequests)
+
+	m.parallelGets = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "parallel_gets_total",
+			Help:      "Objects downloaded with parallel ranged requests.",
+		},
+	)
+	m.registry.MustRegister(m.parallelGets)
+
+	m.multipartSplits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "multipart_splits_total",
+			Help:      "PutObject requests uploaded as multipart uploads.",
+		},
+	)
+	m.registry.MustRegister(m.multipartSplits)
+
+	m.staleUploads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "stale_multipart_uploads_total",
+			Help:      "Stale multipart uploads found by the janitor. They are only aborted if dry_run is false.",
+		},
+		[]string{"installation_id", "dry_run"},
+	)
+	m.registry.MustRegister(m.staleUploads)
+
+	m.staleUploadBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "stale_multipart_upload_bytes_total",
+			Help:      "Bytes held by stale multipart uploads found by the janitor. They are only reclaimed if dry_run is false.",
+		},
+		[]string{"installation_id", "dry_run"},
+	)
+	m.registry.MustRegister(m.staleUploadBytes)
+
+	m.coalesced = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "coalesced_requests_total",
+			Help:      "Requests served with the response of an identical request in flight.",
+		},
+	)
+	m.registry.MustRegister(m.coalesced)
+
+	m.frozen = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "installation_frozen",
+			Help:      "Whether the writes of the installation are frozen.",
+		},
+		[]string{"installation_id"},
+	)
+	m.registry.MustRegister(m.frozen)
+
+	m.freezes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "installation_freezes_total",
+			Help:      "Installations frozen, by reason. Reasons other than manual mean that a mass delete threshold was crossed.",
+		},
+		[]string{"installation_id", "reason"},
+	)
+	m.registry.MustRegister(m.freezes)
+
+	m.trashed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "trashed_objects_total",
+			Help:      "Deleted objects moved to the trash of the installation.",
+		},
+		[]string{"installation_id"},
+	)
+	m.registry.MustRegister(m.trashed)
+
+	m.trashPurged = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "trash_purged_objects_total",
+			Help:      "Objects purged from the trash of the installation once past their retention.",
+		},
+		[]string{"installation_id"},
+	)
+	m.registry.MustRegister(m.trashPurged)
+
+	m.events = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "events_total",
+			Help:      "Object events emitted, by event name.",
+		},
+		[]string{"event_name"},
+	)
+	m.registry.MustRegister(m.events)
+
+	m.webhookDelivered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "webhook_deliveries_total",
+			Help:      "Attempts to deliver events to webhooks, by webhook host and result: success, retry or dead_letter.",
+		},
+		[]string{"webhook", "result"},
+	)
+	m.registry.MustRegister(m.webhookDelivered)
+
+	m.objectScans = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "object_scans_total",
+			Help:      "Objects scanned for malware, by installation and result: clean, infected or error.",
+		},
+		[]string{"installation_id", "result"},
+	)
+	m.registry.MustRegister(m.objectScans)
+
 	return m
 }
 
@@ -54,6 +227,88 @@ func (m *metrics) observeRequest(method, installationID string, statusCode int,
 	).Observe(duration)
 }
 
+func (m *metrics) setUpstreamHealth(endpoint string, healthy bool) {
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	m.upstreamHealthy.With(prometheus.Labels{"endpoint": endpoint}).Set(value)
+}
+
+// setFlowControl records the circuit breaker state and concurrency limit of
+// the scope. A negative limit means that the scope has no limit.
+func (m *metrics) setFlowControl(installationID string, state int, limit float64) {
+	labels := prometheus.Labels{"installation_id": installationID}
+	m.breakerState.With(labels).Set(float64(state))
+	if limit >= 0 {
+		m.concurrencyLimit.With(labels).Set(limit)
+	}
+}
+
+// deleteFlowControl removes the flow control metrics of the scope.
+func (m *metrics) deleteFlowControl(installationID string) {
+	labels := prometheus.Labels{"installation_id": installationID}
+	m.breakerState.Delete(labels)
+	m.concurrencyLimit.Delete(labels)
+	for _, reason := range []string{rejectedCircuitOpen, rejectedConcurrencyLimit} {
+		m.rejectedRequests.Delete(prometheus.Labels{"installation_id": installationID, "reason": reason})
+	}
+}
+
+func (m *metrics) incRejectedRequest(installationID, reason string) {
+	m.rejectedRequests.With(prometheus.Labels{"installation_id": installationID, "reason": reason}).Inc()
+}
+
+func (m *metrics) incParallelGet() {
+	m.parallelGets.Inc()
+}
+
+func (m *metrics) incMultipartSplit() {
+	m.multipartSplits.Inc()
+}
+
+func (m *metrics) addStaleMultipartUpload(installationID string, bytes int64, dryRun bool) {
+	labels := prometheus.Labels{"installation_id": installationID, "dry_run": strconv.FormatBool(dryRun)}
+	m.staleUploads.With(labels).Inc()
+	m.staleUploadBytes.With(labels).Add(float64(bytes))
+}
+
+func (m *metrics) incCoalescedRequest() {
+	m.coalesced.Inc()
+}
+
+func (m *metrics) setInstallationFrozen(installationID string, frozen bool) {
+	value := 0.0
+	if frozen {
+		value = 1
+	}
+	m.frozen.With(prometheus.Labels{"installation_id": installationID}).Set(value)
+}
+
+func (m *metrics) incInstallationFreeze(installationID, reason string) {
+	m.freezes.With(prometheus.Labels{"installation_id": installationID, "reason": reason}).Inc()
+}
+
+func (m *metrics) incTrashedObject(installationID string) {
+	m.trashed.With(prometheus.Labels{"installation_id": installationID}).Inc()
+}
+
+func (m *metrics) incTrashPurgedObject(installationID string) {
+	m.trashPurged.With(prometheus.Labels{"installation_id": installationID}).Inc()
+}
+
+func (m *metrics) incEvent(name string) {
+	m.events.With(prometheus.Labels{"event_name": name}).Inc()
+}
+
+func (m *metrics) incWebhookDelivery(webhook, result string) {
+	m.webhookDelivered.With(prometheus.Labels{"webhook": webhook, "result": result}).Inc()
+}
+
+func (m *metrics) incObjectScan(installationID, result string) {
+	m.objectScans.With(prometheus.Labels{"installation_id": installationID, "result": result}).Inc()
+}
+
 // metricsHandler returns the handler that is going to be used by the
 // service to expose the metrics.
 func (m *metrics) metricsHandler() http.Handler {
@@ -13,12 +13,13 @@ import (
 
 func TestMetrics(t *testing.T) {
 	metrics := newMetrics()
-	server := New(Config{
+	server, err := New(Config{
 		ServiceSettings: ServiceSettings{
 			Host:        "localhost:12345",
 			ServiceHost: "localhost:12346",
 		},
 	})
+	require.NoError(t, err)
 
 	go func() {
 		if err := server.Start(); err != nil {
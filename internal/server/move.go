@@ -0,0 +1,945 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+	"github.com/pkg/errors"
+)
+
+// Phases of the move of an installation.
+const (
+	movePhaseCopy   = "copy"
+	movePhaseVerify = "verify"
+	movePhaseDelete = "delete"
+	movePhaseDone   = "done"
+)
+
+const (
+	// moveConcurrency is the number of objects a move copies at the same
+	// time.
+	moveConcurrency = 8
+	// maxMoveVerifyPasses bounds the passes of the verification, which copy
+	// the objects that changed at their old key during the previous pass.
+	maxMoveVerifyPasses = 3
+)
+
+// moveState tracks the move of the objects of an installation to the prefix
+// of another one. It is kept in the state of the installation moved from,
+// and the one moved to has MovingFrom. The phase, last key and counts are
+// the checkpoint of the move: the copy resumes after the last key, and the
+// verification and deletion start over.
+type moveState struct {
+	To          string     `json:"to"`
+	StartedAt   time.Time  `json:"started_at"`
+	Phase       string     `json:"phase"`
+	LastKey     string     `json:"last_key,omitempty"`
+	Copied      int        `json:"copied,omitempty"`
+	Bytes       int64      `json:"bytes,omitempty"`
+	Skipped     int        `json:"skipped,omitempty"`
+	Recopied    int        `json:"recopied,omitempty"`
+	Deleted     int        `json:"deleted,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// moveLocks serializes the changes of the keys of moving installations,
+// between the requests and the moves, which only copy the objects that are
+// newer at their old key than at their new one. It also keeps track of the
+// moves running in the background.
+type moveLocks struct {
+	mu      sync.Mutex
+	keys    map[string]*keyLock
+	running map[string]bool
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newMoveLocks() *moveLocks {
+	return &moveLocks{
+		keys:    make(map[string]*keyLock),
+		running: make(map[string]bool),
+	}
+}
+
+// lock locks the keys, in order, and returns the function that unlocks them.
+func (l *moveLocks) lock(keys ...string) func() {
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+	locks := make([]*keyLock, 0, len(keys))
+	for _, key := range keys {
+		l.mu.Lock()
+		kl, ok := l.keys[key]
+		if !ok {
+			kl = &keyLock{}
+			l.keys[key] = kl
+		}
+		kl.refs++
+		l.mu.Unlock()
+
+		kl.Lock()
+		locks = append(locks, kl)
+	}
+
+	return func() {
+		for i, kl := range locks {
+			kl.Unlock()
+			l.mu.Lock()
+			kl.refs--
+			if kl.refs == 0 {
+				delete(l.keys, keys[i])
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// start reports whether the move of the installation can start, which it
+// can't while it is already running.
+func (l *moveLocks) start(installationID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.running[installationID] {
+		return false
+	}
+	l.running[installationID] = true
+	return true
+}
+
+func (l *moveLocks) finish(installationID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.running, installationID)
+}
+
+// movePair returns the installation moved from and the one moved to, when
+// the installation is one of them.
+func (s *Server) movePair(installationID string) (string, string, bool) {
+	if installationID == "" {
+		return "", "", false
+	}
+	state := s.states.get(installationID)
+	switch {
+	case state.Moving != nil:
+		return installationID, state.Moving.To, true
+	case state.MovingFrom != "":
+		return state.MovingFrom, installationID, true
+	}
+	return "", "", false
+}
+
+// startMove starts moving the objects of the installation to the prefix of
+// another one, or resumes the move. From now on, the requests of both
+// installations are routed to where their objects are.
+func (s *Server) startMove(from, to string) (*moveState, error) {
+	for _, id := range []string{from, to} {
+		if id == "" || strings.Contains(id, "/") {
+			return nil, &s3Error{StatusCode: http.StatusBadRequest, Code: "InvalidArgument", Message: "Invalid installation ID " + id + "."}
+		}
+	}
+	if from == to {
+		return nil, &s3Error{StatusCode: http.StatusBadRequest, Code: "InvalidArgument", Message: "An installation can't be moved to itself."}
+	}
+
+	conflict := func(message string) error {
+		return &s3Error{StatusCode: http.StatusConflict, Code: "OperationAborted", Message: message}
+	}
+	fromState, toState := s.states.get(from), s.states.get(to)
+	switch {
+	case fromState.Deleting != nil || toState.Deleting != nil:
+		return nil, conflict("Installations being deleted can't be moved.")
+	case fromState.Moving != nil && fromState.Moving.To != to:
+		return nil, conflict("Installation " + from + " is already moving to " + fromState.Moving.To + ".")
+	case fromState.MovingFrom != "" || toState.Moving != nil:
+		return nil, conflict("Installations can't be moved to an installation that is moving, or from one that is being moved to.")
+	case toState.MovingFrom != "" && toState.MovingFrom != from:
+		return nil, conflict("Installation " + toState.MovingFrom + " is already moving to " + to + ".")
+	}
+
+	err := s.states.update(to, func(state *installationState) {
+		state.MovingFrom = from
+	})
+	if err != nil {
+		return nil, err
+	}
+	var moving moveState
+	err = s.states.update(from, func(state *installationState) {
+		if state.Moving == nil {
+			state.Moving = &moveState{To: to, StartedAt: time.Now().UTC(), Phase: movePhaseCopy}
+			s.logger.Info("moving installation", mlog.String("installation_id", from), mlog.String("to", to))
+		}
+		moving = *state.Moving
+	})
+	return &moving, err
+}
+
+// finishMove ends the routing of the requests of a completed move. The
+// requests of the installation moved from reach its prefix again.
+func (s *Server) finishMove(from string) error {
+	moving := s.states.get(from).Moving
+	if moving == nil {
+		return &s3Error{StatusCode: http.StatusNotFound, Code: "NoSuchInstallation", Message: "Installation " + from + " is not moving."}
+	}
+	if moving.Phase != movePhaseDone {
+		return &s3Error{StatusCode: http.StatusConflict, Code: "OperationAborted", Message: "The move of installation " + from + " has not completed."}
+	}
+
+	if err := s.states.update(moving.To, func(state *installationState) {
+		state.MovingFrom = ""
+	}); err != nil {
+		return err
+	}
+	s.logger.Info("finished moving installation", mlog.String("installation_id", from), mlog.String("to", moving.To))
+	return s.states.update(from, func(state *installationState) {
+		state.Moving = nil
+	})
+}
+
+// runMove runs the move of the installation in the background, unless it
+// is already running. Its error, if any, is kept in its state.
+func (s *Server) runMove(installationID string) {
+	if !s.moves.start(installationID) {
+		return
+	}
+	defer s.moves.finish(installationID)
+
+	err := s.MoveInstallation(s.ctx, installationID)
+	if err != nil && s.ctx.Err() == nil {
+		s.logger.Error("failed to move installation", mlog.String("installation_id", installationID), mlog.Err(err))
+	}
+	if updateErr := s.states.update(installationID, func(state *installationState) {
+		if state.Moving != nil && err != nil {
+			state.Moving.Error = err.Error()
+		}
+	}); updateErr != nil {
+		s.logger.Error("failed to save the state of the move", mlog.String("installation_id", installationID), mlog.Err(updateErr))
+	}
+}
+
+// MoveInstallation copies the objects of a moving installation to their key
+// under the prefix of the installation it moves to, with server-side copies.
+// It then verifies that every object is at its new key, copying the ones
+// that changed in the meantime, and deletes the objects at their old keys.
+// The progress is saved in the installation state after every page of
+// objects, and an interrupted move resumes from it.
+func (s *Server) MoveInstallation(ctx context.Context, installationID string) error {
+	moving := s.states.get(installationID).Moving
+	if moving == nil {
+		return errors.Errorf("installation %s is not moving", installationID)
+	}
+	from, to := installationID, moving.To
+	record := func(fn func(moving *moveState)) error {
+		return s.states.update(from, func(state *installationState) {
+			if state.Moving != nil {
+				state.Moving.Error = ""
+				fn(state.Moving)
+			}
+		})
+	}
+	s.logger.Info("running move", mlog.String("installation_id", from), mlog.String("to", to), mlog.String("phase", moving.Phase))
+
+	if moving.Phase == movePhaseCopy {
+		var mu sync.Mutex
+		var copied, skipped int
+		var copiedBytes int64
+		err := s.forEachMovedObject(ctx, from, moving.LastKey, func(rel string) error {
+			unlock := s.moves.lock(from + "/" + rel)
+			defer unlock()
+			size, ok, err := s.copyMovedObject(ctx, from, to, rel, false)
+			mu.Lock()
+			defer mu.Unlock()
+			if ok {
+				copied++
+				copiedBytes += size
+			} else if err == nil {
+				skipped++
+			}
+			return err
+		}, func(lastKey string) error {
+			err := record(func(moving *moveState) {
+				moving.LastKey = lastKey
+				moving.Copied += copied
+				moving.Bytes += copiedBytes
+				moving.Skipped += skipped
+			})
+			copied, skipped, copiedBytes = 0, 0, 0
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := record(func(moving *moveState) { moving.Phase = movePhaseVerify }); err != nil {
+			return err
+		}
+		moving.Phase = movePhaseVerify
+	}
+
+	if moving.Phase == movePhaseVerify {
+		for pass := 1; ; pass++ {
+			var mu sync.Mutex
+			recopied := 0
+			err := s.forEachMovedObject(ctx, from, "", func(rel string) error {
+				unlock := s.moves.lock(from + "/" + rel)
+				defer unlock()
+				_, ok, err := s.copyMovedObject(ctx, from, to, rel, false)
+				if ok {
+					mu.Lock()
+					recopied++
+					mu.Unlock()
+				}
+				return err
+			}, nil)
+			if err != nil {
+				return err
+			}
+			if err := record(func(moving *moveState) { moving.Recopied += recopied }); err != nil {
+				return err
+			}
+			if recopied == 0 {
+				break
+			}
+			if pass == maxMoveVerifyPasses {
+				return errors.Errorf("%d objects changed at their old key during the verification", recopied)
+			}
+		}
+		if err := record(func(moving *moveState) { moving.Phase = movePhaseDelete }); err != nil {
+			return err
+		}
+		moving.Phase = movePhaseDelete
+	}
+
+	if moving.Phase == movePhaseDelete {
+		// Objects written at their old key since the verification are copied
+		// before they are deleted, and checked again under the lock.
+		var mu sync.Mutex
+		deleted := 0
+		err := s.forEachMovedObject(ctx, from, "", func(rel string) error {
+			unlock := s.moves.lock(from + "/" + rel)
+			defer unlock()
+			if err := s.moveObject(ctx, from, to, rel, false); err != nil {
+				return err
+			}
+			mu.Lock()
+			deleted++
+			mu.Unlock()
+			return nil
+		}, func(string) error {
+			err := record(func(moving *moveState) { moving.Deleted += deleted })
+			deleted = 0
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		err = record(func(moving *moveState) {
+			now := time.Now().UTC()
+			moving.Phase = movePhaseDone
+			moving.CompletedAt = &now
+		})
+		if err != nil {
+			return err
+		}
+		s.logger.Info("moved installation", mlog.String("installation_id", from), mlog.String("to", to))
+	}
+	return nil
+}
+
+// forEachMovedObject calls fn, concurrently, with the key within the
+// installation of every object of the installation after startAfter,
+// trash included. pageDone, if any, is called with the last key of every
+// page once fn returned for all of its objects.
+func (s *Server) forEachMovedObject(ctx context.Context, installationID, startAfter string, fn func(rel string) error, pageDone func(lastKey string) error) error {
+	prefix := installationID + "/"
+	if startAfter != "" {
+		startAfter = prefix + startAfter
+	}
+	var token string
+	for {
+		page, err := s.listObjectsV2(ctx, prefix, "", startAfter, token)
+		if err != nil {
+			return err
+		}
+
+		sem := make(chan struct{}, moveConcurrency)
+		errs := make(chan error, len(page.Contents))
+		var wg sync.WaitGroup
+		for _, object := range page.Contents {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(rel string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				if err := fn(rel); err != nil {
+					errs <- errors.Wrapf(err, "failed to move %s", rel)
+				}
+			}(strings.TrimPrefix(object.Key, prefix))
+		}
+		wg.Wait()
+		close(errs)
+		if err := <-errs; err != nil {
+			return err
+		}
+
+		if pageDone != nil && len(page.Contents) > 0 {
+			if err := pageDone(strings.TrimPrefix(page.Contents[len(page.Contents)-1].Key, prefix)); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated {
+			return nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// copyMovedObject copies the object at its old key to its new key, unless
+// the object at the new key is as recent and overwrite isn't set, and
+// reports whether it did, with the size of the object. Objects deleted in
+// the meantime are left alone. The caller holds the lock of the key.
+func (s *Server) copyMovedObject(ctx context.Context, from, to, rel string, overwrite bool) (int64, bool, error) {
+	srcPath, dstPath := "/"+from+"/"+rel, "/"+to+"/"+rel
+	header, size, err := s.headObject(ctx, srcPath)
+	if isS3ErrorCode(err, "404") {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if !overwrite {
+		dstHeader, _, err := s.headObject(ctx, dstPath)
+		switch {
+		case isS3ErrorCode(err, "404"):
+		case err != nil:
+			return 0, false, err
+		case !isOlderObject(dstHeader, header):
+			return 0, false, nil
+		}
+	}
+
+	copyHeader := objectMetadata(header)
+	copyHeader.Set("X-Amz-Metadata-Directive", "REPLACE")
+	copyHeader.Set("X-Amz-Copy-Source-If-Match", header.Get("ETag"))
+	if size > maxCopyObjectSize {
+		// Multipart copies don't copy the tags of their source.
+		tags, err := s.getObjectTagging(ctx, srcPath)
+		if err != nil {
+			return 0, false, err
+		}
+		if len(tags) > 0 {
+			values := make(url.Values)
+			for key, value := range tags {
+				values.Set(key, value)
+			}
+			copyHeader.Set("X-Amz-Tagging", s3utils.QueryEncode(values))
+		}
+	}
+	err = s.copyObject(ctx, srcPath, dstPath, size, copyHeader)
+	switch {
+	case isS3ErrorCode(err, "NoSuchKey"):
+		return 0, false, nil
+	case err != nil:
+		return 0, false, err
+	}
+	s.logger.Debug("copied moved object", mlog.String("from", srcPath), mlog.String("to", dstPath), mlog.Int64("bytes", size))
+	return size, true, nil
+}
+
+// moveObject copies the object to its new key, if needed, and deletes it at
+// its old key. The caller holds the lock of the key.
+func (s *Server) moveObject(ctx context.Context, from, to, rel string, overwrite bool) error {
+	if _, _, err := s.copyMovedObject(ctx, from, to, rel, overwrite); err != nil {
+		return err
+	}
+	return s.deleteObject(ctx, "/"+from+"/"+rel)
+}
+
+// isOlderObject reports whether the object with the header was modified
+// before the one with the other header.
+func isOlderObject(header, other http.Header) bool {
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return true
+	}
+	otherModified, err := http.ParseTime(other.Get("Last-Modified"))
+	return err == nil && modified.Before(otherModified)
+}
+
+// moveRoute is how a request for an object of a moving installation, or a
+// listing of its objects, is routed.
+type moveRoute struct {
+	from, to string
+	// requested is the installation of the request, which the keys of
+	// merged listings belong to.
+	requested string
+	// listing is set for listings, which merge the objects of both
+	// installations.
+	listing bool
+	unlock  func()
+	// completed is called once the request succeeded.
+	completed func()
+}
+
+// done ends the request, once it has been served with the status code.
+func (route *moveRoute) done(statusCode int) {
+	if route.completed != nil && statusCode >= 200 && statusCode < 300 {
+		route.completed()
+	}
+	if route.unlock != nil {
+		route.unlock()
+	}
+}
+
+// routeMove routes the requests of moving installations, which either of
+// their IDs can be used for. Objects are read where they are, at their new
+// key once they have been copied or written there, and at their old key
+// until then. Writes go to the new key. Deletes delete both keys, so that
+// the move doesn't bring the object back. The request and op are changed
+// to target the object where it is, and the route, if any, must be done
+// once the request has been served. Requests for a specific version are
+// left alone.
+func (s *Server) routeMove(r *http.Request, op *s3Request) (*moveRoute, error) {
+	query := r.URL.Query()
+	if query.Has("versionId") {
+		return nil, nil
+	}
+	switch op.Operation {
+	case opListObjects, opListObjectsV2:
+		id, _, ok := strings.Cut(query.Get("prefix"), "/")
+		if !ok {
+			return nil, nil
+		}
+		from, to, moving := s.movePair(id)
+		if !moving {
+			return nil, nil
+		}
+		return &moveRoute{from: from, to: to, requested: id, listing: true}, nil
+	case opDeleteObjects:
+		return s.routeMovedDeletes(r)
+	case opCopyObject, opUploadPartCopy:
+		if err := s.routeMovedCopySource(r); err != nil {
+			return nil, err
+		}
+	}
+
+	id, rel, ok := strings.Cut(op.Key, "/")
+	if !ok || rel == "" {
+		return nil, nil
+	}
+	from, to, moving := s.movePair(id)
+	if !moving {
+		return nil, nil
+	}
+	ctx := r.Context()
+	route := &moveRoute{from: from, to: to, requested: id}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		route.unlock = s.moves.lock(from + "/" + rel)
+	}
+	fail := func(err error) (*moveRoute, error) {
+		route.done(0)
+		return nil, err
+	}
+
+	key := to + "/" + rel
+	switch op.Operation {
+	case opPutObject, opCopyObject, opCreateMultipartUpload:
+	case opDeleteObject:
+		counterpart := from + "/" + rel
+		if id == from {
+			counterpart = key
+		}
+		if err := s.deleteMovedCounterparts(ctx, []string{counterpart}); err != nil {
+			return fail(err)
+		}
+		key = op.Key
+	case opUploadPart, opUploadPartCopy, opListParts, opAbortMultipartUpload, opCompleteMultipartUpload:
+		// Multipart uploads created before the move complete at their old
+		// key, and the object is then moved.
+		_, err := s.listParts(ctx, "/"+key, query.Get("uploadId"), 0)
+		switch {
+		case isS3ErrorCode(err, "NoSuchUpload"):
+			key = from + "/" + rel
+			if op.Operation == opCompleteMultipartUpload {
+				route.completed = func() {
+					if err := s.moveObject(context.WithoutCancel(ctx), from, to, rel, true); err != nil {
+						s.logger.Error("failed to move completed multipart upload", mlog.String("key", key), mlog.Err(err))
+					}
+				}
+			}
+		case err != nil:
+			return fail(err)
+		}
+	default:
+		var err error
+		if key, err = s.movedObjectKey(ctx, from, to, rel); err != nil {
+			return fail(err)
+		}
+	}
+
+	if err := s.rerouteRequest(r, op, key); err != nil {
+		return fail(err)
+	}
+	return route, nil
+}
+
+// movedObjectKey returns the key where the object of a moving installation
+// is.
+func (s *Server) movedObjectKey(ctx context.Context, from, to, rel string) (string, error) {
+	_, _, err := s.headObject(ctx, "/"+to+"/"+rel)
+	switch {
+	case err == nil:
+		return to + "/" + rel, nil
+	case isS3ErrorCode(err, "404"):
+		return from + "/" + rel, nil
+	}
+	return "", err
+}
+
+// rerouteRequest changes the request to target the object at key.
+func (s *Server) rerouteRequest(r *http.Request, op *s3Request, key string) error {
+	targetURL, err := url.Parse(s.cfg.S3Settings.Scheme + "://" + s3utils.EncodePath("/"+key))
+	if err != nil {
+		return err
+	}
+	targetURL.RawQuery = r.URL.RawQuery
+	r.URL = targetURL
+	op.Key = key
+	return nil
+}
+
+// routeMovedCopySource changes the source of a copy from a moving
+// installation to where the object is.
+func (s *Server) routeMovedCopySource(r *http.Request) error {
+	if strings.Contains(r.Header.Get("X-Amz-Copy-Source"), "versionId=") {
+		return nil
+	}
+	source, err := s.copySourceKey(r)
+	if err != nil {
+		return err
+	}
+	id, rel, ok := strings.Cut(source, "/")
+	if !ok {
+		return nil
+	}
+	from, to, moving := s.movePair(id)
+	if !moving {
+		return nil
+	}
+	key, err := s.movedObjectKey(r.Context(), from, to, rel)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("X-Amz-Copy-Source", s.copySource("/"+key))
+	return nil
+}
+
+// routeMovedDeletes deletes the other key of the objects of moving
+// installations in a DeleteObjects request, before the request deletes the
+// ones it names.
+func (s *Server) routeMovedDeletes(r *http.Request) (*moveRoute, error) {
+	request, err := readDeleteObjectsRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	var locks, counterparts []string
+	for _, object := range request.Objects {
+		id, rel, ok := strings.Cut(object.Key, "/")
+		if !ok || rel == "" || object.VersionId != "" {
+			continue
+		}
+		from, to, moving := s.movePair(id)
+		if !moving {
+			continue
+		}
+		locks = append(locks, from+"/"+rel)
+		if id == from {
+			counterparts = append(counterparts, to+"/"+rel)
+		} else {
+			counterparts = append(counterparts, from+"/"+rel)
+		}
+	}
+	if len(counterparts) == 0 {
+		return nil, nil
+	}
+
+	route := &moveRoute{unlock: s.moves.lock(locks...)}
+	if err := s.deleteMovedCounterparts(r.Context(), counterparts); err != nil {
+		route.done(0)
+		return nil, err
+	}
+	return route, nil
+}
+
+// deleteMovedCounterparts deletes the objects at the keys, after moving
+// them to the trash if it is enabled.
+func (s *Server) deleteMovedCounterparts(ctx context.Context, keys []string) error {
+	if s.cfg.TrashSettings.Enable {
+		deletedAt := time.Now()
+		for _, key := range keys {
+			if err := s.trashObject(ctx, key, deletedAt); err != nil {
+				return err
+			}
+		}
+	}
+	objects := make([]objectVersion, 0, len(keys))
+	for _, key := range keys {
+		objects = append(objects, objectVersion{Key: key})
+	}
+	failed, err := s.deleteObjectVersions(ctx, objects)
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("failed to delete %s: %s", failed[0].Key, failed[0].Code)
+	}
+	return nil
+}
+
+// maxListingKeys is the largest number of keys S3 returns in a listing.
+const maxListingKeys = 1000
+
+// movedListingObject is an object in the listing of a moving installation.
+type movedListingObject struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string `xml:",omitempty"`
+}
+
+type movedListingPrefix struct {
+	Prefix string
+}
+
+type movedListingPage struct {
+	Contents       []movedListingObject
+	CommonPrefixes []movedListingPrefix
+	IsTruncated    bool
+}
+
+// movedListingResult is the body of a ListObjects or ListObjectsV2 response.
+type movedListingResult struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Marker                string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	KeyCount              *int   `xml:",omitempty"`
+	MaxKeys               int
+	Delimiter             string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	IsTruncated           bool
+	NextMarker            string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []movedListingObject
+	CommonPrefixes        []movedListingPrefix
+}
+
+// fetchMovedListing lists the objects of a moving installation under both
+// of its prefixes, and merges them into a listing of the installation of
+// the request. Objects at both keys are listed once, as the one at their
+// new key. Continuation tokens are the last key listed, within the
+// installation.
+func (s *Server) fetchMovedListing(r *http.Request, route *moveRoute) (*http.Response, error) {
+	query := r.URL.Query()
+	listV2 := query.Get("list-type") == "2"
+	delimiter := query.Get("delimiter")
+	prefix := query.Get("prefix")
+	requestedPrefix := route.requested + "/"
+	relPrefix := strings.TrimPrefix(prefix, requestedPrefix)
+
+	maxKeys := maxListingKeys
+	if value := query.Get("max-keys"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, &s3Error{StatusCode: http.StatusBadRequest, Code: "InvalidArgument", Message: "Invalid max-keys."}
+		}
+		maxKeys = min(n, maxListingKeys)
+	}
+
+	// The listing starts after the key of the token, marker or start-after,
+	// relative to the installation.
+	var start string
+	if token := query.Get("continuation-token"); listV2 && token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return nil, &s3Error{StatusCode: http.StatusBadRequest, Code: "InvalidArgument", Message: "The continuation token provided is incorrect."}
+		}
+		start = string(decoded)
+	} else if after := listingStart(query, listV2); after != "" {
+		switch {
+		case strings.HasPrefix(after, requestedPrefix):
+			start = strings.TrimPrefix(after, requestedPrefix)
+		case after > requestedPrefix:
+			start = string(utf8.MaxRune)
+		}
+	}
+	// Common prefixes are skipped as a whole.
+	upstreamStart := start
+	if delimiter != "" && strings.HasSuffix(start, delimiter) {
+		upstreamStart += string(utf8.MaxRune)
+	}
+
+	type entry struct {
+		rel    string
+		object *movedListingObject
+	}
+	entries := make(map[string]entry)
+	var truncated bool
+	var cutoff string
+	if maxKeys > 0 {
+		// The installation moved to comes first, so that its objects are the
+		// ones listed.
+		for _, id := range []string{route.to, route.from} {
+			startAfter := ""
+			if upstreamStart != "" {
+				startAfter = id + "/" + upstreamStart
+			}
+			page, err := s.listMovedPrefix(r.Context(), id+"/"+relPrefix, delimiter, startAfter, maxKeys)
+			if err != nil {
+				return nil, err
+			}
+			var last string
+			add := func(key string, object *movedListingObject) {
+				rel := strings.TrimPrefix(key, id+"/")
+				last = max(last, rel)
+				if _, ok := entries[rel]; !ok {
+					entries[rel] = entry{rel: rel, object: object}
+				}
+			}
+			for i := range page.Contents {
+				add(page.Contents[i].Key, &page.Contents[i])
+			}
+			for _, commonPrefix := range page.CommonPrefixes {
+				add(commonPrefix.Prefix, nil)
+			}
+			// Only the keys up to the end of the shortest truncated page can be
+			// listed without missing keys of the other one.
+			if page.IsTruncated && last != "" && (!truncated || last < cutoff) {
+				cutoff = last
+				truncated = true
+			}
+		}
+	}
+
+	listed := make([]entry, 0, len(entries))
+	for rel, e := range entries {
+		if (start != "" && rel <= start) || (truncated && rel > cutoff) {
+			continue
+		}
+		if s.cfg.TrashSettings.Enable && isTrashKey(requestedPrefix+rel) {
+			continue
+		}
+		listed = append(listed, e)
+	}
+	slices.SortFunc(listed, func(a, b entry) int { return strings.Compare(a.rel, b.rel) })
+	next := cutoff
+	if len(listed) > maxKeys {
+		listed = listed[:maxKeys]
+		next = listed[len(listed)-1].rel
+		truncated = true
+	}
+
+	encode := func(value string) string { return value }
+	if query.Get("encoding-type") == "url" {
+		encode = url.QueryEscape
+	}
+	result := movedListingResult{
+		Name:         s.cfg.S3Settings.Bucket,
+		Prefix:       encode(prefix),
+		MaxKeys:      maxKeys,
+		Delimiter:    encode(delimiter),
+		EncodingType: query.Get("encoding-type"),
+		IsTruncated:  truncated,
+	}
+	for _, e := range listed {
+		if e.object == nil {
+			result.CommonPrefixes = append(result.CommonPrefixes, movedListingPrefix{Prefix: encode(requestedPrefix + e.rel)})
+			continue
+		}
+		object := *e.object
+		object.Key = encode(requestedPrefix + e.rel)
+		result.Contents = append(result.Contents, object)
+	}
+	if listV2 {
+		keyCount := len(listed)
+		result.KeyCount = &keyCount
+		result.StartAfter = encode(query.Get("start-after"))
+		result.ContinuationToken = query.Get("continuation-token")
+		if truncated {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(next))
+		}
+	} else {
+		result.Marker = encode(query.Get("marker"))
+		if truncated {
+			result.NextMarker = encode(requestedPrefix + next)
+		}
+	}
+
+	body, err := xml.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	body = append([]byte(xml.Header), body...)
+	header := http.Header{
+		"Content-Type":   {"application/xml"},
+		"Content-Length": {strconv.Itoa(len(body))},
+	}
+	return &http.Response{StatusCode: http.StatusOK, Header: header, ContentLength: int64(len(body)), Body: io.NopCloser(bytes.NewReader(body))}, nil
+}
+
+// listingStart returns the key a ListObjects or ListObjectsV2 request
+// starts after.
+func listingStart(query url.Values, listV2 bool) string {
+	if listV2 {
+		return query.Get("start-after")
+	}
+	return query.Get("marker")
+}
+
+// listMovedPrefix lists a page of the objects under prefix, after the
+// startAfter key, with their details.
+func (s *Server) listMovedPrefix(ctx context.Context, prefix, delimiter, startAfter string, maxKeys int) (*movedListingPage, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "max-keys": {strconv.Itoa(maxKeys)}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if startAfter != "" {
+		query.Set("start-after", startAfter)
+	}
+	req, err := s.newUpstreamRequest(ctx, http.MethodGet, "/", query, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.doS3(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list objects")
+	}
+	defer resp.Body.Close()
+
+	var page movedListingPage
+	if err := decodeS3Response(resp, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
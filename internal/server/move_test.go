@@ -0,0 +1,343 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMoveTestServer returns a server whose installation states are saved
+// to a temporary file, and that can run moves in the background.
+func newMoveTestServer(t *testing.T, cfg Config) (*Server, *fakeS3, http.HandlerFunc) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, cfg)
+	var err error
+	s.states, err = newStateStore(filepath.Join(t.TempDir(), "state.json"))
+	require.NoError(t, err)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	t.Cleanup(s.cancel)
+	return s, fake, s.handler()
+}
+
+// listAll lists every key and common prefix of a listing, following its
+// continuation tokens or markers.
+func listAll(t *testing.T, handler http.HandlerFunc, query url.Values) []string {
+	var keys []string
+	for pages := 0; pages < 100; pages++ {
+		resp := serveRequest(handler, "GET", "?"+query.Encode(), nil, nil)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+
+		var result movedListingResult
+		require.NoError(t, xml.Unmarshal(body, &result))
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		for _, prefix := range result.CommonPrefixes {
+			keys = append(keys, prefix.Prefix)
+		}
+		if !result.IsTruncated {
+			return keys
+		}
+		if query.Get("list-type") == "2" {
+			query.Set("continuation-token", result.NextContinuationToken)
+		} else {
+			query.Set("marker", result.NextMarker)
+		}
+	}
+	t.Fatal("the listing doesn't end")
+	return nil
+}
+
+func TestMoveInstallation(t *testing.T) {
+	s, fake, handler := newMoveTestServer(t, Config{})
+
+	fake.put("old/a", []byte("a"), http.Header{"X-Amz-Meta-Name": {"a"}})
+	fake.put("old/b", []byte("b"), nil)
+	fake.put("old/dir/c", []byte("c"), nil)
+	fake.put("old/.trash/20240101T000000.000000000Z/d", []byte("d"), nil)
+	fake.put("other/e", []byte("e"), nil)
+
+	moving, err := s.startMove("old", "new")
+	require.NoError(t, err)
+	assert.Equal(t, "new", moving.To)
+	assert.Equal(t, movePhaseCopy, moving.Phase)
+	assert.Equal(t, "old", s.states.get("new").MovingFrom)
+
+	// Both IDs reach the objects, wherever they are.
+	for _, path := range []string{"/old/a", "/new/a"} {
+		resp := serveRequest(handler, "GET", path, nil, nil)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+		assert.Equal(t, "a", string(body), path)
+	}
+
+	// Writes go to the new prefix, and deletes delete both keys.
+	resp := serveRequest(handler, "PUT", "/old/f", []byte("f"), nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotNil(t, fake.object("new/f"))
+	assert.Nil(t, fake.object("old/f"))
+	resp = serveRequest(handler, "PUT", "/new/b", []byte("b2"), nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = serveRequest(handler, "PUT", "/other/g", nil, http.Header{"X-Amz-Copy-Source": {"/agnivatest/new/a"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []byte("a"), fake.object("other/g").data)
+	resp = serveRequest(handler, "DELETE", "/new/dir/c", nil, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Nil(t, fake.object("old/dir/c"))
+
+	assert.ElementsMatch(t, []string{"new/.trash/", "new/a", "new/b", "new/f"},
+		listAll(t, handler, url.Values{"list-type": {"2"}, "prefix": {"new/"}, "delimiter": {"/"}}))
+
+	require.NoError(t, s.MoveInstallation(context.Background(), "old"))
+	moving = s.states.get("old").Moving
+	assert.Equal(t, movePhaseDone, moving.Phase)
+	assert.NotNil(t, moving.CompletedAt)
+	assert.Equal(t, 2, moving.Copied)
+	assert.Equal(t, 1, moving.Skipped)
+	assert.Equal(t, 3, moving.Deleted)
+	assert.Empty(t, moving.Error)
+
+	for key := range fake.objects {
+		assert.NotContains(t, key, "old/")
+	}
+	assert.Equal(t, []byte("b2"), fake.object("new/b").data)
+	assert.Equal(t, "a", fake.object("new/a").header.Get("X-Amz-Meta-Name"))
+	assert.NotNil(t, fake.object("new/.trash/20240101T000000.000000000Z/d"))
+
+	// The old ID keeps working until the move is finished.
+	resp = serveRequest(handler, "GET", "/old/a", nil, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, s.finishMove("old"))
+	assert.True(t, s.states.get("old").isEmpty())
+	assert.True(t, s.states.get("new").isEmpty())
+	resp = serveRequest(handler, "GET", "/old/a", nil, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestMoveInstallationResumes(t *testing.T) {
+	s, fake, _ := newMoveTestServer(t, Config{})
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		fake.put("old/"+key, []byte(key), nil)
+	}
+	_, err := s.startMove("old", "new")
+	require.NoError(t, err)
+
+	// The copy carries on after the last key of its checkpoint, and the
+	// verification copies what changed since.
+	require.NoError(t, s.states.update("old", func(state *installationState) {
+		state.Moving.LastKey = "d"
+	}))
+	fake.put("new/a", []byte("a"), nil)
+	fake.put("new/b", []byte("b"), nil)
+	fake.put("new/c", []byte("stale"), nil).lastModified = time.Now().Add(-time.Hour)
+	require.NoError(t, s.MoveInstallation(context.Background(), "old"))
+
+	moving := s.states.get("old").Moving
+	assert.Equal(t, movePhaseDone, moving.Phase)
+	assert.Equal(t, 1, moving.Copied)
+	assert.Equal(t, 2, moving.Recopied)
+	assert.Equal(t, 5, moving.Deleted)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		assert.Equal(t, []byte(key), fake.object("new/"+key).data, key)
+	}
+
+	// Completed moves have nothing left to do.
+	require.NoError(t, s.MoveInstallation(context.Background(), "old"))
+	assert.Equal(t, 5, s.states.get("old").Moving.Deleted)
+}
+
+func TestMoveListing(t *testing.T) {
+	s, fake, handler := newMoveTestServer(t, Config{TrashSettings: TrashSettings{Enable: true}})
+
+	for _, key := range []string{"a", "c", "e", "dir/1", "dir/2", "g h", ".trash/20240101T000000.000000000Z/x"} {
+		fake.put("old/"+key, []byte(key), nil)
+	}
+	for _, key := range []string{"b", "c", "d", "dir/3", "f"} {
+		fake.put("new/"+key, []byte(key), nil)
+	}
+	_, err := s.startMove("old", "new")
+	require.NoError(t, err)
+
+	keys := []string{"a", "b", "c", "d", "dir/1", "dir/2", "dir/3", "e", "f", "g h"}
+	for _, id := range []string{"old", "new"} {
+		var expected []string
+		for _, key := range keys {
+			expected = append(expected, id+"/"+key)
+		}
+		for _, maxKeys := range []string{"", "1", "3"} {
+			v2 := url.Values{"list-type": {"2"}, "prefix": {id + "/"}, "max-keys": {maxKeys}}
+			assert.Equal(t, expected, listAll(t, handler, v2), id+" max-keys="+maxKeys)
+			v1 := url.Values{"prefix": {id + "/"}, "max-keys": {maxKeys}}
+			assert.Equal(t, expected, listAll(t, handler, v1), id+" max-keys="+maxKeys)
+		}
+
+		delimited := url.Values{"prefix": {id + "/"}, "delimiter": {"/"}, "max-keys": {"1"}}
+		assert.Equal(t, []string{id + "/a", id + "/b", id + "/c", id + "/d", id + "/dir/", id + "/e", id + "/f", id + "/g h"}, listAll(t, handler, delimited))
+		after := url.Values{"list-type": {"2"}, "prefix": {id + "/dir/"}, "start-after": {id + "/dir/1"}}
+		assert.Equal(t, []string{id + "/dir/2", id + "/dir/3"}, listAll(t, handler, after))
+	}
+
+	// Objects are listed with their details, from their new key if they
+	// have one.
+	resp := serveRequest(handler, "GET", "?list-type=2&prefix=old/c&encoding-type=url", nil, nil)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var result movedListingResult
+	require.NoError(t, xml.NewDecoder(resp.Body).Decode(&result))
+	require.Len(t, result.Contents, 1)
+	assert.Equal(t, "old%2Fc", result.Contents[0].Key)
+	assert.Equal(t, fake.object("new/c").etag, result.Contents[0].ETag)
+	assert.NotEmpty(t, result.Contents[0].LastModified)
+	assert.Equal(t, 1, *result.KeyCount)
+
+	resp = serveRequest(handler, "GET", "?list-type=2&prefix=old/&continuation-token=!", nil, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestMoveMultipartUpload(t *testing.T) {
+	s, fake, handler := newMoveTestServer(t, Config{})
+
+	fake.put("new/f", []byte("newer"), nil)
+	fake.uploads["upload-1"] = &fakeUpload{key: "old/f", parts: make(map[int][]byte)}
+	_, err := s.startMove("old", "new")
+	require.NoError(t, err)
+
+	// Uploads created before the move complete at their old key, and the
+	// object is then moved.
+	resp := serveRequest(handler, "PUT", "/old/f?partNumber=1&uploadId=upload-1", []byte("part"), nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	sum := md5.Sum([]byte("part"))
+	complete := `<CompleteMultipartUpload xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Part><PartNumber>1</PartNumber><ETag>"` + hex.EncodeToString(sum[:]) + `"</ETag></Part></CompleteMultipartUpload>`
+	resp = serveRequest(handler, "POST", "/new/f?uploadId=upload-1", []byte(complete), nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []byte("part"), fake.object("new/f").data)
+	assert.Nil(t, fake.object("old/f"))
+
+	// The ones created during the move are at the new key.
+	resp = serveRequest(handler, "POST", "/old/g?uploads", nil, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "new/g", fake.uploads["upload-1"].key)
+	resp = serveRequest(handler, "DELETE", "/old/g?uploadId=upload-1", nil, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, fake.uploads)
+}
+
+func TestMoveDeleteObjects(t *testing.T) {
+	s, fake, handler := newMoveTestServer(t, Config{TrashSettings: TrashSettings{Enable: true}})
+
+	fake.put("old/a", []byte("a"), nil)
+	fake.put("new/a", []byte("a2"), nil)
+	fake.put("old/b", []byte("b"), nil)
+	fake.put("other/c", []byte("c"), nil)
+	_, err := s.startMove("old", "new")
+	require.NoError(t, err)
+
+	body := `<Delete><Object><Key>old/a</Key></Object><Object><Key>new/b</Key></Object><Object><Key>other/c</Key></Object></Delete>`
+	resp := serveRequest(handler, "POST", "?delete", []byte(body), nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var keys []string
+	for key := range fake.objects {
+		if !isTrashKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	assert.Empty(t, keys)
+	trash, err := s.ListTrash(context.Background(), "new")
+	require.NoError(t, err)
+	assert.Len(t, trash, 1)
+}
+
+func TestStartMove(t *testing.T) {
+	s, _, _ := newMoveTestServer(t, Config{})
+
+	for _, ids := range [][2]string{{"", "new"}, {"old", ""}, {"old", "old"}, {"old", "a/b"}} {
+		_, err := s.startMove(ids[0], ids[1])
+		assert.True(t, isS3ErrorCode(err, "InvalidArgument"), ids)
+	}
+
+	_, err := s.startMove("old", "new")
+	require.NoError(t, err)
+	_, err = s.startMove("old", "new")
+	require.NoError(t, err)
+	for _, ids := range [][2]string{{"old", "other"}, {"other", "new"}, {"new", "other"}, {"other", "old"}} {
+		_, err := s.startMove(ids[0], ids[1])
+		assert.True(t, isS3ErrorCode(err, "OperationAborted"), ids)
+	}
+	assert.True(t, isS3ErrorCode(s.finishMove("old"), "OperationAborted"))
+	assert.True(t, isS3ErrorCode(s.finishMove("other"), "NoSuchInstallation"))
+
+	// Moving installations can't be offboarded, and the other way around.
+	_, err = s.offboardInstallation("new")
+	assert.True(t, isS3ErrorCode(err, "OperationAborted"))
+	_, err = s.offboardInstallation("gone")
+	require.NoError(t, err)
+	_, err = s.startMove("gone", "elsewhere")
+	assert.True(t, isS3ErrorCode(err, "OperationAborted"))
+}
+
+func TestAdminMove(t *testing.T) {
+	s, fake, _ := newMoveTestServer(t, Config{})
+	router := newAdminRouter(s)
+
+	fake.put("old/a", []byte("a"), nil)
+
+	call := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotFound, call("POST", "/admin/installations/old/move?to=new").Code)
+	assert.Nil(t, s.states.get("old").Moving)
+
+	s.cfg.MoveSettings.Enable = true
+	router = newAdminRouter(s)
+	assert.Equal(t, http.StatusBadRequest, call("POST", "/admin/installations/old/move").Code)
+	w := call("POST", "/admin/installations/old/move?to=new")
+	require.Equal(t, http.StatusOK, w.Code)
+	var moving moveState
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &moving))
+	assert.Equal(t, "new", moving.To)
+
+	require.Eventually(t, func() bool {
+		return s.states.get("old").Moving.Phase == movePhaseDone
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NotNil(t, fake.object("new/a"))
+	assert.Nil(t, fake.object("old/a"))
+
+	assert.Equal(t, http.StatusOK, call("POST", "/admin/installations/old/move/finish").Code)
+	assert.Equal(t, http.StatusNotFound, call("POST", "/admin/installations/old/move/finish").Code)
+}
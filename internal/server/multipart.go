@@ -0,0 +1,440 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMultipartPartSize    = 64 * 1024 * 1024
+	defaultMultipartConcurrency = 4
+	minMultipartPartSize        = 5 * 1024 * 1024
+)
+
+const defaultMultipartMemoryLimit = 512 * 1024 * 1024
+
+// multipartSplitEligible reports whether the request is a PutObject large
+// enough to be uploaded as a multipart upload. The MD5 ETag of the object
+// has to be known before the upload is created, so the bodies of requests
+// without a Content-MD5 header are spooled to disk first, and aren't split
+// without a spool directory.
+func (s *Server) multipartSplitEligible(r *http.Request, op s3Request) bool {
+	settings := s.cfg.MultipartSplitSettings
+	return settings.Enable &&
+		op.Operation == opPutObject &&
+		r.ContentLength >= settings.ThresholdBytes &&
+		r.Header.Get("Content-Encoding") != "aws-chunked" &&
+		(settings.SpoolDirectory != "" || !recordsOriginalETag(r.Header) || contentMD5ETag(r.Header) != "")
+}
+
+// recordsOriginalETag reports whether the MD5 of the body of a split upload
+// has to be recorded as the ETag of the object. Compressed objects already
+// have the ETag of the uncompressed body in their metadata, and the body of
+// encrypted objects is not the one of the client.
+func recordsOriginalETag(header http.Header) bool {
+	return header.Get(originalETagHeader) == "" && header.Get(encryptionHeader) == ""
+}
+
+// contentMD5ETag returns the ETag matching the Content-MD5 header of the
+// request, or an empty string if it has none.
+func contentMD5ETag(header http.Header) string {
+	md, err := base64.StdEncoding.DecodeString(header.Get("Content-Md5"))
+	if err != nil || len(md) != md5.Size {
+		return ""
+	}
+	return `"` + hex.EncodeToString(md) + `"`
+}
+
+// Headers of a PutObject request that only make sense for the request as a
+// whole and must not be passed on to CreateMultipartUpload.
+var putOnlyHeaders = map[string]bool{
+	"Authorization":                true,
+	"Content-Length":               true,
+	"Content-Md5":                  true,
+	"Expect":                       true,
+	"Host":                         true,
+	"Transfer-Encoding":            true,
+	"X-Amz-Content-Sha256":         true,
+	"X-Amz-Date":                   true,
+	"X-Amz-Decoded-Content-Length": true,
+	"X-Amz-Sdk-Checksum-Algorithm": true,
+	"X-Amz-Security-Token":         true,
+	"X-Amz-Trailer":                true,
+}
+
+// partHeaders returns the headers that have to be sent with every part.
+// Objects encrypted with customer provided keys need the key on every part.
+func partHeaders(header http.Header) http.Header {
+	h := make(http.Header)
+	for key, values := range header {
+		if strings.HasPrefix(key, "X-Amz-Server-Side-Encryption-Customer-") {
+			h[key] = values
+		}
+	}
+	return h
+}
+
+// serveMultipartPut uploads the body of a PutObject request as a multipart
+// upload. Parts are read from the client one after the other, buffered in
+// memory or in the spool directory, and uploaded with bounded concurrency.
+// If anything fails, the multipart upload is aborted. The client gets back
+// the response it would have gotten for a PutObject, with the MD5 of the
+// body as the ETag, which is kept in the metadata of the object so that it
+// is served on GetObject and HeadObject too. The metadata of the object is
+// set when the upload is created: the parts are uploaded as they are read
+// if the client sent the MD5 of the body, and only once the whole body has
+// been read and spooled otherwise.
+func (s *Server) serveMultipartPut(w http.ResponseWriter, r *http.Request, objectPath string) (int, error) {
+	settings := s.cfg.MultipartSplitSettings
+	partSize := settings.PartSizeBytes
+	if partSize == 0 {
+		partSize = defaultMultipartPartSize
+	}
+	concurrency := settings.Concurrency
+	if concurrency == 0 {
+		concurrency = defaultMultipartConcurrency
+	}
+
+	header := make(http.Header)
+	for key, values := range r.Header {
+		if !putOnlyHeaders[key] && !strings.HasPrefix(key, "X-Amz-Checksum-") {
+			header[key] = values
+		}
+	}
+	recordETag := recordsOriginalETag(header)
+	streaming := true
+	if recordETag {
+		// The MD5 is checked against the body before the upload is
+		// completed.
+		if etag := contentMD5ETag(r.Header); etag != "" {
+			header.Set(originalETagHeader, etag)
+		} else {
+			streaming = false
+		}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		parts    []completePart
+		pending  []spooledPart
+		firstErr error
+		wg       sync.WaitGroup
+		uploadID string
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+	create := func() error {
+		var err error
+		uploadID, err = s.createMultipartUpload(ctx, objectPath, header)
+		if err != nil {
+			return err
+		}
+		s.logger.Debug("splitting PutObject into a multipart upload", mlog.String("object", objectPath), mlog.String("upload_id", uploadID), mlog.Int64("size", r.ContentLength))
+		return nil
+	}
+
+	sem := make(chan struct{}, concurrency)
+	upload := func(part spooledPart) {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			part.buf.Close()
+			fail(ctx.Err())
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer part.buf.Close()
+
+			reader, err := part.buf.Reader()
+			if err != nil {
+				fail(err)
+				return
+			}
+			etag, err := s.uploadPart(ctx, objectPath, uploadID, part.number, reader, part.size, partHeaders(r.Header))
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			mu.Lock()
+			parts = append(parts, completePart{PartNumber: part.number, ETag: etag})
+			mu.Unlock()
+		}()
+	}
+
+	if streaming {
+		if err := create(); err != nil {
+			return 0, err
+		}
+	}
+
+	// The client's checksums cover the whole body, so S3 can't check them
+	// anymore. We check them ourselves before completing the upload.
+	sha := sha256.New()
+	md := md5.New()
+	body := io.TeeReader(r.Body, io.MultiWriter(sha, md))
+
+	var read int64
+	for partNumber := 1; !failed(); partNumber++ {
+		buf, err := s.newSplitPartBuffer(ctx)
+		if err != nil {
+			fail(err)
+			break
+		}
+
+		n, err := io.CopyN(buf, body, partSize)
+		read += n
+		if err != nil && err != io.EOF {
+			buf.Close()
+			fail(errors.Wrap(err, "failed to read request body"))
+			break
+		}
+		if n == 0 {
+			buf.Close()
+			break
+		}
+
+		part := spooledPart{number: partNumber, buf: buf, size: n}
+		if streaming {
+			upload(part)
+		} else {
+			pending = append(pending, part)
+		}
+
+		if n < partSize {
+			break
+		}
+	}
+	wg.Wait()
+
+	if firstErr == nil && read != r.ContentLength {
+		firstErr = errors.Errorf("request body has %d bytes, expected %d", read, r.ContentLength)
+	}
+	if firstErr == nil {
+		firstErr = verifyBodyChecksums(r.Header, sha, md)
+	}
+
+	if !streaming {
+		if firstErr == nil {
+			header.Set(originalETagHeader, `"`+hex.EncodeToString(md.Sum(nil))+`"`)
+			firstErr = create()
+		}
+		created := firstErr == nil
+		for i, part := range pending {
+			if !created || failed() {
+				for _, part := range pending[i:] {
+					part.buf.Close()
+				}
+				break
+			}
+			upload(part)
+		}
+		wg.Wait()
+	}
+
+	var etag string
+	var respHeader http.Header
+	if firstErr == nil {
+		sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+		etag, respHeader, firstErr = s.completeMultipartUpload(ctx, objectPath, uploadID, parts)
+	}
+
+	if firstErr != nil {
+		// The request context may already be cancelled.
+		if uploadID != "" {
+			if err := s.abortMultipartUpload(context.Background(), objectPath, uploadID); err != nil {
+				s.logger.Error("failed to abort multipart upload", mlog.String("upload_id", uploadID), mlog.Err(err))
+			}
+		}
+		return 0, firstErr
+	}
+
+	if recordETag {
+		etag = header.Get(originalETagHeader)
+	}
+	for _, key := range []string{"X-Amz-Version-Id", "X-Amz-Server-Side-Encryption", "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", "X-Amz-Request-Id", "X-Amz-Id-2"} {
+		if value := respHeader.Get(key); value != "" {
+			w.Header().Set(key, value)
+		}
+	}
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+	s.metrics.incMultipartSplit()
+
+	return http.StatusOK, nil
+}
+
+// spooledPart is a part of a split upload buffered until it is uploaded.
+type spooledPart struct {
+	number int
+	buf    partBuffer
+	size   int64
+}
+
+// newSplitPartBuffer returns a buffer for a part of a split upload. Parts
+// are buffered in memory without a spool directory, up to MemoryLimitBytes
+// across all the uploads of the server, which wait for the memory of the
+// other ones to be released beyond it.
+func (s *Server) newSplitPartBuffer(ctx context.Context) (partBuffer, error) {
+	settings := s.cfg.MultipartSplitSettings
+	if settings.SpoolDirectory != "" {
+		return newPartBuffer(settings.SpoolDirectory)
+	}
+
+	select {
+	case s.splitMemory <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	buf, err := newPartBuffer("")
+	if err != nil {
+		<-s.splitMemory
+		return nil, err
+	}
+	return &limitedPartBuffer{partBuffer: buf, release: func() { <-s.splitMemory }}, nil
+}
+
+// newSplitMemory returns the semaphore of the parts of split uploads that
+// can be buffered in memory at once.
+func newSplitMemory(settings MultipartSplitSettings) chan struct{} {
+	partSize := settings.PartSizeBytes
+	if partSize == 0 {
+		partSize = defaultMultipartPartSize
+	}
+	limit := settings.MemoryLimitBytes
+	if limit == 0 {
+		limit = defaultMultipartMemoryLimit
+	}
+	return make(chan struct{}, max(1, limit/partSize))
+}
+
+// limitedPartBuffer is a part buffer that releases its share of the memory
+// limit once it is closed.
+type limitedPartBuffer struct {
+	partBuffer
+	once    sync.Once
+	release func()
+}
+
+func (b *limitedPartBuffer) Close() error {
+	err := b.partBuffer.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// verifyBodyChecksums compares the checksums of the body with the ones the
+// client sent in the X-Amz-Content-Sha256 and Content-MD5 headers.
+func verifyBodyChecksums(header http.Header, sha, md hash.Hash) error {
+	if expected := header.Get("X-Amz-Content-Sha256"); expected != "" && expected != unsignedPayload {
+		if hex.EncodeToString(sha.Sum(nil)) != expected {
+			return &s3Error{StatusCode: http.StatusBadRequest, Code: "XAmzContentSHA256Mismatch", Message: "The provided 'x-amz-content-sha256' header does not match what was computed."}
+		}
+	}
+	if expected := header.Get("Content-Md5"); expected != "" {
+		if base64.StdEncoding.EncodeToString(md.Sum(nil)) != expected {
+			return &s3Error{StatusCode: http.StatusBadRequest, Code: "BadDigest", Message: "The Content-MD5 you specified did not match what we received."}
+		}
+	}
+	return nil
+}
+
+// bodyChecksums returns the checksums of the body sent by the client that
+// verifyBodyChecksums can check. The payload hash is left out if it doesn't
+// cover the body itself, as with unsigned and aws-chunked bodies.
+func bodyChecksums(header http.Header) http.Header {
+	checksums := make(http.Header)
+	if sha := header.Get("X-Amz-Content-Sha256"); len(sha) == sha256.Size*2 {
+		checksums.Set("X-Amz-Content-Sha256", sha)
+	}
+	if md := header.Get("Content-Md5"); md != "" {
+		checksums.Set("Content-Md5", md)
+	}
+	return checksums
+}
+
+// partBuffer holds a part until it is uploaded, either in memory or in a
+// temporary file.
+type partBuffer interface {
+	io.Writer
+	Reader() (io.Reader, error)
+	Close() error
+}
+
+func newPartBuffer(spoolDirectory string) (partBuffer, error) {
+	if spoolDirectory == "" {
+		return &memoryPartBuffer{}, nil
+	}
+	f, err := os.CreateTemp(spoolDirectory, "bifrost-part-")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create spool file")
+	}
+	return &filePartBuffer{f: f}, nil
+}
+
+type memoryPartBuffer struct {
+	bytes.Buffer
+}
+
+func (b *memoryPartBuffer) Reader() (io.Reader, error) {
+	return &b.Buffer, nil
+}
+
+func (b *memoryPartBuffer) Close() error {
+	b.Buffer = bytes.Buffer{}
+	return nil
+}
+
+type filePartBuffer struct {
+	f *os.File
+}
+
+func (b *filePartBuffer) Write(p []byte) (int, error) {
+	return b.f.Write(p)
+}
+
+func (b *filePartBuffer) Reader() (io.Reader, error) {
+	if _, err := b.f.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "failed to rewind spool file")
+	}
+	return b.f, nil
+}
+
+func (b *filePartBuffer) Close() error {
+	b.f.Close()
+	return os.Remove(b.f.Name())
+}
@@ -0,0 +1,255 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultipartSplit(t *testing.T) {
+	content := make([]byte, 1000)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+	sha := sha256.Sum256(content)
+	md := md5.Sum(content)
+
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{
+		// The part size is below the S3 minimum, which is only enforced by
+		// IsValid.
+		MultipartSplitSettings: MultipartSplitSettings{
+			Enable:         true,
+			ThresholdBytes: 500,
+			PartSizeBytes:  300,
+			Concurrency:    2,
+		},
+	})
+	handler := s.handler()
+	withMD5 := http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(md[:])}}
+
+	put := func(path string, body []byte, header http.Header) *http.Response {
+		fake.mu.Lock()
+		fake.requests = nil
+		fake.mu.Unlock()
+
+		req := httptest.NewRequest("PUT", "http://example.com/agnivatest"+path, bytes.NewReader(body))
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Result()
+	}
+
+	t.Run("large objects are split", func(t *testing.T) {
+		resp := put("/inst/large", content, http.Header{
+			"Content-Type":         {"video/mp4"},
+			"X-Amz-Meta-Owner":     {"bob"},
+			"X-Amz-Content-Sha256": {hex.EncodeToString(sha[:])},
+			"Content-Md5":          {base64.StdEncoding.EncodeToString(md[:])},
+		})
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		obj := fake.object("inst/large")
+		require.NotNil(t, obj)
+		assert.Equal(t, content, obj.data)
+		etag := `"` + hex.EncodeToString(md[:]) + `"`
+		assert.Equal(t, etag, resp.Header.Get("ETag"))
+		assert.Equal(t, etag, obj.header.Get(originalETagHeader))
+		// The ETag is recorded when the upload is created, without a copy.
+		assert.NotContains(t, fake.requests, "PUT /inst/large")
+		assert.Equal(t, "video/mp4", obj.header.Get("Content-Type"))
+		assert.Equal(t, "bob", obj.header.Get("X-Amz-Meta-Owner"))
+		assert.Empty(t, obj.header.Get("Content-Md5"))
+		assert.Empty(t, fake.uploads)
+	})
+
+	t.Run("the MD5 ETag is served", func(t *testing.T) {
+		etag := `"` + hex.EncodeToString(md[:]) + `"`
+		// The ETag of a copy isn't always the MD5 of the object in S3.
+		fake.mu.Lock()
+		fake.objects["inst/large"].etag = `"copied"`
+		fake.mu.Unlock()
+		for _, method := range []string{"GET", "HEAD"} {
+			resp := serveRequest(handler, method, "/inst/large", nil, nil)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, etag, resp.Header.Get("ETag"))
+			assert.Empty(t, resp.Header.Get(originalETagHeader))
+		}
+
+		resp := serveRequest(handler, "GET", "/inst/large", nil, http.Header{"If-None-Match": {etag}})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+		s.cfg.ParallelGetSettings = ParallelGetSettings{Enable: true, PartSizeBytes: 300}
+		defer func() { s.cfg.ParallelGetSettings = ParallelGetSettings{} }()
+		resp = serveRequest(handler, "GET", "/inst/large", nil, nil)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, content, body)
+		assert.Equal(t, etag, resp.Header.Get("ETag"))
+	})
+
+	t.Run("small objects are sent as they are", func(t *testing.T) {
+		resp := put("/inst/small", content[:100], nil)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, []string{"PUT /inst/small"}, fake.requests)
+		assert.Equal(t, content[:100], fake.object("inst/small").data)
+	})
+
+	t.Run("checksum mismatch aborts the upload", func(t *testing.T) {
+		resp := put("/inst/corrupt", content, http.Header{
+			"X-Amz-Content-Sha256": {hex.EncodeToString(make([]byte, 32))},
+			"Content-Md5":          withMD5["Content-Md5"],
+		})
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Nil(t, fake.object("inst/corrupt"))
+		assert.Empty(t, fake.uploads)
+		assert.Contains(t, fake.requests, "DELETE /inst/corrupt?uploadId=upload-2")
+	})
+
+	t.Run("failed part aborts the upload", func(t *testing.T) {
+		fake.mu.Lock()
+		fake.failPart = 2
+		fake.mu.Unlock()
+		defer func() { fake.failPart = 0 }()
+
+		resp := put("/inst/failed", content, withMD5)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		assert.Nil(t, fake.object("inst/failed"))
+		assert.Empty(t, fake.uploads)
+	})
+
+	t.Run("parts are spooled to disk", func(t *testing.T) {
+		dir := t.TempDir()
+		s.cfg.MultipartSplitSettings.SpoolDirectory = dir
+		defer func() { s.cfg.MultipartSplitSettings.SpoolDirectory = "" }()
+
+		// Without the MD5 of the client, the whole body is spooled before
+		// the upload is created.
+		resp := put("/inst/spooled", content, nil)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		obj := fake.object("inst/spooled")
+		require.NotNil(t, obj)
+		assert.Equal(t, content, obj.data)
+		etag := `"` + hex.EncodeToString(md[:]) + `"`
+		assert.Equal(t, etag, resp.Header.Get("ETag"))
+		assert.Equal(t, etag, obj.header.Get(originalETagHeader))
+		assert.Equal(t, "POST /inst/spooled?uploads=", fake.requests[0])
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+}
+
+func TestMultipartSplitMemoryLimit(t *testing.T) {
+	assert.Equal(t, 2, cap(newSplitMemory(MultipartSplitSettings{PartSizeBytes: 100, MemoryLimitBytes: 250})))
+	assert.Equal(t, 1, cap(newSplitMemory(MultipartSplitSettings{PartSizeBytes: 100, MemoryLimitBytes: 10})))
+	assert.Equal(t, 8, cap(newSplitMemory(MultipartSplitSettings{})))
+
+	content := make([]byte, 1000)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+	md := md5.Sum(content)
+
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{
+		MultipartSplitSettings: MultipartSplitSettings{
+			Enable:         true,
+			ThresholdBytes: 500,
+			PartSizeBytes:  300,
+			Concurrency:    4,
+		},
+	})
+	// A single part in memory at once across the server is still enough.
+	s.splitMemory = make(chan struct{}, 1)
+	handler := s.handler()
+
+	resp := serveRequest(handler, "PUT", "/inst/a", content, http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(md[:])}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, content, fake.object("inst/a").data)
+	assert.Empty(t, s.splitMemory)
+}
+
+func TestMultipartSplitEligible(t *testing.T) {
+	s := &Server{cfg: Config{MultipartSplitSettings: MultipartSplitSettings{Enable: true, ThresholdBytes: 100}}}
+	put := s3Request{Operation: opPutObject, Key: "inst/file"}
+
+	// Bodies without an MD5 can only be spooled to disk.
+	req := httptest.NewRequest("PUT", "http://example.com/agnivatest/inst/file", strings.NewReader(strings.Repeat("a", 100)))
+	assert.False(t, s.multipartSplitEligible(req, put))
+	req.Header.Set(encryptionHeader, encryptionScheme)
+	assert.True(t, s.multipartSplitEligible(req, put))
+	req.Header.Del(encryptionHeader)
+	req.Header.Set("Content-Md5", "not base64")
+	assert.False(t, s.multipartSplitEligible(req, put))
+	req.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(make([]byte, md5.Size)))
+	assert.True(t, s.multipartSplitEligible(req, put))
+	s.cfg.MultipartSplitSettings.SpoolDirectory = os.TempDir()
+	req.Header.Del("Content-Md5")
+	assert.True(t, s.multipartSplitEligible(req, put))
+	assert.False(t, s.multipartSplitEligible(req, s3Request{Operation: opUploadPart}))
+
+	req.Header.Set("Content-Encoding", "aws-chunked")
+	assert.False(t, s.multipartSplitEligible(req, put))
+
+	req = httptest.NewRequest("PUT", "http://example.com/agnivatest/inst/file", strings.NewReader("a"))
+	assert.False(t, s.multipartSplitEligible(req, put))
+
+	s.cfg.MultipartSplitSettings.Enable = false
+	req = httptest.NewRequest("PUT", "http://example.com/agnivatest/inst/file", strings.NewReader(strings.Repeat("a", 100)))
+	assert.False(t, s.multipartSplitEligible(req, put))
+}
+
+func TestEncryptedMultipartSplit(t *testing.T) {
+	s, fake, _ := newEncryptionTestServer(t)
+	s.cfg.MultipartSplitSettings = MultipartSplitSettings{Enable: true, ThresholdBytes: 1000, PartSizeBytes: encryptedSegmentSize}
+	handler := s.handler()
+
+	content := make([]byte, 3*encryptionSegmentSize)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+	resp := serveRequest(handler, "PUT", "/inst/a", content, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The MD5 of the encrypted body is not the ETag of the object.
+	obj := fake.object("inst/a")
+	require.NotNil(t, obj)
+	assert.Empty(t, obj.header.Get(originalETagHeader))
+	assert.Equal(t, obj.etag, resp.Header.Get("ETag"))
+
+	resp = serveRequest(handler, "GET", "/inst/a", nil, nil)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, content, body)
+}
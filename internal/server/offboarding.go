@@ -0,0 +1,423 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+// Phases of the deletion of an offboarded installation.
+const (
+	deletionPhaseUploads  = "uploads"
+	deletionPhaseVersions = "versions"
+	deletionPhaseVerify   = "verify"
+	deletionPhaseDone     = "done"
+)
+
+const (
+	defaultOffboardingMaxAttempts  = 5
+	defaultOffboardingRetryBackoff = time.Second
+	maxOffboardingRetryBackoff     = time.Minute
+)
+
+// deletionState tracks the offboarding of an installation, from the request
+// to the completion of the deletion of its data. The requests of deleting
+// installations are rejected. The phase and counts are the checkpoint of the
+// deletion: deleted versions and aborted uploads don't show up in listings
+// anymore, so a deletion resumed after a restart starts the listings over,
+// and only has to carry on the counts.
+type deletionState struct {
+	RequestedAt     time.Time             `json:"requested_at"`
+	DeleteAfter     time.Time             `json:"delete_after"`
+	StartedAt       *time.Time            `json:"started_at,omitempty"`
+	Phase           string                `json:"phase,omitempty"`
+	AbortedUploads  int                   `json:"aborted_uploads,omitempty"`
+	DeletedVersions int                   `json:"deleted_versions,omitempty"`
+	CompletedAt     *time.Time            `json:"completed_at,omitempty"`
+	Report          *SignedDeletionReport `json:"report,omitempty"`
+}
+
+// DeletionReport attests that the data of an installation was deleted, and
+// that nothing was left under its prefix once the deletion completed.
+type DeletionReport struct {
+	InstallationID  string    `json:"installation_id"`
+	Bucket          string    `json:"bucket"`
+	Prefix          string    `json:"prefix"`
+	RequestedAt     time.Time `json:"requested_at"`
+	StartedAt       time.Time `json:"started_at"`
+	CompletedAt     time.Time `json:"completed_at"`
+	AbortedUploads  int       `json:"aborted_uploads"`
+	DeletedVersions int       `json:"deleted_versions"`
+}
+
+// SignedDeletionReport is a deletion report along with its Ed25519
+// signature. The signature is over Payload, the JSON encoding of the report,
+// which is what the report should be read from once the signature has been
+// verified. KeyID is the hex encoded SHA-256 of the public key, in PKIX form.
+type SignedDeletionReport struct {
+	Report    DeletionReport `json:"report"`
+	Payload   []byte         `json:"payload"`
+	KeyID     string         `json:"key_id"`
+	Signature []byte         `json:"signature"`
+}
+
+// loadSigningKey reads the Ed25519 private key of a PEM encoded PKCS #8 file,
+// as generated by `openssl genpkey -algorithm ed25519`.
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read signing key file")
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("signing key file has no PEM encoded private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse signing key")
+	}
+	signingKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key is not an Ed25519 key")
+	}
+	return signingKey, nil
+}
+
+// signDeletionReport signs the report with the signing key.
+func signDeletionReport(report DeletionReport, key ed25519.PrivateKey) (*SignedDeletionReport, error) {
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	keyID := sha256.Sum256(publicKey)
+	return &SignedDeletionReport{
+		Report:    report,
+		Payload:   payload,
+		KeyID:     hex.EncodeToString(keyID[:]),
+		Signature: ed25519.Sign(key, payload),
+	}, nil
+}
+
+// offboardInstallation schedules the deletion of the data of the
+// installation once the grace period is over. Its requests are rejected
+// from now on, until the offboarding is cancelled. Offboarding an
+// installation again keeps the schedule it already has.
+func (s *Server) offboardInstallation(installationID string) (*deletionState, error) {
+	if installationID == "" || strings.Contains(installationID, "/") {
+		return nil, errors.Errorf("invalid installation ID %q", installationID)
+	}
+
+	if state := s.states.get(installationID); state.Moving != nil || state.MovingFrom != "" {
+		return nil, &s3Error{StatusCode: http.StatusConflict, Code: "OperationAborted", Message: "Installation " + installationID + " is moving."}
+	}
+
+	var deleting deletionState
+	var scheduled bool
+	err := s.states.update(installationID, func(state *installationState) {
+		if state.Deleting == nil {
+			now := time.Now().UTC()
+			state.Deleting = &deletionState{
+				RequestedAt: now,
+				DeleteAfter: now.Add(time.Duration(s.cfg.OffboardingSettings.GracePeriodSecs) * time.Second),
+			}
+			scheduled = true
+		}
+		deleting = *state.Deleting
+	})
+	if scheduled {
+		s.logger.Info("offboarding installation", mlog.String("installation_id", installationID), mlog.String("delete_after", deleting.DeleteAfter.Format(time.RFC3339)))
+	}
+	return &deleting, err
+}
+
+// cancelOffboarding lets the installation serve requests again, as long as
+// the deletion of its data hasn't started.
+func (s *Server) cancelOffboarding(installationID string) error {
+	var cancelErr error
+	err := s.states.update(installationID, func(state *installationState) {
+		switch {
+		case state.Deleting == nil:
+			cancelErr = &s3Error{StatusCode: http.StatusNotFound, Code: "NoSuchInstallation", Message: "Installation " + installationID + " is not being offboarded."}
+		case state.Deleting.StartedAt != nil:
+			cancelErr = &s3Error{StatusCode: http.StatusConflict, Code: "OperationAborted", Message: "The deletion of installation " + installationID + " has already started."}
+		default:
+			state.Deleting = nil
+		}
+	})
+	if cancelErr != nil {
+		return cancelErr
+	}
+	s.logger.Info("cancelled offboarding", mlog.String("installation_id", installationID))
+	return err
+}
+
+// guardDeletion rejects every request of the installations being deleted,
+// including the listings of their prefix, the keys of DeleteObjects requests
+// and the sources of copies.
+func (s *Server) guardDeletion(r *http.Request, op s3Request, installationID string) error {
+	installations := []string{installationID}
+	switch op.Operation {
+	case opListObjects, opListObjectsV2, opListMultipartUploads:
+		id, _, _ := strings.Cut(r.URL.Query().Get("prefix"), "/")
+		installations = append(installations, id)
+	case opDeleteObjects:
+		request, err := readDeleteObjectsRequest(r)
+		if err != nil {
+			return err
+		}
+		for id := range request.installations() {
+			installations = append(installations, id)
+		}
+	case opCopyObject, opUploadPartCopy:
+		source, err := s.copySourceKey(r)
+		if err != nil {
+			return err
+		}
+		id, _, _ := strings.Cut(source, "/")
+		installations = append(installations, id)
+	}
+
+	for _, id := range installations {
+		if id != "" && s.states.get(id).Deleting != nil {
+			s.metrics.incRejectedRequest(id, "deleting")
+			return &s3Error{StatusCode: http.StatusForbidden, Code: "AccessDenied", Message: "Installation " + id + " is being deleted."}
+		}
+	}
+	return nil
+}
+
+func (s *Server) runOffboarding(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(s.cfg.OffboardingSettings.IntervalSecs) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		for installationID, state := range s.states.list() {
+			if state.Deleting == nil || state.Deleting.CompletedAt != nil || time.Now().Before(state.Deleting.DeleteAfter) {
+				continue
+			}
+			if _, err := s.DeleteInstallation(ctx, installationID); err != nil && ctx.Err() == nil {
+				s.logger.Error("failed to delete installation", mlog.String("installation_id", installationID), mlog.Err(err))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeleteInstallation deletes every multipart upload, object version and
+// delete marker under the prefix of an offboarded installation whose grace
+// period is over, checks that nothing is left, and returns the signed report
+// of the deletion. The progress is saved in the installation state after
+// every batch, and an interrupted deletion resumes from it. Once completed,
+// the installation stays offboarded, and the report is kept in its state.
+func (s *Server) DeleteInstallation(ctx context.Context, installationID string) (*SignedDeletionReport, error) {
+	if s.signingKey == nil {
+		return nil, errors.New("offboarding is not enabled")
+	}
+
+	var deleting deletionState
+	var startErr error
+	err := s.states.update(installationID, func(state *installationState) {
+		switch {
+		case state.Deleting == nil:
+			startErr = errors.Errorf("installation %s is not being offboarded", installationID)
+		case state.Deleting.CompletedAt != nil:
+		case time.Now().Before(state.Deleting.DeleteAfter):
+			startErr = errors.Errorf("the grace period of installation %s ends at %s", installationID, state.Deleting.DeleteAfter.Format(time.RFC3339))
+		case state.Deleting.StartedAt == nil:
+			now := time.Now().UTC()
+			state.Deleting.StartedAt = &now
+			state.Deleting.Phase = deletionPhaseUploads
+		}
+		if state.Deleting != nil {
+			deleting = *state.Deleting
+		}
+	})
+	if startErr != nil {
+		return nil, startErr
+	}
+	if deleting.Report != nil {
+		return deleting.Report, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info("deleting installation", mlog.String("installation_id", installationID), mlog.String("phase", deleting.Phase), mlog.Int("aborted_uploads", deleting.AbortedUploads), mlog.Int("deleted_versions", deleting.DeletedVersions))
+
+	prefix := installationID + "/"
+	checkpoint := func(phase string, uploads, versions int) error {
+		return s.states.update(installationID, func(state *installationState) {
+			state.Deleting.Phase = phase
+			state.Deleting.AbortedUploads += uploads
+			state.Deleting.DeletedVersions += versions
+			deleting = *state.Deleting
+		})
+	}
+
+	// The uploads and versions handled before an error are counted too.
+	var keyMarker, uploadIDMarker string
+	for {
+		page, err := s.listMultipartUploads(ctx, prefix, "", keyMarker, uploadIDMarker)
+		if err != nil {
+			return nil, err
+		}
+		aborted := 0
+		for _, upload := range page.Uploads {
+			err = s.abortMultipartUpload(ctx, "/"+upload.Key, upload.UploadID)
+			if err != nil && !isS3ErrorCode(err, "NoSuchUpload") {
+				break
+			}
+			err = nil
+			aborted++
+		}
+		if checkpointErr := checkpoint(deletionPhaseUploads, aborted, 0); err == nil {
+			err = checkpointErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !page.IsTruncated {
+			break
+		}
+		keyMarker, uploadIDMarker = page.NextKeyMarker, page.NextUploadIDMarker
+	}
+
+	if err := checkpoint(deletionPhaseVersions, 0, 0); err != nil {
+		return nil, err
+	}
+	var versionIDMarker string
+	keyMarker = ""
+	for {
+		page, err := s.listObjectVersions(ctx, prefix, keyMarker, versionIDMarker)
+		if err != nil {
+			return nil, err
+		}
+		deleted, err := s.deleteVersionBatch(ctx, append(page.Versions, page.DeleteMarkers...))
+		if checkpointErr := checkpoint(deletionPhaseVersions, 0, deleted); err == nil {
+			err = checkpointErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !page.IsTruncated {
+			break
+		}
+		keyMarker, versionIDMarker = page.NextKeyMarker, page.NextVersionIDMarker
+	}
+
+	if err := checkpoint(deletionPhaseVerify, 0, 0); err != nil {
+		return nil, err
+	}
+	uploads, err := s.listMultipartUploads(ctx, prefix, "", "", "")
+	if err != nil {
+		return nil, err
+	}
+	versions, err := s.listObjectVersions(ctx, prefix, "", "")
+	if err != nil {
+		return nil, err
+	}
+	if len(uploads.Uploads) > 0 || len(versions.Versions) > 0 || len(versions.DeleteMarkers) > 0 {
+		return nil, errors.Errorf("%d multipart uploads and %d object versions are left under %s", len(uploads.Uploads), len(versions.Versions)+len(versions.DeleteMarkers), prefix)
+	}
+
+	report, err := signDeletionReport(DeletionReport{
+		InstallationID:  installationID,
+		Bucket:          s.cfg.S3Settings.Bucket,
+		Prefix:          prefix,
+		RequestedAt:     deleting.RequestedAt,
+		StartedAt:       *deleting.StartedAt,
+		CompletedAt:     time.Now().UTC(),
+		AbortedUploads:  deleting.AbortedUploads,
+		DeletedVersions: deleting.DeletedVersions,
+	}, s.signingKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign the deletion report")
+	}
+	err = s.states.update(installationID, func(state *installationState) {
+		state.Deleting.Phase = deletionPhaseDone
+		state.Deleting.CompletedAt = &report.Report.CompletedAt
+		state.Deleting.Report = report
+	})
+	s.logger.Info("deleted installation", mlog.String("installation_id", installationID), mlog.Int("aborted_uploads", report.Report.AbortedUploads), mlog.Int("deleted_versions", report.Report.DeletedVersions))
+	return report, err
+}
+
+// deleteVersionBatch deletes the versions with a DeleteObjects request, and
+// retries the versions that couldn't be deleted, or the whole request when
+// S3 is unavailable or slowing down, with an exponential backoff. It returns
+// the number of versions deleted, even when some of them couldn't be.
+func (s *Server) deleteVersionBatch(ctx context.Context, versions []objectVersion) (int, error) {
+	if len(versions) == 0 {
+		return 0, nil
+	}
+	settings := s.cfg.OffboardingSettings
+	maxAttempts := settings.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = defaultOffboardingMaxAttempts
+	}
+	backoff := time.Duration(settings.RetryBackoffMillis) * time.Millisecond
+	if backoff == 0 {
+		backoff = defaultOffboardingRetryBackoff
+	}
+
+	deleted := 0
+	for attempt := 1; ; attempt++ {
+		failed, err := s.deleteObjectVersions(ctx, versions)
+		if err == nil {
+			deleted += len(versions) - len(failed)
+			if len(failed) == 0 {
+				return deleted, nil
+			}
+			versions = make([]objectVersion, 0, len(failed))
+			for _, version := range failed {
+				versions = append(versions, objectVersion{Key: version.Key, VersionID: version.VersionID})
+			}
+			err = errors.Errorf("failed to delete %d object versions, like %s: %s", len(failed), failed[0].Key, failed[0].Code)
+		} else if !isRetryableDeleteError(err) {
+			return deleted, err
+		}
+		if attempt == maxAttempts || ctx.Err() != nil {
+			return deleted, err
+		}
+		s.logger.Debug("failed to delete object versions, retrying", mlog.Int("attempt", attempt), mlog.Err(err))
+
+		select {
+		case <-ctx.Done():
+			return deleted, err
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxOffboardingRetryBackoff)
+	}
+}
+
+// isRetryableDeleteError reports whether a DeleteObjects request that failed
+// with err can be sent again.
+func isRetryableDeleteError(err error) bool {
+	var s3Err *s3Error
+	if !errors.As(err, &s3Err) {
+		return true
+	}
+	return s3Err.StatusCode >= http.StatusInternalServerError || s3Err.Code == "SlowDown"
+}
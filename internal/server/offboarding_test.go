@@ -0,0 +1,241 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newOffboardingTestServer returns a server whose installation states are
+// saved to a temporary file, with offboarding enabled.
+func newOffboardingTestServer(t *testing.T, settings OffboardingSettings) (*Server, *fakeS3, ed25519.PublicKey) {
+	fake, ts := newFakeS3(t)
+	settings.Enable = true
+	settings.RetryBackoffMillis = 1
+	s := newFakeS3Server(t, ts, Config{OffboardingSettings: settings})
+	var err error
+	s.states, err = newStateStore(filepath.Join(t.TempDir(), "state.json"))
+	require.NoError(t, err)
+	publicKey, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	s.signingKey = signingKey
+	return s, fake, publicKey
+}
+
+// endGracePeriod lets the deletion of the installation start.
+func endGracePeriod(t *testing.T, s *Server, installationID string) {
+	require.NoError(t, s.states.update(installationID, func(state *installationState) {
+		state.Deleting.DeleteAfter = time.Now().Add(-time.Second)
+	}))
+}
+
+func TestOffboardInstallation(t *testing.T) {
+	s, fake, publicKey := newOffboardingTestServer(t, OffboardingSettings{GracePeriodSecs: 3600})
+	handler := s.handler()
+
+	fake.put("inst/a", []byte("a"), nil)
+	fake.put("inst/b", []byte("b"), nil)
+	fake.put("inst/.trash/20240101T000000.000000000Z/c", []byte("c"), nil)
+	fake.put("other/d", []byte("d"), nil)
+	fake.versions = []fakeVersion{{key: "inst/a", versionID: "v1"}, {key: "inst/e", versionID: "v2", deleteMarker: true}}
+	fake.uploads["upload-1"] = &fakeUpload{key: "inst/f", parts: make(map[int][]byte)}
+
+	deleting, err := s.offboardInstallation("inst")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), deleting.DeleteAfter, time.Minute)
+
+	// Every request of the installation is rejected, including the ones
+	// reaching it from other installations.
+	for _, request := range []struct {
+		method, path, body string
+		header             http.Header
+	}{
+		{method: "GET", path: "/inst/a"},
+		{method: "PUT", path: "/inst/new", body: "new"},
+		{method: "GET", path: "?list-type=2&prefix=inst/"},
+		{method: "POST", path: "?delete", body: `<Delete><Object><Key>other/d</Key></Object><Object><Key>inst/a</Key></Object></Delete>`},
+		{method: "PUT", path: "/other/copy", header: http.Header{"X-Amz-Copy-Source": {"/agnivatest/inst/a"}}},
+	} {
+		resp := serveRequest(handler, request.method, request.path, []byte(request.body), request.header)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, request.method+" "+request.path)
+	}
+	assert.NotNil(t, fake.object("other/d"))
+	resp := serveRequest(handler, "GET", "/other/d", nil, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The deletion waits for the grace period, during which the offboarding
+	// can be cancelled.
+	_, err = s.DeleteInstallation(context.Background(), "inst")
+	assert.Error(t, err)
+	require.NoError(t, s.cancelOffboarding("inst"))
+	assert.True(t, s.states.get("inst").isEmpty())
+	resp = serveRequest(handler, "GET", "/inst/a", nil, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, isS3ErrorCode(s.cancelOffboarding("inst"), "NoSuchInstallation"))
+
+	_, err = s.offboardInstallation("inst")
+	require.NoError(t, err)
+	endGracePeriod(t, s, "inst")
+	fake.failDeletes = 1
+	signed, err := s.DeleteInstallation(context.Background(), "inst")
+	require.NoError(t, err)
+	assert.Equal(t, "inst", signed.Report.InstallationID)
+	assert.Equal(t, "inst/", signed.Report.Prefix)
+	assert.Equal(t, 1, signed.Report.AbortedUploads)
+	assert.Equal(t, 5, signed.Report.DeletedVersions)
+	for key := range fake.objects {
+		assert.Equal(t, "other/d", key)
+	}
+	assert.Empty(t, fake.versions)
+	assert.Empty(t, fake.uploads)
+
+	// The report is read from its signed payload.
+	require.True(t, ed25519.Verify(publicKey, signed.Payload, signed.Signature))
+	var report DeletionReport
+	require.NoError(t, json.Unmarshal(signed.Payload, &report))
+	assert.Equal(t, signed.Report, report)
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	require.NoError(t, err)
+	keyID := sha256.Sum256(der)
+	assert.Equal(t, hex.EncodeToString(keyID[:]), signed.KeyID)
+
+	// The installation stays offboarded, with its report.
+	assert.True(t, isS3ErrorCode(s.cancelOffboarding("inst"), "OperationAborted"))
+	resp = serveRequest(handler, "GET", "/inst/a", nil, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	again, err := s.DeleteInstallation(context.Background(), "inst")
+	require.NoError(t, err)
+	assert.Equal(t, signed.Signature, again.Signature)
+
+	states, err := newStateStore(s.states.path)
+	require.NoError(t, err)
+	deleting = states.get("inst").Deleting
+	require.NotNil(t, deleting)
+	assert.Equal(t, deletionPhaseDone, deleting.Phase)
+	require.NotNil(t, deleting.Report)
+	assert.Equal(t, signed.Payload, deleting.Report.Payload)
+}
+
+func TestDeleteInstallationResumes(t *testing.T) {
+	s, fake, _ := newOffboardingTestServer(t, OffboardingSettings{MaxAttempts: 2})
+	s.handler()
+
+	fake.put("inst/a", []byte("a"), nil)
+	fake.put("inst/b", []byte("b"), nil)
+	fake.put("inst/c", []byte("c"), nil)
+	fake.uploads["upload-1"] = &fakeUpload{key: "inst/d", parts: make(map[int][]byte)}
+
+	_, err := s.offboardInstallation("inst")
+	require.NoError(t, err)
+	fake.failDeletes = 3
+	_, err = s.DeleteInstallation(context.Background(), "inst")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "InternalError")
+
+	deleting := s.states.get("inst").Deleting
+	require.NotNil(t, deleting.StartedAt)
+	assert.Equal(t, deletionPhaseVersions, deleting.Phase)
+	assert.Equal(t, 1, deleting.AbortedUploads)
+	assert.Nil(t, deleting.Report)
+	assert.True(t, isS3ErrorCode(s.cancelOffboarding("inst"), "OperationAborted"))
+
+	// The deletion carries on from its checkpoint.
+	signed, err := s.DeleteInstallation(context.Background(), "inst")
+	require.NoError(t, err)
+	assert.Equal(t, 1, signed.Report.AbortedUploads)
+	assert.Equal(t, 3, signed.Report.DeletedVersions)
+	assert.Equal(t, *deleting.StartedAt, signed.Report.StartedAt)
+	assert.Empty(t, fake.objects)
+}
+
+func TestAdminOffboarding(t *testing.T) {
+	s, fake, _ := newOffboardingTestServer(t, OffboardingSettings{GracePeriodSecs: 3600})
+	router := newAdminRouter(s)
+
+	fake.put("inst/a", []byte("a"), nil)
+
+	call := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	w := call("POST", "/admin/installations/inst/offboard")
+	require.Equal(t, http.StatusOK, w.Code)
+	var deleting deletionState
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &deleting))
+	assert.True(t, deleting.DeleteAfter.After(time.Now()))
+	assert.Equal(t, http.StatusNotFound, call("GET", "/admin/installations/inst/offboard/report").Code)
+
+	assert.Equal(t, http.StatusOK, call("POST", "/admin/installations/inst/offboard/cancel").Code)
+	assert.Equal(t, http.StatusNotFound, call("POST", "/admin/installations/inst/offboard/cancel").Code)
+
+	assert.Equal(t, http.StatusOK, call("POST", "/admin/installations/inst/offboard").Code)
+	endGracePeriod(t, s, "inst")
+	_, err := s.DeleteInstallation(context.Background(), "inst")
+	require.NoError(t, err)
+	w = call("GET", "/admin/installations/inst/offboard/report")
+	require.Equal(t, http.StatusOK, w.Code)
+	var signed SignedDeletionReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &signed))
+	assert.Equal(t, 1, signed.Report.DeletedVersions)
+	assert.Equal(t, http.StatusConflict, call("POST", "/admin/installations/inst/offboard/cancel").Code)
+
+	s.cfg.OffboardingSettings.Enable = false
+	router = newAdminRouter(s)
+	assert.Equal(t, http.StatusNotFound, call("POST", "/admin/installations/other/offboard").Code)
+	assert.Equal(t, http.StatusNotFound, call("GET", "/admin/installations/inst/offboard/report").Code)
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	writeKey := func(key any) string {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		require.NoError(t, err)
+		path := filepath.Join(t.TempDir(), "key.pem")
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+		return path
+	}
+
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	loaded, err := loadSigningKey(writeKey(signingKey))
+	require.NoError(t, err)
+	assert.Equal(t, signingKey, loaded)
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, err = loadSigningKey(writeKey(ecdsaKey))
+	assert.Error(t, err)
+	_, err = loadSigningKey(filepath.Join(t.TempDir(), "missing.pem"))
+	assert.Error(t, err)
+}
+
+func TestOffboardingSettingsIsValid(t *testing.T) {
+	assert.NoError(t, Config{ServiceSettings: ServiceSettings{AdminToken: "secret"}, OffboardingSettings: OffboardingSettings{Enable: true, IntervalSecs: 60, SigningKeyFile: "key.pem"}}.IsValid())
+	assert.Error(t, Config{ServiceSettings: ServiceSettings{AdminToken: "secret"}, OffboardingSettings: OffboardingSettings{Enable: true, IntervalSecs: 60}}.IsValid())
+	assert.Error(t, Config{ServiceSettings: ServiceSettings{AdminToken: "secret"}, OffboardingSettings: OffboardingSettings{Enable: true, SigningKeyFile: "key.pem"}}.IsValid())
+	assert.Error(t, Config{ServiceSettings: ServiceSettings{AdminToken: "secret"}, OffboardingSettings: OffboardingSettings{Enable: true, IntervalSecs: 60, SigningKeyFile: "key.pem", GracePeriodSecs: -1}}.IsValid())
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// S3 operations Bifrost needs to tell apart.
+const (
+	opUnknown                 = "Unknown"
+	opGetObject               = "GetObject"
+	opHeadObject              = "HeadObject"
+	opPutObject               = "PutObject"
+	opCopyObject              = "CopyObject"
+	opDeleteObject            = "DeleteObject"
+	opDeleteObjects           = "DeleteObjects"
+	opCreateMultipartUpload   = "CreateMultipartUpload"
+	opUploadPart              = "UploadPart"
+	opUploadPartCopy          = "UploadPartCopy"
+	opCompleteMultipartUpload = "CompleteMultipartUpload"
+	opAbortMultipartUpload    = "AbortMultipartUpload"
+	opListParts               = "ListParts"
+	opListObjects             = "ListObjects"
+	opListObjectsV2           = "ListObjectsV2"
+	opListMultipartUploads    = "ListMultipartUploads"
+	opHeadBucket              = "HeadBucket"
+)
+
+// s3Request describes the S3 operation of an incoming request.
+type s3Request struct {
+	Operation string
+	// Key is the key of the object in the bucket, without a leading slash.
+	// It is empty for bucket operations.
+	Key string
+}
+
+// classifyRequest finds out which S3 operation an incoming path-style
+// request is for.
+func classifyRequest(r *http.Request, bucket string) s3Request {
+	key := strings.TrimPrefix(r.URL.Path, "/"+bucket)
+	key = strings.TrimPrefix(key, "/")
+	query := r.URL.Query()
+	has := func(name string) bool {
+		_, ok := query[name]
+		return ok
+	}
+
+	req := s3Request{Operation: opUnknown, Key: key}
+
+	if key == "" {
+		switch {
+		case r.Method == http.MethodGet && has("uploads"):
+			req.Operation = opListMultipartUploads
+		case r.Method == http.MethodGet && hasSubresource(query, listQueryParameters):
+		case r.Method == http.MethodGet && query.Get("list-type") == "2":
+			req.Operation = opListObjectsV2
+		case r.Method == http.MethodGet:
+			req.Operation = opListObjects
+		case r.Method == http.MethodHead && len(query) == 0:
+			req.Operation = opHeadBucket
+		case r.Method == http.MethodPost && has("delete"):
+			req.Operation = opDeleteObjects
+		}
+		return req
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		switch {
+		case has("uploadId"):
+			req.Operation = opListParts
+		case !hasSubresource(query, objectQueryParameters):
+			req.Operation = opGetObject
+		}
+	case http.MethodHead:
+		if !hasSubresource(query, objectQueryParameters) {
+			req.Operation = opHeadObject
+		}
+	case http.MethodPut:
+		copySource := r.Header.Get("X-Amz-Copy-Source") != ""
+		switch {
+		case has("uploadId") && has("partNumber") && copySource:
+			req.Operation = opUploadPartCopy
+		case has("uploadId") && has("partNumber"):
+			req.Operation = opUploadPart
+		case hasSubresource(query, objectQueryParameters):
+		case copySource:
+			req.Operation = opCopyObject
+		default:
+			req.Operation = opPutObject
+		}
+	case http.MethodPost:
+		switch {
+		case has("uploads"):
+			req.Operation = opCreateMultipartUpload
+		case has("uploadId"):
+			req.Operation = opCompleteMultipartUpload
+		}
+	case http.MethodDelete:
+		switch {
+		case has("uploadId"):
+			req.Operation = opAbortMultipartUpload
+		case !hasSubresource(query, objectQueryParameters):
+			req.Operation = opDeleteObject
+		}
+	}
+
+	return req
+}
+
+// objectQueryParameters are the query parameters of object requests that do
+// not select a subresource.
+var objectQueryParameters = map[string]bool{
+	"versionId":                    true,
+	"partNumber":                   true,
+	"response-cache-control":       true,
+	"response-content-disposition": true,
+	"response-content-encoding":    true,
+	"response-content-language":    true,
+	"response-content-type":        true,
+	"response-expires":             true,
+	"x-id":                         true,
+}
+
+// listQueryParameters are the query parameters of ListObjects and
+// ListObjectsV2 requests.
+var listQueryParameters = map[string]bool{
+	"list-type":          true,
+	"prefix":             true,
+	"delimiter":          true,
+	"marker":             true,
+	"max-keys":           true,
+	"encoding-type":      true,
+	"continuation-token": true,
+	"fetch-owner":        true,
+	"start-after":        true,
+	"x-id":               true,
+}
+
+// hasSubresource reports whether the query selects a subresource, such as
+// ?acl or ?tagging, that is any parameter not in allowed.
+func hasSubresource(query map[string][]string, allowed map[string]bool) bool {
+	for name := range query {
+		if !allowed[name] {
+			return true
+		}
+	}
+	return false
+}
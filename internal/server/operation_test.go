@@ -0,0 +1,52 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyRequest(t *testing.T) {
+	for _, test := range []struct {
+		method     string
+		target     string
+		copySource bool
+		operation  string
+		key        string
+	}{
+		{"GET", "/bucket/inst/file", false, opGetObject, "inst/file"},
+		{"GET", "/bucket/inst/file?versionId=1&response-content-type=text", false, opGetObject, "inst/file"},
+		{"GET", "/bucket/inst/file?acl", false, opUnknown, "inst/file"},
+		{"GET", "/bucket/inst/file?uploadId=1", false, opListParts, "inst/file"},
+		{"HEAD", "/bucket/inst/file", false, opHeadObject, "inst/file"},
+		{"PUT", "/bucket/inst/file", false, opPutObject, "inst/file"},
+		{"PUT", "/bucket/inst/file", true, opCopyObject, "inst/file"},
+		{"PUT", "/bucket/inst/file?tagging", false, opUnknown, "inst/file"},
+		{"PUT", "/bucket/inst/file?partNumber=1&uploadId=1", false, opUploadPart, "inst/file"},
+		{"PUT", "/bucket/inst/file?partNumber=1&uploadId=1", true, opUploadPartCopy, "inst/file"},
+		{"POST", "/bucket/inst/file?uploads", false, opCreateMultipartUpload, "inst/file"},
+		{"POST", "/bucket/inst/file?uploadId=1", false, opCompleteMultipartUpload, "inst/file"},
+		{"DELETE", "/bucket/inst/file?uploadId=1", false, opAbortMultipartUpload, "inst/file"},
+		{"DELETE", "/bucket/inst/file", false, opDeleteObject, "inst/file"},
+		{"GET", "/bucket?list-type=2&prefix=inst/", false, opListObjectsV2, ""},
+		{"GET", "/bucket/?prefix=inst/", false, opListObjects, ""},
+		{"GET", "/bucket?uploads", false, opListMultipartUploads, ""},
+		{"GET", "/bucket?policy", false, opUnknown, ""},
+		{"HEAD", "/bucket", false, opHeadBucket, ""},
+		{"POST", "/bucket?delete", false, opDeleteObjects, ""},
+	} {
+		t.Run(test.method+" "+test.target, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "http://example.com"+test.target, nil)
+			if test.copySource {
+				req.Header.Set("X-Amz-Copy-Source", "/bucket/inst/other")
+			}
+			op := classifyRequest(req, "bucket")
+			assert.Equal(t, test.operation, op.Operation)
+			assert.Equal(t, test.key, op.Key)
+		})
+	}
+}
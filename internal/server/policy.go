@@ -0,0 +1,540 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+// Effects of the policy statements.
+const (
+	policyAllow = "Allow"
+	policyDeny  = "Deny"
+)
+
+// Keys of the policy conditions. They are matched regardless of case.
+const (
+	policyKeyContentLength = "s3:contentlength"
+	policyKeyContentType   = "s3:contenttype"
+	policyKeySourceIP      = "aws:sourceip"
+	policyKeyCurrentTime   = "aws:currenttime"
+)
+
+// policyFile is the document of the policy file. Requests that no statement
+// allows or denies get the default effect, Allow unless set.
+type policyFile struct {
+	DefaultEffect string
+	Policies      []policyDocument
+}
+
+// policyDocument is a set of statements applying to the installations that
+// match any of its patterns. Bucket requests belong to no installation, so
+// only policies for "*" apply to them.
+type policyDocument struct {
+	Name          string
+	Installations []string
+	Statement     []policyStatement
+}
+
+// policyStatement allows or denies the actions on the keys, relative to the
+// installation, that match its patterns, if all of its conditions are met.
+// A statement without Resource applies to every key.
+type policyStatement struct {
+	Sid       string
+	Effect    string
+	Action    policyValues
+	Resource  policyValues
+	Condition map[string]map[string]policyValues
+}
+
+// policyValues are the values of a policy field, which can be a single
+// value or an array of them.
+type policyValues []string
+
+func (v *policyValues) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+	values, ok := value.([]any)
+	if !ok {
+		values = []any{value}
+	}
+	*v = nil
+	for _, value := range values {
+		switch value := value.(type) {
+		case string:
+			*v = append(*v, value)
+		case json.Number:
+			*v = append(*v, value.String())
+		case bool:
+			*v = append(*v, strconv.FormatBool(value))
+		default:
+			return errors.Errorf("invalid policy value %s", data)
+		}
+	}
+	return nil
+}
+
+// policySet holds the compiled policies of a policy file.
+type policySet struct {
+	defaultEffect string
+	policies      []compiledPolicy
+}
+
+type compiledPolicy struct {
+	name          string
+	installations []string
+	statements    []compiledStatement
+}
+
+type compiledStatement struct {
+	sid        string
+	effect     string
+	actions    []string
+	resources  []string
+	conditions []policyCondition
+}
+
+// policyCondition compares the value of a key of the request with the
+// values of the condition, parsed for the operator. A condition with several
+// values is met if any of them matches, or for the negated operators, if
+// none of them does.
+type policyCondition struct {
+	operator string
+	key      string
+	values   []string
+	numbers  []float64
+	times    []time.Time
+	networks []*net.IPNet
+}
+
+// loadPolicies reads and compiles the policy file.
+func loadPolicies(path string) (*policySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read policy file")
+	}
+	var file policyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, errors.Wrap(err, "failed to decode policy file")
+	}
+	return compilePolicies(file)
+}
+
+// compilePolicies checks the policies and parses the values of their
+// conditions, so that mistakes are reported when the policies are loaded
+// rather than when requests are evaluated.
+func compilePolicies(file policyFile) (*policySet, error) {
+	set := &policySet{defaultEffect: file.DefaultEffect}
+	if set.defaultEffect == "" {
+		set.defaultEffect = policyAllow
+	}
+	if set.defaultEffect != policyAllow && set.defaultEffect != policyDeny {
+		return nil, errors.Errorf("invalid DefaultEffect %q", file.DefaultEffect)
+	}
+
+	for i, document := range file.Policies {
+		policy := compiledPolicy{name: document.Name, installations: document.Installations}
+		if policy.name == "" {
+			policy.name = strconv.Itoa(i)
+		}
+		if len(policy.installations) == 0 {
+			return nil, errors.Errorf("policy %s applies to no installations", policy.name)
+		}
+		for j, statement := range document.Statement {
+			compiled, err := compileStatement(statement)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid statement %d of policy %s", j, policy.name)
+			}
+			policy.statements = append(policy.statements, compiled)
+		}
+		set.policies = append(set.policies, policy)
+	}
+	return set, nil
+}
+
+func compileStatement(statement policyStatement) (compiledStatement, error) {
+	compiled := compiledStatement{sid: statement.Sid, effect: statement.Effect, resources: statement.Resource}
+	if compiled.effect != policyAllow && compiled.effect != policyDeny {
+		return compiled, errors.Errorf("invalid Effect %q", statement.Effect)
+	}
+	if len(statement.Action) == 0 {
+		return compiled, errors.New("Action is required")
+	}
+	for _, action := range statement.Action {
+		compiled.actions = append(compiled.actions, strings.ToLower(action))
+	}
+
+	for operator, keys := range statement.Condition {
+		for key, values := range keys {
+			condition := policyCondition{operator: operator, key: strings.ToLower(key), values: values}
+			switch condition.key {
+			case policyKeyContentLength, policyKeyContentType, policyKeySourceIP, policyKeyCurrentTime:
+			default:
+				return compiled, errors.Errorf("unknown condition key %q", key)
+			}
+			if err := condition.parse(); err != nil {
+				return compiled, errors.Wrapf(err, "invalid %s condition on %s", operator, key)
+			}
+			compiled.conditions = append(compiled.conditions, condition)
+		}
+	}
+	// Conditions are evaluated in a stable order, whatever the order of the
+	// maps they were decoded into.
+	slices.SortFunc(compiled.conditions, func(a, b policyCondition) int {
+		return strings.Compare(a.operator+" "+a.key, b.operator+" "+b.key)
+	})
+	return compiled, nil
+}
+
+// parse parses the values of the condition for its operator.
+func (c *policyCondition) parse() error {
+	if len(c.values) == 0 {
+		return errors.New("no values")
+	}
+	switch c.operator {
+	case "StringEquals", "StringNotEquals", "StringLike", "StringNotLike":
+	case "NumericEquals", "NumericNotEquals", "NumericLessThan", "NumericLessThanEquals", "NumericGreaterThan", "NumericGreaterThanEquals":
+		for _, value := range c.values {
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return errors.Errorf("invalid number %q", value)
+			}
+			c.numbers = append(c.numbers, number)
+		}
+	case "DateEquals", "DateNotEquals", "DateLessThan", "DateLessThanEquals", "DateGreaterThan", "DateGreaterThanEquals":
+		for _, value := range c.values {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return errors.Errorf("invalid date %q", value)
+			}
+			c.times = append(c.times, t)
+		}
+	case "IpAddress", "NotIpAddress":
+		for _, value := range c.values {
+			if !strings.Contains(value, "/") {
+				if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+					value += "/32"
+				} else {
+					value += "/128"
+				}
+			}
+			_, network, err := net.ParseCIDR(value)
+			if err != nil {
+				return errors.Errorf("invalid IP address %q", value)
+			}
+			c.networks = append(c.networks, network)
+		}
+	default:
+		return errors.New("unknown operator")
+	}
+	return nil
+}
+
+// negated reports whether the operator is met when none of the values
+// match.
+func (c *policyCondition) negated() bool {
+	return strings.Contains(c.operator, "Not")
+}
+
+// met reports whether the condition is met by the value of its key, which is
+// missing if ok is false. Conditions on missing keys are only met by the
+// negated operators.
+func (c *policyCondition) met(value string, ok bool) bool {
+	if !ok {
+		return c.negated()
+	}
+	match := false
+	switch {
+	case c.numbers != nil:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+		match = slices.ContainsFunc(c.numbers, func(n float64) bool {
+			switch c.operator {
+			case "NumericLessThan":
+				return number < n
+			case "NumericLessThanEquals":
+				return number <= n
+			case "NumericGreaterThan":
+				return number > n
+			case "NumericGreaterThanEquals":
+				return number >= n
+			default:
+				return number == n
+			}
+		})
+	case c.times != nil:
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return false
+		}
+		match = slices.ContainsFunc(c.times, func(limit time.Time) bool {
+			switch c.operator {
+			case "DateLessThan":
+				return t.Before(limit)
+			case "DateLessThanEquals":
+				return !t.After(limit)
+			case "DateGreaterThan":
+				return t.After(limit)
+			case "DateGreaterThanEquals":
+				return !t.Before(limit)
+			default:
+				return t.Equal(limit)
+			}
+		})
+	case c.networks != nil:
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return false
+		}
+		match = slices.ContainsFunc(c.networks, func(network *net.IPNet) bool {
+			return network.Contains(ip)
+		})
+	default:
+		like := c.operator == "StringLike" || c.operator == "StringNotLike"
+		match = slices.ContainsFunc(c.values, func(v string) bool {
+			if like {
+				return wildcardMatch(v, value)
+			}
+			return v == value
+		})
+	}
+	return match != c.negated()
+}
+
+// policyRequest is what the policies know of a request.
+type policyRequest struct {
+	InstallationID string `json:"installation_id"`
+	Action         string `json:"action"`
+	// Key is the key of the object relative to the installation, or the
+	// prefix of listings.
+	Key string `json:"key"`
+	// ContentLength is the length of the body, -1 if it is unknown.
+	ContentLength int64     `json:"content_length"`
+	ContentType   string    `json:"content_type"`
+	SourceIP      string    `json:"source_ip"`
+	Time          time.Time `json:"time"`
+}
+
+// value returns the value of a condition key for the request, and whether
+// it has one.
+func (req policyRequest) value(key string) (string, bool) {
+	switch key {
+	case policyKeyContentLength:
+		return strconv.FormatInt(req.ContentLength, 10), req.ContentLength >= 0
+	case policyKeyContentType:
+		return req.ContentType, req.ContentType != ""
+	case policyKeySourceIP:
+		return req.SourceIP, req.SourceIP != ""
+	case policyKeyCurrentTime:
+		return req.Time.UTC().Format(time.RFC3339), true
+	}
+	return "", false
+}
+
+// policyDecision is the outcome of the evaluation of a request, with the
+// statement that decided it. Requests decided by the default effect have
+// no statement.
+type policyDecision struct {
+	Effect    string `json:"effect"`
+	Policy    string `json:"policy,omitempty"`
+	Statement string `json:"statement,omitempty"`
+}
+
+// evaluate decides whether the request is allowed. An explicit Deny wins
+// over any Allow, and an Allow over the default effect.
+func (p *policySet) evaluate(req policyRequest) policyDecision {
+	action := strings.ToLower(req.Action)
+	var allowed *policyDecision
+	for _, policy := range p.policies {
+		if !slices.ContainsFunc(policy.installations, func(pattern string) bool {
+			return wildcardMatch(pattern, req.InstallationID)
+		}) {
+			continue
+		}
+		for _, statement := range policy.statements {
+			if !statement.matches(req, action) {
+				continue
+			}
+			decision := policyDecision{Effect: statement.effect, Policy: policy.name, Statement: statement.sid}
+			if statement.effect == policyDeny {
+				return decision
+			}
+			if allowed == nil {
+				allowed = &decision
+			}
+		}
+	}
+	if allowed != nil {
+		return *allowed
+	}
+	return policyDecision{Effect: p.defaultEffect}
+}
+
+func (st *compiledStatement) matches(req policyRequest, action string) bool {
+	if !slices.ContainsFunc(st.actions, func(pattern string) bool {
+		return wildcardMatch(pattern, action)
+	}) {
+		return false
+	}
+	if st.resources != nil && !slices.ContainsFunc(st.resources, func(pattern string) bool {
+		return wildcardMatch(pattern, req.Key)
+	}) {
+		return false
+	}
+	for _, condition := range st.conditions {
+		if !condition.met(req.value(condition.key)) {
+			return false
+		}
+	}
+	return true
+}
+
+// wildcardMatch reports whether s matches the pattern, in which * matches
+// any sequence of characters, slashes included, and ? any single character.
+func wildcardMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, next := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case star >= 0:
+			// Let the last star match one more character.
+			next++
+			p, i = star+1, next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// checkPolicies evaluates the policies for the request, and returns an
+// AccessDenied error if they deny it. DeleteObjects requests are evaluated
+// as a DeleteObject of each of their keys, and copies also need GetObject
+// on their source.
+func (s *Server) checkPolicies(r *http.Request, op s3Request) error {
+	base := policyRequest{
+		Action:        policyAction(r, op),
+		ContentLength: r.ContentLength,
+		ContentType:   r.Header.Get("Content-Type"),
+		Time:          time.Now(),
+	}
+	base.SourceIP, _, _ = net.SplitHostPort(r.RemoteAddr)
+
+	var requests []policyRequest
+	add := func(action, key string) {
+		req := base
+		req.Action = action
+		req.InstallationID, req.Key, _ = strings.Cut(key, "/")
+		requests = append(requests, req)
+	}
+
+	switch op.Operation {
+	case opDeleteObjects:
+		request, err := readDeleteObjectsRequest(r)
+		if err != nil {
+			return err
+		}
+		for _, object := range request.Objects {
+			add("s3:"+opDeleteObject, object.Key)
+		}
+	case opListObjects, opListObjectsV2, opListMultipartUploads:
+		// Listings whose prefix doesn't name an installation are bucket
+		// requests.
+		prefix := r.URL.Query().Get("prefix")
+		if !strings.Contains(prefix, "/") {
+			prefix = ""
+		}
+		add(base.Action, prefix)
+	case opCopyObject, opUploadPartCopy:
+		source, err := s.copySourceKey(r)
+		if err != nil {
+			return err
+		}
+		add(base.Action, op.Key)
+		add("s3:"+opGetObject, source)
+	default:
+		add(base.Action, op.Key)
+	}
+
+	for _, req := range requests {
+		decision := s.policies.evaluate(req)
+		if decision.Effect == policyAllow {
+			continue
+		}
+		s.metrics.incRejectedRequest(req.InstallationID, "policy")
+		s.logger.Info("request denied by policy",
+			mlog.String("installation_id", req.InstallationID),
+			mlog.String("action", req.Action),
+			mlog.String("key", req.Key),
+			mlog.String("policy", decision.Policy),
+			mlog.String("statement", decision.Statement),
+			mlog.String("source_ip", req.SourceIP),
+		)
+		return &s3Error{StatusCode: http.StatusForbidden, Code: "AccessDenied", Message: "Access Denied"}
+	}
+	return nil
+}
+
+// policyAction returns the action of the request in the policies: s3: and
+// the operation, or for subresources, the method, Bucket or Object, and the
+// subresource, such as s3:GetBucketAcl or s3:PutObjectTagging.
+func policyAction(r *http.Request, op s3Request) string {
+	if op.Operation != opUnknown {
+		return "s3:" + op.Operation
+	}
+
+	scope, allowed := "Object", objectQueryParameters
+	if op.Key == "" {
+		scope, allowed = "Bucket", listQueryParameters
+	}
+	var subresources []string
+	for name := range r.URL.Query() {
+		if !allowed[name] {
+			subresources = append(subresources, name)
+		}
+	}
+	var subresource string
+	if len(subresources) > 0 {
+		slices.Sort(subresources)
+		subresource = camelCase(subresources[0])
+	}
+	return "s3:" + camelCase(strings.ToLower(r.Method)) + scope + subresource
+}
+
+// camelCase turns a name such as object-lock into ObjectLock.
+func camelCase(name string) string {
+	var b strings.Builder
+	for _, word := range strings.Split(name, "-") {
+		if word != "" {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return b.String()
+}
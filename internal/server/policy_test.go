@@ -0,0 +1,292 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPolicies = `{
+	"Policies": [
+		{
+			"Name": "no-bucket-subresources",
+			"Installations": ["*"],
+			"Statement": [
+				{"Sid": "acl", "Effect": "Deny", "Action": ["s3:*BucketAcl", "s3:*BucketPolicy", "s3:*BucketLifecycle"]}
+			]
+		},
+		{
+			"Name": "keep-exports",
+			"Installations": ["inst"],
+			"Statement": [
+				{"Sid": "delete", "Effect": "Deny", "Action": "s3:DeleteObject", "Resource": "exports/*"}
+			]
+		},
+		{
+			"Name": "uploads",
+			"Installations": ["limited-*"],
+			"Statement": [
+				{"Sid": "size", "Effect": "Deny", "Action": ["s3:PutObject", "s3:UploadPart"], "Condition": {"NumericGreaterThan": {"s3:ContentLength": 10}}},
+				{"Sid": "type", "Effect": "Deny", "Action": "s3:PutObject", "Condition": {"StringNotLike": {"s3:ContentType": ["image/*", "text/plain"]}}},
+				{"Sid": "network", "Effect": "Deny", "Action": "s3:*", "Condition": {"NotIpAddress": {"aws:SourceIp": ["10.0.0.0/8", "192.0.2.1"]}}}
+			]
+		}
+	]
+}`
+
+func newTestPolicies(t *testing.T, document string) *policySet {
+	path := filepath.Join(t.TempDir(), "policies.json")
+	require.NoError(t, os.WriteFile(path, []byte(document), 0600))
+	policies, err := loadPolicies(path)
+	require.NoError(t, err)
+	return policies
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	policies := newTestPolicies(t, testPolicies)
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name     string
+		req      policyRequest
+		decision policyDecision
+	}{
+		{
+			name:     "default",
+			req:      policyRequest{InstallationID: "inst", Action: "s3:GetObject", Key: "exports/a"},
+			decision: policyDecision{Effect: policyAllow},
+		},
+		{
+			name:     "deny key",
+			req:      policyRequest{InstallationID: "inst", Action: "s3:deleteobject", Key: "exports/2024/a"},
+			decision: policyDecision{Effect: policyDeny, Policy: "keep-exports", Statement: "delete"},
+		},
+		{
+			name:     "other key",
+			req:      policyRequest{InstallationID: "inst", Action: "s3:DeleteObject", Key: "data/exports/a"},
+			decision: policyDecision{Effect: policyAllow},
+		},
+		{
+			name:     "other installation",
+			req:      policyRequest{InstallationID: "other", Action: "s3:DeleteObject", Key: "exports/a"},
+			decision: policyDecision{Effect: policyAllow},
+		},
+		{
+			name:     "bucket subresource",
+			req:      policyRequest{Action: "s3:PutBucketPolicy"},
+			decision: policyDecision{Effect: policyDeny, Policy: "no-bucket-subresources", Statement: "acl"},
+		},
+		{
+			name:     "too large",
+			req:      policyRequest{InstallationID: "limited-1", Action: "s3:UploadPart", Key: "a", ContentLength: 11, SourceIP: "10.1.2.3"},
+			decision: policyDecision{Effect: policyDeny, Policy: "uploads", Statement: "size"},
+		},
+		{
+			name:     "allowed type",
+			req:      policyRequest{InstallationID: "limited-1", Action: "s3:PutObject", Key: "a", ContentLength: 10, ContentType: "image/png", SourceIP: "192.0.2.1"},
+			decision: policyDecision{Effect: policyAllow},
+		},
+		{
+			name:     "denied type",
+			req:      policyRequest{InstallationID: "limited-1", Action: "s3:PutObject", Key: "a", ContentType: "application/zip", SourceIP: "10.1.2.3"},
+			decision: policyDecision{Effect: policyDeny, Policy: "uploads", Statement: "type"},
+		},
+		{
+			// Negated conditions are met by missing keys.
+			name:     "missing type",
+			req:      policyRequest{InstallationID: "limited-1", Action: "s3:PutObject", Key: "a", ContentLength: -1, SourceIP: "10.1.2.3"},
+			decision: policyDecision{Effect: policyDeny, Policy: "uploads", Statement: "type"},
+		},
+		{
+			name:     "denied network",
+			req:      policyRequest{InstallationID: "limited-1", Action: "s3:GetObject", Key: "a", SourceIP: "172.16.0.1"},
+			decision: policyDecision{Effect: policyDeny, Policy: "uploads", Statement: "network"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.req.Time = now
+			assert.Equal(t, tc.decision, policies.evaluate(tc.req))
+		})
+	}
+}
+
+func TestPolicyDefaultDeny(t *testing.T) {
+	policies := newTestPolicies(t, `{
+		"DefaultEffect": "Deny",
+		"Policies": [{
+			"Name": "business-hours",
+			"Installations": ["inst"],
+			"Statement": [
+				{"Effect": "Allow", "Action": "s3:*", "Condition": {"DateGreaterThanEquals": {"aws:CurrentTime": "2024-01-01T08:00:00Z"}, "DateLessThan": {"aws:CurrentTime": "2024-01-01T18:00:00Z"}}},
+				{"Effect": "Deny", "Action": "s3:DeleteObject", "Resource": ["private/*"]}
+			]
+		}]
+	}`)
+
+	at := func(hour int) time.Time {
+		return time.Date(2024, 1, 1, hour, 0, 0, 0, time.UTC)
+	}
+	assert.Equal(t, policyAllow, policies.evaluate(policyRequest{InstallationID: "inst", Action: "s3:GetObject", Key: "a", Time: at(8)}).Effect)
+	assert.Equal(t, policyDeny, policies.evaluate(policyRequest{InstallationID: "inst", Action: "s3:GetObject", Key: "a", Time: at(18)}).Effect)
+	assert.Equal(t, policyDeny, policies.evaluate(policyRequest{InstallationID: "other", Action: "s3:GetObject", Key: "a", Time: at(12)}).Effect)
+	// An explicit Deny wins over an Allow.
+	assert.Equal(t, policyDeny, policies.evaluate(policyRequest{InstallationID: "inst", Action: "s3:DeleteObject", Key: "private/a", Time: at(12)}).Effect)
+}
+
+func TestLoadPoliciesErrors(t *testing.T) {
+	for name, document := range map[string]string{
+		"default effect":  `{"DefaultEffect": "Maybe"}`,
+		"installations":   `{"Policies": [{"Statement": [{"Effect": "Deny", "Action": "s3:*"}]}]}`,
+		"effect":          `{"Policies": [{"Installations": ["*"], "Statement": [{"Effect": "deny", "Action": "s3:*"}]}]}`,
+		"action":          `{"Policies": [{"Installations": ["*"], "Statement": [{"Effect": "Deny"}]}]}`,
+		"operator":        `{"Policies": [{"Installations": ["*"], "Statement": [{"Effect": "Deny", "Action": "s3:*", "Condition": {"NumericAbout": {"s3:ContentLength": 1}}}]}]}`,
+		"key":             `{"Policies": [{"Installations": ["*"], "Statement": [{"Effect": "Deny", "Action": "s3:*", "Condition": {"StringEquals": {"s3:Prefix": "a"}}}]}]}`,
+		"number":          `{"Policies": [{"Installations": ["*"], "Statement": [{"Effect": "Deny", "Action": "s3:*", "Condition": {"NumericLessThan": {"s3:ContentLength": "ten"}}}]}]}`,
+		"date":            `{"Policies": [{"Installations": ["*"], "Statement": [{"Effect": "Deny", "Action": "s3:*", "Condition": {"DateLessThan": {"aws:CurrentTime": "tomorrow"}}}]}]}`,
+		"ip address":      `{"Policies": [{"Installations": ["*"], "Statement": [{"Effect": "Deny", "Action": "s3:*", "Condition": {"IpAddress": {"aws:SourceIp": "10.0.0.0/33"}}}]}]}`,
+		"condition value": `{"Policies": [{"Installations": ["*"], "Statement": [{"Effect": "Deny", "Action": "s3:*", "Condition": {"StringEquals": {"s3:ContentType": {"a": "b"}}}}]}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "policies.json")
+			require.NoError(t, os.WriteFile(path, []byte(document), 0600))
+			_, err := loadPolicies(path)
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := loadPolicies(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestPolicyAction(t *testing.T) {
+	for _, tc := range []struct {
+		method string
+		target string
+		header http.Header
+		action string
+	}{
+		{"GET", "/agnivatest/inst/a", nil, "s3:GetObject"},
+		{"PUT", "/agnivatest/inst/a", http.Header{"X-Amz-Copy-Source": {"/agnivatest/inst/b"}}, "s3:CopyObject"},
+		{"GET", "/agnivatest?acl", nil, "s3:GetBucketAcl"},
+		{"PUT", "/agnivatest?policy", nil, "s3:PutBucketPolicy"},
+		{"DELETE", "/agnivatest?lifecycle", nil, "s3:DeleteBucketLifecycle"},
+		{"PUT", "/agnivatest/inst/a?tagging&versionId=1", nil, "s3:PutObjectTagging"},
+		{"PUT", "/agnivatest?object-lock", nil, "s3:PutBucketObjectLock"},
+		{"POST", "/agnivatest/inst/a", nil, "s3:PostObject"},
+	} {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		for name, values := range tc.header {
+			r.Header[name] = values
+		}
+		assert.Equal(t, tc.action, policyAction(r, classifyRequest(r, "agnivatest")), tc.method+" "+tc.target)
+	}
+}
+
+func TestWildcardMatch(t *testing.T) {
+	assert.True(t, wildcardMatch("*", ""))
+	assert.True(t, wildcardMatch("exports/*", "exports/2024/a.csv"))
+	assert.True(t, wildcardMatch("*/*.csv", "exports/2024/a.csv"))
+	assert.True(t, wildcardMatch("a?c", "abc"))
+	assert.True(t, wildcardMatch("a*b*c", "aXbYbZc"))
+	assert.False(t, wildcardMatch("exports/*", "exports"))
+	assert.False(t, wildcardMatch("a?c", "ac"))
+	assert.False(t, wildcardMatch("*.csv", "a.csv.gz"))
+}
+
+func TestCheckPolicies(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{})
+	s.policies = newTestPolicies(t, testPolicies)
+	handler := s.handler()
+
+	fake.put("inst/exports/a", []byte("a"), nil)
+	fake.put("inst/data/b", []byte("b"), nil)
+
+	resp := serveRequest(handler, "DELETE", "/inst/exports/a", nil, nil)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "AccessDenied", readS3ErrorCode(t, resp))
+	assert.NotNil(t, fake.object("inst/exports/a"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.metrics.rejectedRequests.WithLabelValues("inst", "policy")))
+
+	resp = serveRequest(handler, "DELETE", "/inst/data/b", nil, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Nil(t, fake.object("inst/data/b"))
+
+	// DeleteObjects is denied if any of its keys is.
+	body := []byte(`<Delete><Object><Key>other/a</Key></Object><Object><Key>inst/exports/a</Key></Object></Delete>`)
+	resp = serveRequest(handler, "POST", "/?delete", body, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.NotNil(t, fake.object("inst/exports/a"))
+
+	resp = serveRequest(handler, "GET", "?acl", nil, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = serveRequest(handler, "PUT", "/limited-1/a", bytes.Repeat([]byte("a"), 11), http.Header{"Content-Type": {"text/plain"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = serveRequest(handler, "PUT", "/limited-1/a", []byte("hello"), http.Header{"Content-Type": {"text/plain"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Copies need GetObject on their source.
+	s.policies = newTestPolicies(t, `{"Policies": [{"Installations": ["inst"], "Statement": [{"Effect": "Deny", "Action": "s3:GetObject", "Resource": "exports/*"}]}]}`)
+	resp = serveRequest(handler, "PUT", "/other/a", nil, http.Header{"X-Amz-Copy-Source": {"/agnivatest/inst/exports/a"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Nil(t, fake.object("other/a"))
+}
+
+func TestAdminSimulatePolicy(t *testing.T) {
+	_, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{})
+	router := newAdminRouter(s)
+
+	simulate := func(body string) (int, policyDecision) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/policies/simulate", bytes.NewBufferString(body)))
+		var decision policyDecision
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &decision))
+		}
+		return w.Code, decision
+	}
+
+	code, _ := simulate(`{"installation_id": "inst", "action": "s3:DeleteObject", "key": "exports/a"}`)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	s.policies = newTestPolicies(t, testPolicies)
+	code, decision := simulate(`{"installation_id": "inst", "action": "s3:DeleteObject", "key": "exports/a"}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, policyDecision{Effect: policyDeny, Policy: "keep-exports", Statement: "delete"}, decision)
+
+	// The content length is unknown unless given.
+	code, decision = simulate(`{"installation_id": "limited-1", "action": "s3:PutObject", "key": "a", "content_type": "text/plain", "source_ip": "10.0.0.1"}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, policyAllow, decision.Effect)
+
+	// Candidate policies are evaluated instead of the loaded ones.
+	code, decision = simulate(`{"installation_id": "inst", "action": "s3:DeleteObject", "key": "exports/a", "policies": {"DefaultEffect": "Deny"}}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, policyDecision{Effect: policyDeny}, decision)
+
+	code, _ = simulate(`{"installation_id": "inst", "action": "s3:GetObject", "policies": {"DefaultEffect": "Maybe"}}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = simulate(`{"installation_id": "inst"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
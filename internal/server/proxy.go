@@ -0,0 +1,135 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+)
+
+// Hop-by-hop headers only apply to a single connection and must not be
+// forwarded by proxies. See RFC 9110, section 7.6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Request headers that are kept regardless of the allowlist, because the
+// body can't be read correctly without them.
+var requiredRequestHeaders = map[string]bool{
+	"Content-Encoding":             true,
+	"Content-Length":               true,
+	"Expect":                       true,
+	"X-Amz-Content-Sha256":         true,
+	"X-Amz-Decoded-Content-Length": true,
+	"X-Amz-Trailer":                true,
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers, along with the
+// headers listed in the Connection header.
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// prepareUpstreamHeaders removes the headers of an incoming request that must
+// not reach S3. Expect: 100-continue is a hop-by-hop mechanism too, but it is
+// kept: the transport then waits for S3 to accept the request before it reads
+// the body, and the server only sends 100 Continue to the client once the
+// body is read. A request S3 rejects right away is never uploaded.
+func (s *Server) prepareUpstreamHeaders(r *http.Request) {
+	removeHopByHopHeaders(r.Header)
+
+	allowlist := s.cfg.ProxySettings.RequestHeaderAllowlist
+	if len(allowlist) == 0 {
+		return
+	}
+	for name := range r.Header {
+		if !requiredRequestHeaders[name] && !headerAllowed(name, allowlist) {
+			s.logger.Debug("removing request header not in allowlist", mlog.String("header", name))
+			r.Header.Del(name)
+		}
+	}
+}
+
+// headerAllowed reports whether the header matches an entry of the
+// allowlist. Entries ending with * match any header starting with the rest
+// of the entry.
+func headerAllowed(name string, allowlist []string) bool {
+	for _, entry := range allowlist {
+		if prefix, ok := strings.CutSuffix(entry, "*"); ok {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(name, entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyResponseHeaders copies the headers of the S3 response to the client,
+// leaving out hop-by-hop headers. Headers with several values keep all of
+// them.
+func copyResponseHeaders(w http.ResponseWriter, header http.Header) {
+	header = header.Clone()
+	removeHopByHopHeaders(header)
+	for key, values := range header {
+		w.Header()[key] = values
+	}
+}
+
+// announceTrailers declares the trailers of the S3 response in the response
+// to the client. It must be called before the header is written, and returns
+// the number of trailers announced.
+func announceTrailers(w http.ResponseWriter, trailer http.Header) int {
+	for key := range trailer {
+		w.Header().Add("Trailer", key)
+	}
+	return len(trailer)
+}
+
+// copyTrailers sends the trailers of the S3 response to the client, once the
+// body has been read. Trailers that weren't announced are sent with the
+// http.TrailerPrefix.
+func copyTrailers(w http.ResponseWriter, trailer http.Header, announced int) {
+	for key, values := range trailer {
+		if announced != len(trailer) {
+			key = http.TrailerPrefix + key
+		}
+		w.Header()[key] = values
+	}
+}
+
+// copyResponse writes the S3 response to the client, with its headers, body
+// and trailers.
+func (s *Server) copyResponse(w http.ResponseWriter, resp *http.Response) {
+	copyResponseHeaders(w, resp.Header)
+	announced := announceTrailers(w, resp.Trailer)
+	w.WriteHeader(resp.StatusCode)
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		s.logger.Warn("failed to copy response body", mlog.Err(err))
+		return
+	}
+	copyTrailers(w, resp.Trailer, announced)
+}
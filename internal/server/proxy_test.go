@@ -0,0 +1,139 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderAllowed(t *testing.T) {
+	allowlist := []string{"Content-Type", "x-amz-meta-*"}
+
+	assert.True(t, headerAllowed("Content-Type", allowlist))
+	assert.True(t, headerAllowed("X-Amz-Meta-Owner", allowlist))
+	assert.False(t, headerAllowed("X-Amz-Acl", allowlist))
+	assert.False(t, headerAllowed("Content-Disposition", allowlist))
+}
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	header := http.Header{
+		"Connection":        {"keep-alive, X-Private"},
+		"Keep-Alive":        {"timeout=5"},
+		"X-Private":         {"secret"},
+		"Transfer-Encoding": {"chunked"},
+		"X-Amz-Meta-Tag":    {"a", "b"},
+	}
+	removeHopByHopHeaders(header)
+	assert.Equal(t, http.Header{"X-Amz-Meta-Tag": {"a", "b"}}, header)
+}
+
+func TestProxying(t *testing.T) {
+	var received *http.Request
+	var receivedBody string
+	var bodyRead int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/inst/forbidden" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		received, receivedBody = r, string(body)
+
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.Header().Add("X-Amz-Meta-Tag", "a")
+		w.Header().Add("X-Amz-Meta-Tag", "b")
+		w.Header().Set("Trailer", "X-Amz-Checksum-Crc32")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "response")
+		w.Header().Set("X-Amz-Checksum-Crc32", "abcd")
+	}))
+	defer upstream.Close()
+
+	s := newFakeS3Server(t, upstream, Config{
+		ProxySettings: ProxySettings{RequestHeaderAllowlist: []string{"Content-Type", "X-Amz-Meta-*"}},
+	})
+	ts := httptest.NewServer(s.handler())
+	defer ts.Close()
+
+	t.Run("headers and trailers", func(t *testing.T) {
+		req, err := http.NewRequest("PUT", ts.URL+"/agnivatest/inst/file", io.NopCloser(strings.NewReader("request")))
+		require.NoError(t, err)
+		req.ContentLength = -1
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("X-Amz-Meta-Owner", "bob")
+		req.Header.Set("X-Amz-Acl", "public-read")
+		req.Header.Set("Proxy-Authorization", "Basic secret")
+		req.Trailer = http.Header{"X-Amz-Checksum-Crc32": {"1234"}}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "response", string(body))
+		assert.Equal(t, []string{"a", "b"}, resp.Header.Values("X-Amz-Meta-Tag"))
+		assert.Empty(t, resp.Header.Get("X-Hop"))
+		assert.Equal(t, "abcd", resp.Trailer.Get("X-Amz-Checksum-Crc32"))
+
+		require.NotNil(t, received)
+		assert.Equal(t, "request", receivedBody)
+		assert.Equal(t, "text/plain", received.Header.Get("Content-Type"))
+		assert.Equal(t, "bob", received.Header.Get("X-Amz-Meta-Owner"))
+		assert.Empty(t, received.Header.Get("X-Amz-Acl"))
+		assert.Empty(t, received.Header.Get("Proxy-Authorization"))
+		assert.Equal(t, "1234", received.Trailer.Get("X-Amz-Checksum-Crc32"))
+	})
+
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	put := func(path string) (*http.Response, bool) {
+		atomic.StoreInt32(&bodyRead, 0)
+		body := readNotifier{Reader: strings.NewReader("request"), read: &bodyRead}
+		req, err := http.NewRequest("PUT", ts.URL+"/agnivatest"+path, body)
+		require.NoError(t, err)
+		req.ContentLength = int64(len("request"))
+		req.Header.Set("Expect", "100-continue")
+
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp, atomic.LoadInt32(&bodyRead) > 0
+	}
+
+	t.Run("100-continue accepted", func(t *testing.T) {
+		resp, sent := put("/inst/file")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.True(t, sent)
+		assert.Equal(t, "request", receivedBody)
+	})
+
+	t.Run("100-continue rejected", func(t *testing.T) {
+		resp, sent := put("/inst/forbidden")
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.False(t, sent)
+	})
+}
+
+type readNotifier struct {
+	io.Reader
+	read *int32
+}
+
+func (r readNotifier) Read(p []byte) (int, error) {
+	atomic.StoreInt32(r.read, 1)
+	return r.Reader.Read(p)
+}
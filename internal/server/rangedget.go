@@ -0,0 +1,327 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultParallelGetPartSize    = 8 * 1024 * 1024
+	defaultParallelGetConcurrency = 4
+)
+
+// parallelGetEligible reports whether the request is a plain GetObject that
+// can be served with parallel ranged requests. Requests for subresources,
+// specific versions or parts, conditional requests, multi-range requests and
+// suffix ranges, whose start depends on the size of the object, are always
+// sent as they are.
+func (s *Server) parallelGetEligible(r *http.Request) bool {
+	if !s.cfg.ParallelGetSettings.Enable || r.Method != http.MethodGet || r.URL.RawQuery != "" {
+		return false
+	}
+	for _, h := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		if r.Header.Get(h) != "" {
+			return false
+		}
+	}
+	rangeHeader := r.Header.Get("Range")
+	return !strings.Contains(rangeHeader, ",") && !strings.HasPrefix(rangeHeader, "bytes=-")
+}
+
+// byteRange is an inclusive range of bytes of an object.
+type byteRange struct {
+	start, end int64
+}
+
+// parseRange parses a single range of a Range header for an object of the
+// given size. It returns false if the range can't be satisfied, in which case
+// S3 should answer the request itself.
+func parseRange(header string, size int64) (byteRange, bool, error) {
+	if header == "" {
+		return byteRange{0, size - 1}, false, nil
+	}
+
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return byteRange{}, false, errors.Errorf("unsupported range unit in %q", header)
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return byteRange{}, false, errors.Errorf("invalid range %q", header)
+	}
+
+	var r byteRange
+	if first == "" {
+		// A suffix range: the last N bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return byteRange{}, false, errors.Errorf("invalid range %q", header)
+		}
+		if n > size {
+			n = size
+		}
+		r = byteRange{size - n, size - 1}
+	} else {
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 || start >= size {
+			return byteRange{}, false, errors.Errorf("unsatisfiable range %q", header)
+		}
+		r = byteRange{start, size - 1}
+		if last != "" {
+			end, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || end < start {
+				return byteRange{}, false, errors.Errorf("invalid range %q", header)
+			}
+			if end < size {
+				r.end = end
+			}
+		}
+	}
+
+	return r, true, nil
+}
+
+// parseContentRange parses the Content-Range header of a 206 response into
+// the range it holds and the size of the object.
+func parseContentRange(header string) (byteRange, int64, bool) {
+	var r byteRange
+	var size int64
+	if _, err := fmt.Sscanf(header, "bytes %d-%d/%d", &r.start, &r.end, &size); err != nil {
+		return byteRange{}, 0, false
+	}
+	return r, size, true
+}
+
+// serveParallelGet serves a large object by fetching ranges of it from S3 in
+// parallel and writing them to the client in order. The first range is
+// requested on its own, and its response tells the size and the ETag of the
+// object. Objects smaller than MinObjectSizeBytes are then served with one
+// more request for the rest of the range, and larger ones with parallel
+// requests, of which at most Concurrency parts are held in memory at once.
+// Every part is requested with If-Match on the ETag of the first one, so that
+// an object overwritten while it is being downloaded is never mixed up with
+// its previous version. If a part fails once the response has started, the
+// connection is aborted so that the client doesn't take a truncated body for
+// the object.
+//
+// It returns false, without writing anything to the client, if the request
+// should be sent as it is instead.
+func (s *Server) serveParallelGet(w http.ResponseWriter, r *http.Request) (int, bool) {
+	settings := s.cfg.ParallelGetSettings
+	partSize := settings.PartSizeBytes
+	if partSize == 0 {
+		partSize = defaultParallelGetPartSize
+	}
+	concurrency := settings.Concurrency
+	if concurrency == 0 {
+		concurrency = defaultParallelGetConcurrency
+	}
+
+	// The start of the range of the client doesn't depend on the size of
+	// the object, which isn't known yet.
+	requested, _, err := parseRange(r.Header.Get("Range"), math.MaxInt64)
+	if err != nil {
+		return 0, false
+	}
+	first := r.Clone(r.Context())
+	first.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", requested.start, requested.start+partSize-1))
+	resp, err := s.doUpstream(first)
+	if err != nil {
+		s.logger.Debug("failed to get the first part of a parallel get", mlog.Err(err))
+		return 0, false
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode >= http.StatusBadRequest && resp.StatusCode != http.StatusRequestedRangeNotSatisfiable:
+		// Errors don't depend on the range. Unsatisfiable ranges are left
+		// to S3, since empty objects and compressed objects can't be
+		// satisfied by the first part of a range but can be by the range.
+		defer resp.Body.Close()
+		s.copyResponse(w, resp)
+		return resp.StatusCode, true
+	default:
+		resp.Body.Close()
+		return 0, false
+	}
+
+	// The parts of encrypted or compressed objects don't line up with what
+	// the client gets, and objects to scan are scanned as a whole.
+	etag := resp.Header.Get("ETag")
+	got, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || etag == "" || isTransformedObject(resp.Header) || s.scanOnReadEligible(r, resp) {
+		resp.Body.Close()
+		return 0, false
+	}
+	rng, partial, err := parseRange(r.Header.Get("Range"), size)
+	if err != nil || got != (byteRange{rng.start, min(rng.start+partSize-1, rng.end)}) {
+		resp.Body.Close()
+		return 0, false
+	}
+	defer resp.Body.Close()
+
+	var parts []byteRange
+	switch {
+	case got.end == rng.end:
+	case size < settings.MinObjectSizeBytes:
+		parts = append(parts, byteRange{got.end + 1, rng.end})
+	default:
+		for start := got.end + 1; start <= rng.end; start += partSize {
+			parts = append(parts, byteRange{start, min(start+partSize-1, rng.end)})
+		}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// Every part gets its own channel so that the parts are written in order,
+	// and the semaphore is only released once a part has been written,
+	// which bounds the memory used to Concurrency parts. The rest of the
+	// range of small objects is streamed instead.
+	sem := make(chan struct{}, concurrency)
+	results := make([]chan partResult, len(parts))
+	for i := range results {
+		results[i] = make(chan partResult, 1)
+	}
+	if size >= settings.MinObjectSizeBytes {
+		go func() {
+			for i, part := range parts {
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				go func(i int, part byteRange) {
+					data, err := s.fetchPart(ctx, r, part, etag)
+					results[i] <- partResult{data: data, err: err}
+				}(i, part)
+			}
+		}()
+	}
+
+	if originalETag := resp.Header.Get(originalETagHeader); originalETag != "" {
+		resp.Header.Set("ETag", originalETag)
+	}
+	removeBifrostMetadata(resp.Header)
+	copyResponseHeaders(w, resp.Header)
+	w.Header().Set("Content-Length", strconv.FormatInt(rng.end-rng.start+1, 10))
+	w.Header().Del("Content-Range")
+	statusCode := http.StatusOK
+	if partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rng.start, rng.end, size))
+		statusCode = http.StatusPartialContent
+	}
+	w.WriteHeader(statusCode)
+
+	// The headers have already been sent, so a part that fails can only
+	// abort the response.
+	if err := copyPart(w, resp.Body, got); err != nil {
+		s.abortParallelGet(got, err)
+	}
+	for i, part := range parts {
+		if size < settings.MinObjectSizeBytes {
+			rest, err := s.fetchRange(ctx, r, part, etag)
+			if err == nil {
+				err = copyPart(w, rest.Body, part)
+				rest.Body.Close()
+			}
+			if err != nil {
+				s.abortParallelGet(part, err)
+			}
+			continue
+		}
+
+		var result partResult
+		select {
+		case result = <-results[i]:
+		case <-ctx.Done():
+			s.abortParallelGet(part, ctx.Err())
+		}
+		if result.err != nil {
+			s.abortParallelGet(part, result.err)
+		}
+		if _, err := w.Write(result.data); err != nil {
+			s.abortParallelGet(part, err)
+		}
+		<-sem
+	}
+	if len(parts) > 0 && size >= settings.MinObjectSizeBytes {
+		s.metrics.incParallelGet()
+	}
+
+	return statusCode, true
+}
+
+// abortParallelGet aborts the response to a parallel get whose part failed.
+// The connection is closed, or the stream reset, so that the client sees an
+// error instead of a truncated body.
+func (s *Server) abortParallelGet(part byteRange, err error) {
+	s.logger.Warn("failed to copy part of a parallel get", mlog.Int64("start", part.start), mlog.Err(err))
+	panic(http.ErrAbortHandler)
+}
+
+// copyPart copies a part of the object to the client, and checks that it
+// wasn't cut short.
+func copyPart(w io.Writer, body io.Reader, part byteRange) error {
+	n, err := io.Copy(w, body)
+	if err != nil {
+		return errors.Wrap(err, "failed to copy part")
+	}
+	if n != part.end-part.start+1 {
+		return errors.Errorf("short part; got %d bytes, expected %d", n, part.end-part.start+1)
+	}
+	return nil
+}
+
+type partResult struct {
+	data []byte
+	err  error
+}
+
+// fetchRange requests a range of the object, which must still have the
+// given ETag.
+func (s *Server) fetchRange(ctx context.Context, r *http.Request, part byteRange, etag string) (*http.Response, error) {
+	req := r.Clone(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", part.start, part.end))
+	req.Header.Set("If-Match", etag)
+
+	resp, err := s.doUpstream(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, errors.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("ETag"); got != etag {
+		resp.Body.Close()
+		return nil, errors.Errorf("object changed during download; etag=%s, expected=%s", got, etag)
+	}
+	return resp, nil
+}
+
+func (s *Server) fetchPart(ctx context.Context, r *http.Request, part byteRange, etag string) ([]byte, error) {
+	resp, err := s.fetchRange(ctx, r, part, etag)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	buf := bytes.NewBuffer(make([]byte, 0, part.end-part.start+1))
+	if err := copyPart(buf, resp.Body, part); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	for _, test := range []struct {
+		header   string
+		expected byteRange
+		partial  bool
+		valid    bool
+	}{
+		{"", byteRange{0, 99}, false, true},
+		{"bytes=10-19", byteRange{10, 19}, true, true},
+		{"bytes=10-", byteRange{10, 99}, true, true},
+		{"bytes=90-200", byteRange{90, 99}, true, true},
+		{"bytes=-10", byteRange{90, 99}, true, true},
+		{"bytes=-200", byteRange{0, 99}, true, true},
+		{"bytes=100-", byteRange{}, false, false},
+		{"bytes=20-10", byteRange{}, false, false},
+		{"bytes=-0", byteRange{}, false, false},
+		{"items=1-2", byteRange{}, false, false},
+		{"bytes=abc", byteRange{}, false, false},
+	} {
+		t.Run(test.header, func(t *testing.T) {
+			r, partial, err := parseRange(test.header, 100)
+			if !test.valid {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, r)
+			assert.Equal(t, test.partial, partial)
+		})
+	}
+}
+
+func TestParallelGet(t *testing.T) {
+	content := make([]byte, 1000)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	var gets, heads int64
+	etag := `"v1"`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			atomic.AddInt64(&heads, 1)
+		} else {
+			atomic.AddInt64(&gets, 1)
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set(installationMetadataHeader, "inst")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/small"):
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content[:50]))
+			return
+		case strings.HasSuffix(r.URL.Path, "/medium"):
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content[:90]))
+			return
+		case strings.HasSuffix(r.URL.Path, "/empty"):
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(nil))
+			return
+		case strings.HasSuffix(r.URL.Path, "/missing"):
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	cfg := Config{
+		S3Settings: AmazonS3Settings{
+			AccessKeyID:     "AKIA2AccessKey",
+			SecretAccessKey: "start/secretkey/end",
+			Region:          "us-east-1",
+			Scheme:          "http",
+			Bucket:          "agnivatest",
+		},
+		ParallelGetSettings: ParallelGetSettings{
+			Enable:             true,
+			MinObjectSizeBytes: 100,
+			PartSizeBytes:      64,
+			Concurrency:        3,
+		},
+	}
+
+	s := &Server{
+		logger:    mlog.NewTestingLogger(t, os.Stderr),
+		cfg:       cfg,
+		getHostFn: func(_, _ string) string { return strings.TrimPrefix(ts.URL, "http://") },
+		client:    http.DefaultClient,
+		creds: credentials.NewStatic(cfg.S3Settings.AccessKeyID,
+			cfg.S3Settings.SecretAccessKey, "", credentials.SignatureV4),
+		metrics: newMetrics(),
+	}
+	handler := s.handler()
+
+	get := func(path, rangeHeader string) *http.Response {
+		atomic.StoreInt64(&gets, 0)
+		atomic.StoreInt64(&heads, 0)
+		req := httptest.NewRequest("GET", "http://example.com/"+cfg.S3Settings.Bucket+path, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Result()
+	}
+
+	t.Run("whole object", func(t *testing.T) {
+		resp := get("/inst/video", "")
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "1000", resp.Header.Get("Content-Length"))
+		assert.Equal(t, "video/mp4", resp.Header.Get("Content-Type"))
+		assert.Empty(t, resp.Header.Get(installationMetadataHeader))
+		assert.Equal(t, etag, resp.Header.Get("ETag"))
+		assert.Equal(t, content, body)
+		assert.Zero(t, atomic.LoadInt64(&heads))
+		assert.Equal(t, int64(16), atomic.LoadInt64(&gets))
+	})
+
+	t.Run("client range", func(t *testing.T) {
+		resp := get("/inst/video", "bytes=100-299")
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, "bytes 100-299/1000", resp.Header.Get("Content-Range"))
+		assert.Equal(t, content[100:300], body)
+		assert.Equal(t, int64(4), atomic.LoadInt64(&gets))
+	})
+
+	t.Run("suffix range", func(t *testing.T) {
+		resp := get("/inst/video", "bytes=-10")
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, "bytes 990-999/1000", resp.Header.Get("Content-Range"))
+		assert.Equal(t, content[990:], body)
+		assert.Equal(t, int64(1), atomic.LoadInt64(&gets))
+	})
+
+	t.Run("unsatisfiable range is left to S3", func(t *testing.T) {
+		resp := get("/inst/video", "bytes=5000-")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+	})
+
+	t.Run("small objects are fetched at once", func(t *testing.T) {
+		resp := get("/inst/small", "")
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "50", resp.Header.Get("Content-Length"))
+		assert.Empty(t, resp.Header.Get("Content-Range"))
+		assert.Equal(t, content[:50], body)
+		assert.Equal(t, int64(1), atomic.LoadInt64(&gets))
+
+		resp = get("/inst/medium", "bytes=10-")
+		defer resp.Body.Close()
+		body, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, "bytes 10-89/90", resp.Header.Get("Content-Range"))
+		assert.Equal(t, content[10:90], body)
+		assert.Equal(t, int64(2), atomic.LoadInt64(&gets))
+		assert.Zero(t, atomic.LoadInt64(&heads))
+	})
+
+	t.Run("errors are passed on", func(t *testing.T) {
+		resp := get("/inst/missing", "")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.Equal(t, int64(1), atomic.LoadInt64(&gets))
+
+		resp = get("/inst/empty", "")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "0", resp.Header.Get("Content-Length"))
+	})
+
+	t.Run("object changed during download", func(t *testing.T) {
+		s.cfg.ParallelGetSettings.Concurrency = 1
+		defer func() { s.cfg.ParallelGetSettings.Concurrency = 3 }()
+
+		var once int32
+		ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", etag)
+			if r.Method == http.MethodGet && atomic.AddInt32(&once, 1) > 1 {
+				w.Header().Set("ETag", `"v2"`)
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		})
+
+		// The connection is aborted, instead of ending a short body.
+		req := httptest.NewRequest("GET", "http://example.com/"+cfg.S3Settings.Bucket+"/inst/video", nil)
+		w := httptest.NewRecorder()
+		assert.PanicsWithValue(t, http.ErrAbortHandler, func() { handler(w, req) })
+		assert.Equal(t, content[:64], w.Body.Bytes())
+	})
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+)
+
+// Modes of the header policies.
+const (
+	// HeaderModePass passes the headers of the client on as they are.
+	HeaderModePass = ""
+	// HeaderModeStrip removes the headers of the client.
+	HeaderModeStrip = "strip"
+	// HeaderModeOverride replaces the headers of the client by the values
+	// of the policy.
+	HeaderModeOverride = "override"
+)
+
+// The headers of the families the header policies apply to.
+const (
+	serverSideEncryptionHeaderPrefix = "X-Amz-Server-Side-Encryption"
+	storageClassHeader               = "X-Amz-Storage-Class"
+)
+
+// serverSideEncryptionOverrideHeaders are the server-side encryption headers
+// a policy can set. Keys provided by customers are left out, since they
+// would be needed to read the objects too.
+var serverSideEncryptionOverrideHeaders = map[string]bool{
+	"X-Amz-Server-Side-Encryption":                    true,
+	"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id":     true,
+	"X-Amz-Server-Side-Encryption-Context":            true,
+	"X-Amz-Server-Side-Encryption-Bucket-Key-Enabled": true,
+}
+
+// privateCannedACLs are the canned ACLs that grant nothing to anyone but
+// the owner of the bucket.
+var privateCannedACLs = map[string]bool{
+	"private":                   true,
+	"bucket-owner-read":         true,
+	"bucket-owner-full-control": true,
+}
+
+// guardRequest rejects the requests that would change the security of the
+// whole bucket, which Bifrost signs with credentials shared by all the
+// installations: bucket requests other than reads and DeleteObjects, such as
+// PUT /?policy or DeleteBucket, changes of the ACL of objects, public canned
+// ACLs and grant headers. The operations, canned ACLs and grants allowed in
+// the settings are let through.
+func (s *Server) guardRequest(r *http.Request, op s3Request, installationID string) error {
+	settings := s.cfg.RequestGuardSettings
+
+	reject := func(reason, message string) error {
+		s.metrics.incRejectedRequest(installationID, "request_guard")
+		sourceIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+		s.logger.Warn("dangerous request rejected",
+			mlog.String("installation_id", installationID),
+			mlog.String("action", policyAction(r, op)),
+			mlog.String("key", op.Key),
+			mlog.String("reason", reason),
+			mlog.String("source_ip", sourceIP),
+		)
+		return &s3Error{StatusCode: http.StatusForbidden, Code: "AccessDenied", Message: message}
+	}
+
+	if isDangerousOperation(r, op) {
+		action := policyAction(r, op)
+		if !slices.ContainsFunc(settings.AllowedOperations, func(pattern string) bool {
+			return wildcardMatch(strings.ToLower(pattern), strings.ToLower(action))
+		}) {
+			return reject("operation", "Operation "+action+" is not allowed.")
+		}
+	}
+
+	if acl := r.Header.Get("X-Amz-Acl"); acl != "" && !privateCannedACLs[strings.ToLower(acl)] && !slices.ContainsFunc(settings.AllowedCannedACLs, func(allowed string) bool {
+		return strings.EqualFold(allowed, acl)
+	}) {
+		return reject("canned_acl", "Canned ACL "+acl+" is not allowed.")
+	}
+
+	if !settings.AllowGrantHeaders {
+		for name := range r.Header {
+			if strings.HasPrefix(name, "X-Amz-Grant-") {
+				return reject("grant", "Header "+name+" is not allowed.")
+			}
+		}
+	}
+	return nil
+}
+
+// isDangerousOperation reports whether the request changes the bucket, or
+// the ACL of an object.
+func isDangerousOperation(r *http.Request, op s3Request) bool {
+	if op.Key == "" {
+		return r.Method != http.MethodGet && r.Method != http.MethodHead && op.Operation != opDeleteObjects
+	}
+	_, acl := r.URL.Query()["acl"]
+	return acl && op.Operation == opUnknown && r.Method != http.MethodGet && r.Method != http.MethodHead
+}
+
+// applyHeaderPolicies strips or overrides the server-side encryption and
+// storage class headers of the requests writing objects. Parts can only
+// carry keys provided by customers, so they are stripped of the headers of
+// the client, and never get the values of the policy.
+func (s *Server) applyHeaderPolicies(r *http.Request, op s3Request) {
+	settings := s.cfg.RequestGuardSettings
+	switch op.Operation {
+	case opPutObject, opCopyObject, opCreateMultipartUpload:
+		s.applyHeaderPolicy(r, op, settings.ServerSideEncryption, serverSideEncryptionHeaderPrefix, true)
+		s.applyHeaderPolicy(r, op, settings.StorageClass, storageClassHeader, true)
+	case opUploadPart, opUploadPartCopy:
+		s.applyHeaderPolicy(r, op, settings.ServerSideEncryption, serverSideEncryptionHeaderPrefix, false)
+	}
+}
+
+// applyHeaderPolicy applies the policy to the headers starting with prefix.
+func (s *Server) applyHeaderPolicy(r *http.Request, op s3Request, policy HeaderPolicy, prefix string, override bool) {
+	if policy.Mode == HeaderModePass {
+		return
+	}
+	// The values aren't logged, since they can be keys.
+	for name := range r.Header {
+		if strings.HasPrefix(name, prefix) {
+			s.logger.Debug("removing header of the client", mlog.String("header", name), mlog.String("key", op.Key), mlog.String("operation", op.Operation))
+			r.Header.Del(name)
+		}
+	}
+	if policy.Mode != HeaderModeOverride || !override {
+		return
+	}
+	for name, value := range policy.Values {
+		r.Header.Set(name, value)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGuardRequest(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{})
+	handler := s.handler()
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		header http.Header
+	}{
+		{"bucket policy", "PUT", "?policy", nil},
+		{"bucket ACL", "PUT", "?acl", nil},
+		{"bucket lifecycle", "DELETE", "?lifecycle", nil},
+		{"delete bucket", "DELETE", "", nil},
+		{"create bucket", "PUT", "", nil},
+		{"object ACL", "PUT", "/inst/a?acl", nil},
+		{"public canned ACL", "PUT", "/inst/a", http.Header{"X-Amz-Acl": {"public-read"}}},
+		{"grant", "PUT", "/inst/a", http.Header{"X-Amz-Grant-Read": {`uri="http://acs.amazonaws.com/groups/global/AllUsers"`}}},
+		{"public multipart upload", "POST", "/inst/a?uploads", http.Header{"X-Amz-Acl": {"public-read-write"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := serveRequest(handler, tc.method, tc.path, []byte("a"), tc.header)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusForbidden, resp.StatusCode)
+			assert.Equal(t, "AccessDenied", readS3ErrorCode(t, resp))
+		})
+	}
+	assert.Empty(t, fake.requests)
+	assert.Nil(t, fake.object("inst/a"))
+	assert.Equal(t, 4.0, testutil.ToFloat64(s.metrics.rejectedRequests.WithLabelValues("inst", "request_guard")))
+
+	resp := serveRequest(handler, "PUT", "/inst/a", []byte("a"), http.Header{"X-Amz-Acl": {"bucket-owner-full-control"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = serveRequest(handler, "POST", "/?delete", []byte(`<Delete><Object><Key>inst/a</Key></Object></Delete>`), nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, fake.object("inst/a"))
+
+	// Allowlisted operations, canned ACLs and grants are let through.
+	s.cfg.RequestGuardSettings = RequestGuardSettings{
+		AllowedOperations: []string{"s3:*BucketLifecycle"},
+		AllowedCannedACLs: []string{"public-read"},
+		AllowGrantHeaders: true,
+	}
+	resp = serveRequest(handler, "DELETE", "?lifecycle", nil, nil)
+	resp.Body.Close()
+	assert.NotEqual(t, http.StatusForbidden, resp.StatusCode)
+	resp = serveRequest(handler, "PUT", "?policy", nil, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = serveRequest(handler, "PUT", "/inst/b", []byte("b"), http.Header{"X-Amz-Acl": {"public-read"}, "X-Amz-Grant-Read": {`id="owner"`}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "public-read", fake.object("inst/b").header.Get("X-Amz-Acl"))
+}
+
+func TestHeaderPolicies(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{RequestGuardSettings: RequestGuardSettings{
+		ServerSideEncryption: HeaderPolicy{Mode: HeaderModeOverride, Values: map[string]string{
+			"X-Amz-Server-Side-Encryption":                "aws:kms",
+			"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "key",
+		}},
+		StorageClass: HeaderPolicy{Mode: HeaderModeStrip},
+	}})
+	handler := s.handler()
+
+	header := http.Header{
+		"X-Amz-Server-Side-Encryption":                    {"AES256"},
+		"X-Amz-Server-Side-Encryption-Customer-Algorithm": {"AES256"},
+		"X-Amz-Storage-Class":                             {"GLACIER"},
+	}
+	resp := serveRequest(handler, "PUT", "/inst/a", []byte("a"), header)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	stored := fake.object("inst/a").header
+	assert.Equal(t, "aws:kms", stored.Get("X-Amz-Server-Side-Encryption"))
+	assert.Equal(t, "key", stored.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+	assert.Empty(t, stored.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm"))
+	assert.Empty(t, stored.Get("X-Amz-Storage-Class"))
+
+	// Reads are left alone.
+	resp = serveRequest(handler, "GET", "/inst/a", nil, http.Header{"X-Amz-Server-Side-Encryption-Customer-Algorithm": {"AES256"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Parts are stripped, but don't get the values of the policy.
+	resp = serveRequest(handler, "POST", "/inst/b?uploads", nil, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var upload *fakeUpload
+	for _, u := range fake.uploads {
+		upload = u
+	}
+	require.NotNil(t, upload)
+	assert.Equal(t, "aws:kms", upload.header.Get("X-Amz-Server-Side-Encryption"))
+
+	r, err := http.NewRequest("PUT", "/agnivatest/inst/b?partNumber=1&uploadId=upload-1", nil)
+	require.NoError(t, err)
+	r.Header = header.Clone()
+	op := classifyRequest(r, "agnivatest")
+	require.Equal(t, opUploadPart, op.Operation)
+	s.applyHeaderPolicies(r, op)
+	assert.Equal(t, http.Header{"X-Amz-Storage-Class": {"GLACIER"}}, r.Header)
+}
+
+func TestHeaderPolicyIsValid(t *testing.T) {
+	sse := func(name string) bool {
+		return serverSideEncryptionOverrideHeaders[name]
+	}
+	assert.NoError(t, HeaderPolicy{}.isValid(sse))
+	assert.NoError(t, HeaderPolicy{Mode: HeaderModeStrip}.isValid(sse))
+	assert.NoError(t, HeaderPolicy{Mode: HeaderModeOverride, Values: map[string]string{"x-amz-server-side-encryption": "AES256"}}.isValid(sse))
+	assert.Error(t, HeaderPolicy{Mode: HeaderModeOverride}.isValid(sse))
+	assert.Error(t, HeaderPolicy{Mode: HeaderModeOverride, Values: map[string]string{"X-Amz-Server-Side-Encryption-Customer-Key": "key"}}.isValid(sse))
+	assert.Error(t, HeaderPolicy{Mode: HeaderModeStrip, Values: map[string]string{"X-Amz-Server-Side-Encryption": "AES256"}}.isValid(sse))
+	assert.Error(t, HeaderPolicy{Mode: "drop"}.isValid(sse))
+
+	err := Config{RequestGuardSettings: RequestGuardSettings{StorageClass: HeaderPolicy{Mode: HeaderModeOverride, Values: map[string]string{"X-Amz-Acl": "private"}}}}.IsValid()
+	assert.Error(t, err)
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"context"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+// KeyRotationReport sums up the re-encryption of the objects of an
+// installation with its current master key.
+type KeyRotationReport struct {
+	KeyID string
+	// Objects is the number of objects looked at, and Reencrypted the number
+	// of objects whose data key was wrapped with the current key.
+	Objects     int
+	Reencrypted int
+}
+
+// RotateEncryptionKey generates a new master key for the installation and
+// makes it the key new objects are encrypted with. The previous keys stay
+// in the key store, so that existing objects can still be read until they
+// are re-encrypted with ReencryptObjects.
+func (s *Server) RotateEncryptionKey(installationID string) (string, error) {
+	ks, ok := s.keys.(*fileKeyStore)
+	if !ok {
+		return "", errors.New("the key store doesn't support key rotation")
+	}
+	keyID, err := ks.rotate(installationID)
+	if err != nil {
+		return "", err
+	}
+	s.logger.Info("rotated encryption key", mlog.String("installation_id", installationID), mlog.String("key_id", keyID))
+	return keyID, nil
+}
+
+// ReencryptObjects wraps the data keys of the objects of the installation
+// that were encrypted with a previous master key with the current one. The
+// objects themselves don't change, only their metadata is replaced by copying
+// them onto themselves. Objects changed or deleted in the meantime are
+// skipped. The report covers the objects handled before an error, if any.
+func (s *Server) ReencryptObjects(ctx context.Context, installationID string) (*KeyRotationReport, error) {
+	if s.keys == nil {
+		return nil, errors.New("encryption is not enabled")
+	}
+	keyID, masterKey, err := s.keys.currentKey(installationID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &KeyRotationReport{KeyID: keyID}
+	var token string
+	for {
+		page, err := s.listObjectsV2(ctx, installationID+"/", "", "", token)
+		if err != nil {
+			return report, err
+		}
+		for _, object := range page.Contents {
+			report.Objects++
+			done, err := s.reencryptObject(ctx, "/"+object.Key, keyID, masterKey)
+			if err != nil {
+				return report, errors.Wrapf(err, "failed to re-encrypt %s", object.Key)
+			}
+			if done {
+				report.Reencrypted++
+			}
+		}
+		if !page.IsTruncated {
+			return report, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// reencryptObject wraps the data key of the object with the given master key,
+// unless it already is. It reports whether the object was changed.
+func (s *Server) reencryptObject(ctx context.Context, objectPath, keyID string, masterKey []byte) (bool, error) {
+	header, size, err := s.headObject(ctx, objectPath)
+	if isS3ErrorCode(err, "404") {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	key, err := s.objectKeyFromHeader(header)
+	if err != nil || key == nil || key.keyID == keyID {
+		return false, err
+	}
+
+	wrapped, err := wrapKey(masterKey, keyID, key.dataKey, key.size)
+	if err != nil {
+		return false, err
+	}
+
+	copyHeader := objectMetadata(header)
+	(&objectKey{keyID: keyID, wrapped: wrapped, size: key.size}).setHeader(copyHeader)
+	copyHeader.Set("X-Amz-Metadata-Directive", "REPLACE")
+	copyHeader.Set("X-Amz-Copy-Source-If-Match", header.Get("ETag"))
+
+	err = s.copyObject(ctx, objectPath, objectPath, size, copyHeader)
+	if isS3ErrorCode(err, "PreconditionFailed") || isS3ErrorCode(err, "NoSuchKey") {
+		// The object was replaced by one encrypted with the current key, or
+		// deleted.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	s.logger.Debug("re-encrypted object", mlog.String("object", objectPath), mlog.String("previous_key_id", key.keyID), mlog.String("key_id", keyID))
+	return true, nil
+}
+
+// isS3ErrorCode reports whether err is an S3 error with the given code.
+func isS3ErrorCode(err error, code string) bool {
+	var s3Err *s3Error
+	return errors.As(err, &s3Err) && s3Err.Code == code
+}
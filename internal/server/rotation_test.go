@@ -0,0 +1,77 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReencryptObjects(t *testing.T) {
+	s, fake, _ := newEncryptionTestServer(t)
+	handler := s.handler()
+
+	contents := map[string]string{
+		"/inst/a":   "first object",
+		"/inst/b":   "second object",
+		"/inst/c":   "third object",
+		"/other/a":  "not encrypted",
+		"/inst2/a":  "other installation",
+		"/inst/d/e": "nested object",
+	}
+	for path, content := range contents {
+		resp := serveRequest(handler, "PUT", path, []byte(content), http.Header{
+			"Content-Type":     {"text/plain"},
+			"X-Amz-Meta-Owner": {"bob"},
+		})
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	// An object put before encryption was enabled.
+	fake.mu.Lock()
+	fake.put("inst/plain", []byte("plain"), http.Header{})
+	fake.mu.Unlock()
+
+	keyID, err := s.RotateEncryptionKey("inst")
+	require.NoError(t, err)
+	assert.NotEqual(t, "inst-1", keyID)
+
+	report, err := s.ReencryptObjects(context.Background(), "inst")
+	require.NoError(t, err)
+	assert.Equal(t, &KeyRotationReport{KeyID: keyID, Objects: 5, Reencrypted: 4}, report)
+
+	for path, content := range contents {
+		if path == "/other/a" || path == "/inst2/a" {
+			continue
+		}
+		obj := fake.object(path[1:])
+		require.NotNil(t, obj)
+		assert.Equal(t, keyID, obj.header.Get(encryptionKeyIDHeader))
+		assert.Equal(t, "text/plain", obj.header.Get("Content-Type"))
+		assert.Equal(t, "bob", obj.header.Get("X-Amz-Meta-Owner"))
+
+		resp := serveRequest(handler, "GET", path, nil, nil)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, content, string(body))
+	}
+	assert.Empty(t, fake.object("inst/plain").header.Get(encryptionHeader))
+
+	t.Run("nothing left to re-encrypt", func(t *testing.T) {
+		report, err := s.ReencryptObjects(context.Background(), "inst")
+		require.NoError(t, err)
+		assert.Equal(t, 0, report.Reencrypted)
+	})
+
+	t.Run("installation without a key", func(t *testing.T) {
+		_, err := s.ReencryptObjects(context.Background(), "other")
+		assert.ErrorIs(t, err, errNoInstallationKey)
+	})
+}
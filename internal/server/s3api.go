@@ -0,0 +1,638 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	emptySHA256     = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// The requests below are sent by Bifrost itself rather than on behalf of a
+// client. They go through doUpstream, so they are balanced and signed the
+// same way as proxied requests.
+
+// newUpstreamRequest creates a request for the object at objectPath, which is
+// the unescaped path of the object in the bucket, with a leading slash. The
+// host is set by doUpstream.
+func (s *Server) newUpstreamRequest(ctx context.Context, method, objectPath string, query url.Values, body io.Reader) (*http.Request, error) {
+	urlStr := s.cfg.S3Settings.Scheme + "://" + s3utils.EncodePath(objectPath)
+	if len(query) > 0 {
+		urlStr += "?" + s3utils.QueryEncode(query)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, urlStr, body)
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	} else {
+		req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	}
+
+	return req, nil
+}
+
+// doS3 sends a request created by newUpstreamRequest and turns error
+// responses into an *s3Error. The caller must close the body of the response.
+func (s *Server) doS3(req *http.Request) (*http.Response, error) {
+	resp, err := s.doUpstream(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		return nil, parseS3Error(resp)
+	}
+	return resp, nil
+}
+
+// parseS3Error reads the error of an S3 response.
+func parseS3Error(resp *http.Response) error {
+	s3Err := &s3Error{
+		StatusCode: resp.StatusCode,
+		Code:       strconv.Itoa(resp.StatusCode),
+		Message:    http.StatusText(resp.StatusCode),
+	}
+
+	var errResp minio.ErrorResponse
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err := xml.Unmarshal(body, &errResp); err == nil && errResp.Code != "" {
+		s3Err.Code = errResp.Code
+		s3Err.Message = errResp.Message
+	}
+	return s3Err
+}
+
+// decodeS3Response decodes the XML body of a successful response. Some
+// operations, like CompleteMultipartUpload, can fail after S3 already sent a
+// 200 status code, in which case the body is an error document.
+func decodeS3Response(resp *http.Response, v any) error {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read S3 response")
+	}
+
+	var errResp minio.ErrorResponse
+	if xml.Unmarshal(body, &errResp) == nil && errResp.Code != "" {
+		return &s3Error{StatusCode: http.StatusInternalServerError, Code: errResp.Code, Message: errResp.Message}
+	}
+
+	if err := xml.Unmarshal(body, v); err != nil {
+		return errors.Wrap(err, "failed to decode S3 response")
+	}
+	return nil
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completePart struct {
+	PartNumber int
+	ETag       string
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	ETag string
+}
+
+// createMultipartUpload starts a multipart upload. The headers are sent with
+// the request, so that the metadata of the object can be set.
+func (s *Server) createMultipartUpload(ctx context.Context, objectPath string, header http.Header) (string, error) {
+	req, err := s.newUpstreamRequest(ctx, http.MethodPost, objectPath, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := s.doS3(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create multipart upload")
+	}
+	defer resp.Body.Close()
+
+	var result initiateMultipartUploadResult
+	if err := decodeS3Response(resp, &result); err != nil {
+		return "", err
+	}
+	return result.UploadID, nil
+}
+
+// uploadPart uploads a part of a multipart upload and returns its ETag.
+func (s *Server) uploadPart(ctx context.Context, objectPath, uploadID string, partNumber int, body io.Reader, size int64, header http.Header) (string, error) {
+	query := url.Values{"uploadId": {uploadID}, "partNumber": {strconv.Itoa(partNumber)}}
+	req, err := s.newUpstreamRequest(ctx, http.MethodPut, objectPath, query, body)
+	if err != nil {
+		return "", err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.ContentLength = size
+
+	resp, err := s.doS3(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to upload part %d", partNumber)
+	}
+	resp.Body.Close()
+
+	return resp.Header.Get("ETag"), nil
+}
+
+// completeMultipartUpload completes a multipart upload and returns the
+// response headers along with the ETag of the object.
+func (s *Server) completeMultipartUpload(ctx context.Context, objectPath, uploadID string, parts []completePart) (string, http.Header, error) {
+	body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return "", nil, err
+	}
+
+	req, err := s.newUpstreamRequest(ctx, http.MethodPost, objectPath, url.Values{"uploadId": {uploadID}}, bytes.NewReader(body))
+	if err != nil {
+		return "", nil, err
+	}
+
+	resp, err := s.doS3(req)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to complete multipart upload")
+	}
+	defer resp.Body.Close()
+
+	var result completeMultipartUploadResult
+	if err := decodeS3Response(resp, &result); err != nil {
+		return "", nil, err
+	}
+	return result.ETag, resp.Header, nil
+}
+
+// abortMultipartUpload aborts a multipart upload and frees its parts.
+func (s *Server) abortMultipartUpload(ctx context.Context, objectPath, uploadID string) error {
+	req, err := s.newUpstreamRequest(ctx, http.MethodDelete, objectPath, url.Values{"uploadId": {uploadID}}, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.doS3(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to abort multipart upload")
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type multipartUpload struct {
+	Key       string
+	UploadID  string `xml:"UploadId"`
+	Initiated time.Time
+}
+
+type listMultipartUploadsResult struct {
+	Uploads            []multipartUpload `xml:"Upload"`
+	CommonPrefixes     []commonPrefix
+	IsTruncated        bool
+	NextKeyMarker      string
+	NextUploadIDMarker string `xml:"NextUploadIdMarker"`
+}
+
+type commonPrefix struct {
+	Prefix string
+}
+
+// listMultipartUploads lists a page of the multipart uploads in progress under
+// prefix, starting after the given markers.
+func (s *Server) listMultipartUploads(ctx context.Context, prefix, delimiter, keyMarker, uploadIDMarker string) (*listMultipartUploadsResult, error) {
+	query := url.Values{"uploads": {""}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if keyMarker != "" {
+		query.Set("key-marker", keyMarker)
+		query.Set("upload-id-marker", uploadIDMarker)
+	}
+	req, err := s.newUpstreamRequest(ctx, http.MethodGet, "/", query, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.doS3(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list multipart uploads")
+	}
+	defer resp.Body.Close()
+
+	var result listMultipartUploadsResult
+	if err := decodeS3Response(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+type listPartsResult struct {
+	Parts []struct {
+		PartNumber int
+		Size       int64
+	} `xml:"Part"`
+	IsTruncated          bool
+	NextPartNumberMarker int
+}
+
+// listParts lists a page of the parts uploaded so far, starting after
+// partNumberMarker.
+func (s *Server) listParts(ctx context.Context, objectPath, uploadID string, partNumberMarker int) (*listPartsResult, error) {
+	query := url.Values{"uploadId": {uploadID}}
+	if partNumberMarker > 0 {
+		query.Set("part-number-marker", strconv.Itoa(partNumberMarker))
+	}
+	req, err := s.newUpstreamRequest(ctx, http.MethodGet, objectPath, query, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.doS3(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list parts")
+	}
+	defer resp.Body.Close()
+
+	var result listPartsResult
+	if err := decodeS3Response(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// headObject returns the headers and the size of an object.
+func (s *Server) headObject(ctx context.Context, objectPath string) (http.Header, int64, error) {
+	req, err := s.newUpstreamRequest(ctx, http.MethodHead, objectPath, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := s.doS3(req)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to head object")
+	}
+	resp.Body.Close()
+	return resp.Header, resp.ContentLength, nil
+}
+
+type listObjectsV2Result struct {
+	Contents []struct {
+		Key  string
+		Size int64
+		ETag string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// listObjectsV2 lists a page of the objects under prefix, starting at the
+// continuation token of the previous page, or after the startAfter key for
+// the first page. With a delimiter, the keys that contain it after the
+// prefix are rolled up into common prefixes.
+func (s *Server) listObjectsV2(ctx context.Context, prefix, delimiter, startAfter, continuationToken string) (*listObjectsV2Result, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if startAfter != "" {
+		query.Set("start-after", startAfter)
+	}
+	if continuationToken != "" {
+		query.Set("continuation-token", continuationToken)
+	}
+	req, err := s.newUpstreamRequest(ctx, http.MethodGet, "/", query, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.doS3(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list objects")
+	}
+	defer resp.Body.Close()
+
+	var result listObjectsV2Result
+	if err := decodeS3Response(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// deleteObject deletes the object at objectPath.
+func (s *Server) deleteObject(ctx context.Context, objectPath string) error {
+	req, err := s.newUpstreamRequest(ctx, http.MethodDelete, objectPath, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.doS3(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to delete object")
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// objectVersion is a version of an object, or a delete marker. Buckets
+// without versioning have a single version per object, whose ID is "null".
+// Deleting an object without a version ID deletes its current version.
+type objectVersion struct {
+	Key       string
+	VersionID string `xml:"VersionId,omitempty"`
+}
+
+type listObjectVersionsResult struct {
+	Versions            []objectVersion `xml:"Version"`
+	DeleteMarkers       []objectVersion `xml:"DeleteMarker"`
+	IsTruncated         bool
+	NextKeyMarker       string
+	NextVersionIDMarker string `xml:"NextVersionIdMarker"`
+}
+
+// listObjectVersions lists a page of the versions and delete markers under
+// prefix, starting after the given markers.
+func (s *Server) listObjectVersions(ctx context.Context, prefix, keyMarker, versionIDMarker string) (*listObjectVersionsResult, error) {
+	query := url.Values{"versions": {""}, "prefix": {prefix}}
+	if keyMarker != "" {
+		query.Set("key-marker", keyMarker)
+		query.Set("version-id-marker", versionIDMarker)
+	}
+	req, err := s.newUpstreamRequest(ctx, http.MethodGet, "/", query, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.doS3(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list object versions")
+	}
+	defer resp.Body.Close()
+
+	var result listObjectVersionsResult
+	if err := decodeS3Response(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+type deleteObjectsBody struct {
+	XMLName xml.Name        `xml:"http://s3.amazonaws.com/doc/2006-03-01/ Delete"`
+	Quiet   bool            `xml:"Quiet"`
+	Objects []objectVersion `xml:"Object"`
+}
+
+// deleteError is a version a DeleteObjects request failed to delete.
+type deleteError struct {
+	Key       string
+	VersionID string `xml:"VersionId"`
+	Code      string
+	Message   string
+}
+
+type deleteObjectsResult struct {
+	Errors []deleteError `xml:"Error"`
+}
+
+// deleteObjectVersions deletes up to 1000 versions with a single
+// DeleteObjects request, and returns the ones that couldn't be deleted.
+func (s *Server) deleteObjectVersions(ctx context.Context, versions []objectVersion) ([]deleteError, error) {
+	body, err := xml.Marshal(deleteObjectsBody{Quiet: true, Objects: versions})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := s.newUpstreamRequest(ctx, http.MethodPost, "/", url.Values{"delete": {""}}, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(body)
+	req.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+
+	resp, err := s.doS3(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to delete objects")
+	}
+	defer resp.Body.Close()
+
+	var result deleteObjectsResult
+	if err := decodeS3Response(resp, &result); err != nil {
+		return nil, err
+	}
+	return result.Errors, nil
+}
+
+// objectTagging is the tag set of an object.
+type objectTagging struct {
+	XMLName xml.Name    `xml:"Tagging"`
+	TagSet  []objectTag `xml:"TagSet>Tag"`
+}
+
+type objectTag struct {
+	Key   string
+	Value string
+}
+
+// getObjectTagging returns the tags of the object at objectPath.
+func (s *Server) getObjectTagging(ctx context.Context, objectPath string) (map[string]string, error) {
+	req, err := s.newUpstreamRequest(ctx, http.MethodGet, objectPath, url.Values{"tagging": {""}}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.doS3(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get object tagging")
+	}
+	defer resp.Body.Close()
+
+	var result objectTagging
+	if err := decodeS3Response(resp, &result); err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(result.TagSet))
+	for _, tag := range result.TagSet {
+		tags[tag.Key] = tag.Value
+	}
+	return tags, nil
+}
+
+// putObjectTagging replaces the tags of the object at objectPath.
+func (s *Server) putObjectTagging(ctx context.Context, objectPath string, tags map[string]string) error {
+	tagging := objectTagging{XMLName: xml.Name{Space: "http://s3.amazonaws.com/doc/2006-03-01/", Local: "Tagging"}}
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		tagging.TagSet = append(tagging.TagSet, objectTag{Key: key, Value: tags[key]})
+	}
+	body, err := xml.Marshal(tagging)
+	if err != nil {
+		return err
+	}
+
+	req, err := s.newUpstreamRequest(ctx, http.MethodPut, objectPath, url.Values{"tagging": {""}}, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(body)
+	req.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+
+	resp, err := s.doS3(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to put object tagging")
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// maxCopyObjectSize is the size of the largest object S3 copies with a single
+// CopyObject request. Larger objects are copied part by part, copyPartSize
+// bytes at a time.
+const (
+	maxCopyObjectSize = 5 * 1024 * 1024 * 1024
+	copyPartSize      = 1024 * 1024 * 1024
+)
+
+// copySource returns the X-Amz-Copy-Source header for the object at
+// objectPath.
+func (s *Server) copySource(objectPath string) string {
+	return "/" + s.cfg.S3Settings.Bucket + s3utils.EncodePath(objectPath)
+}
+
+// copyObject copies the object at srcPath, of the given size, to dstPath.
+// The headers are sent with the request, so that the metadata of the copy
+// can be set and the copy can be made conditional.
+func (s *Server) copyObject(ctx context.Context, srcPath, dstPath string, size int64, header http.Header) error {
+	if size > maxCopyObjectSize {
+		return s.copyObjectMultipart(ctx, srcPath, dstPath, size, copyPartSize, header)
+	}
+
+	req, err := s.newUpstreamRequest(ctx, http.MethodPut, dstPath, nil, nil)
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("X-Amz-Copy-Source", s.copySource(srcPath))
+
+	resp, err := s.doS3(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to copy object")
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		ETag string
+	}
+	return decodeS3Response(resp, &result)
+}
+
+// Headers of a CopyObject request that only apply to the source object.
+var copySourceHeaders = map[string]bool{
+	"X-Amz-Copy-Source-If-Match":            true,
+	"X-Amz-Copy-Source-If-None-Match":       true,
+	"X-Amz-Copy-Source-If-Modified-Since":   true,
+	"X-Amz-Copy-Source-If-Unmodified-Since": true,
+}
+
+// copyObjectMultipart copies an object with UploadPartCopy requests of
+// partSize bytes. The metadata of the copy is always the one in header.
+func (s *Server) copyObjectMultipart(ctx context.Context, srcPath, dstPath string, size, partSize int64, header http.Header) error {
+	createHeader := make(http.Header)
+	conditions := make(http.Header)
+	for key, values := range header {
+		switch {
+		case copySourceHeaders[key]:
+			conditions[key] = values
+		case key != "X-Amz-Metadata-Directive":
+			createHeader[key] = values
+		}
+	}
+
+	uploadID, err := s.createMultipartUpload(ctx, dstPath, createHeader)
+	if err != nil {
+		return err
+	}
+
+	var parts []completePart
+	for start := int64(0); start < size && err == nil; start += partSize {
+		var etag string
+		rng := byteRange{start, min(start+partSize, size) - 1}
+		etag, err = s.uploadPartCopy(ctx, dstPath, uploadID, len(parts)+1, srcPath, rng, conditions)
+		parts = append(parts, completePart{PartNumber: len(parts) + 1, ETag: etag})
+	}
+	if err == nil {
+		_, _, err = s.completeMultipartUpload(ctx, dstPath, uploadID, parts)
+	}
+	if err != nil {
+		if abortErr := s.abortMultipartUpload(context.WithoutCancel(ctx), dstPath, uploadID); abortErr != nil {
+			return errors.Wrapf(err, "failed to abort multipart copy: %s", abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// uploadPartCopy copies a range of the object at srcPath into a part of a
+// multipart upload and returns the ETag of the part.
+func (s *Server) uploadPartCopy(ctx context.Context, objectPath, uploadID string, partNumber int, srcPath string, rng byteRange, header http.Header) (string, error) {
+	query := url.Values{"uploadId": {uploadID}, "partNumber": {strconv.Itoa(partNumber)}}
+	req, err := s.newUpstreamRequest(ctx, http.MethodPut, objectPath, query, nil)
+	if err != nil {
+		return "", err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("X-Amz-Copy-Source", s.copySource(srcPath))
+	req.Header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", rng.start, rng.end))
+
+	resp, err := s.doS3(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to copy part %d", partNumber)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		ETag string
+	}
+	if err := decodeS3Response(resp, &result); err != nil {
+		return "", err
+	}
+	return result.ETag, nil
+}
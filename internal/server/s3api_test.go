@@ -0,0 +1,77 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseS3Error(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusNotFound,
+		Body:       io.NopCloser(strings.NewReader(`<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)),
+	}
+	var s3Err *s3Error
+	require.True(t, errors.As(parseS3Error(resp), &s3Err))
+	assert.Equal(t, http.StatusNotFound, s3Err.StatusCode)
+	assert.Equal(t, "NoSuchKey", s3Err.Code)
+
+	resp = &http.Response{StatusCode: http.StatusBadGateway, Body: io.NopCloser(strings.NewReader("bad gateway"))}
+	require.True(t, errors.As(parseS3Error(resp), &s3Err))
+	assert.Equal(t, "502", s3Err.Code)
+}
+
+func TestDecodeS3Response(t *testing.T) {
+	var result completeMultipartUploadResult
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(`<CompleteMultipartUploadResult><ETag>"abc-2"</ETag></CompleteMultipartUploadResult>`)),
+	}
+	require.NoError(t, decodeS3Response(resp, &result))
+	assert.Equal(t, `"abc-2"`, result.ETag)
+
+	resp = &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(`<Error><Code>InternalError</Code><Message>We encountered an internal error.</Message></Error>`)),
+	}
+	var s3Err *s3Error
+	require.True(t, errors.As(decodeS3Response(resp, &result), &s3Err))
+	assert.Equal(t, "InternalError", s3Err.Code)
+}
+
+func TestCopyObjectMultipart(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{})
+	obj := fake.put("src", []byte("0123456789abcdefghij"), http.Header{})
+
+	header := http.Header{
+		"Content-Type":               {"text/plain"},
+		"X-Amz-Metadata-Directive":   {"REPLACE"},
+		"X-Amz-Copy-Source-If-Match": {obj.etag},
+	}
+	require.NoError(t, s.copyObjectMultipart(context.Background(), "/src", "/dst", 20, 8, header))
+
+	copied := fake.object("dst")
+	require.NotNil(t, copied)
+	assert.Equal(t, "0123456789abcdefghij", string(copied.data))
+	assert.Equal(t, "text/plain", copied.header.Get("Content-Type"))
+	assert.Empty(t, copied.header.Get("X-Amz-Copy-Source-If-Match"))
+	assert.Empty(t, fake.uploads)
+
+	header.Set("X-Amz-Copy-Source-If-Match", `"other"`)
+	err := s.copyObjectMultipart(context.Background(), "/src", "/dst2", 20, 8, header)
+	var s3Err *s3Error
+	require.True(t, errors.As(err, &s3Err))
+	assert.Equal(t, "PreconditionFailed", s3Err.Code)
+	assert.Nil(t, fake.object("dst2"))
+	assert.Empty(t, fake.uploads)
+}
@@ -0,0 +1,322 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+// scannedHeader marks the objects that were scanned for malware when they
+// were written, with the time of the scan. Objects of multipart uploads are
+// marked when the upload is created, and scanned once it is complete.
+const scannedHeader = "X-Amz-Meta-Bifrost-Scanned"
+
+const (
+	defaultScanMaxSize = 64 * 1024 * 1024
+	defaultScanTimeout = time.Minute
+)
+
+// Results of the scans, as reported by the metrics.
+const (
+	scanResultClean    = "clean"
+	scanResultInfected = "infected"
+	scanResultError    = "error"
+)
+
+// scanEligible reports whether the objects written by the installation are
+// scanned.
+func (s *Server) scanEligible(installationID string) bool {
+	return s.scanner != nil && slices.Contains(s.cfg.ScanSettings.Installations, installationID)
+}
+
+func (s *Server) scanMaxSize() int64 {
+	if size := s.cfg.ScanSettings.MaxSizeBytes; size > 0 {
+		return size
+	}
+	return defaultScanMaxSize
+}
+
+// prepareScan scans the body of a PutObject before it is sent upstream, and
+// marks the object as scanned if it is clean. The body is buffered in memory
+// or in the spool directory while it is scanned, and replayed to S3. The
+// objects of multipart uploads are marked when the upload is created. It
+// returns a function releasing the buffer once the request is done.
+func (s *Server) prepareScan(r *http.Request, op s3Request) (func(), error) {
+	noop := func() {}
+	switch op.Operation {
+	case opCreateMultipartUpload:
+		r.Header.Set(scannedHeader, time.Now().UTC().Format(time.RFC3339))
+		return noop, nil
+	case opPutObject:
+	default:
+		return noop, nil
+	}
+
+	if r.ContentLength < 0 {
+		return noop, &s3Error{StatusCode: http.StatusLengthRequired, Code: "MissingContentLength", Message: "You must provide the Content-Length HTTP header."}
+	}
+	if r.ContentLength > s.scanMaxSize() {
+		return noop, s.scanTooLarge(op, r.ContentLength)
+	}
+	if r.ContentLength == 0 {
+		r.Header.Set(scannedHeader, time.Now().UTC().Format(time.RFC3339))
+		return noop, nil
+	}
+
+	buf, err := newPartBuffer(s.cfg.ScanSettings.SpoolDirectory)
+	if err != nil {
+		return noop, err
+	}
+	cleanup := func() {
+		if err := buf.Close(); err != nil {
+			s.logger.Warn("failed to release scan buffer", mlog.Err(err))
+		}
+	}
+
+	// The body is read to the end whatever happens to the scan, so that it
+	// can be stored if the scan fails and FailOpen is set.
+	var size byteCounter
+	body := &errorRecordingReader{r: io.TeeReader(r.Body, io.MultiWriter(buf, &size))}
+	scanned, scanErr := s.scanBody(r, op, body, r.ContentLength)
+	io.Copy(io.Discard, body)
+	if body.err != nil {
+		cleanup()
+		return noop, errors.Wrap(body.err, "failed to read request body")
+	}
+	if int64(size) != r.ContentLength {
+		cleanup()
+		return noop, &s3Error{StatusCode: http.StatusBadRequest, Code: "IncompleteBody", Message: "You did not provide the number of bytes specified by the Content-Length HTTP header."}
+	}
+	if scanErr != nil {
+		cleanup()
+		return noop, scanErr
+	}
+
+	reader, err := buf.Reader()
+	if err != nil {
+		cleanup()
+		return noop, err
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{reader, r.Body}
+	if scanned {
+		r.Header.Set(scannedHeader, time.Now().UTC().Format(time.RFC3339))
+	}
+	return cleanup, nil
+}
+
+// errorRecordingReader keeps the error a read failed with, other than EOF.
+type errorRecordingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errorRecordingReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// scanBody scans the body of the object of the request. It reports whether
+// the body was scanned, and returns an error if the request must be
+// rejected, because malware was found or because the scan failed without
+// FailOpen.
+func (s *Server) scanBody(r *http.Request, op s3Request, body io.Reader, size int64) (bool, error) {
+	installationID, _, _ := strings.Cut(op.Key, "/")
+	threat, err := s.scanner.scan(r.Context(), op.Key, body, size)
+	if err != nil {
+		s.metrics.incObjectScan(installationID, scanResultError)
+		if s.cfg.ScanSettings.FailOpen {
+			s.logger.Error("failed to scan object, letting it through", mlog.String("installation_id", installationID), mlog.String("key", op.Key), mlog.String("operation", op.Operation), mlog.Err(err))
+			return false, nil
+		}
+		s.logger.Error("failed to scan object", mlog.String("installation_id", installationID), mlog.String("key", op.Key), mlog.String("operation", op.Operation), mlog.Err(err))
+		return false, &s3Error{StatusCode: http.StatusServiceUnavailable, Code: "ServiceUnavailable", Message: "The object could not be scanned for malware. Please try again."}
+	}
+	if threat == "" {
+		s.metrics.incObjectScan(installationID, scanResultClean)
+		return true, nil
+	}
+
+	s.metrics.incObjectScan(installationID, scanResultInfected)
+	sourceIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+	s.logger.Warn("malware detected",
+		mlog.String("installation_id", installationID),
+		mlog.String("key", op.Key),
+		mlog.String("operation", op.Operation),
+		mlog.String("threat", threat),
+		mlog.String("source_ip", sourceIP),
+	)
+	if s.events != nil {
+		record := s.events.newRecord(eventObjectRejectedMalware, op.Key)
+		record.RequestParameters.SourceIPAddress = sourceIP
+		record.S3.Object.Size = size
+		record.ScanEventData = &eventScanData{Operation: op.Operation, Threat: threat}
+		s.events.emit(record)
+	}
+	return false, &s3Error{StatusCode: http.StatusForbidden, Code: "MalwareDetected", Message: "The object was rejected because malware was found in it: " + threat + "."}
+}
+
+// scanTooLarge returns the error of an object larger than the maximum size
+// of the scans, unless such objects are let through with FailOpen.
+func (s *Server) scanTooLarge(op s3Request, size int64) error {
+	installationID, _, _ := strings.Cut(op.Key, "/")
+	if s.cfg.ScanSettings.FailOpen {
+		s.logger.Warn("object too large to be scanned, letting it through", mlog.String("installation_id", installationID), mlog.String("key", op.Key), mlog.String("operation", op.Operation), mlog.Int64("size", size))
+		return nil
+	}
+	if op.Operation == opGetObject {
+		return &s3Error{StatusCode: http.StatusForbidden, Code: "AccessDenied", Message: "The object is too large to be scanned for malware."}
+	}
+	return &s3Error{StatusCode: http.StatusBadRequest, Code: "EntityTooLarge", Message: "Your proposed upload exceeds the maximum size of the objects scanned for malware."}
+}
+
+// completeScannedMultipartUpload completes a multipart upload and scans the
+// object it assembled. The object is deleted if it must be rejected, before
+// the client gets the response. It was marked as scanned when the upload
+// was created, so it stays marked if it is let through with FailOpen.
+func (s *Server) completeScannedMultipartUpload(r *http.Request, op s3Request) (*http.Response, error) {
+	resp, err := s.doUpstream(r)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	// S3 can fail after it sent a 200 status code.
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the response of CompleteMultipartUpload")
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	var result struct {
+		XMLName xml.Name
+	}
+	if xml.Unmarshal(body, &result) == nil && result.XMLName.Local == "Error" {
+		return resp, nil
+	}
+
+	if err := s.scanStoredObject(r, op); err != nil {
+		// The client got no object, whatever happens to the request.
+		ctx := context.WithoutCancel(r.Context())
+		if deleteErr := s.deleteObject(ctx, "/"+op.Key); deleteErr != nil {
+			s.logger.Error("failed to delete rejected object", mlog.String("key", op.Key), mlog.Err(deleteErr))
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// scanStoredObject scans an object that is already stored.
+func (s *Server) scanStoredObject(r *http.Request, op s3Request) error {
+	req, err := s.newUpstreamRequest(r.Context(), http.MethodGet, "/"+op.Key, nil, nil)
+	if err != nil {
+		return err
+	}
+	req.RemoteAddr = r.RemoteAddr
+	resp, err := s.fetchDecodedObject(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Wrap(parseS3Error(resp), "failed to get the object to scan")
+	}
+	if resp.ContentLength > s.scanMaxSize() {
+		return s.scanTooLarge(op, resp.ContentLength)
+	}
+	_, err = s.scanBody(r, op, resp.Body, resp.ContentLength)
+	return err
+}
+
+// scanOnReadEligible reports whether the object of the response to a
+// GetObject is scanned before it is served, because it wasn't scanned when
+// it was written.
+func (s *Server) scanOnReadEligible(r *http.Request, resp *http.Response) bool {
+	if !s.cfg.ScanSettings.ScanOnRead || r.Method != http.MethodGet || resp.Header.Get(scannedHeader) != "" {
+		return false
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return false
+	}
+	installationID, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	return s.scanEligible(installationID)
+}
+
+// scanObjectResponse scans the object of the response to a GetObject before
+// it is served. The body is buffered while it is scanned. The whole object
+// is scanned before a range of it is served.
+func (s *Server) scanObjectResponse(r *http.Request, resp *http.Response) (*http.Response, error) {
+	op := s3Request{Operation: opGetObject, Key: strings.TrimPrefix(r.URL.Path, "/")}
+
+	if resp.StatusCode == http.StatusPartialContent {
+		size, err := contentRangeSize(resp.Header.Get("Content-Range"))
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if size > s.scanMaxSize() {
+			if err := s.scanTooLarge(op, size); err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+			return resp, nil
+		}
+		if err := s.scanStoredObject(r, op); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		return resp, nil
+	}
+
+	if resp.ContentLength > s.scanMaxSize() || resp.ContentLength < 0 {
+		if err := s.scanTooLarge(op, resp.ContentLength); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		return resp, nil
+	}
+
+	buf, err := newPartBuffer(s.cfg.ScanSettings.SpoolDirectory)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	body := io.TeeReader(resp.Body, buf)
+	_, err = s.scanBody(r, op, body, resp.ContentLength)
+	if err == nil {
+		// The scan may have failed before the end, with FailOpen.
+		_, err = io.Copy(io.Discard, body)
+	}
+	resp.Body.Close()
+	if err != nil {
+		buf.Close()
+		return nil, err
+	}
+
+	reader, err := buf.Reader()
+	if err != nil {
+		buf.Close()
+		return nil, err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{reader, buf}
+	return resp, nil
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newScanServer(t *testing.T, settings ScanSettings) (*fakeS3, *fakeICAP, *Server) {
+	fake, ts := newFakeS3(t)
+	icap := newFakeICAP(t)
+	settings.Enable = true
+	settings.ICAPURL = icap.url()
+	settings.Installations = []string{"inst"}
+	s := newFakeS3Server(t, ts, Config{ScanSettings: settings})
+	return fake, icap, s
+}
+
+// readS3ErrorCode returns the code of the S3 error of the response.
+func readS3ErrorCode(t *testing.T, resp *http.Response) string {
+	var body struct {
+		Code string
+	}
+	require.NoError(t, xml.NewDecoder(resp.Body).Decode(&body))
+	return body.Code
+}
+
+func TestScanPutObject(t *testing.T) {
+	fake, icap, s := newScanServer(t, ScanSettings{})
+	journalFile := filepath.Join(t.TempDir(), "events.jsonl")
+	events, err := newEventEmitter(EventSettings{Enable: true, JournalFile: journalFile}, s.cfg.S3Settings, s.metrics, s.logger)
+	require.NoError(t, err)
+	s.events = events
+	handler := s.handler()
+
+	resp := serveRequest(handler, "PUT", "/inst/clean", []byte("hello"), nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotNil(t, fake.object("inst/clean"))
+	assert.Equal(t, "hello", string(fake.object("inst/clean").data))
+	assert.NotEmpty(t, fake.object("inst/clean").header.Get(scannedHeader))
+
+	resp = serveRequest(handler, "PUT", "/inst/eicar", []byte(eicar), nil)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "MalwareDetected", readS3ErrorCode(t, resp))
+	assert.Nil(t, fake.object("inst/eicar"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.metrics.objectScans.WithLabelValues("inst", scanResultInfected)))
+
+	// Clients can't mark the objects they upload.
+	resp = serveRequest(handler, "PUT", "/inst/empty", nil, http.Header{scannedHeader: {"yes"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEqual(t, "yes", fake.object("inst/empty").header.Get(scannedHeader))
+
+	// Other installations aren't scanned.
+	resp = serveRequest(handler, "PUT", "/other/eicar", []byte(eicar), nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"inst/clean", "inst/eicar"}, icap.scanned())
+
+	s.events.close()
+	journal := readJSONLines[eventRecord](t, journalFile)
+	require.Len(t, journal, 4)
+	rejected := journal[1]
+	assert.Equal(t, eventObjectRejectedMalware, rejected.EventName)
+	assert.Equal(t, "inst/eicar", rejected.S3.Object.Key)
+	require.NotNil(t, rejected.ScanEventData)
+	assert.Equal(t, "Eicar-Test-Signature", rejected.ScanEventData.Threat)
+	assert.Equal(t, opPutObject, rejected.ScanEventData.Operation)
+	assert.Nil(t, journal[0].ScanEventData)
+}
+
+func TestScanFailures(t *testing.T) {
+	t.Run("fail closed", func(t *testing.T) {
+		fake, icap, s := newScanServer(t, ScanSettings{MaxSizeBytes: 8})
+		handler := s.handler()
+		icap.setFail(true)
+
+		resp := serveRequest(handler, "PUT", "/inst/a", []byte("hello"), nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Nil(t, fake.object("inst/a"))
+		assert.Equal(t, 1.0, testutil.ToFloat64(s.metrics.objectScans.WithLabelValues("inst", scanResultError)))
+
+		resp = serveRequest(handler, "PUT", "/inst/large", []byte("too large to scan"), nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, "EntityTooLarge", readS3ErrorCode(t, resp))
+	})
+
+	t.Run("fail open", func(t *testing.T) {
+		fake, icap, s := newScanServer(t, ScanSettings{MaxSizeBytes: 8, FailOpen: true})
+		handler := s.handler()
+		icap.setFail(true)
+
+		// The objects are stored, but not marked as scanned.
+		resp := serveRequest(handler, "PUT", "/inst/a", []byte("hello"), nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "hello", string(fake.object("inst/a").data))
+		assert.Empty(t, fake.object("inst/a").header.Get(scannedHeader))
+
+		resp = serveRequest(handler, "PUT", "/inst/large", []byte("too large to scan"), nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "too large to scan", string(fake.object("inst/large").data))
+		assert.Empty(t, fake.object("inst/large").header.Get(scannedHeader))
+	})
+}
+
+func TestScanOnRead(t *testing.T) {
+	fake, icap, s := newScanServer(t, ScanSettings{ScanOnRead: true})
+	handler := s.handler()
+
+	fake.put("inst/old", []byte("old content"), nil)
+	fake.put("inst/old-eicar", []byte(eicar), nil)
+	fake.put("inst/scanned", []byte(eicar), http.Header{scannedHeader: {"2024-01-01T00:00:00Z"}})
+
+	resp := serveRequest(handler, "GET", "/inst/old", nil, nil)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "old content", string(body))
+	assert.Empty(t, resp.Header.Get(scannedHeader))
+
+	resp = serveRequest(handler, "GET", "/inst/old-eicar", nil, nil)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "MalwareDetected", readS3ErrorCode(t, resp))
+
+	// The whole object is scanned before a range of it is served.
+	resp = serveRequest(handler, "GET", "/inst/old-eicar", nil, http.Header{"Range": {"bytes=0-3"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = serveRequest(handler, "GET", "/inst/old", nil, http.Header{"Range": {"bytes=4-10"}})
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(body))
+
+	// Objects scanned when they were written aren't scanned again, and
+	// HeadObject doesn't scan.
+	resp = serveRequest(handler, "GET", "/inst/scanned", nil, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = serveRequest(handler, "HEAD", "/inst/old-eicar", nil, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assert.Equal(t, []string{"inst/old", "inst/old-eicar", "inst/old-eicar", "inst/old"}, icap.scanned())
+}
+
+func TestScanMultipartUpload(t *testing.T) {
+	fake, icap, s := newScanServer(t, ScanSettings{ScanOnRead: true})
+	handler := s.handler()
+
+	upload := func(key string, parts ...string) *http.Response {
+		resp := serveRequest(handler, "POST", "/"+key+"?uploads", nil, nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&result))
+
+		complete := `<CompleteMultipartUpload xmlns="http://s3.amazonaws.com/doc/2006-03-01/">`
+		for i, part := range parts {
+			resp := serveRequest(handler, "PUT", fmt.Sprintf("/%s?partNumber=%d&uploadId=%s", key, i+1, result.UploadID), []byte(part), nil)
+			resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			sum := md5.Sum([]byte(part))
+			complete += fmt.Sprintf(`<Part><PartNumber>%d</PartNumber><ETag>"%s"</ETag></Part>`, i+1, hex.EncodeToString(sum[:]))
+		}
+		complete += "</CompleteMultipartUpload>"
+		return serveRequest(handler, "POST", "/"+key+"?uploadId="+result.UploadID, []byte(complete), nil)
+	}
+
+	resp := upload("inst/clean", "hello ", "world")
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotNil(t, fake.object("inst/clean"))
+	assert.NotEmpty(t, fake.object("inst/clean").header.Get(scannedHeader))
+
+	// The signature spans both parts.
+	resp = upload("inst/eicar", eicar[:30], eicar[30:])
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "MalwareDetected", readS3ErrorCode(t, resp))
+	assert.Nil(t, fake.object("inst/eicar"))
+
+	// Marked objects aren't scanned again when they are read.
+	resp = serveRequest(handler, "GET", "/inst/clean", nil, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"inst/clean", "inst/eicar"}, icap.scanned())
+}
@@ -5,10 +5,11 @@ package server
 
 import (
 	"context"
+	"crypto/ed25519"
 	"crypto/tls"
-	"errors"
 	"net"
 	"net/http"
+	"regexp"
 	"runtime/debug"
 	"strings"
 	"sync"
@@ -17,6 +18,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/mattermost/mattermost-server/v5/mlog"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pkg/errors"
 )
 
 // Version information, assigned by ldflags
@@ -36,12 +38,46 @@ type Server struct {
 	lookupAddrFn func(addr string) (names []string, err error)
 	creds        *credentials.Credentials
 	metrics      *metrics
+	upstreams    *upstreamPool
+	flow         *flowControl
+	coalescer    *coalescer
+	keys         keyStore
+	states       *stateStore
+	massDeletes  *massDeleteDetector
+	events       *eventEmitter
+	changes      *changeFeed
+	scanner      *icapClient
+	policies     *policySet
+	signingKey   ed25519.PrivateKey
+	moves        *moveLocks
+	splitMemory  chan struct{}
+
+	// ctx is cancelled when the server stops, to end background jobs.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	clientIdentityRe *regexp.Regexp
 }
 
 // New creates a new Bifrost server
-func New(cfg Config) *Server {
+func New(cfg Config) (*Server, error) {
+	logger := mlog.NewLogger(&mlog.LoggerConfiguration{
+		ConsoleJson:   cfg.LogSettings.ConsoleJSON,
+		ConsoleLevel:  strings.ToLower(cfg.LogSettings.ConsoleLevel),
+		EnableConsole: cfg.LogSettings.EnableConsole,
+		EnableFile:    cfg.LogSettings.EnableFile,
+		FileJson:      cfg.LogSettings.FileJSON,
+		FileLevel:     strings.ToLower(cfg.LogSettings.FileLevel),
+		FileLocation:  cfg.LogSettings.FileLocation,
+	})
+
+	tlsConfig, err := upstreamTLSConfig(cfg.S3Settings, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to configure TLS for S3")
+	}
+
 	// All settings are same as DefaultTransport,
-	// with MaxConnsPerHost and ResponseHeaderTimeout added.
+	// with MaxConnsPerHost, ResponseHeaderTimeout and TLSClientConfig added.
 	client := &http.Client{
 		Transport: &http.Transport{
 			Proxy: http.ProxyFromEnvironment,
@@ -55,6 +91,7 @@ func New(cfg Config) *Server {
 			MaxIdleConns:          100,
 			IdleConnTimeout:       90 * time.Second,
 			TLSHandshakeTimeout:   10 * time.Second,
+			TLSClientConfig:       tlsConfig,
 			ResponseHeaderTimeout: time.Duration(cfg.ServiceSettings.ResponseHeaderTimeoutSecs) * time.Second,
 			ExpectContinueTimeout: 1 * time.Second,
 		},
@@ -75,22 +112,25 @@ func New(cfg Config) *Server {
 	}
 
 	s := &Server{
-		srv:    server,
-		client: client,
-		logger: mlog.NewLogger(&mlog.LoggerConfiguration{
-			ConsoleJson:   cfg.LogSettings.ConsoleJSON,
-			ConsoleLevel:  strings.ToLower(cfg.LogSettings.ConsoleLevel),
-			EnableConsole: cfg.LogSettings.EnableConsole,
-			EnableFile:    cfg.LogSettings.EnableFile,
-			FileJson:      cfg.LogSettings.FileJSON,
-			FileLevel:     strings.ToLower(cfg.LogSettings.FileLevel),
-			FileLocation:  cfg.LogSettings.FileLocation,
-		}),
+		srv:     server,
+		client:  client,
+		logger:  logger,
 		cfg:     cfg,
 		creds:   credentials.NewStatic(cfg.S3Settings.AccessKeyID, cfg.S3Settings.SecretAccessKey, "", credentials.SignatureV4),
 		metrics: newMetrics(),
 	}
 
+	states, err := newStateStore(cfg.ServiceSettings.StateFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load installation states")
+	}
+	s.states = states
+	for installationID, state := range states.list() {
+		if state.Frozen != nil {
+			s.metrics.setInstallationFrozen(installationID, true)
+		}
+	}
+
 	if cfg.ServiceSettings.ServiceHost != "" {
 		serviceMux := mux.NewRouter()
 		s.serviceSrv = &http.Server{
@@ -102,30 +142,110 @@ func New(cfg Config) *Server {
 		}
 		serviceMux.HandleFunc("/health", s.healthHandler).Methods("GET")
 		serviceMux.Handle("/metrics", s.metrics.metricsHandler())
+		s.registerAdminRoutes(serviceMux)
 	}
 
 	if s.isUsingIAMRoleCredentials() {
 		s.creds = credentials.NewIAM("")
 	}
 
+	if cfg.CircuitBreakerSettings.Enable {
+		s.flow = newFlowControl(cfg.CircuitBreakerSettings, s.metrics)
+	}
+
+	if cfg.EncryptionSettings.Enable {
+		keys, err := newKeyStore(cfg.EncryptionSettings, logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load encryption keys")
+		}
+		s.keys = keys
+	}
+
+	if cfg.PolicySettings.Enable {
+		policies, err := loadPolicies(cfg.PolicySettings.File)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load access policies")
+		}
+		s.policies = policies
+	}
+
+	if cfg.OffboardingSettings.Enable {
+		signingKey, err := loadSigningKey(cfg.OffboardingSettings.SigningKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load the offboarding signing key")
+		}
+		s.signingKey = signingKey
+	}
+
+	if cfg.ChangeFeedSettings.Enable {
+		// The feed is loaded before the emitter starts, whose sequencers
+		// come after the ones in the journal.
+		changes, err := newChangeFeed(cfg.ChangeFeedSettings, cfg.EventSettings.JournalFile, logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load the change feed")
+		}
+		s.changes = changes
+	}
+
+	if cfg.EventSettings.Enable {
+		events, err := newEventEmitter(cfg.EventSettings, cfg.S3Settings, s.metrics, logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to set up events")
+		}
+		events.feed = s.changes
+		s.events = events
+	}
+
+	if pattern := cfg.ServiceSettings.TLSClientIdentityPattern; pattern != "" {
+		// The pattern has already been validated by Config.IsValid.
+		s.clientIdentityRe = regexp.MustCompile(pattern)
+	}
+
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 	s.getHostFn = s.getHost
 	s.lookupAddrFn = net.LookupAddr
 	s.srv.Handler = s.withRecovery(s.handler())
 
-	return s
+	return s, nil
 }
 
 // Start starts the server
 func (s *Server) Start() error {
 	var wg sync.WaitGroup
 
+	if s.cfg.S3Settings.HealthCheckIntervalSecs > 0 {
+		go s.runHealthChecks(s.ctx)
+	}
+
+	if s.cfg.MultipartJanitorSettings.Enable {
+		go s.runMultipartJanitor(s.ctx)
+	}
+
+	if s.cfg.TrashSettings.Enable {
+		go s.runTrashJanitor(s.ctx)
+	}
+
+	if s.cfg.OffboardingSettings.Enable {
+		go s.runOffboarding(s.ctx)
+	}
+
+	// Moves interrupted by a restart carry on.
+	for installationID, state := range s.states.list() {
+		if state.Moving != nil && state.Moving.Phase != movePhaseDone {
+			go s.runMove(installationID)
+		}
+	}
+
 	errChan := make(chan error, 2)
 	wg.Add(1)
 	go func() {
 		s.logger.Info("server started", mlog.String("host", s.cfg.ServiceSettings.Host))
 		var err error
 		if s.cfg.ServiceSettings.TLSCertFile != "" && s.cfg.ServiceSettings.TLSKeyFile != "" {
-			err = s.srv.ListenAndServeTLS(s.cfg.ServiceSettings.TLSCertFile, s.cfg.ServiceSettings.TLSKeyFile)
+			if err = s.configureTLS(); err == nil {
+				// The certificate is served by the reloader configured above.
+				err = s.srv.ListenAndServeTLS("", "")
+			}
 		} else {
 			err = s.srv.ListenAndServe()
 		}
@@ -153,6 +273,8 @@ func (s *Server) Start() error {
 
 // Stop stops the server
 func (s *Server) Stop() error {
+	s.cancel()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
@@ -166,13 +288,24 @@ func (s *Server) Stop() error {
 		}
 	}
 
+	// Requests are done, and can't emit events anymore.
+	if s.events != nil {
+		s.events.close()
+	}
+
 	return nil
 }
 
+// withRecovery logs the panics of the handler instead of crashing. Handlers
+// that abort their response on purpose with http.ErrAbortHandler still get
+// their connection closed.
 func (s *Server) withRecovery(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if x := recover(); x != nil {
+				if x == http.ErrAbortHandler {
+					panic(x)
+				}
 				s.logger.Error("recovered from a panic",
 					mlog.String("url", r.URL.String()),
 					mlog.Any("error", x),
@@ -15,10 +15,11 @@ import (
 )
 
 type panicHandler struct {
+	value any
 }
 
 func (ph panicHandler) ServeHTTP(_ http.ResponseWriter, _ *http.Request) {
-	panic("")
+	panic(ph.value)
 }
 
 func TestWithRecovery(t *testing.T) {
@@ -26,7 +27,7 @@ func TestWithRecovery(t *testing.T) {
 		s := Server{
 			logger: mlog.NewTestingLogger(t, os.Stderr),
 		}
-		ph := panicHandler{}
+		ph := panicHandler{value: ""}
 		handler := s.withRecovery(ph)
 
 		req := httptest.NewRequest("GET", "http://random", nil)
@@ -41,3 +42,15 @@ func TestWithRecovery(t *testing.T) {
 		}
 	})
 }
+
+func TestWithRecoveryAbort(t *testing.T) {
+	s := Server{
+		logger: mlog.NewTestingLogger(t, os.Stderr),
+	}
+	handler := s.withRecovery(panicHandler{value: http.ErrAbortHandler})
+
+	req := httptest.NewRequest("GET", "http://random", nil)
+	require.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	})
+}
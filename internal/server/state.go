@@ -0,0 +1,154 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// installationState is what Bifrost knows about an installation beyond its
+// configuration, like whether its writes are frozen, or its data is being
+// deleted or moved to another installation.
+type installationState struct {
+	Frozen     *freezeState   `json:"frozen,omitempty"`
+	Deleting   *deletionState `json:"deleting,omitempty"`
+	Moving     *moveState     `json:"moving,omitempty"`
+	MovingFrom string         `json:"moving_from,omitempty"`
+}
+
+// isEmpty reports whether the state is the one of installations Bifrost
+// knows nothing about.
+func (s installationState) isEmpty() bool {
+	return s.Frozen == nil && s.Deleting == nil && s.Moving == nil && s.MovingFrom == ""
+}
+
+// clone returns a copy of the state that doesn't share anything with it, so
+// that it can be read while the state is updated.
+func (s installationState) clone() installationState {
+	if s.Frozen != nil {
+		frozen := *s.Frozen
+		s.Frozen = &frozen
+	}
+	if s.Deleting != nil {
+		deleting := *s.Deleting
+		s.Deleting = &deleting
+	}
+	if s.Moving != nil {
+		moving := *s.Moving
+		s.Moving = &moving
+	}
+	return s
+}
+
+// freezeState describes why and since when an installation is frozen. The
+// counts are the ones of the window whose threshold was crossed.
+type freezeState struct {
+	Reason     string    `json:"reason"`
+	Since      time.Time `json:"since"`
+	WindowSecs int       `json:"window_secs,omitempty"`
+	Deletes    int       `json:"deletes,omitempty"`
+	Overwrites int       `json:"overwrites,omitempty"`
+}
+
+// stateStore holds the state of the installations. It is saved to a JSON
+// file whenever it changes, so that it survives restarts, unless the store
+// has no path.
+type stateStore struct {
+	path string
+
+	mu            sync.Mutex
+	installations map[string]installationState
+}
+
+func newStateStore(path string) (*stateStore, error) {
+	st := &stateStore{
+		path:          path,
+		installations: make(map[string]installationState),
+	}
+	if path == "" {
+		return st, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read state file")
+	}
+	if err := json.Unmarshal(data, &st.installations); err != nil {
+		return nil, errors.Wrap(err, "failed to decode state file")
+	}
+	return st, nil
+}
+
+// get returns the state of the installation.
+func (st *stateStore) get(installationID string) installationState {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.installations[installationID].clone()
+}
+
+// list returns the state of the installations that have one.
+func (st *stateStore) list() map[string]installationState {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	installations := make(map[string]installationState, len(st.installations))
+	for id, state := range st.installations {
+		installations[id] = state.clone()
+	}
+	return installations
+}
+
+// update changes the state of the installation with fn and saves the store.
+// The change is kept even if it can't be saved.
+func (st *stateStore) update(installationID string, fn func(state *installationState)) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	state := st.installations[installationID]
+	fn(&state)
+	if state.isEmpty() {
+		delete(st.installations, installationID)
+	} else {
+		st.installations[installationID] = state
+	}
+	return st.save()
+}
+
+func (st *stateStore) save() error {
+	if st.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(st.installations, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(replaceFile(st.path, data), "failed to save state file")
+}
+
+// replaceFile replaces the file at path by one with the data at once, so
+// that it is never left half written.
+func replaceFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
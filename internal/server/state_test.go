@@ -0,0 +1,70 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	st, err := newStateStore(path)
+	require.NoError(t, err)
+	assert.Empty(t, st.list())
+
+	since := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, st.update("inst", func(state *installationState) {
+		state.Frozen = &freezeState{Reason: freezeReasonDeletes, Since: since, WindowSecs: 60, Deletes: 1001}
+	}))
+
+	reloaded, err := newStateStore(path)
+	require.NoError(t, err)
+	assert.Equal(t, st.list(), reloaded.list())
+	assert.Equal(t, freezeReasonDeletes, reloaded.get("inst").Frozen.Reason)
+	assert.Nil(t, reloaded.get("other").Frozen)
+
+	require.NoError(t, reloaded.update("inst", func(state *installationState) {
+		state.Frozen = nil
+	}))
+	assert.Empty(t, reloaded.list())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{}`, string(data))
+
+	t.Run("memory only", func(t *testing.T) {
+		st, err := newStateStore("")
+		require.NoError(t, err)
+		require.NoError(t, st.update("inst", func(state *installationState) {
+			state.Frozen = &freezeState{Reason: freezeReasonManual}
+		}))
+		assert.NotNil(t, st.get("inst").Frozen)
+	})
+
+	t.Run("copies", func(t *testing.T) {
+		st, err := newStateStore("")
+		require.NoError(t, err)
+		require.NoError(t, st.update("inst", func(state *installationState) {
+			state.Frozen = &freezeState{Reason: freezeReasonDeletes, Deletes: 1}
+		}))
+		frozen := st.get("inst").Frozen
+		require.NoError(t, st.update("inst", func(state *installationState) {
+			state.Frozen.Deletes++
+		}))
+		assert.Equal(t, 1, frozen.Deletes)
+		assert.Equal(t, 2, st.list()["inst"].Frozen.Deletes)
+	})
+
+	t.Run("invalid file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "state.json")
+		require.NoError(t, os.WriteFile(path, []byte("{"), 0600))
+		_, err := newStateStore(path)
+		assert.Error(t, err)
+	})
+}
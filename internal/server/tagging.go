@@ -0,0 +1,196 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+	"github.com/pkg/errors"
+)
+
+// Metadata of the objects written through Bifrost, telling which
+// installation wrote them and with which request.
+const (
+	installationMetadataHeader = bifrostMetadataPrefix + "Installation"
+	requestIDMetadataHeader    = bifrostMetadataPrefix + "Request-Id"
+)
+
+// Placeholders of the tag template.
+const (
+	tagInstallationID = "{installation_id}"
+	tagRequestID      = "{request_id}"
+)
+
+// maxObjectTags is the number of tags S3 allows on an object.
+const maxObjectTags = 10
+
+// defaultTagTemplate is the tag template when the settings have none.
+var defaultTagTemplate = map[string]string{
+	"installation": tagInstallationID,
+	"writer":       "bifrost",
+}
+
+// newRequestID returns a random ID for a request Bifrost handles.
+func newRequestID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return strings.ToUpper(hex.EncodeToString(id))
+}
+
+// tagTemplate returns the template of the tags of the objects.
+func (s *Server) tagTemplate() map[string]string {
+	if len(s.cfg.TaggingSettings.Tags) > 0 {
+		return s.cfg.TaggingSettings.Tags
+	}
+	return defaultTagTemplate
+}
+
+// objectTags returns the tags of the template for an object written by the
+// installation with the request.
+func (s *Server) objectTags(installationID, requestID string) map[string]string {
+	replacer := strings.NewReplacer(tagInstallationID, installationID, tagRequestID, requestID)
+	tags := make(map[string]string)
+	for key, value := range s.tagTemplate() {
+		tags[key] = replacer.Replace(value)
+	}
+	return tags
+}
+
+// prepareTagging adds the tags of the template, and the metadata telling
+// which installation wrote the object with which request, to PutObject,
+// CopyObject and CreateMultipartUpload. The tags of the client are kept,
+// unless they have the key of a tag of the template. Copies get the tags of
+// their source rather than the ones of the request, unless the request
+// replaces them. Their metadata is the one of their source, unless the
+// request replaces it too.
+func (s *Server) prepareTagging(r *http.Request, op s3Request, installationID string) error {
+	switch op.Operation {
+	case opPutObject, opCreateMultipartUpload, opCopyObject:
+	default:
+		return nil
+	}
+
+	tags, err := url.ParseQuery(r.Header.Get("X-Amz-Tagging"))
+	if err != nil {
+		return &s3Error{StatusCode: http.StatusBadRequest, Code: "InvalidArgument", Message: "The header 'x-amz-tagging' shall be encoded as UTF-8 then URLEncoded URL query parameters without tag name duplicates."}
+	}
+	if op.Operation == opCopyObject && !strings.EqualFold(r.Header.Get("X-Amz-Tagging-Directive"), "REPLACE") {
+		key, err := s.copySourceKey(r)
+		if err != nil {
+			return err
+		}
+		source, err := s.getObjectTagging(r.Context(), "/"+key)
+		if err != nil {
+			return err
+		}
+		tags = make(url.Values)
+		for key, value := range source {
+			tags.Set(key, value)
+		}
+		r.Header.Set("X-Amz-Tagging-Directive", "REPLACE")
+	}
+
+	requestID := newRequestID()
+	for key, value := range s.objectTags(installationID, requestID) {
+		tags.Set(key, value)
+	}
+	r.Header.Set("X-Amz-Tagging", s3utils.QueryEncode(tags))
+	r.Header.Set(installationMetadataHeader, installationID)
+	r.Header.Set(requestIDMetadataHeader, requestID)
+	s.logger.Debug("tagged object", mlog.String("installation_id", installationID), mlog.String("key", op.Key), mlog.String("operation", op.Operation), mlog.String("request_id", requestID))
+	return nil
+}
+
+// TagBackfillReport sums up the tagging of the existing objects of an
+// installation.
+type TagBackfillReport struct {
+	RequestID string
+	// Objects is the number of objects looked at, and Tagged the number of
+	// objects whose tags were, or would be with a dry run, changed.
+	Objects int
+	Tagged  int
+}
+
+// BackfillTags adds the tags of the template to the objects of the
+// installation, its trash included, keeping their other tags. The tags of
+// the template holding the request ID get the ID of the backfill, and are
+// only added to the objects that don't have them yet, so that backfills can
+// be run again. Objects deleted in the meantime are skipped. The report
+// covers the objects handled before an error, if any.
+func (s *Server) BackfillTags(ctx context.Context, installationID string, dryRun bool) (*TagBackfillReport, error) {
+	if installationID == "" || strings.Contains(installationID, "/") {
+		return nil, errors.Errorf("invalid installation ID %q", installationID)
+	}
+	report := &TagBackfillReport{RequestID: newRequestID()}
+	template := s.objectTags(installationID, report.RequestID)
+
+	var token string
+	for {
+		page, err := s.listObjectsV2(ctx, installationID+"/", "", "", token)
+		if err != nil {
+			return report, err
+		}
+		for _, object := range page.Contents {
+			report.Objects++
+			tagged, err := s.backfillObjectTags(ctx, "/"+object.Key, template, dryRun)
+			if err != nil {
+				return report, errors.Wrapf(err, "failed to tag %s", object.Key)
+			}
+			if tagged {
+				report.Tagged++
+			}
+		}
+		if !page.IsTruncated {
+			return report, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// backfillObjectTags merges the tags into the tags of the object. It reports
+// whether the tags of the object changed.
+func (s *Server) backfillObjectTags(ctx context.Context, objectPath string, template map[string]string, dryRun bool) (bool, error) {
+	tags, err := s.getObjectTagging(ctx, objectPath)
+	if isS3ErrorCode(err, "NoSuchKey") {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	merged := maps.Clone(tags)
+	for key, value := range template {
+		if _, ok := tags[key]; ok && strings.Contains(s.tagTemplate()[key], tagRequestID) {
+			continue
+		}
+		merged[key] = value
+	}
+	if maps.Equal(merged, tags) {
+		return false, nil
+	}
+	if len(merged) > maxObjectTags {
+		return false, errors.Errorf("the object would have more than %d tags", maxObjectTags)
+	}
+	if dryRun {
+		return true, nil
+	}
+
+	err = s.putObjectTagging(ctx, objectPath, merged)
+	if isS3ErrorCode(err, "NoSuchKey") {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	s.logger.Debug("backfilled object tags", mlog.String("object", objectPath))
+	return true, nil
+}
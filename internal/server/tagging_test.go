@@ -0,0 +1,126 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// objectTagSet returns the tags the fake S3 stored for the object.
+func objectTagSet(t *testing.T, fake *fakeS3, key string) url.Values {
+	obj := fake.object(key)
+	require.NotNil(t, obj, key)
+	tags, err := url.ParseQuery(obj.header.Get("X-Amz-Tagging"))
+	require.NoError(t, err)
+	return tags
+}
+
+func TestPrepareTagging(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{TaggingSettings: TaggingSettings{Enable: true}})
+	handler := s.handler()
+
+	resp := serveRequest(handler, "PUT", "/inst/a", []byte("a"), http.Header{
+		"X-Amz-Tagging":            {"project=apollo%2011&installation=other"},
+		installationMetadataHeader: {"other"},
+	})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, url.Values{"installation": {"inst"}, "writer": {"bifrost"}, "project": {"apollo 11"}}, objectTagSet(t, fake, "inst/a"))
+	header := fake.object("inst/a").header
+	assert.Equal(t, "inst", header.Get(installationMetadataHeader))
+	assert.Len(t, header.Get(requestIDMetadataHeader), 16)
+
+	// The metadata is hidden from clients.
+	resp = serveRequest(handler, "HEAD", "/inst/a", nil, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get(installationMetadataHeader))
+
+	// Copies keep the tags of their source.
+	resp = serveRequest(handler, "PUT", "/other/b", nil, http.Header{"X-Amz-Copy-Source": {"/agnivatest/inst/a"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, url.Values{"installation": {"other"}, "writer": {"bifrost"}, "project": {"apollo 11"}}, objectTagSet(t, fake, "other/b"))
+
+	resp = serveRequest(handler, "PUT", "/other/c", nil, http.Header{
+		"X-Amz-Copy-Source":       {"/agnivatest/inst/a"},
+		"X-Amz-Tagging-Directive": {"REPLACE"},
+		"X-Amz-Tagging":           {"team=blue"},
+	})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, url.Values{"installation": {"other"}, "writer": {"bifrost"}, "team": {"blue"}}, objectTagSet(t, fake, "other/c"))
+
+	resp = serveRequest(handler, "POST", "/inst/upload?uploads", nil, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	for _, upload := range fake.uploads {
+		assert.Equal(t, "installation=inst&writer=bifrost", upload.header.Get("X-Amz-Tagging"))
+		assert.Equal(t, "inst", upload.header.Get(installationMetadataHeader))
+	}
+
+	resp = serveRequest(handler, "PUT", "/inst/d", []byte("d"), http.Header{"X-Amz-Tagging": {"a=%zz"}})
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "InvalidArgument", readS3ErrorCode(t, resp))
+}
+
+func TestTagTemplate(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{TaggingSettings: TaggingSettings{
+		Enable: true,
+		Tags:   map[string]string{"owner": "mm-{installation_id}", "request": tagRequestID},
+	}})
+	handler := s.handler()
+
+	resp := serveRequest(handler, "PUT", "/inst/a", []byte("a"), nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	tags := objectTagSet(t, fake, "inst/a")
+	assert.Equal(t, "mm-inst", tags.Get("owner"))
+	assert.Equal(t, fake.object("inst/a").header.Get(requestIDMetadataHeader), tags.Get("request"))
+}
+
+func TestBackfillTags(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{TaggingSettings: TaggingSettings{
+		Enable: true,
+		Tags:   map[string]string{"installation": tagInstallationID, "backfill": tagRequestID},
+	}})
+
+	fake.put("inst/a", []byte("a"), nil)
+	fake.put("inst/b", []byte("b"), http.Header{"X-Amz-Tagging": {"project=x&installation=wrong"}})
+	fake.put("inst/.trash/20240101T000000.000000000Z/c", []byte("c"), nil)
+	fake.put("other/d", []byte("d"), nil)
+
+	report, err := s.BackfillTags(context.Background(), "inst", true)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Objects)
+	assert.Equal(t, 3, report.Tagged)
+	assert.Empty(t, objectTagSet(t, fake, "inst/a"))
+
+	report, err = s.BackfillTags(context.Background(), "inst", false)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Tagged)
+	assert.Equal(t, url.Values{"installation": {"inst"}, "backfill": {report.RequestID}}, objectTagSet(t, fake, "inst/a"))
+	assert.Equal(t, url.Values{"installation": {"inst"}, "backfill": {report.RequestID}, "project": {"x"}}, objectTagSet(t, fake, "inst/b"))
+	assert.Empty(t, objectTagSet(t, fake, "other/d"))
+
+	// The tags holding the request ID are kept when the backfill runs again.
+	first := report.RequestID
+	report, err = s.BackfillTags(context.Background(), "inst", false)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Tagged)
+	assert.Equal(t, first, objectTagSet(t, fake, "inst/a").Get("backfill"))
+
+	_, err = s.BackfillTags(context.Background(), "", false)
+	assert.Error(t, err)
+}
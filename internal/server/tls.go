@@ -0,0 +1,217 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+// Client certificate authentication modes.
+const (
+	// TLSClientAuthNone does not ask clients for a certificate.
+	TLSClientAuthNone = ""
+	// TLSClientAuthVerify verifies a client certificate if one is presented,
+	// but still accepts clients that do not present any.
+	TLSClientAuthVerify = "verify"
+	// TLSClientAuthRequire rejects clients that do not present a certificate
+	// issued by the configured client CA.
+	TLSClientAuthRequire = "require"
+)
+
+// certCheckInterval is the minimum amount of time between two checks of the
+// certificate files on disk.
+const certCheckInterval = 5 * time.Second
+
+// certificateReloader serves the server certificate during TLS handshakes and
+// reloads it from disk whenever the certificate or key file changes. This
+// allows certificates rotated by cert-manager to be picked up without a
+// restart.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+	logger   *mlog.Logger
+	nowFn    func() time.Time
+
+	mu          sync.RWMutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastCheck   time.Time
+}
+
+func newCertificateReloader(certFile, keyFile string, logger *mlog.Logger) (*certificateReloader, error) {
+	c := &certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+		nowFn:    time.Now,
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate implements the tls.Config.GetCertificate callback.
+func (c *certificateReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.maybeReload()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+func (c *certificateReloader) maybeReload() {
+	now := c.nowFn()
+
+	c.mu.Lock()
+	if now.Sub(c.lastCheck) < certCheckInterval {
+		c.mu.Unlock()
+		return
+	}
+	c.lastCheck = now
+	c.mu.Unlock()
+
+	certModTime, keyModTime, err := c.modTimes()
+	if err != nil {
+		c.logger.Warn("failed to stat TLS certificate files", mlog.Err(err))
+		return
+	}
+
+	c.mu.RLock()
+	changed := !certModTime.Equal(c.certModTime) || !keyModTime.Equal(c.keyModTime)
+	c.mu.RUnlock()
+	if !changed {
+		return
+	}
+
+	// If the files are in the middle of being rotated, the pair might not
+	// match yet. We keep serving the previous certificate and try again on
+	// the next check.
+	if err := c.load(); err != nil {
+		c.logger.Warn("failed to reload TLS certificate, keeping the previous one", mlog.Err(err))
+		return
+	}
+	c.logger.Info("reloaded TLS certificate", mlog.String("cert_file", c.certFile))
+}
+
+func (c *certificateReloader) load() error {
+	certModTime, keyModTime, err := c.modTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load TLS key pair")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.certModTime = certModTime
+	c.keyModTime = keyModTime
+	c.lastCheck = c.nowFn()
+	return nil
+}
+
+func (c *certificateReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Wrap(err, "failed to stat certificate file")
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Wrap(err, "failed to stat key file")
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// configureTLS sets up the certificate reloader and the client certificate
+// authentication on the server's TLS config.
+func (s *Server) configureTLS() error {
+	reloader, err := newCertificateReloader(s.cfg.ServiceSettings.TLSCertFile, s.cfg.ServiceSettings.TLSKeyFile, s.logger)
+	if err != nil {
+		return err
+	}
+	s.srv.TLSConfig.GetCertificate = reloader.GetCertificate
+
+	if s.cfg.ServiceSettings.TLSClientAuth == TLSClientAuthNone {
+		return nil
+	}
+
+	pem, err := os.ReadFile(s.cfg.ServiceSettings.TLSClientCAFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to read client CA file")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.New("no certificates found in client CA file")
+	}
+	s.srv.TLSConfig.ClientCAs = pool
+
+	switch s.cfg.ServiceSettings.TLSClientAuth {
+	case TLSClientAuthVerify:
+		s.srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case TLSClientAuthRequire:
+		s.srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return nil
+}
+
+// validateClientCertificate checks that the verified client certificate of
+// the request, if any, belongs to the installation the request is for.
+func (s *Server) validateClientCertificate(r *http.Request, installationID string) error {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		if s.cfg.ServiceSettings.TLSClientAuth == TLSClientAuthRequire {
+			return errors.New("no client certificate presented")
+		}
+		return nil
+	}
+
+	identity, ok := clientCertificateIdentity(r.TLS.PeerCertificates[0], s.clientIdentityRe)
+	if !ok {
+		return errors.New("could not find an installation ID in the client certificate")
+	}
+	if identity != installationID {
+		return errors.Errorf("client certificate identity does not match; identity=%s, installationID=%s", identity, installationID)
+	}
+
+	s.logger.Debug("client certificate validation passed", mlog.String("installationID", installationID))
+
+	return nil
+}
+
+// clientCertificateIdentity extracts the installation ID from a client
+// certificate. Without a pattern, the subject common name is the installation
+// ID. With a pattern, the common name, DNS names and URIs are tried in order
+// and the first capture group of the first match is used.
+func clientCertificateIdentity(cert *x509.Certificate, re *regexp.Regexp) (string, bool) {
+	if re == nil {
+		return cert.Subject.CommonName, cert.Subject.CommonName != ""
+	}
+
+	candidates := []string{cert.Subject.CommonName}
+	candidates = append(candidates, cert.DNSNames...)
+	for _, u := range cert.URIs {
+		candidates = append(candidates, u.String())
+	}
+
+	for _, candidate := range candidates {
+		if m := re.FindStringSubmatch(candidate); m != nil && m[1] != "" {
+			return m[1], true
+		}
+	}
+	return "", false
+}
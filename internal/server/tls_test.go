@@ -0,0 +1,270 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificate creates a certificate with the given common name, signed by
+// parent if it is not nil, or self-signed otherwise.
+func testCertificate(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, modify func(*x509.Certificate)) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		parent, parentKey = tmpl, key
+	}
+	if modify != nil {
+		modify(tmpl)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert, key
+}
+
+func writeTestKeyPair(t *testing.T, dir, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) (string, string) {
+	t.Helper()
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	require.NoError(t, err)
+
+	return certFile, keyFile
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	logger := mlog.NewTestingLogger(t, os.Stderr)
+
+	first, firstKey := testCertificate(t, "first", nil, nil, nil)
+	certFile, keyFile := writeTestKeyPair(t, dir, "server", first, firstKey)
+
+	reloader, err := newCertificateReloader(certFile, keyFile, logger)
+	require.NoError(t, err)
+
+	now := time.Now()
+	reloader.nowFn = func() time.Time { return now }
+
+	cert, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, first.Raw, cert.Certificate[0])
+
+	second, secondKey := testCertificate(t, "second", nil, nil, nil)
+	writeTestKeyPair(t, dir, "server", second, secondKey)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	require.NoError(t, os.Chtimes(keyFile, later, later))
+
+	t.Run("does not check files before the interval elapses", func(t *testing.T) {
+		cert, err := reloader.GetCertificate(nil)
+		require.NoError(t, err)
+		assert.Equal(t, first.Raw, cert.Certificate[0])
+	})
+
+	t.Run("reloads changed files", func(t *testing.T) {
+		now = now.Add(certCheckInterval)
+		cert, err := reloader.GetCertificate(nil)
+		require.NoError(t, err)
+		assert.Equal(t, second.Raw, cert.Certificate[0])
+	})
+
+	t.Run("keeps the previous certificate on a broken pair", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0600))
+		evenLater := later.Add(time.Minute)
+		require.NoError(t, os.Chtimes(keyFile, evenLater, evenLater))
+
+		now = now.Add(certCheckInterval)
+		cert, err := reloader.GetCertificate(nil)
+		require.NoError(t, err)
+		assert.Equal(t, second.Raw, cert.Certificate[0])
+	})
+
+	t.Run("missing files fail on creation", func(t *testing.T) {
+		_, err := newCertificateReloader(filepath.Join(dir, "nope.crt"), keyFile, logger)
+		require.Error(t, err)
+	})
+}
+
+func TestClientCertificateIdentity(t *testing.T) {
+	u, err := url.Parse("spiffe://cloud/ns/inst2/sa/mattermost")
+	require.NoError(t, err)
+
+	cert, _ := testCertificate(t, "inst1", nil, nil, func(c *x509.Certificate) {
+		c.DNSNames = []string{"mattermost.inst3.svc.cluster.local"}
+		c.URIs = []*url.URL{u}
+	})
+
+	for _, test := range []struct {
+		description string
+		pattern     string
+		expected    string
+		found       bool
+	}{
+		{"common name", "", "inst1", true},
+		{"common name with pattern", `^(inst1)$`, "inst1", true},
+		{"uri", `^spiffe://cloud/ns/([^/]+)/`, "inst2", true},
+		{"dns name", `^mattermost\.([^.]+)\.svc\.cluster\.local$`, "inst3", true},
+		{"no match", `^nothing-(.*)$`, "", false},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			var re *regexp.Regexp
+			if test.pattern != "" {
+				re = regexp.MustCompile(test.pattern)
+			}
+			identity, found := clientCertificateIdentity(cert, re)
+			assert.Equal(t, test.found, found)
+			assert.Equal(t, test.expected, identity)
+		})
+	}
+}
+
+func TestClientCertificateAuthentication(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, caKey := testCertificate(t, "bifrost-ca", nil, nil, nil)
+	caFile, _ := writeTestKeyPair(t, dir, "ca", ca, caKey)
+
+	serverCert, serverKey := testCertificate(t, "bifrost", ca, caKey, func(c *x509.Certificate) {
+		c.DNSNames = []string{"localhost"}
+		c.IPAddresses = nil
+	})
+	serverCertFile, serverKeyFile := writeTestKeyPair(t, dir, "server", serverCert, serverKey)
+
+	clientCert, clientKey := testCertificate(t, "inst1", ca, caKey, nil)
+	otherCA, otherCAKey := testCertificate(t, "other-ca", nil, nil, nil)
+	strangerCert, strangerKey := testCertificate(t, "inst1", otherCA, otherCAKey, nil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	newServer := func(t *testing.T, mode string) *httptest.Server {
+		s := &Server{
+			logger: mlog.NewTestingLogger(t, os.Stderr),
+			cfg: Config{
+				ServiceSettings: ServiceSettings{
+					TLSCertFile:     serverCertFile,
+					TLSKeyFile:      serverKeyFile,
+					TLSClientCAFile: caFile,
+					TLSClientAuth:   mode,
+				},
+			},
+			srv: &http.Server{TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12}},
+		}
+		require.NoError(t, s.configureTLS())
+
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := s.validateClientCertificate(r, "inst1"); err != nil {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		ts.TLS = s.srv.TLSConfig
+		ts.StartTLS()
+		t.Cleanup(ts.Close)
+		return ts
+	}
+
+	get := func(ts *httptest.Server, cert *x509.Certificate, key *ecdsa.PrivateKey) (int, error) {
+		tlsCfg := &tls.Config{RootCAs: roots, ServerName: "localhost", MinVersion: tls.VersionTLS12}
+		if cert != nil {
+			// Always present the certificate, even when it was not issued by
+			// one of the CAs the server asks for.
+			tlsCfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}, nil
+			}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	t.Run("require mode", func(t *testing.T) {
+		ts := newServer(t, TLSClientAuthRequire)
+
+		code, err := get(ts, clientCert, clientKey)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, code)
+
+		_, err = get(ts, nil, nil)
+		assert.Error(t, err)
+
+		_, err = get(ts, strangerCert, strangerKey)
+		assert.Error(t, err)
+	})
+
+	t.Run("verify mode", func(t *testing.T) {
+		ts := newServer(t, TLSClientAuthVerify)
+
+		code, err := get(ts, clientCert, clientKey)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, code)
+
+		code, err = get(ts, nil, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, code)
+
+		_, err = get(ts, strangerCert, strangerKey)
+		assert.Error(t, err)
+	})
+
+	t.Run("identity mismatch", func(t *testing.T) {
+		ts := newServer(t, TLSClientAuthRequire)
+
+		otherInstallation, otherKey := testCertificate(t, "inst2", ca, caKey, nil)
+		code, err := get(ts, otherInstallation, otherKey)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+}
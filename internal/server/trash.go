@@ -0,0 +1,509 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+// trashPrefix is the prefix of the trash within the prefix of every
+// installation. Trashed objects are kept under the time they were deleted
+// at, which sorts the trash by deletion time:
+//
+//	<installation>/.trash/<deleted at>/<key within the installation>
+const trashPrefix = ".trash/"
+
+// trashTimeFormat is the format of the deletion time in trash keys. It has a
+// fixed width, so that the keys sort in the order of deletion.
+const trashTimeFormat = "20060102T150405.000000000Z"
+
+// trashConcurrency is the number of objects of a DeleteObjects request that
+// are moved to the trash at the same time.
+const trashConcurrency = 8
+
+// maxListingBodySize bounds the listings filtered by Bifrost, which have at
+// most 1000 keys of at most 1024 bytes along with their details.
+const maxListingBodySize = 16 * 1024 * 1024
+
+// TrashedObject is an object in the trash of an installation.
+type TrashedObject struct {
+	Key       string    `json:"key"`
+	TrashKey  string    `json:"trash_key"`
+	DeletedAt time.Time `json:"deleted_at"`
+	Size      int64     `json:"size"`
+}
+
+// TrashPurgeReport sums up the objects purged from the trash by a run of the
+// trash janitor, per installation.
+type TrashPurgeReport struct {
+	Installations map[string]*TrashPurgeStats
+}
+
+// TrashPurgeStats are the objects purged from the trash of an installation.
+type TrashPurgeStats struct {
+	Objects int
+	Bytes   int64
+}
+
+// Total returns the number of purged objects and their size over all
+// installations.
+func (r *TrashPurgeReport) Total() TrashPurgeStats {
+	var total TrashPurgeStats
+	for _, stats := range r.Installations {
+		total.Objects += stats.Objects
+		total.Bytes += stats.Bytes
+	}
+	return total
+}
+
+// trashKey returns the key the object with the given key is kept at in the
+// trash of its installation.
+func trashKey(key string, deletedAt time.Time) string {
+	installationID, name, _ := strings.Cut(key, "/")
+	return installationID + "/" + trashPrefix + deletedAt.UTC().Format(trashTimeFormat) + "/" + name
+}
+
+// parseTrashKey returns the original key of a trashed object and the time it
+// was deleted at.
+func parseTrashKey(key string) (string, time.Time, bool) {
+	installationID, rest, _ := strings.Cut(key, "/")
+	rest, ok := strings.CutPrefix(rest, trashPrefix)
+	if !ok {
+		return "", time.Time{}, false
+	}
+	stamp, name, ok := strings.Cut(rest, "/")
+	if !ok || name == "" {
+		return "", time.Time{}, false
+	}
+	deletedAt, err := time.Parse(trashTimeFormat, stamp)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return installationID + "/" + name, deletedAt, true
+}
+
+// isTrashKey reports whether the key is within the trash of an installation.
+func isTrashKey(key string) bool {
+	_, rest, ok := strings.Cut(key, "/")
+	return ok && strings.HasPrefix(rest, trashPrefix)
+}
+
+// prepareTrash keeps the trash out of the reach of clients, and moves the
+// objects deleted by DeleteObject and DeleteObjects requests to the trash
+// before the request is sent. The deletion of a specific version of an object
+// is left alone, as are objects outside of any installation. If an object
+// can't be moved to the trash, the request fails without deleting anything.
+func (s *Server) prepareTrash(r *http.Request, op s3Request) error {
+	var keys []string
+	switch op.Operation {
+	case opDeleteObjects:
+		request, err := readDeleteObjectsRequest(r)
+		if err != nil {
+			return err
+		}
+		for _, object := range request.Objects {
+			if isTrashKey(object.Key) {
+				return errTrashAccessDenied
+			}
+			if object.VersionId == "" {
+				keys = append(keys, object.Key)
+			}
+		}
+	case opCopyObject, opUploadPartCopy:
+		source, err := s.copySourceKey(r)
+		if err != nil {
+			return err
+		}
+		if isTrashKey(source) {
+			return errTrashAccessDenied
+		}
+	case opDeleteObject:
+		if r.URL.Query().Get("versionId") == "" {
+			keys = append(keys, op.Key)
+		}
+	}
+	if isTrashKey(op.Key) {
+		return errTrashAccessDenied
+	}
+
+	deletedAt := time.Now()
+	sem := make(chan struct{}, trashConcurrency)
+	errs := make(chan error, len(keys))
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs <- s.trashObject(r.Context(), key, deletedAt)
+		}(key)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errTrashAccessDenied is returned to clients that try to reach the trash.
+var errTrashAccessDenied = &s3Error{StatusCode: http.StatusForbidden, Code: "AccessDenied", Message: "Objects in the trash can only be reached through the admin API."}
+
+// trashObject copies the object to the trash of its installation, along with
+// its metadata, so that it is kept as it is stored, encrypted or compressed.
+// Objects that don't exist have nothing to keep.
+func (s *Server) trashObject(ctx context.Context, key string, deletedAt time.Time) error {
+	installationID, _, ok := strings.Cut(key, "/")
+	if !ok {
+		return nil
+	}
+
+	header, size, err := s.headObject(ctx, "/"+key)
+	if isS3ErrorCode(err, "404") {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to move %s to the trash", key)
+	}
+
+	copyHeader := objectMetadata(header)
+	copyHeader.Set("X-Amz-Metadata-Directive", "REPLACE")
+	copyHeader.Set("X-Amz-Copy-Source-If-Match", header.Get("ETag"))
+	dst := trashKey(key, deletedAt)
+	err = s.copyObject(ctx, "/"+key, "/"+dst, size, copyHeader)
+	switch {
+	case isS3ErrorCode(err, "NoSuchKey"):
+		// The object was deleted in the meantime.
+		return nil
+	case isS3ErrorCode(err, "PreconditionFailed"):
+		return &s3Error{StatusCode: http.StatusConflict, Code: "OperationAborted", Message: "The object changed while it was moved to the trash. Please try again."}
+	case err != nil:
+		return errors.Wrapf(err, "failed to move %s to the trash", key)
+	}
+
+	s.metrics.incTrashedObject(installationID)
+	s.logger.Debug("moved object to the trash", mlog.String("key", key), mlog.String("trash_key", dst))
+	return nil
+}
+
+// fetchListing sends a ListObjects or ListObjectsV2 request, and removes the
+// trash from the listing. Pages may hold fewer keys than asked for, or none
+// at all, when some of them were in the trash.
+func (s *Server) fetchListing(r *http.Request) (*http.Response, error) {
+	query := r.URL.Query()
+	urlEncoded := query.Get("encoding-type") == "url"
+	listV2 := query.Get("list-type") == "2"
+
+	resp, err := s.doUpstream(r)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxListingBodySize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read listing")
+	}
+	if len(body) > maxListingBodySize {
+		return nil, errors.New("listing is too large to be filtered")
+	}
+	if body, err = removeTrashFromListing(body, urlEncoded, listV2); err != nil {
+		return nil, err
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return resp, nil
+}
+
+// removeTrashFromListing removes the objects and the common prefixes in the
+// trash from the body of a listing, and updates its key count. The rest of
+// the body is kept byte for byte. Clients continue truncated ListObjects
+// listings after the last key they got, unless there is a next marker, which
+// is added so that they don't list the removed keys again.
+func removeTrashFromListing(body []byte, urlEncoded, listV2 bool) ([]byte, error) {
+	type span struct{ start, end int64 }
+	var removed []span
+	var keyCount *span
+	var keys int
+	var lastKey string
+	var truncated, nextMarker bool
+	var end int64
+
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	depth := 0
+	for {
+		start := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode listing")
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if depth != 1 {
+				depth++
+				continue
+			}
+			switch t.Name.Local {
+			case "Contents", "CommonPrefixes":
+				var entry struct {
+					Key    string
+					Prefix string
+				}
+				if err := decoder.DecodeElement(&entry, &t); err != nil {
+					return nil, errors.Wrap(err, "failed to decode listing")
+				}
+				key := entry.Key + entry.Prefix
+				if entry.Key != "" {
+					lastKey = entry.Key
+				}
+				if urlEncoded {
+					if key, err = url.QueryUnescape(key); err != nil {
+						return nil, errors.Wrap(err, "failed to decode listing key")
+					}
+				}
+				if isTrashKey(key) {
+					removed = append(removed, span{start, decoder.InputOffset()})
+				} else {
+					keys++
+				}
+			case "KeyCount":
+				if err := decoder.Skip(); err != nil {
+					return nil, errors.Wrap(err, "failed to decode listing")
+				}
+				keyCount = &span{start, decoder.InputOffset()}
+			case "IsTruncated":
+				var value bool
+				if err := decoder.DecodeElement(&value, &t); err != nil {
+					return nil, errors.Wrap(err, "failed to decode listing")
+				}
+				truncated = value
+			case "NextMarker":
+				nextMarker = true
+				depth++
+			default:
+				depth++
+			}
+		case xml.EndElement:
+			depth--
+			if depth == 0 {
+				end = start
+			}
+		}
+	}
+
+	if len(removed) == 0 {
+		return body, nil
+	}
+	if keyCount != nil {
+		removed = append(removed, *keyCount)
+		sort.Slice(removed, func(i, j int) bool { return removed[i].start < removed[j].start })
+	}
+
+	var filtered bytes.Buffer
+	var offset int64
+	for _, sp := range removed {
+		filtered.Write(body[offset:sp.start])
+		if keyCount != nil && sp == *keyCount {
+			filtered.WriteString("<KeyCount>" + strconv.Itoa(keys) + "</KeyCount>")
+		}
+		offset = sp.end
+	}
+	filtered.Write(body[offset:end])
+	if !listV2 && truncated && !nextMarker && lastKey != "" {
+		filtered.WriteString("<NextMarker>")
+		if err := xml.EscapeText(&filtered, []byte(lastKey)); err != nil {
+			return nil, err
+		}
+		filtered.WriteString("</NextMarker>")
+	}
+	filtered.Write(body[end:])
+	return filtered.Bytes(), nil
+}
+
+// ListTrash returns the objects in the trash of the installation, from the
+// oldest to the most recently deleted.
+func (s *Server) ListTrash(ctx context.Context, installationID string) ([]TrashedObject, error) {
+	objects := []TrashedObject{}
+	err := s.walkTrash(ctx, installationID, func(object TrashedObject) bool {
+		objects = append(objects, object)
+		return true
+	})
+	return objects, err
+}
+
+// walkTrash calls fn with the objects in the trash of the installation, from
+// the oldest to the most recently deleted, until fn returns false. Objects
+// whose keys Bifrost didn't make are skipped.
+func (s *Server) walkTrash(ctx context.Context, installationID string, fn func(object TrashedObject) bool) error {
+	var token string
+	for {
+		page, err := s.listObjectsV2(ctx, installationID+"/"+trashPrefix, "", "", token)
+		if err != nil {
+			return errors.Wrapf(err, "failed to list the trash of %s", installationID)
+		}
+		for _, object := range page.Contents {
+			key, deletedAt, ok := parseTrashKey(object.Key)
+			if !ok {
+				continue
+			}
+			if !fn(TrashedObject{Key: key, TrashKey: object.Key, DeletedAt: deletedAt, Size: object.Size}) {
+				return nil
+			}
+		}
+		if !page.IsTruncated {
+			return nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// RestoreTrashedObject copies an object in the trash of the installation back
+// to its original key, and removes it from the trash. Unless overwrite is
+// set, an object that was created at the original key since is kept, and
+// the restore fails.
+func (s *Server) RestoreTrashedObject(ctx context.Context, installationID, trashedKey string, overwrite bool) (*TrashedObject, error) {
+	key, deletedAt, ok := parseTrashKey(trashedKey)
+	if !ok || !strings.HasPrefix(trashedKey, installationID+"/") {
+		return nil, &s3Error{StatusCode: http.StatusBadRequest, Code: "InvalidArgument", Message: trashedKey + " is not in the trash of " + installationID + "."}
+	}
+
+	header, size, err := s.headObject(ctx, "/"+trashedKey)
+	if isS3ErrorCode(err, "404") {
+		return nil, &s3Error{StatusCode: http.StatusNotFound, Code: "NoSuchKey", Message: trashedKey + " is not in the trash."}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !overwrite {
+		_, _, err := s.headObject(ctx, "/"+key)
+		if err == nil {
+			return nil, &s3Error{StatusCode: http.StatusConflict, Code: "ObjectExists", Message: key + " exists, and is only replaced with overwrite."}
+		}
+		if !isS3ErrorCode(err, "404") {
+			return nil, err
+		}
+	}
+
+	copyHeader := objectMetadata(header)
+	copyHeader.Set("X-Amz-Metadata-Directive", "REPLACE")
+	copyHeader.Set("X-Amz-Copy-Source-If-Match", header.Get("ETag"))
+	if err := s.copyObject(ctx, "/"+trashedKey, "/"+key, size, copyHeader); err != nil {
+		return nil, errors.Wrapf(err, "failed to restore %s", trashedKey)
+	}
+	if err := s.deleteObject(ctx, "/"+trashedKey); err != nil {
+		return nil, errors.Wrapf(err, "failed to remove %s from the trash", trashedKey)
+	}
+
+	if s.events != nil {
+		record := s.events.newRecord(eventObjectCreatedCopy, key)
+		if err := s.describeEventObject(ctx, key, &record.S3.Object); err != nil {
+			s.logger.Warn("failed to get the size of a restored object", mlog.String("key", key), mlog.Err(err))
+		}
+		s.events.emit(record)
+	}
+
+	s.logger.Info("restored object from the trash", mlog.String("installation_id", installationID), mlog.String("key", key), mlog.String("trash_key", trashedKey))
+	return &TrashedObject{Key: key, TrashKey: trashedKey, DeletedAt: deletedAt, Size: size}, nil
+}
+
+func (s *Server) runTrashJanitor(ctx context.Context) {
+	settings := s.cfg.TrashSettings
+	ticker := time.NewTicker(time.Duration(settings.PurgeIntervalSecs) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		report, err := s.PurgeTrash(ctx, time.Duration(settings.RetentionSecs)*time.Second)
+		if err != nil && ctx.Err() == nil {
+			s.logger.Error("failed to purge the trash", mlog.Err(err))
+		} else if total := report.Total(); total.Objects > 0 {
+			s.logger.Info("purged the trash", mlog.Int("objects", total.Objects), mlog.Int64("bytes", total.Bytes))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PurgeTrash deletes the objects that were deleted more than retention ago
+// from the trash of every installation. The installations are the top level
+// prefixes of the bucket. The report covers the objects purged before an
+// error, if any.
+func (s *Server) PurgeTrash(ctx context.Context, retention time.Duration) (*TrashPurgeReport, error) {
+	report := &TrashPurgeReport{Installations: make(map[string]*TrashPurgeStats)}
+	cutoff := time.Now().Add(-retention)
+
+	var prefixes []string
+	var token string
+	for {
+		page, err := s.listObjectsV2(ctx, "", "/", "", token)
+		if err != nil {
+			return report, errors.Wrap(err, "failed to list installations")
+		}
+		for _, prefix := range page.CommonPrefixes {
+			prefixes = append(prefixes, prefix.Prefix)
+		}
+		if !page.IsTruncated {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+
+	for _, prefix := range prefixes {
+		installationID := strings.TrimSuffix(prefix, "/")
+		var deleteErr error
+		err := s.walkTrash(ctx, installationID, func(object TrashedObject) bool {
+			if !object.DeletedAt.Before(cutoff) {
+				return false
+			}
+			if deleteErr = s.deleteObject(ctx, "/"+object.TrashKey); deleteErr != nil {
+				return false
+			}
+			s.logger.Debug("purged object from the trash", mlog.String("installation_id", installationID), mlog.String("trash_key", object.TrashKey))
+
+			stats, ok := report.Installations[installationID]
+			if !ok {
+				stats = &TrashPurgeStats{}
+				report.Installations[installationID] = stats
+			}
+			stats.Objects++
+			stats.Bytes += object.Size
+			s.metrics.incTrashPurgedObject(installationID)
+			return true
+		})
+		if err == nil {
+			err = deleteErr
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
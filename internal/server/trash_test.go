@@ -0,0 +1,275 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrashKey(t *testing.T) {
+	deletedAt := time.Date(2024, 5, 1, 12, 30, 15, 42, time.UTC)
+	key := trashKey("inst/data/file.txt", deletedAt)
+	assert.Equal(t, "inst/.trash/20240501T123015.000000042Z/data/file.txt", key)
+	assert.True(t, isTrashKey(key))
+
+	original, parsed, ok := parseTrashKey(key)
+	require.True(t, ok)
+	assert.Equal(t, "inst/data/file.txt", original)
+	assert.True(t, deletedAt.Equal(parsed))
+
+	// Keys sort in the order of deletion.
+	assert.Less(t, trashKey("inst/b", deletedAt), trashKey("inst/a", deletedAt.Add(time.Nanosecond)))
+
+	for _, key := range []string{"inst/file", "inst/.trash", ".trash/a", "inst/.trash/notatime/a", "inst/.trash/20240501T123015.000000042Z/"} {
+		_, _, ok := parseTrashKey(key)
+		assert.False(t, ok, key)
+	}
+	assert.False(t, isTrashKey("inst/data/.trash/a"))
+	assert.False(t, isTrashKey(".trash/a"))
+}
+
+func TestRemoveTrashFromListing(t *testing.T) {
+	t.Run("objects and prefixes", func(t *testing.T) {
+		body := `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>bucket</Name><KeyCount>4</KeyCount>
+<Contents><Key>inst/.trash/20240501T123015.000000042Z/a</Key><Size>1</Size></Contents>
+<Contents><Key>inst/a</Key><Size>1</Size></Contents>
+<CommonPrefixes><Prefix>inst/.trash/</Prefix></CommonPrefixes>
+<CommonPrefixes><Prefix>inst/data/</Prefix></CommonPrefixes>
+<IsTruncated>false</IsTruncated></ListBucketResult>`
+
+		filtered, err := removeTrashFromListing([]byte(body), false, true)
+		require.NoError(t, err)
+		assert.Equal(t, `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>bucket</Name><KeyCount>2</KeyCount>
+
+<Contents><Key>inst/a</Key><Size>1</Size></Contents>
+
+<CommonPrefixes><Prefix>inst/data/</Prefix></CommonPrefixes>
+<IsTruncated>false</IsTruncated></ListBucketResult>`, string(filtered))
+	})
+
+	t.Run("url encoding", func(t *testing.T) {
+		body := `<ListBucketResult><Contents><Key>inst%2F.trash%2F20240501T123015.000000042Z%2Fa</Key></Contents><Contents><Key>inst%2Fa</Key></Contents></ListBucketResult>`
+		filtered, err := removeTrashFromListing([]byte(body), true, true)
+		require.NoError(t, err)
+		assert.Equal(t, `<ListBucketResult><Contents><Key>inst%2Fa</Key></Contents></ListBucketResult>`, string(filtered))
+	})
+
+	t.Run("no trash", func(t *testing.T) {
+		body := `<ListBucketResult><KeyCount>1</KeyCount><Contents><Key>inst/a</Key></Contents></ListBucketResult>`
+		filtered, err := removeTrashFromListing([]byte(body), false, true)
+		require.NoError(t, err)
+		assert.Equal(t, body, string(filtered))
+	})
+
+	t.Run("next marker", func(t *testing.T) {
+		body := `<ListBucketResult><IsTruncated>true</IsTruncated><Contents><Key>inst/a</Key></Contents><Contents><Key>inst/.trash/20240501T123015.000000042Z/a&amp;b</Key></Contents></ListBucketResult>`
+		filtered, err := removeTrashFromListing([]byte(body), false, false)
+		require.NoError(t, err)
+		assert.Equal(t, `<ListBucketResult><IsTruncated>true</IsTruncated><Contents><Key>inst/a</Key></Contents><NextMarker>inst/.trash/20240501T123015.000000042Z/a&amp;b</NextMarker></ListBucketResult>`, string(filtered))
+
+		body = `<ListBucketResult><IsTruncated>true</IsTruncated><NextMarker>inst/.trash/</NextMarker><CommonPrefixes><Prefix>inst/.trash/</Prefix></CommonPrefixes></ListBucketResult>`
+		filtered, err = removeTrashFromListing([]byte(body), false, false)
+		require.NoError(t, err)
+		assert.Equal(t, `<ListBucketResult><IsTruncated>true</IsTruncated><NextMarker>inst/.trash/</NextMarker></ListBucketResult>`, string(filtered))
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		_, err := removeTrashFromListing([]byte(`<ListBucketResult><Contents>`), false, true)
+		assert.Error(t, err)
+	})
+}
+
+func TestTrash(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{TrashSettings: TrashSettings{Enable: true, RetentionSecs: 3600, PurgeIntervalSecs: 60}})
+	handler := s.handler()
+
+	fake.put("inst/a", []byte("data a"), http.Header{"Content-Type": {"text/plain"}, "X-Amz-Meta-Owner": {"alice"}})
+	fake.put("inst/b", []byte("data b"), nil)
+	fake.put("inst/c", []byte("data c"), nil)
+
+	resp := serveRequest(handler, "DELETE", "/inst/a", nil, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Nil(t, fake.object("inst/a"))
+
+	body := `<Delete><Object><Key>inst/b</Key></Object><Object><Key>inst/missing</Key></Object></Delete>`
+	resp = serveRequest(handler, "POST", "?delete", []byte(body), nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, fake.object("inst/b"))
+
+	trashed, err := s.ListTrash(context.Background(), "inst")
+	require.NoError(t, err)
+	require.Len(t, trashed, 2)
+	assert.Equal(t, "inst/a", trashed[0].Key)
+	assert.Equal(t, "inst/b", trashed[1].Key)
+	assert.Equal(t, int64(6), trashed[0].Size)
+	assert.WithinDuration(t, time.Now(), trashed[0].DeletedAt, time.Minute)
+
+	// The object is kept with its metadata.
+	obj := fake.object(trashed[0].TrashKey)
+	require.NotNil(t, obj)
+	assert.Equal(t, "data a", string(obj.data))
+	assert.Equal(t, "alice", obj.header.Get("X-Amz-Meta-Owner"))
+	assert.Equal(t, "text/plain", obj.header.Get("Content-Type"))
+
+	t.Run("hidden from listings", func(t *testing.T) {
+		// The fake returns two keys per page, the first one holding only
+		// the trash.
+		var keys []string
+		var token string
+		for {
+			resp := serveRequest(handler, "GET", "?list-type=2&prefix=inst/&continuation-token="+token, nil, nil)
+			var page listObjectsV2Result
+			require.NoError(t, xml.NewDecoder(resp.Body).Decode(&page))
+			resp.Body.Close()
+			for _, object := range page.Contents {
+				keys = append(keys, object.Key)
+			}
+			if !page.IsTruncated {
+				break
+			}
+			token = page.NextContinuationToken
+		}
+		assert.Equal(t, []string{"inst/c"}, keys)
+
+		resp := serveRequest(handler, "GET", "?list-type=2&prefix=inst/&delimiter=/", nil, nil)
+		listing, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.NotContains(t, string(listing), ".trash")
+		assert.Contains(t, string(listing), "<KeyCount>1</KeyCount>")
+	})
+
+	t.Run("out of reach of clients", func(t *testing.T) {
+		for _, test := range []struct {
+			method string
+			path   string
+			body   string
+			header http.Header
+		}{
+			{"GET", "/" + trashed[0].TrashKey, "", nil},
+			{"PUT", "/" + trashed[0].TrashKey, "data", nil},
+			{"DELETE", "/" + trashed[0].TrashKey, "", nil},
+			{"PUT", "/inst/copy", "", http.Header{"X-Amz-Copy-Source": {"/agnivatest/" + trashed[0].TrashKey}}},
+			{"POST", "?delete", `<Delete><Object><Key>` + trashed[0].TrashKey + `</Key></Object></Delete>`, nil},
+		} {
+			resp := serveRequest(handler, test.method, test.path, []byte(test.body), test.header)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode, "%s %s", test.method, test.path)
+		}
+		assert.NotNil(t, fake.object(trashed[0].TrashKey))
+		assert.Nil(t, fake.object("inst/copy"))
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		restored, err := s.RestoreTrashedObject(context.Background(), "inst", trashed[0].TrashKey, false)
+		require.NoError(t, err)
+		assert.Equal(t, "inst/a", restored.Key)
+		obj := fake.object("inst/a")
+		require.NotNil(t, obj)
+		assert.Equal(t, "data a", string(obj.data))
+		assert.Equal(t, "alice", obj.header.Get("X-Amz-Meta-Owner"))
+		assert.Nil(t, fake.object(trashed[0].TrashKey))
+
+		_, err = s.RestoreTrashedObject(context.Background(), "inst", trashed[0].TrashKey, false)
+		assert.True(t, isS3ErrorCode(err, "NoSuchKey"))
+		_, err = s.RestoreTrashedObject(context.Background(), "other", trashed[1].TrashKey, false)
+		assert.True(t, isS3ErrorCode(err, "InvalidArgument"))
+
+		fake.put("inst/b", []byte("new b"), nil)
+		_, err = s.RestoreTrashedObject(context.Background(), "inst", trashed[1].TrashKey, false)
+		assert.True(t, isS3ErrorCode(err, "ObjectExists"))
+		assert.Equal(t, "new b", string(fake.object("inst/b").data))
+
+		_, err = s.RestoreTrashedObject(context.Background(), "inst", trashed[1].TrashKey, true)
+		require.NoError(t, err)
+		assert.Equal(t, "data b", string(fake.object("inst/b").data))
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		now := time.Now()
+		fake.put(trashKey("inst/old", now.Add(-2*time.Hour)), []byte("old"), nil)
+		fake.put(trashKey("inst/recent", now.Add(-time.Minute)), []byte("recent"), nil)
+		fake.put(trashKey("other/old", now.Add(-3*time.Hour)), []byte("other old"), nil)
+
+		report, err := s.PurgeTrash(context.Background(), time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, TrashPurgeStats{Objects: 2, Bytes: 12}, report.Total())
+		assert.Equal(t, 1, report.Installations["inst"].Objects)
+
+		trashed, err := s.ListTrash(context.Background(), "inst")
+		require.NoError(t, err)
+		require.Len(t, trashed, 1)
+		assert.Equal(t, "inst/recent", trashed[0].Key)
+		trashed, err = s.ListTrash(context.Background(), "other")
+		require.NoError(t, err)
+		assert.Empty(t, trashed)
+	})
+}
+
+func TestTrashDisabled(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{})
+	handler := s.handler()
+
+	fake.put("inst/a", []byte("data"), nil)
+	resp := serveRequest(handler, "DELETE", "/inst/a", nil, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	trashed, err := s.ListTrash(context.Background(), "inst")
+	require.NoError(t, err)
+	assert.Empty(t, trashed)
+}
+
+func TestAdminTrash(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	s := newFakeS3Server(t, ts, Config{TrashSettings: TrashSettings{Enable: true, RetentionSecs: 3600, PurgeIntervalSecs: 60}})
+	handler := s.handler()
+	router := newAdminRouter(s)
+
+	fake.put("inst/a", []byte("data"), nil)
+	resp := serveRequest(handler, "DELETE", "/inst/a", nil, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/installations/inst/trash", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var trashed []map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &trashed))
+	require.Len(t, trashed, 1)
+	assert.Equal(t, "inst/a", trashed[0]["key"])
+	trashKey := trashed[0]["trash_key"].(string)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/installations/inst/trash/restore?trash_key=inst/a", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/installations/inst/trash/restore?trash_key="+trashKey, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), `"key":"inst/a"`))
+	assert.NotNil(t, fake.object("inst/a"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/installations/inst/trash", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "[]\n", w.Body.String())
+}
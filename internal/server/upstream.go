@@ -0,0 +1,259 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+// Load balancing strategies between the S3 endpoints.
+const (
+	LoadBalancingRoundRobin       = "round-robin"
+	LoadBalancingLeastConnections = "least-connections"
+)
+
+const (
+	defaultOutlierConsecutiveErrors = 5
+	defaultOutlierEjectionSecs      = 30
+	defaultHealthCheckTimeoutSecs   = 5
+)
+
+// upstream is a single S3 endpoint that requests can be sent to.
+type upstream struct {
+	endpoint string
+	host     string
+	active   int64
+
+	// The fields below are protected by the pool's mutex.
+	unhealthy           bool
+	consecutiveFailures int
+	ejectedUntil        time.Time
+}
+
+// upstreamPool balances requests between the configured S3 endpoints. An
+// endpoint is skipped while it fails active health checks or while it is
+// ejected after consecutive connection errors or 5xx responses.
+type upstreamPool struct {
+	strategy         string
+	maxFailures      int
+	ejectionDuration time.Duration
+	nowFn            func() time.Time
+
+	next uint64
+
+	mu        sync.Mutex
+	upstreams []*upstream
+}
+
+// endpoints returns the configured S3 endpoints, falling back to the single
+// Endpoint setting.
+func (settings AmazonS3Settings) endpoints() []string {
+	if len(settings.Endpoints) > 0 {
+		return settings.Endpoints
+	}
+	return []string{settings.Endpoint}
+}
+
+func (s *Server) newUpstreamPool() *upstreamPool {
+	settings := s.cfg.S3Settings
+
+	p := &upstreamPool{
+		strategy:         settings.LoadBalancing,
+		maxFailures:      settings.OutlierConsecutiveErrors,
+		ejectionDuration: time.Duration(settings.OutlierEjectionSecs) * time.Second,
+		nowFn:            time.Now,
+	}
+	if p.maxFailures == 0 {
+		p.maxFailures = defaultOutlierConsecutiveErrors
+	}
+	if p.ejectionDuration == 0 {
+		p.ejectionDuration = defaultOutlierEjectionSecs * time.Second
+	}
+
+	for _, endpoint := range settings.endpoints() {
+		p.upstreams = append(p.upstreams, &upstream{
+			endpoint: endpoint,
+			host:     s.getHostFn(settings.Bucket, endpoint),
+		})
+	}
+
+	return p
+}
+
+// pick returns the upstream to send the next request to, skipping the ones
+// in exclude. If every upstream is down, all of them are considered again,
+// since failing open is better than refusing every request because of a
+// broken health check. The caller must call done once the request finishes.
+func (p *upstreamPool) pick(exclude map[*upstream]bool) *upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.nowFn()
+	var candidates []*upstream
+	for _, u := range p.upstreams {
+		if !exclude[u] && !u.unhealthy && !now.Before(u.ejectedUntil) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, u := range p.upstreams {
+			if !exclude[u] {
+				candidates = append(candidates, u)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var chosen *upstream
+	switch p.strategy {
+	case LoadBalancingLeastConnections:
+		for _, u := range candidates {
+			if chosen == nil || atomic.LoadInt64(&u.active) < atomic.LoadInt64(&chosen.active) {
+				chosen = u
+			}
+		}
+	default:
+		chosen = candidates[p.next%uint64(len(candidates))]
+		p.next++
+	}
+
+	atomic.AddInt64(&chosen.active, 1)
+	return chosen
+}
+
+// done records the outcome of a request sent to the upstream, and releases
+// it.
+func (p *upstreamPool) done(u *upstream, statusCode int, err error) {
+	p.record(u, statusCode, err)
+	p.release(u)
+}
+
+// release ends a request picked for the upstream, which no longer counts
+// towards its active requests.
+func (p *upstreamPool) release(u *upstream) {
+	atomic.AddInt64(&u.active, -1)
+}
+
+// record records the outcome of a request sent to the upstream. A connection
+// error or a 5xx response counts as a failure for outlier ejection.
+func (p *upstreamPool) record(u *upstream, statusCode int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil && statusCode < http.StatusInternalServerError {
+		u.consecutiveFailures = 0
+		return
+	}
+
+	u.consecutiveFailures++
+	if u.consecutiveFailures >= p.maxFailures {
+		u.consecutiveFailures = 0
+		u.ejectedUntil = p.nowFn().Add(p.ejectionDuration)
+	}
+}
+
+// upstreamBody is the body of a response of an upstream, which releases the
+// upstream once it is closed, so that the responses still being streamed
+// count towards the active requests of their upstream.
+type upstreamBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *upstreamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+func (p *upstreamPool) setHealthy(u *upstream, healthy bool) (changed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	changed = u.unhealthy == healthy
+	u.unhealthy = !healthy
+	return changed
+}
+
+func (p *upstreamPool) list() []*upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]*upstream(nil), p.upstreams...)
+}
+
+// runHealthChecks probes every upstream with a signed HeadBucket request at
+// the configured interval until the context is cancelled.
+func (s *Server) runHealthChecks(ctx context.Context) {
+	interval := time.Duration(s.cfg.S3Settings.HealthCheckIntervalSecs) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.checkUpstreams(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) checkUpstreams(ctx context.Context) {
+	for _, u := range s.upstreams.list() {
+		err := s.headBucket(ctx, u)
+		healthy := err == nil
+		if s.upstreams.setHealthy(u, healthy) {
+			if healthy {
+				s.logger.Info("S3 endpoint is healthy again", mlog.String("endpoint", u.endpoint))
+			} else {
+				s.logger.Warn("S3 endpoint failed its health check", mlog.String("endpoint", u.endpoint), mlog.Err(err))
+			}
+		}
+		s.metrics.setUpstreamHealth(u.endpoint, healthy)
+	}
+}
+
+// headBucket sends a signed HeadBucket request to the upstream. Any response
+// below 500 means that the endpoint is up, even if it is a permission error.
+func (s *Server) headBucket(ctx context.Context, u *upstream) error {
+	timeout := time.Duration(s.cfg.S3Settings.HealthCheckTimeoutSecs) * time.Second
+	if timeout == 0 {
+		timeout = defaultHealthCheckTimeoutSecs * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.cfg.S3Settings.Scheme+"://"+u.host+"/", nil)
+	if err != nil {
+		return err
+	}
+	req, err = s.signRequest(req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return errors.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
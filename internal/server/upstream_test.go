@@ -0,0 +1,196 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPool(strategy string, endpoints ...string) *upstreamPool {
+	s := &Server{
+		cfg: Config{S3Settings: AmazonS3Settings{
+			Bucket:                   "bucket",
+			Endpoints:                endpoints,
+			LoadBalancing:            strategy,
+			OutlierConsecutiveErrors: 2,
+		}},
+	}
+	s.getHostFn = s.getHost
+	return s.newUpstreamPool()
+}
+
+func TestUpstreamPool(t *testing.T) {
+	t.Run("single endpoint setting", func(t *testing.T) {
+		s := &Server{cfg: Config{S3Settings: AmazonS3Settings{Bucket: "bucket", Endpoint: "s3.amazonaws.com"}}}
+		s.getHostFn = s.getHost
+		p := s.newUpstreamPool()
+		require.Len(t, p.list(), 1)
+		assert.Equal(t, "bucket.s3.amazonaws.com", p.list()[0].host)
+	})
+
+	t.Run("round robin", func(t *testing.T) {
+		p := newTestPool(LoadBalancingRoundRobin, "a", "b", "c")
+		var hosts []string
+		for i := 0; i < 4; i++ {
+			u := p.pick(nil)
+			hosts = append(hosts, u.host)
+			p.done(u, http.StatusOK, nil)
+		}
+		assert.Equal(t, []string{"bucket.a", "bucket.b", "bucket.c", "bucket.a"}, hosts)
+	})
+
+	t.Run("least connections", func(t *testing.T) {
+		p := newTestPool(LoadBalancingLeastConnections, "a", "b")
+		first := p.pick(nil)
+		second := p.pick(nil)
+		assert.NotEqual(t, first, second)
+
+		p.done(second, http.StatusOK, nil)
+		assert.Equal(t, second, p.pick(nil))
+	})
+
+	t.Run("outlier ejection", func(t *testing.T) {
+		p := newTestPool(LoadBalancingRoundRobin, "a", "b")
+		now := time.Now()
+		p.nowFn = func() time.Time { return now }
+		a := p.list()[0]
+
+		p.done(p.pick(map[*upstream]bool{p.list()[1]: true}), http.StatusServiceUnavailable, nil)
+		p.done(p.pick(map[*upstream]bool{p.list()[1]: true}), 0, errors.New("connection refused"))
+
+		for i := 0; i < 3; i++ {
+			u := p.pick(nil)
+			assert.NotEqual(t, a, u)
+			p.done(u, http.StatusOK, nil)
+		}
+
+		now = now.Add(defaultOutlierEjectionSecs * time.Second)
+		seen := map[*upstream]bool{}
+		for i := 0; i < 2; i++ {
+			u := p.pick(nil)
+			seen[u] = true
+			p.done(u, http.StatusOK, nil)
+		}
+		assert.True(t, seen[a])
+	})
+
+	t.Run("successes reset the failure count", func(t *testing.T) {
+		p := newTestPool(LoadBalancingRoundRobin, "a")
+		a := p.list()[0]
+		p.done(p.pick(nil), http.StatusInternalServerError, nil)
+		p.done(p.pick(nil), http.StatusNotFound, nil)
+		p.done(p.pick(nil), http.StatusInternalServerError, nil)
+		assert.True(t, a.ejectedUntil.IsZero())
+	})
+
+	t.Run("fails open when every endpoint is down", func(t *testing.T) {
+		p := newTestPool(LoadBalancingRoundRobin, "a", "b")
+		for _, u := range p.list() {
+			p.setHealthy(u, false)
+		}
+		assert.NotNil(t, p.pick(nil))
+	})
+
+	t.Run("unhealthy endpoints are skipped", func(t *testing.T) {
+		p := newTestPool(LoadBalancingRoundRobin, "a", "b")
+		assert.False(t, p.setHealthy(p.list()[1], true))
+		assert.True(t, p.setHealthy(p.list()[0], false))
+		for i := 0; i < 3; i++ {
+			u := p.pick(nil)
+			assert.Equal(t, p.list()[1], u)
+			p.done(u, http.StatusOK, nil)
+		}
+	})
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	var healthy *httptest.Server
+	healthy = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The request must have been signed for the endpoint it reached.
+		assert.Equal(t, strings.TrimPrefix(healthy.URL, "http://"), r.Host)
+		assert.Contains(t, r.Header.Get("Authorization"), "SignedHeaders=host;")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	hosts := map[string]string{
+		"healthy": strings.TrimPrefix(healthy.URL, "http://"),
+		"down":    strings.TrimPrefix(down.URL, "http://"),
+	}
+
+	cfg := Config{
+		S3Settings: AmazonS3Settings{
+			AccessKeyID:     "AKIA2AccessKey",
+			SecretAccessKey: "start/secretkey/end",
+			Region:          "us-east-1",
+			Endpoints:       []string{"down", "healthy"},
+			Scheme:          "http",
+			Bucket:          "agnivatest",
+		},
+	}
+
+	s := &Server{
+		logger:    mlog.NewTestingLogger(t, os.Stderr),
+		cfg:       cfg,
+		getHostFn: func(_, endpoint string) string { return hosts[endpoint] },
+		client:    http.DefaultClient,
+		creds: credentials.NewStatic(cfg.S3Settings.AccessKeyID,
+			cfg.S3Settings.SecretAccessKey, "", credentials.SignatureV4),
+		metrics: newMetrics(),
+	}
+	handler := s.handler()
+
+	t.Run("requests without body fail over", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest("GET", "http://example.com/"+cfg.S3Settings.Bucket+"/foo", nil)
+			w := httptest.NewRecorder()
+			handler(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+		}
+	})
+
+	t.Run("responses count until their body is closed", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "http://example.com/foo", nil)
+		require.NoError(t, err)
+		resp, err := s.doUpstream(req)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), s.upstreams.list()[1].active)
+		require.NoError(t, resp.Body.Close())
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, int64(0), s.upstreams.list()[1].active)
+	})
+
+	t.Run("requests with body do not fail over", func(t *testing.T) {
+		s.upstreams.next = 0
+		for _, u := range s.upstreams.list() {
+			u.ejectedUntil = time.Time{}
+		}
+		req := httptest.NewRequest("PUT", "http://example.com/"+cfg.S3Settings.Bucket+"/foo", strings.NewReader("data"))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+	})
+
+	t.Run("health checks", func(t *testing.T) {
+		s.checkUpstreams(context.Background())
+		list := s.upstreams.list()
+		assert.True(t, list[0].unhealthy)
+		assert.False(t, list[1].unhealthy)
+	})
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"os"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/pkg/errors"
+)
+
+// tlsVersions maps the configurable minimum TLS versions to their constants.
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// upstreamTLSConfig builds the TLS configuration used to connect to the S3
+// endpoint. Without any TLS setting, it only enforces TLS 1.2 or later.
+func upstreamTLSConfig(settings AmazonS3Settings, logger *mlog.Logger) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[settings.TLSMinVersion]
+	if !ok {
+		return nil, errors.Errorf("unsupported TLSMinVersion %q", settings.TLSMinVersion)
+	}
+
+	cfg := &tls.Config{
+		MinVersion: minVersion,
+		ServerName: settings.TLSServerName,
+	}
+
+	if settings.CACertFile != "" {
+		pem, err := os.ReadFile(settings.CACertFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read S3 CA file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in S3 CA file")
+		}
+		cfg.RootCAs = pool
+	}
+
+	if settings.ClientCertFile != "" || settings.ClientKeyFile != "" {
+		reloader, err := newCertificateReloader(settings.ClientCertFile, settings.ClientKeyFile, logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load S3 client certificate")
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return reloader.GetCertificate(nil)
+		}
+	}
+
+	if len(settings.PinnedSPKIHashes) > 0 {
+		pins := make(map[string]bool, len(settings.PinnedSPKIHashes))
+		for _, pin := range settings.PinnedSPKIHashes {
+			pins[pin] = true
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifySPKIPins(cs, pins)
+		}
+	}
+
+	if settings.InsecureSkipVerify {
+		logger.Warn("TLS certificate verification of the S3 endpoint is disabled; connections to it can be intercepted",
+			mlog.String("endpoint", settings.Endpoint))
+		cfg.InsecureSkipVerify = true
+	}
+
+	return cfg, nil
+}
+
+// verifySPKIPins checks that at least one certificate of the connection has
+// a public key whose base64 encoded SHA-256 hash is pinned. Verified chains
+// are used when available, so that a pin on an intermediate or root only
+// matches when the chain actually leads to it.
+func verifySPKIPins(cs tls.ConnectionState, pins map[string]bool) error {
+	certs := cs.PeerCertificates
+	if len(cs.VerifiedChains) > 0 {
+		certs = nil
+		for _, chain := range cs.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+	}
+
+	for _, cert := range certs {
+		if pins[spkiHash(cert)] {
+			return nil
+		}
+	}
+	return errors.New("no certificate of the S3 endpoint matches a pinned public key")
+}
+
+// spkiHash returns the base64 encoded SHA-256 hash of the certificate's
+// subject public key info, in the same format as HPKP pins.
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
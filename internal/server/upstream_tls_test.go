@@ -0,0 +1,140 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	logger := mlog.NewTestingLogger(t, os.Stderr)
+
+	ca, caKey := testCertificate(t, "private-ca", nil, nil, nil)
+	caFile, _ := writeTestKeyPair(t, dir, "ca", ca, caKey)
+
+	serverCert, serverKey := testCertificate(t, "s3.internal", ca, caKey, func(c *x509.Certificate) {
+		c.DNSNames = []string{"s3.internal"}
+	})
+	clientCert, clientKey := testCertificate(t, "bifrost", ca, caKey, nil)
+	clientCertFile, clientKeyFile := writeTestKeyPair(t, dir, "client", clientCert, clientKey)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Header().Set("X-Client", r.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.TLS = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw, ca.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    clientCAs,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(t *testing.T, settings AmazonS3Settings) (*http.Response, error) {
+		cfg, err := upstreamTLSConfig(settings, logger)
+		require.NoError(t, err)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		resp, err := client.Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	t.Run("system roots do not trust the private CA", func(t *testing.T) {
+		_, err := get(t, AmazonS3Settings{TLSServerName: "s3.internal"})
+		require.Error(t, err)
+	})
+
+	t.Run("custom CA bundle", func(t *testing.T) {
+		resp, err := get(t, AmazonS3Settings{CACertFile: caFile, TLSServerName: "s3.internal"})
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("X-Client"))
+	})
+
+	t.Run("SNI override must match the certificate", func(t *testing.T) {
+		_, err := get(t, AmazonS3Settings{CACertFile: caFile, TLSServerName: "s3.elsewhere"})
+		require.Error(t, err)
+	})
+
+	t.Run("client certificate", func(t *testing.T) {
+		resp, err := get(t, AmazonS3Settings{
+			CACertFile:     caFile,
+			TLSServerName:  "s3.internal",
+			ClientCertFile: clientCertFile,
+			ClientKeyFile:  clientKeyFile,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "bifrost", resp.Header.Get("X-Client"))
+	})
+
+	t.Run("matching pin on the CA", func(t *testing.T) {
+		_, err := get(t, AmazonS3Settings{
+			CACertFile:       caFile,
+			TLSServerName:    "s3.internal",
+			PinnedSPKIHashes: []string{"bm90IHRoaXMgb25l", spkiHash(ca)},
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("no matching pin", func(t *testing.T) {
+		other, _ := testCertificate(t, "other", nil, nil, nil)
+		_, err := get(t, AmazonS3Settings{
+			CACertFile:       caFile,
+			TLSServerName:    "s3.internal",
+			PinnedSPKIHashes: []string{spkiHash(other)},
+		})
+		require.Error(t, err)
+	})
+
+	t.Run("pinning still applies when skipping verification", func(t *testing.T) {
+		_, err := get(t, AmazonS3Settings{InsecureSkipVerify: true})
+		require.NoError(t, err)
+
+		other, _ := testCertificate(t, "other", nil, nil, nil)
+		_, err = get(t, AmazonS3Settings{InsecureSkipVerify: true, PinnedSPKIHashes: []string{spkiHash(other)}})
+		require.Error(t, err)
+
+		_, err = get(t, AmazonS3Settings{InsecureSkipVerify: true, PinnedSPKIHashes: []string{spkiHash(serverCert)}})
+		require.NoError(t, err)
+	})
+
+	t.Run("minimum version", func(t *testing.T) {
+		cfg, err := upstreamTLSConfig(AmazonS3Settings{TLSMinVersion: "1.3"}, logger)
+		require.NoError(t, err)
+		assert.Equal(t, uint16(tls.VersionTLS13), cfg.MinVersion)
+
+		_, err = upstreamTLSConfig(AmazonS3Settings{TLSMinVersion: "1.0"}, logger)
+		require.Error(t, err)
+	})
+
+	t.Run("invalid files", func(t *testing.T) {
+		_, err := upstreamTLSConfig(AmazonS3Settings{CACertFile: filepath.Join(dir, "missing.pem")}, logger)
+		require.Error(t, err)
+
+		_, err = upstreamTLSConfig(AmazonS3Settings{CACertFile: clientKeyFile}, logger)
+		require.Error(t, err)
+
+		_, err = upstreamTLSConfig(AmazonS3Settings{ClientCertFile: clientCertFile, ClientKeyFile: caFile}, logger)
+		require.Error(t, err)
+	})
+}